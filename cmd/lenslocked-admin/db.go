@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"lenslocked.com/models"
+)
+
+func migrate(ctx context.Context, s *models.Services, args []string) error {
+	fs := newFlagSet("migrate")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if err := s.AutoMigrate(); err != nil {
+		return err
+	}
+	fmt.Println("database migrated")
+	return nil
+}
+
+func backfill(ctx context.Context, s *models.Services, args []string) error {
+	fs := newFlagSet("backfill")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if err := s.Backfill(ctx); err != nil {
+		return err
+	}
+	fmt.Println("backfill done")
+	return nil
+}
+
+// db dispatches the "db <subcommand>" commands. reset is the only
+// one for now.
+func db(ctx context.Context, s *models.Services, args []string) error {
+	if len(args) == 0 || args[0] != "reset" {
+		return errors.New("usage: lenslocked-admin db reset -confirm")
+	}
+
+	fs := newFlagSet("db reset")
+	confirm := fs.Bool("confirm", false,
+		"required; acknowledges that every table will be dropped")
+	if err := parse(fs, args[1:]); err != nil {
+		return err
+	}
+	if !*confirm {
+		return errors.New("db reset drops every table and all of its data; " +
+			"rerun with -confirm to proceed")
+	}
+	if err := s.DestructiveReset(); err != nil {
+		return err
+	}
+	fmt.Println("database reset")
+	return nil
+}
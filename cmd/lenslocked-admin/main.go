@@ -0,0 +1,132 @@
+// Command lenslocked-admin performs administrative tasks against the
+// lenslocked database. It reads the same LENSLOCKED_* environment
+// variables as the web server to decide which database to use.
+//
+// Usage:
+//
+//	lenslocked-admin <command> [flags]
+//
+// Run lenslocked-admin help for the list of commands.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"lenslocked.com/config"
+	"lenslocked.com/models"
+)
+
+// command is a single lenslocked-admin subcommand.
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, s *models.Services, args []string) error
+}
+
+// cfg is the configuration loaded by run, for commands that need
+// more than the services.
+var cfg config.Config
+
+var commands = []command{
+	{"create-user", "create a new user", createUser},
+	{"reset-password", "set a new password for a user", resetPassword},
+	{"delete-user", "delete a user", deleteUser},
+	{"restore-user", "restore a deleted account and its galleries", restoreUser},
+	{"purge-deleted", "permanently remove accounts past the deletion grace period", purgeDeleted},
+	{"list-users", "list every user", listUsers},
+	{"make-admin", "grant or revoke the admin role", makeAdmin},
+	{"migrate", "create or update the database tables", migrate},
+	{"backfill", "update data written by older versions, once after upgrading", backfill},
+	{"seed", "fill the database with fake users and galleries", seed},
+	{"db", "database maintenance (db reset)", db},
+}
+
+// errUsage is returned by commands whose arguments are invalid. The
+// flag package has already printed the problem by then.
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "-h" {
+		usage()
+		return
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == os.Args[1] {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "lenslocked-admin: unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err := run(cmd, os.Args[2:]); err != nil {
+		if err != errUsage {
+			fmt.Fprintln(os.Stderr, "lenslocked-admin:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: lenslocked-admin <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", c.name, c.usage)
+	}
+}
+
+func run(cmd *command, args []string) error {
+	var err error
+	cfg, err = config.Load()
+	if err != nil {
+		return err
+	}
+	logger := cfg.NewLogger()
+	slog.SetDefault(logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx = models.WithClientInfo(ctx, models.ClientInfo{
+		UserAgent: "lenslocked-admin",
+	})
+
+	services, err := models.NewServices(cfg.Database.Dialect,
+		cfg.Database.ConnectionInfo(),
+		models.WithLogger(logger),
+		models.WithSQLLogLevel(cfg.SQLLog),
+		models.WithImageDir(cfg.ImageDir),
+		models.WithPasswordPolicy(cfg.PasswordPolicy))
+	if err != nil {
+		return err
+	}
+	defer services.Close()
+
+	return cmd.run(ctx, services, args)
+}
+
+// newFlagSet returns a FlagSet for the named command that reports
+// errors instead of exiting.
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("lenslocked-admin "+name, flag.ContinueOnError)
+}
+
+// parse parses args into fs, turning any failure into errUsage.
+func parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	mrand "math/rand"
+
+	"lenslocked.com/models"
+)
+
+// seedPassword is the password given to every seeded user so demo
+// accounts are easy to log in to.
+const seedPassword = "darkroom silver print"
+
+var (
+	seedFirstNames = []string{"Ada", "Grace", "Ansel", "Dorothea",
+		"Henri", "Vivian", "Sebastião", "Annie", "Robert", "Diane"}
+	seedLastNames = []string{"Adams", "Lange", "Cartier", "Maier",
+		"Salgado", "Leibovitz", "Capa", "Arbus", "Hopper", "Lovelace"}
+	seedPlaces = []string{"Yosemite", "Lisbon", "Kyoto", "Iceland",
+		"Patagonia", "Tuscany", "Banff", "Marrakesh", "Big Sur", "Oslo"}
+	seedEvents = []string{"Wedding", "Road Trip", "Portraits",
+		"Engagement", "Street", "Landscapes", "Family", "Sunrise"}
+)
+
+func seed(ctx context.Context, s *models.Services, args []string) error {
+	fs := newFlagSet("seed")
+	nUsers := fs.Int("users", 5, "number of users to create")
+	nGalleries := fs.Int("galleries", 3, "number of galleries per user")
+	randSeed := fs.Int64("seed", 1, "random seed, for repeatable data")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+
+	rng := mrand.New(mrand.NewSource(*randSeed))
+	for i := 0; i < *nUsers; i++ {
+		first := seedFirstNames[rng.Intn(len(seedFirstNames))]
+		last := seedLastNames[rng.Intn(len(seedLastNames))]
+		user := models.User{
+			Name:     first + " " + last,
+			Email:    fmt.Sprintf("demo%d@example.com", i+1),
+			Password: seedPassword,
+		}
+		if err := s.User.Create(ctx, &user); err != nil {
+			return fmt.Errorf("create %s: %w", user.Email, err)
+		}
+
+		for j := 0; j < *nGalleries; j++ {
+			gallery := models.Gallery{
+				UserID: user.ID,
+				Title: fmt.Sprintf("%s %s",
+					seedPlaces[rng.Intn(len(seedPlaces))],
+					seedEvents[rng.Intn(len(seedEvents))]),
+			}
+			if err := s.Gallery.Create(ctx, &gallery); err != nil {
+				return fmt.Errorf("create gallery for %s: %w", user.Email, err)
+			}
+		}
+		fmt.Printf("created %s <%s> with %d galleries\n",
+			user.Name, user.Email, *nGalleries)
+	}
+	fmt.Printf("every seeded user has the password %q\n", seedPassword)
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"lenslocked.com/models"
+	"lenslocked.com/rand"
+)
+
+// generatedPasswordBytes is the number of random bytes used when a
+// password is generated for the user.
+const generatedPasswordBytes = 12
+
+func createUser(ctx context.Context, s *models.Services, args []string) error {
+	fs := newFlagSet("create-user")
+	name := fs.String("name", "", "full name")
+	email := fs.String("email", "", "email address (required)")
+	password := fs.String("password", "", "password; generated and printed if empty")
+	admin := fs.Bool("admin", false, "give the user the admin role")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+
+	pw, generated, err := passwordOrRandom(*password)
+	if err != nil {
+		return err
+	}
+	user := models.User{
+		Name:     *name,
+		Email:    *email,
+		Password: pw,
+	}
+	if *admin {
+		user.Role = models.RoleAdmin
+	}
+	if err := s.User.Create(ctx, &user); err != nil {
+		return err
+	}
+
+	audit(ctx, s, models.AuditAdminCreateUser, &user)
+	fmt.Printf("created user %d <%s> with role %s\n", user.ID, user.Email, user.Role)
+	if generated {
+		fmt.Printf("password: %s\n", pw)
+	}
+	return nil
+}
+
+func resetPassword(ctx context.Context, s *models.Services, args []string) error {
+	fs := newFlagSet("reset-password")
+	sel := userFlags(fs)
+	password := fs.String("password", "", "new password; generated and printed if empty")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+
+	user, err := sel.lookup(ctx, s.User)
+	if err != nil {
+		return err
+	}
+	pw, generated, err := passwordOrRandom(*password)
+	if err != nil {
+		return err
+	}
+	user.Password = pw
+	if err := s.User.Update(ctx, user); err != nil {
+		return err
+	}
+
+	audit(ctx, s, models.AuditAdminResetPW, user)
+	fmt.Printf("reset password for user %d <%s>\n", user.ID, user.Email)
+	if generated {
+		fmt.Printf("password: %s\n", pw)
+	}
+	return nil
+}
+
+func deleteUser(ctx context.Context, s *models.Services, args []string) error {
+	fs := newFlagSet("delete-user")
+	sel := userFlags(fs)
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+
+	user, err := sel.lookup(ctx, s.User)
+	if err != nil {
+		return err
+	}
+	if err := s.User.Delete(ctx, user.ID); err != nil {
+		return err
+	}
+	audit(ctx, s, models.AuditAdminDeleteUser, user)
+	fmt.Printf("deleted user %d <%s>\n", user.ID, user.Email)
+	return nil
+}
+
+func listUsers(ctx context.Context, s *models.Services, args []string) error {
+	fs := newFlagSet("list-users")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+
+	users, err := s.User.All(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tEMAIL\tROLE\tCREATED")
+	for _, u := range users {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", u.ID, u.Name, u.Email,
+			u.Role, u.CreatedAt.Format("2006-01-02 15:04"))
+	}
+	return tw.Flush()
+}
+
+func makeAdmin(ctx context.Context, s *models.Services, args []string) error {
+	fs := newFlagSet("make-admin")
+	sel := userFlags(fs)
+	revoke := fs.Bool("revoke", false, "remove the admin role instead")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+
+	user, err := sel.lookup(ctx, s.User)
+	if err != nil {
+		return err
+	}
+	user.Role = models.RoleAdmin
+	if *revoke {
+		user.Role = models.RoleUser
+	}
+	if err := s.User.Update(ctx, user); err != nil {
+		return err
+	}
+	audit(ctx, s, models.AuditAdminSetRole, user)
+	fmt.Printf("user %d <%s> now has role %s\n", user.ID, user.Email, user.Role)
+	return nil
+}
+
+// audit records an admin action taken against user. The command
+// has no signed in actor, so events are told apart by the
+// lenslocked-admin user agent set up in run.
+func audit(ctx context.Context, s *models.Services, action string, user *models.User) {
+	s.Audit.Record(ctx, &models.AuditEvent{
+		UserID:  user.ID,
+		Action:  action,
+		Success: true,
+		Details: fmt.Sprintf("%s role=%s", user.Email, user.Role),
+	})
+}
+
+// userSelector holds the flags used to pick a single user.
+type userSelector struct {
+	id    *uint
+	email *string
+}
+
+func userFlags(fs *flag.FlagSet) userSelector {
+	return userSelector{
+		id:    fs.Uint("id", 0, "ID of the user"),
+		email: fs.String("email", "", "email address of the user"),
+	}
+}
+
+func (sel userSelector) lookup(ctx context.Context, us models.UserService) (*models.User, error) {
+	switch {
+	case *sel.id != 0 && *sel.email != "":
+		return nil, errors.New("use only one of -id or -email")
+	case *sel.id != 0:
+		return us.ByID(ctx, *sel.id)
+	case *sel.email != "":
+		return us.ByEmail(ctx, *sel.email)
+	}
+	return nil, errors.New("one of -id or -email is required")
+}
+
+// passwordOrRandom returns pw, or a newly generated password if pw
+// is empty. generated reports which one happened.
+func passwordOrRandom(pw string) (password string, generated bool, err error) {
+	if pw != "" {
+		return pw, false, nil
+	}
+	pw, err = rand.Strings(generatedPasswordBytes)
+	if err != nil {
+		return "", false, err
+	}
+	return pw, true, nil
+}
+
+func restoreUser(ctx context.Context, s *models.Services, args []string) error {
+	fs := newFlagSet("restore-user")
+	email := fs.String("email", "", "email address of the deleted user (required)")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if *email == "" {
+		return errors.New("-email is required")
+	}
+
+	user, err := s.Account.Restore(ctx, *email)
+	if err == models.ErrNotFound {
+		return fmt.Errorf("no deleted user with email %s; it may already "+
+			"have been purged", *email)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored user %d <%s>\n", user.ID, user.Email)
+	return nil
+}
+
+func purgeDeleted(ctx context.Context, s *models.Services, args []string) error {
+	fs := newFlagSet("purge-deleted")
+	grace := fs.Duration("grace", cfg.DeletionGrace,
+		"only purge accounts deleted at least this long ago")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+
+	n, err := s.Account.Purge(ctx, time.Now().Add(-*grace))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("purged %d deleted accounts\n", n)
+	return nil
+}
@@ -0,0 +1,443 @@
+// Package config loads the runtime settings shared by the web
+// server and the admin command from LENSLOCKED_* environment
+// variables.
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"lenslocked.com/context"
+	"lenslocked.com/email"
+	"lenslocked.com/models"
+	"lenslocked.com/password"
+	"lenslocked.com/sso"
+)
+
+// Config holds the runtime settings for the lenslocked server.
+// Every field can be set with a LENSLOCKED_* environment variable
+// and falls back to a default that is suitable for development.
+type Config struct {
+	// LogLevel is one of debug, info, warn or error.
+	LogLevel slog.Level
+	// LogFormat is either "text" or "json".
+	LogFormat string
+	// SQLLog is one of errors, off or all.
+	SQLLog models.SQLLogLevel
+
+	// ImageDir is where gallery files are stored.
+	ImageDir string
+
+	// DeletionGrace is how long deleted accounts can be restored
+	// before they are purged. SweepInterval is how often the
+	// server looks for accounts to purge; 0 disables the sweep.
+	DeletionGrace time.Duration
+	SweepInterval time.Duration
+
+	// UploadExpiry is how long a resumable upload is kept after its
+	// last chunk. Expired uploads are removed by the same sweep.
+	UploadExpiry time.Duration
+
+	// Quota is what users can store unless an admin gives them a
+	// quota of their own.
+	Quota models.Quota
+
+	// Resize signs the URLs of resized photos and limits how much
+	// disk they are cached on.
+	Resize models.ResizeConfig
+
+	// PasswordPolicy is the set of rules new passwords must pass.
+	PasswordPolicy models.PasswordPolicy
+
+	Server   ServerConfig
+	Database DatabaseConfig
+	Mail     MailConfig
+
+	// OIDC lists the OpenID Connect providers users can sign in
+	// with.
+	OIDC []sso.Config
+}
+
+// DatabaseConfig describes which database to connect to.
+type DatabaseConfig struct {
+	// Dialect is "postgres" or "sqlite3".
+	Dialect string
+
+	// Host, Port, User, Password and Name are used to build the
+	// postgres connection string.
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Name     string
+
+	// Path is the SQLite database file, or ":memory:".
+	Path string
+}
+
+// ConnectionInfo returns the connection string gorm expects for
+// the configured dialect.
+func (c DatabaseConfig) ConnectionInfo() string {
+	if c.Dialect == models.DialectSQLite {
+		return c.Path
+	}
+	if c.Password == "" {
+		return fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=disable",
+			c.Host, c.Port, c.User, c.Name)
+	}
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		c.Host, c.Port, c.User, c.Password, c.Name)
+}
+
+// MailConfig says how emails are delivered: through the SMTP
+// server at SMTP.Addr, or, in development, by writing them to the
+// log.
+type MailConfig struct {
+	SMTP email.SMTPMailer
+	// Log writes emails to the log instead of sending them.
+	Log bool
+}
+
+// NewMailer returns the Mailer c describes. It fails if no way of
+// delivering mail is configured, so a server can't start up
+// quietly dropping its emails.
+func (c MailConfig) NewMailer(logger *slog.Logger) (email.Mailer, error) {
+	switch {
+	case c.SMTP.Addr != "":
+		smtp := c.SMTP
+		return &smtp, nil
+	case c.Log:
+		return &email.LogMailer{Logger: logger}, nil
+	}
+	return nil, fmt.Errorf("no mail delivery configured: set LENSLOCKED_SMTP_ADDR, " +
+		"or LENSLOCKED_MAIL_LOG=true in development")
+}
+
+// ServerConfig holds the settings used to build the http.Server.
+type ServerConfig struct {
+	// Addr is the host:port the server listens on.
+	Addr string
+
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	// ShutdownTimeout is how long in-flight requests are given to
+	// finish once a shutdown signal has been received.
+	ShutdownTimeout time.Duration
+
+	// TLSCertFile and TLSKeyFile enable HTTPS when both are set.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// BaseURL is the address users reach the site at, used to
+	// build links in emails. It defaults to Addr with the scheme
+	// implied by the TLS settings.
+	BaseURL string
+
+	// TrustProxy makes the server take the client address from
+	// X-Forwarded-For. Only enable it behind a proxy that sets the
+	// header, otherwise clients can spoof their IP.
+	TrustProxy bool
+}
+
+// TLS reports whether the server should serve HTTPS.
+func (c ServerConfig) TLS() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// Load reads the Config from the environment.
+func Load() (Config, error) {
+	var cfg Config
+	if err := cfg.LogLevel.UnmarshalText(
+		[]byte(envOr("LENSLOCKED_LOG_LEVEL", "info"))); err != nil {
+		return cfg, fmt.Errorf("LENSLOCKED_LOG_LEVEL: %w", err)
+	}
+
+	cfg.LogFormat = strings.ToLower(envOr("LENSLOCKED_LOG_FORMAT", "text"))
+	switch cfg.LogFormat {
+	case "text", "json":
+	default:
+		return cfg, fmt.Errorf("LENSLOCKED_LOG_FORMAT: unknown format %q",
+			cfg.LogFormat)
+	}
+
+	sqlLog, err := models.ParseSQLLogLevel(envOr("LENSLOCKED_SQL_LOG", "errors"))
+	if err != nil {
+		return cfg, fmt.Errorf("LENSLOCKED_SQL_LOG: %w", err)
+	}
+	cfg.SQLLog = sqlLog
+
+	cfg.ImageDir = envOr("LENSLOCKED_IMAGE_DIR", "images")
+	if cfg.DeletionGrace, err = envDuration("LENSLOCKED_DELETION_GRACE",
+		models.DefaultDeletionGrace); err != nil {
+		return cfg, err
+	}
+	if cfg.SweepInterval, err = envDuration("LENSLOCKED_SWEEP_INTERVAL",
+		time.Hour); err != nil {
+		return cfg, err
+	}
+	if cfg.UploadExpiry, err = envDuration("LENSLOCKED_UPLOAD_EXPIRY",
+		models.DefaultUploadExpiry); err != nil {
+		return cfg, err
+	}
+
+	if cfg.Quota, err = loadQuota(); err != nil {
+		return cfg, err
+	}
+
+	cfg.Resize.Key = envOr("LENSLOCKED_RESIZE_KEY", "")
+	cacheMB, err := envInt("LENSLOCKED_RESIZE_CACHE_MB",
+		models.DefaultResizeCacheSize>>20)
+	if err != nil {
+		return cfg, err
+	}
+	if cacheMB < 0 {
+		return cfg, fmt.Errorf("LENSLOCKED_RESIZE_CACHE_MB: can't be negative")
+	}
+	cfg.Resize.CacheSize = int64(cacheMB) << 20
+
+	if cfg.PasswordPolicy, err = loadPasswordPolicy(); err != nil {
+		return cfg, err
+	}
+
+	if cfg.Server, err = loadServerConfig(); err != nil {
+		return cfg, err
+	}
+	if cfg.Database, err = loadDatabaseConfig(); err != nil {
+		return cfg, err
+	}
+	if cfg.Mail, err = loadMailConfig(); err != nil {
+		return cfg, err
+	}
+	if cfg.OIDC, err = loadOIDCConfig(cfg.Server.BaseURL); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+func loadQuota() (models.Quota, error) {
+	q := models.DefaultQuota
+	mb, err := envInt("LENSLOCKED_QUOTA_MB", int(q.Bytes>>20))
+	if err != nil {
+		return q, err
+	}
+	if mb < 0 {
+		return q, fmt.Errorf("LENSLOCKED_QUOTA_MB: can't be negative")
+	}
+	q.Bytes = int64(mb) << 20
+	if q.Photos, err = envInt("LENSLOCKED_QUOTA_PHOTOS", q.Photos); err != nil {
+		return q, err
+	}
+	if q.Photos < 0 {
+		return q, fmt.Errorf("LENSLOCKED_QUOTA_PHOTOS: can't be negative")
+	}
+	return q, nil
+}
+
+func loadPasswordPolicy() (models.PasswordPolicy, error) {
+	p := models.DefaultPasswordPolicy
+	var err error
+	if p.MinLength, err = envInt("LENSLOCKED_PASSWORD_MIN_LENGTH",
+		p.MinLength); err != nil {
+		return p, err
+	}
+	if p.MinLength < 1 {
+		return p, fmt.Errorf("LENSLOCKED_PASSWORD_MIN_LENGTH: must be at least 1")
+	}
+	score, err := envInt("LENSLOCKED_PASSWORD_MIN_SCORE", int(p.MinScore))
+	if err != nil {
+		return p, err
+	}
+	if score < int(password.VeryWeak) || score > int(password.VeryStrong) {
+		return p, fmt.Errorf("LENSLOCKED_PASSWORD_MIN_SCORE: must be between %d and %d",
+			password.VeryWeak, password.VeryStrong)
+	}
+	p.MinScore = password.Score(score)
+	return p, nil
+}
+
+func loadDatabaseConfig() (DatabaseConfig, error) {
+	var err error
+	c := DatabaseConfig{
+		Host:     envOr("LENSLOCKED_DB_HOST", "localhost"),
+		User:     envOr("LENSLOCKED_DB_USER", "postgres"),
+		Password: envOr("LENSLOCKED_DB_PASSWORD", "your-password"),
+		Name:     envOr("LENSLOCKED_DB_NAME", "lenslocked_dev"),
+		Path:     envOr("LENSLOCKED_DB_PATH", "lenslocked_dev.db"),
+	}
+	if c.Dialect, err = models.ParseDialect(
+		envOr("LENSLOCKED_DB_DIALECT", models.DialectPostgres)); err != nil {
+		return c, fmt.Errorf("LENSLOCKED_DB_DIALECT: %w", err)
+	}
+	if c.Port, err = envInt("LENSLOCKED_DB_PORT", 5432); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+func loadMailConfig() (MailConfig, error) {
+	var err error
+	c := MailConfig{
+		SMTP: email.SMTPMailer{
+			Addr:     envOr("LENSLOCKED_SMTP_ADDR", ""),
+			Username: envOr("LENSLOCKED_SMTP_USER", ""),
+			Password: envOr("LENSLOCKED_SMTP_PASSWORD", ""),
+			From:     envOr("LENSLOCKED_MAIL_FROM", ""),
+		},
+	}
+	if c.Log, err = envBool("LENSLOCKED_MAIL_LOG", false); err != nil {
+		return c, err
+	}
+	if c.SMTP.Addr == "" {
+		return c, nil
+	}
+	if c.Log {
+		return c, fmt.Errorf("LENSLOCKED_SMTP_ADDR and LENSLOCKED_MAIL_LOG " +
+			"can't both be set")
+	}
+	if c.SMTP.From == "" {
+		return c, fmt.Errorf("LENSLOCKED_MAIL_FROM must be set " +
+			"along with LENSLOCKED_SMTP_ADDR")
+	}
+	return c, nil
+}
+
+func loadServerConfig() (ServerConfig, error) {
+	var err error
+	c := ServerConfig{
+		Addr:        envOr("LENSLOCKED_ADDR", "localhost:3000"),
+		TLSCertFile: envOr("LENSLOCKED_TLS_CERT", ""),
+		TLSKeyFile:  envOr("LENSLOCKED_TLS_KEY", ""),
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return c, fmt.Errorf("LENSLOCKED_TLS_CERT and LENSLOCKED_TLS_KEY " +
+			"must be set together")
+	}
+
+	durations := []struct {
+		key string
+		def time.Duration
+		dst *time.Duration
+	}{
+		{"LENSLOCKED_READ_TIMEOUT", 15 * time.Second, &c.ReadTimeout},
+		{"LENSLOCKED_READ_HEADER_TIMEOUT", 5 * time.Second, &c.ReadHeaderTimeout},
+		{"LENSLOCKED_WRITE_TIMEOUT", 30 * time.Second, &c.WriteTimeout},
+		{"LENSLOCKED_IDLE_TIMEOUT", 60 * time.Second, &c.IdleTimeout},
+		{"LENSLOCKED_SHUTDOWN_TIMEOUT", 20 * time.Second, &c.ShutdownTimeout},
+	}
+	for _, d := range durations {
+		if *d.dst, err = envDuration(d.key, d.def); err != nil {
+			return c, err
+		}
+	}
+
+	if c.MaxHeaderBytes, err = envInt("LENSLOCKED_MAX_HEADER_BYTES",
+		1<<20); err != nil {
+		return c, err
+	}
+	if c.TrustProxy, err = envBool("LENSLOCKED_TRUST_PROXY", false); err != nil {
+		return c, err
+	}
+
+	scheme := "http://"
+	if c.TLS() {
+		scheme = "https://"
+	}
+	c.BaseURL = strings.TrimSuffix(
+		envOr("LENSLOCKED_BASE_URL", scheme+c.Addr), "/")
+	return c, nil
+}
+
+// loadOIDCConfig reads the providers named in the comma separated
+// LENSLOCKED_OIDC_PROVIDERS. Each provider NAME is configured with
+// LENSLOCKED_OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET and
+// optionally _DISPLAY_NAME.
+func loadOIDCConfig(baseURL string) ([]sso.Config, error) {
+	var providers []sso.Config
+	for _, name := range strings.Split(envOr("LENSLOCKED_OIDC_PROVIDERS", ""), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "LENSLOCKED_OIDC_" + strings.ToUpper(name) + "_"
+		c := sso.Config{
+			Name:         name,
+			DisplayName:  envOr(prefix+"DISPLAY_NAME", name),
+			Issuer:       envOr(prefix+"ISSUER", ""),
+			ClientID:     envOr(prefix+"CLIENT_ID", ""),
+			ClientSecret: envOr(prefix+"CLIENT_SECRET", ""),
+			RedirectURL:  baseURL + "/auth/" + name + "/callback",
+		}
+		if c.Issuer == "" || c.ClientID == "" {
+			return nil, fmt.Errorf("%sISSUER and %sCLIENT_ID must be set",
+				prefix, prefix)
+		}
+		providers = append(providers, c)
+	}
+	return providers, nil
+}
+
+// NewLogger builds the application logger described by cfg. Every
+// record is passed through context.LogHandler so request IDs end
+// up on each line.
+func (cfg Config) NewLogger() *slog.Logger {
+	opts := &slog.HandlerOptions{Level: cfg.LogLevel}
+	var h slog.Handler
+	if cfg.LogFormat == "json" {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	return slog.New(context.NewLogHandler(h))
+}
+
+func envOr(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return d, nil
+}
+
+func envInt(key string, def int) (int, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return n, nil
+}
+
+func envBool(key string, def bool) (bool, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", key, err)
+	}
+	return b, nil
+}
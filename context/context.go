@@ -9,7 +9,8 @@ import (
 type privateKey string
 
 const (
-	userKey privateKey = "user"
+	userKey      privateKey = "user"
+	requestIDKey privateKey = "request_id"
 )
 
 func WithUser(ctx context.Context, user *models.User) context.Context {
@@ -24,3 +25,21 @@ func User(ctx context.Context) *models.User {
 	}
 	return nil
 }
+
+// WithRequestID returns a copy of ctx that carries the provided
+// request ID so it can be attached to every log line written
+// while handling the request.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request ID stored in ctx, or an empty
+// string if there isn't one.
+func RequestID(ctx context.Context) string {
+	if temp := ctx.Value(requestIDKey); temp != nil {
+		if id, ok := temp.(string); ok {
+			return id
+		}
+	}
+	return ""
+}
@@ -0,0 +1,38 @@
+package context
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LogHandler wraps another slog.Handler and adds the request ID
+// and signed in user ID found in the record's context to every
+// log record. This lets any layer that logs with one of the
+// *Context methods (eg InfoContext) be tied back to the request
+// that triggered it without passing the ID around by hand.
+type LogHandler struct {
+	slog.Handler
+}
+
+// NewLogHandler returns a LogHandler wrapping h.
+func NewLogHandler(h slog.Handler) *LogHandler {
+	return &LogHandler{Handler: h}
+}
+
+func (h *LogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if user := User(ctx); user != nil {
+		r.AddAttrs(slog.Uint64("user_id", uint64(user.ID)))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &LogHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+	return &LogHandler{Handler: h.Handler.WithGroup(name)}
+}
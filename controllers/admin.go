@@ -0,0 +1,397 @@
+package controllers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+// NewAdmin returns the admin controller. defaultQuota is shown for
+// users who haven't been given a quota of their own.
+func NewAdmin(us models.UserService, gs models.GalleryService,
+	ss models.StatsService, as models.AuditService, defaultQuota models.Quota,
+	logger *slog.Logger) *Admin {
+	return &Admin{
+		DashboardView: views.NewView("bootstrap", "admin/dashboard", "admin/nav"),
+		UsersView:     views.NewView("bootstrap", "admin/users", "admin/nav"),
+		GalleriesView: views.NewView("bootstrap", "admin/galleries", "admin/nav"),
+		AuditView:     views.NewView("bootstrap", "admin/audit", "admin/nav"),
+		us:            us,
+		gs:            gs,
+		ss:            ss,
+		as:            as,
+		defaultQuota:  defaultQuota,
+		logger:        logger,
+	}
+}
+
+// Admin serves the /admin area. Every handler expects to be
+// wrapped in middleware.RequireAdmin.
+type Admin struct {
+	DashboardView *views.View
+	UsersView     *views.View
+	GalleriesView *views.View
+	AuditView     *views.View
+	us            models.UserService
+	gs            models.GalleryService
+	ss            models.StatsService
+	as            models.AuditService
+	defaultQuota  models.Quota
+	logger        *slog.Logger
+}
+
+// AdminUsersData is the Yield for the admin users page.
+type AdminUsersData struct {
+	Query         string
+	Users         []models.User
+	CurrentUserID uint
+	// DefaultQuota applies to users without a quota of their own.
+	DefaultQuota models.Quota
+}
+
+// AdminAuditData is the Yield for the admin audit log page.
+type AdminAuditData struct {
+	UserID  uint
+	Action  string
+	Actions []string
+	Events  []models.AuditEvent
+}
+
+// AdminGallery pairs a gallery with its owner for listing.
+type AdminGallery struct {
+	models.Gallery
+	Owner *models.User
+}
+
+// AdminGalleriesData is the Yield for the admin galleries page.
+type AdminGalleriesData struct {
+	Query     string
+	Galleries []AdminGallery
+}
+
+// Dashboard shows basic site statistics.
+//
+// GET /admin
+func (a *Admin) Dashboard(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	stats, err := a.ss.Site(r.Context())
+	if err != nil {
+		vd.SetAlert(err)
+		a.DashboardView.Render(w, vd)
+		return
+	}
+	vd.Yield = stats
+	a.DashboardView.Render(w, vd)
+}
+
+// Users lists users, optionally filtered by the "q" query
+// parameter.
+//
+// GET /admin/users
+func (a *Admin) Users(w http.ResponseWriter, r *http.Request) {
+	a.renderUsers(w, r, views.Data{}, r.FormValue("q"))
+}
+
+// DisableUser stops a user from logging in.
+//
+// POST /admin/users/:id/disable
+func (a *Admin) DisableUser(w http.ResponseWriter, r *http.Request) {
+	a.updateUser(w, r, models.AuditAdminDisable, func(user *models.User) string {
+		user.Disabled = true
+		return fmt.Sprintf("Disabled %s.", user.Email)
+	})
+}
+
+// EnableUser lets a previously disabled user log in again.
+//
+// POST /admin/users/:id/enable
+func (a *Admin) EnableUser(w http.ResponseWriter, r *http.Request) {
+	a.updateUser(w, r, models.AuditAdminEnable, func(user *models.User) string {
+		user.Disabled = false
+		return fmt.Sprintf("Enabled %s.", user.Email)
+	})
+}
+
+// ForcePasswordReset requires the user to choose a new password
+// the next time they use the site.
+//
+// POST /admin/users/:id/force-reset
+func (a *Admin) ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	a.updateUser(w, r, models.AuditAdminForceReset, func(user *models.User) string {
+		user.PasswordResetRequired = true
+		return fmt.Sprintf("%s must reset their password.", user.Email)
+	})
+}
+
+// SetQuota gives a user a quota of their own. The quota_mb and
+// quota_photos fields are in megabytes and photos; 0 means no limit
+// and an empty field puts the default back.
+//
+// POST /admin/users/:id/quota
+func (a *Admin) SetQuota(w http.ResponseWriter, r *http.Request) {
+	mb, err := parseQuotaField(r.PostFormValue("quota_mb"))
+	if err != nil {
+		var vd views.Data
+		vd.AlertError("Storage quota must be a whole number of MB.")
+		a.renderUsers(w, r, vd, r.PostFormValue("q"))
+		return
+	}
+	photos, err := parseQuotaField(r.PostFormValue("quota_photos"))
+	if err != nil {
+		var vd views.Data
+		vd.AlertError("Photo quota must be a whole number.")
+		a.renderUsers(w, r, vd, r.PostFormValue("q"))
+		return
+	}
+	a.updateUser(w, r, models.AuditAdminSetQuota, func(user *models.User) string {
+		user.QuotaBytes, user.QuotaPhotos = nil, nil
+		if mb != nil {
+			b := *mb << 20
+			user.QuotaBytes = &b
+		}
+		if photos != nil {
+			n := int(*photos)
+			user.QuotaPhotos = &n
+		}
+		return fmt.Sprintf("Updated the quota of %s.", user.Email)
+	})
+}
+
+// parseQuotaField parses a quota form field, returning nil when it
+// is empty.
+func parseQuotaField(v string) (*int64, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// updateUser looks up the user in the route, applies fn, saves
+// the result, records action in the audit log and re-renders the
+// users page with fn's message. Admins can't use it on their own
+// account so they can't lock themselves out.
+func (a *Admin) updateUser(w http.ResponseWriter, r *http.Request,
+	action string, fn func(*models.User) string) {
+	var vd views.Data
+	query := r.PostFormValue("q")
+
+	id, err := routeID(r)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusNotFound)
+		return
+	}
+	admin := context.User(r.Context())
+	if id == admin.ID {
+		vd.AlertError("You can't change your own account from the admin area.")
+		a.renderUsers(w, r, vd, query)
+		return
+	}
+
+	user, err := a.us.ByID(r.Context(), id)
+	if err != nil {
+		vd.SetAlert(err)
+		a.renderUsers(w, r, vd, query)
+		return
+	}
+	msg := fn(user)
+	if err := a.us.Update(r.Context(), user); err != nil {
+		vd.SetAlert(err)
+		a.renderUsers(w, r, vd, query)
+		return
+	}
+	a.logger.InfoContext(r.Context(), "admin updated user",
+		"target", user, "path", r.URL.Path)
+	a.as.Record(r.Context(), &models.AuditEvent{
+		UserID:  user.ID,
+		ActorID: admin.ID,
+		Action:  action,
+		Success: true,
+	})
+	vd.AlertSuccess(msg)
+	a.renderUsers(w, r, vd, query)
+}
+
+func (a *Admin) renderUsers(w http.ResponseWriter, r *http.Request,
+	vd views.Data, query string) {
+	users, err := a.us.Search(r.Context(), query)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = AdminUsersData{
+		Query:         query,
+		Users:         users,
+		CurrentUserID: context.User(r.Context()).ID,
+		DefaultQuota:  a.defaultQuota,
+	}
+	a.UsersView.Render(w, vd)
+}
+
+// Galleries lists galleries, optionally filtered by the "q" query
+// parameter.
+//
+// GET /admin/galleries
+func (a *Admin) Galleries(w http.ResponseWriter, r *http.Request) {
+	a.renderGalleries(w, r, views.Data{}, r.FormValue("q"))
+}
+
+type TransferForm struct {
+	Email string `schema:"email"`
+	Query string `schema:"q"`
+}
+
+// TransferGallery moves a gallery to the user with the email
+// address provided in the form.
+//
+// POST /admin/galleries/:id/transfer
+func (a *Admin) TransferGallery(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form TransferForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		a.renderGalleries(w, r, vd, "")
+		return
+	}
+
+	id, err := routeID(r)
+	if err != nil {
+		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
+		return
+	}
+	gallery, err := a.gs.ByID(r.Context(), id)
+	if err != nil {
+		vd.SetAlert(err)
+		a.renderGalleries(w, r, vd, form.Query)
+		return
+	}
+	owner, err := a.us.ByEmail(r.Context(), form.Email)
+	if err != nil {
+		if err == models.ErrNotFound {
+			vd.AlertError("No user exists with that email address")
+		} else {
+			vd.SetAlert(err)
+		}
+		a.renderGalleries(w, r, vd, form.Query)
+		return
+	}
+
+	from := gallery.UserID
+	gallery.UserID = owner.ID
+	if err := a.gs.Update(r.Context(), gallery); err != nil {
+		vd.SetAlert(err)
+		a.renderGalleries(w, r, vd, form.Query)
+		return
+	}
+	a.logger.InfoContext(r.Context(), "admin transferred gallery",
+		"gallery_id", gallery.ID, "from_user_id", from, "to", owner)
+	a.as.Record(r.Context(), &models.AuditEvent{
+		UserID:  owner.ID,
+		ActorID: context.User(r.Context()).ID,
+		Action:  models.AuditAdminTransfer,
+		Success: true,
+		Details: fmt.Sprintf("gallery %d from user %d", gallery.ID, from),
+	})
+	vd.AlertSuccess(fmt.Sprintf("Transferred %q to %s.", gallery.Title, owner.Email))
+	a.renderGalleries(w, r, vd, form.Query)
+}
+
+func (a *Admin) renderGalleries(w http.ResponseWriter, r *http.Request,
+	vd views.Data, query string) {
+	galleries, err := a.gs.Search(r.Context(), query)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+
+	owners := make(map[uint]*models.User)
+	data := AdminGalleriesData{Query: query}
+	for _, g := range galleries {
+		owner, ok := owners[g.UserID]
+		if !ok {
+			// A missing owner is shown as such rather than failing
+			// the whole page.
+			owner, _ = a.us.ByID(r.Context(), g.UserID)
+			owners[g.UserID] = owner
+		}
+		data.Galleries = append(data.Galleries, AdminGallery{
+			Gallery: g,
+			Owner:   owner,
+		})
+	}
+	vd.Yield = data
+	a.GalleriesView.Render(w, vd)
+}
+
+// auditActions are the actions offered in the audit log filter.
+var auditActions = []string{
+	models.AuditLogin,
+	models.AuditLoginLinkRequest,
+	models.AuditIdentityLink,
+	models.AuditSignup,
+	models.AuditPasswordChange,
+	models.AuditNameChange,
+	models.AuditEmailChangeRequest,
+	models.AuditEmailChange,
+	models.AuditAccountDelete,
+	models.AuditAccountRestore,
+	models.AuditAccountPurge,
+	models.AuditRememberRotate,
+	models.AuditGalleryCreate,
+	models.AuditGalleryUpdate,
+	models.AuditGalleryDelete,
+	models.AuditPhotoUpload,
+	models.AuditPhotoDelete,
+	models.AuditCommentHide,
+	models.AuditCommentDelete,
+	models.AuditAdminDisable,
+	models.AuditAdminEnable,
+	models.AuditAdminForceReset,
+	models.AuditAdminTransfer,
+	models.AuditAdminCreateUser,
+	models.AuditAdminDeleteUser,
+	models.AuditAdminResetPW,
+	models.AuditAdminSetRole,
+	models.AuditAdminSetQuota,
+}
+
+// Audit shows the most recent audit events, optionally filtered by
+// the "user_id" and "action" query parameters.
+//
+// GET /admin/audit
+func (a *Admin) Audit(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	data := AdminAuditData{
+		Action:  r.FormValue("action"),
+		Actions: auditActions,
+	}
+	if v := r.FormValue("user_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			vd.AlertError("User ID must be a number")
+			vd.Yield = data
+			a.AuditView.Render(w, vd)
+			return
+		}
+		data.UserID = uint(id)
+	}
+
+	events, err := a.as.Search(r.Context(), models.AuditFilter{
+		UserID: data.UserID,
+		Action: data.Action,
+	})
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	data.Events = events
+	vd.Yield = data
+	a.AuditView.Render(w, vd)
+}
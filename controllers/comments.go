@@ -0,0 +1,353 @@
+package controllers
+
+import (
+	stdctx "context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"lenslocked.com/context"
+	"lenslocked.com/email"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+// CommentingForm turns comments on or off on the edit page.
+type CommentingForm struct {
+	Comments        bool `schema:"comments"`
+	VisitorComments bool `schema:"visitor_comments"`
+}
+
+// CommentForm is a comment, or a reply to one. Author is only asked
+// of clients on the proofing link; signed in users comment under
+// their own name.
+type CommentForm struct {
+	PhotoID  uint   `schema:"photo_id"`
+	ParentID uint   `schema:"parent_id"`
+	Author   string `schema:"author"`
+	Body     string `schema:"body"`
+}
+
+// CommentsData is the comment section of a gallery, photo or
+// proofing page.
+type CommentsData struct {
+	Gallery *models.Gallery
+	// PhotoID is the photo the comments are on, or 0 for the
+	// gallery itself.
+	PhotoID uint
+	Threads []models.CommentThread
+	// Action is where comments are posted, or "" if the viewer
+	// can't leave one.
+	Action string
+	// Visitor is set for clients on the proofing link, who have to
+	// say who they are.
+	Visitor bool
+	// Owner is set when the viewer may hide and delete comments.
+	Owner bool
+}
+
+// CommentItem is a comment along with the section it is shown in,
+// which its template needs to know who may reply or moderate.
+type CommentItem struct {
+	Section *CommentsData
+	models.CommentThread
+}
+
+// Items pairs threads with cd, for the comment template.
+func (cd *CommentsData) Items(threads []models.CommentThread) []CommentItem {
+	items := make([]CommentItem, len(threads))
+	for i, t := range threads {
+		items[i] = CommentItem{Section: cd, CommentThread: t}
+	}
+	return items
+}
+
+// UpdateCommenting turns comments on the gallery and its photos on
+// or off.
+//
+// POST /galleries/:id/commenting
+func (g *Galleries) UpdateCommenting(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	var form CommentingForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	gallery.Comments = form.Comments
+	gallery.VisitorComments = form.Comments && form.VisitorComments
+	if err := g.gs.Update(r.Context(), gallery); err != nil {
+		vd.SetAlert(err)
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	g.audit(r, models.AuditGalleryUpdate, gallery)
+	if gallery.Comments {
+		vd.AlertSuccess("Comments are on.")
+	} else {
+		vd.AlertSuccess("Comments are off. Existing comments are hidden until you turn them back on.")
+	}
+	g.render(w, r, g.EditView, vd, gallery)
+}
+
+// Comment leaves a comment from the signed in user on the gallery,
+// or on one of its photos.
+//
+// POST /galleries/:id/comments
+func (g *Galleries) Comment(w http.ResponseWriter, r *http.Request) {
+	id, err := routeID(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	gallery, err := g.gs.ByID(r.Context(), id)
+	if err != nil {
+		g.photoError(w, r, err)
+		return
+	}
+	if !gallery.Comments {
+		http.Error(w, models.ErrCommentsDisabled.Public(), http.StatusForbidden)
+		return
+	}
+	var vd views.Data
+	var form CommentForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderShow(w, r, vd, gallery)
+		return
+	}
+	var photo *models.Photo
+	if form.PhotoID != 0 {
+		photo, err = g.ps.ByID(r.Context(), form.PhotoID)
+		if err == nil && photo.GalleryID != gallery.ID {
+			err = models.ErrNotFound
+		}
+		if err != nil {
+			g.photoError(w, r, err)
+			return
+		}
+	}
+	user := context.User(r.Context())
+	comment := models.Comment{
+		GalleryID:  gallery.ID,
+		PhotoID:    form.PhotoID,
+		ParentID:   form.ParentID,
+		UserID:     user.ID,
+		AuthorName: user.Name,
+		Body:       form.Body,
+	}
+	if comment.AuthorName == "" {
+		comment.AuthorName = "LensLocked user"
+	}
+	if err := g.cs.Create(models.ValidateAll(r.Context()), &comment); err != nil {
+		vd.SetAlert(err)
+		vd.Form = r.PostForm
+		if photo != nil {
+			g.renderPhoto(w, r, vd, gallery, photo)
+		} else {
+			g.renderShow(w, r, vd, gallery)
+		}
+		return
+	}
+	g.logger.InfoContext(r.Context(), "comment created",
+		"gallery_id", gallery.ID, "comment_id", comment.ID)
+	g.notifyComment(r, gallery, &comment)
+	http.Redirect(w, r, commentPath(gallery, &comment), http.StatusFound)
+}
+
+// VisitorComment leaves a comment on the gallery from a client on
+// its proofing link, if the gallery lets them.
+//
+// POST /proof/:token/comments
+func (g *Galleries) VisitorComment(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.proofGallery(w, r)
+	if err != nil {
+		return
+	}
+	if !gallery.Comments || !gallery.VisitorComments {
+		http.Error(w, models.ErrCommentsDisabled.Public(), http.StatusForbidden)
+		return
+	}
+	proof, err := g.clientProof(r, gallery)
+	if err != nil {
+		g.proofError(w, r, err)
+		return
+	}
+	var vd views.Data
+	var form CommentForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderProof(w, r, vd, gallery, proof)
+		return
+	}
+	comment := models.Comment{
+		GalleryID:  gallery.ID,
+		ParentID:   form.ParentID,
+		AuthorName: form.Author,
+		Body:       form.Body,
+	}
+	if err := g.cs.Create(models.ValidateAll(r.Context()), &comment); err != nil {
+		vd.SetAlert(err)
+		vd.Form = r.PostForm
+		g.renderProof(w, r, vd, gallery, proof)
+		return
+	}
+	g.logger.InfoContext(r.Context(), "visitor comment created",
+		"gallery_id", gallery.ID, "comment_id", comment.ID)
+	g.notifyComment(r, gallery, &comment)
+	http.Redirect(w, r, fmt.Sprintf("/proof/%s#comment-%d",
+		gallery.ProofToken, comment.ID), http.StatusFound)
+}
+
+// HideComment hides a comment on the gallery, along with the
+// replies to it, from everyone but the owner. Hiding it again shows
+// it again.
+//
+// POST /galleries/:id/comments/:comment_id/hide
+func (g *Galleries) HideComment(w http.ResponseWriter, r *http.Request) {
+	gallery, comment, err := g.ownedComment(w, r)
+	if err != nil {
+		return
+	}
+	comment.Hidden = !comment.Hidden
+	if err := g.cs.Update(r.Context(), comment); err != nil {
+		g.logger.ErrorContext(r.Context(), "hide comment",
+			"comment_id", comment.ID, "err", err)
+		http.Error(w, "Whoops! Something went wrong",
+			http.StatusInternalServerError)
+		return
+	}
+	g.audit(r, models.AuditCommentHide, gallery)
+	http.Redirect(w, r, commentPath(gallery, comment), http.StatusFound)
+}
+
+// DeleteComment deletes a comment on the gallery and all of the
+// replies to it.
+//
+// POST /galleries/:id/comments/:comment_id/delete
+func (g *Galleries) DeleteComment(w http.ResponseWriter, r *http.Request) {
+	gallery, comment, err := g.ownedComment(w, r)
+	if err != nil {
+		return
+	}
+	if err := g.cs.Delete(r.Context(), comment.ID); err != nil {
+		g.logger.ErrorContext(r.Context(), "delete comment",
+			"comment_id", comment.ID, "err", err)
+		http.Error(w, "Whoops! Something went wrong",
+			http.StatusInternalServerError)
+		return
+	}
+	g.audit(r, models.AuditCommentDelete, gallery)
+	comment.ID = 0
+	http.Redirect(w, r, commentPath(gallery, comment), http.StatusFound)
+}
+
+// ownedComment looks up the comment in the route and makes sure it
+// is on a gallery the signed in user owns. Like ownedGallery, it
+// writes the error response itself.
+func (g *Galleries) ownedComment(w http.ResponseWriter, r *http.Request) (*models.Gallery, *models.Comment, error) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["comment_id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, nil, err
+	}
+	comment, err := g.cs.ByID(r.Context(), uint(id))
+	if err == nil && comment.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		g.photoError(w, r, err)
+		return nil, nil, err
+	}
+	return gallery, comment, nil
+}
+
+// commentPath is where comment is shown to signed in users. If
+// comment has no ID, it is the comment section it was in.
+func commentPath(gallery *models.Gallery, comment *models.Comment) string {
+	path := fmt.Sprintf("/galleries/%d", gallery.ID)
+	if comment.PhotoID != 0 {
+		path += fmt.Sprintf("/photos/%d", comment.PhotoID)
+	}
+	if comment.ID == 0 {
+		return path + "#comments"
+	}
+	return path + fmt.Sprintf("#comment-%d", comment.ID)
+}
+
+// comments returns the comment section for the gallery, or for the
+// photo with the given ID, as the viewer of r sees it. It is nil if
+// the gallery has comments turned off. A failure to load the
+// comments is shown as an alert unless vd already has one.
+func (g *Galleries) comments(r *http.Request, vd *views.Data,
+	gallery *models.Gallery, photoID uint) *CommentsData {
+	if !gallery.Comments {
+		return nil
+	}
+	cd := &CommentsData{
+		Gallery: gallery,
+		PhotoID: photoID,
+		Owner:   isOwner(r, gallery),
+	}
+	if context.User(r.Context()) != nil {
+		cd.Action = fmt.Sprintf("/galleries/%d/comments", gallery.ID)
+	}
+	var err error
+	cd.Threads, err = g.cs.Threads(r.Context(), gallery.ID, photoID, cd.Owner)
+	if err != nil {
+		g.logger.ErrorContext(r.Context(), "look up comments",
+			"gallery_id", gallery.ID, "photo_id", photoID, "err", err)
+		if vd.Alert == nil {
+			vd.SetAlert(err)
+		}
+	}
+	return cd
+}
+
+// notifyComment emails the gallery's owner about comment, unless
+// they left it themselves.
+func (g *Galleries) notifyComment(r *http.Request, gallery *models.Gallery,
+	comment *models.Comment) {
+	if comment.UserID == gallery.UserID {
+		return
+	}
+	owner, err := g.users.ByID(r.Context(), gallery.UserID)
+	if err != nil {
+		g.logger.ErrorContext(r.Context(), "look up gallery owner",
+			"gallery_id", gallery.ID, "err", err)
+		return
+	}
+	what := "your gallery"
+	if comment.PhotoID != 0 {
+		what = "a photo in your gallery"
+	}
+	msg := email.Message{
+		To:      owner.Email,
+		Subject: fmt.Sprintf("New comment on %q", gallery.Title),
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"%s commented on %s %q:\n\n"+
+			"%s\n\n"+
+			"See the comment, reply or hide it here:\n\n"+
+			"%s\n",
+			owner.Name, comment.AuthorName, what, gallery.Title,
+			comment.Body, g.baseURL+commentPath(gallery, comment)),
+	}
+	// The commenter shouldn't have to wait on the mail server.
+	ctx := stdctx.WithoutCancel(r.Context())
+	go func() {
+		if err := g.mailer.Send(ctx, msg); err != nil {
+			g.logger.ErrorContext(ctx, "send comment notification",
+				"comment_id", comment.ID, "err", err)
+		}
+	}()
+}
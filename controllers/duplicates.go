@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+// maxDuplicateNames is how many duplicates an upload warning names
+// before it just counts the rest.
+const maxDuplicateNames = 3
+
+// Duplicates lists the signed in user's photos that are exact or
+// near copies of one another, so they can pick which to delete.
+//
+// GET /galleries/duplicates
+func (g *Galleries) Duplicates(w http.ResponseWriter, r *http.Request) {
+	g.renderDuplicates(w, r, views.Data{})
+}
+
+// DeleteDuplicate deletes a photo from the duplicates page and
+// shows the page again.
+//
+// POST /galleries/:id/duplicates/:photo_id/delete
+func (g *Galleries) DeleteDuplicate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	photo, err := g.ownedPhoto(r, gallery)
+	if err == nil {
+		err = g.ps.Remove(r.Context(), gallery, photo)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderDuplicates(w, r, vd)
+		return
+	}
+	g.audit(r, models.AuditPhotoDelete, gallery)
+	vd.AlertSuccess(fmt.Sprintf("Deleted %s from %s.", photo.Name, gallery.Title))
+	g.renderDuplicates(w, r, vd)
+}
+
+func (g *Galleries) renderDuplicates(w http.ResponseWriter, r *http.Request,
+	vd views.Data) {
+	groups, err := g.ps.Duplicates(r.Context(), context.User(r.Context()).ID)
+	if err != nil {
+		g.logger.ErrorContext(r.Context(), "find duplicates", "err", err)
+		vd.SetAlert(err)
+	}
+	vd.Yield = groups
+	g.DuplicatesView.Render(w, vd)
+}
+
+// duplicateWarning describes which of the photos just uploaded to
+// gallery look like ones the user already has, or returns "" if
+// none do. Failing to look is logged rather than failing the upload.
+func (g *Galleries) duplicateWarning(r *http.Request, gallery *models.Gallery,
+	photos []models.Photo) string {
+	if len(photos) == 0 {
+		return ""
+	}
+	matches, err := g.ps.Matches(r.Context(), gallery, photos)
+	if err != nil {
+		g.logger.ErrorContext(r.Context(), "look for duplicates",
+			"gallery_id", gallery.ID, "err", err)
+		return ""
+	}
+	if len(matches) == 0 {
+		return ""
+	}
+	var names []string
+	for _, photo := range photos {
+		found, ok := matches[photo.ID]
+		if !ok {
+			continue
+		}
+		if len(names) == maxDuplicateNames {
+			names = append(names, fmt.Sprintf("%d more",
+				len(matches)-maxDuplicateNames))
+			break
+		}
+		m := found[0]
+		how := "looks like"
+		if m.Exact {
+			how = "is a copy of"
+		}
+		names = append(names, fmt.Sprintf("%s %s %s in %s",
+			photo.Name, how, m.Name, m.Gallery.Title))
+	}
+	intro := fmt.Sprintf("%d of them may be duplicates", len(matches))
+	if len(photos) == 1 {
+		intro = "It may be a duplicate"
+	}
+	return fmt.Sprintf("%s: %s. Use Find duplicates on your galleries "+
+		"page to review them.", intro, strings.Join(names, "; "))
+}
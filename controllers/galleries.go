@@ -1,40 +1,128 @@
 package controllers
 
 import (
+	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
 
 	"github.com/gorilla/mux"
 
 	"lenslocked.com/context"
+	"lenslocked.com/email"
+	"lenslocked.com/metrics"
 	"lenslocked.com/models"
 	"lenslocked.com/views"
 )
 
 const (
-	ShowGallery = "show_gallery"
+	ShowGallery  = "show_gallery"
+	EditGallery  = "edit_gallery"
+	IndexGallery = "index_gallery"
 )
 
 type Galleries struct {
-	New      *views.View
-	ShowView *views.View
-	gs       models.GalleryService
-	r        *mux.Router
+	New            *views.View
+	ShowView       *views.View
+	EditView       *views.View
+	IndexView      *views.View
+	PhotoView      *views.View
+	DuplicatesView *views.View
+	ProofView      *views.View
+	ProofsView     *views.View
+	gs             models.GalleryService
+	ps             models.PhotoService
+	us             models.UploadService
+	prs            models.ProofService
+	cs             models.CommentService
+	as             models.AuditService
+	users          models.UserService
+	mailer         email.Mailer
+	baseURL        string
+	r              *mux.Router
+	logger         *slog.Logger
 }
 
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title    string `schema:"title"`
+	StripGPS bool   `schema:"strip_gps"`
 }
 
-func NewGalleries(gs models.GalleryService, r *mux.Router) *Galleries {
+// NewGalleries returns the galleries controller. Gallery owners are
+// told about new comments through mailer, with links to baseURL.
+func NewGalleries(gs models.GalleryService, ps models.PhotoService,
+	us models.UploadService, prs models.ProofService,
+	cs models.CommentService, as models.AuditService,
+	users models.UserService, mailer email.Mailer, baseURL string,
+	r *mux.Router, logger *slog.Logger) *Galleries {
 	return &Galleries{
-		New:      views.NewView("bootstrap", "galleries/new"),
-		ShowView: views.NewView("bootstrap", "galleries/show"),
-		gs:       gs,
-		r:        r,
+		New:            views.NewView("bootstrap", "galleries/new"),
+		ShowView:       views.NewView("bootstrap", "galleries/show", "galleries/comments"),
+		EditView:       views.NewView("bootstrap", "galleries/edit"),
+		IndexView:      views.NewView("bootstrap", "galleries/index"),
+		PhotoView:      views.NewView("bootstrap", "galleries/photo", "galleries/comments"),
+		DuplicatesView: views.NewView("bootstrap", "galleries/duplicates"),
+		ProofView:      views.NewView("bootstrap", "galleries/proof", "galleries/comments"),
+		ProofsView:     views.NewView("bootstrap", "galleries/proofs"),
+		gs:             gs,
+		ps:             ps,
+		us:             us,
+		prs:            prs,
+		cs:             cs,
+		as:             as,
+		users:          users,
+		mailer:         mailer,
+		baseURL:        baseURL,
+		r:              r,
+		logger:         logger,
 	}
 }
 
+// GalleryData is the Yield for the pages showing a single gallery.
+type GalleryData struct {
+	*models.Gallery
+	// Photos are the gallery's photos in order.
+	Photos []models.Photo
+	// CommentSection is only set on the gallery's own page, and only if
+	// it takes comments.
+	CommentSection *CommentsData
+}
+
+// GalleryCard is a gallery in a list, along with its cover photo
+// if it has any photos.
+type GalleryCard struct {
+	models.Gallery
+	Cover *models.Photo
+}
+
+// Index lists the galleries owned by the signed in user.
+//
+// GET /galleries
+func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	galleries, err := g.gs.ByUserID(r.Context(), user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		g.IndexView.Render(w, vd)
+		return
+	}
+	covers, err := g.ps.Covers(r.Context(), galleries)
+	if err != nil {
+		g.logger.ErrorContext(r.Context(), "look up gallery covers", "err", err)
+		vd.SetAlert(err)
+	}
+	cards := make([]GalleryCard, len(galleries))
+	for i, gallery := range galleries {
+		cards[i].Gallery = gallery
+		if cover, ok := covers[gallery.ID]; ok {
+			cards[i].Cover = &cover
+		}
+	}
+	vd.Yield = cards
+	g.IndexView.Render(w, vd)
+}
+
 // POST /galleries
 func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	var vd views.Data
@@ -49,16 +137,23 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 		Title:  form.Title,
 		UserID: user.ID,
 	}
-	if err := g.gs.Create(&gallery); err != nil {
+	if err := g.gs.Create(models.ValidateAll(r.Context()), &gallery); err != nil {
+		g.logger.InfoContext(r.Context(), "create gallery failed", "err", err)
 		vd.SetAlert(err)
+		vd.Form = r.PostForm
 		g.New.Render(w, vd)
 		return
 	}
+	g.logger.InfoContext(r.Context(), "gallery created",
+		"gallery_id", gallery.ID)
+	metrics.GalleriesCreated.Inc()
+	g.audit(r, models.AuditGalleryCreate, &gallery)
 
 	url, err := g.r.Get(ShowGallery).URL("id",
 		strconv.Itoa(int(gallery.ID)))
 	if err != nil {
 		http.Redirect(w, r, "/", http.StatusFound)
+		return
 	}
 	http.Redirect(w, r, url.Path, http.StatusFound)
 
@@ -81,19 +176,170 @@ func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// look up gallery based on id
-	gallery, err := g.gs.ByID(uint(id))
+	gallery, err := g.gs.ByID(r.Context(), uint(id))
 	if err != nil {
 		switch err {
 		case models.ErrNotFound:
 			vd.AlertError("Gallery not found!")
 			g.ShowView.Render(w, vd)
 		default:
+			g.logger.ErrorContext(r.Context(), "look up gallery",
+				"gallery_id", id, "err", err)
 			http.Error(w, "Whoops! Something went wrong",
 				http.StatusInternalServerError)
 		}
 		return
 	}
 
-	vd.Yield = gallery
+	g.renderShow(w, r, vd, gallery)
+}
+
+// Edit renders the form used to change a gallery.
+//
+// GET /galleries/:id/edit
+func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	g.render(w, r, g.EditView, views.Data{}, gallery)
+}
+
+// Update saves the changes made in the edit form.
+//
+// POST /galleries/:id/update
+func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	var form GalleryForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	gallery.Title = form.Title
+	gallery.StripGPS = form.StripGPS
+	if err := g.gs.Update(models.ValidateAll(r.Context()), gallery); err != nil {
+		vd.SetAlert(err)
+		vd.Form = r.PostForm
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	g.audit(r, models.AuditGalleryUpdate, gallery)
+	vd.AlertSuccess("Gallery successfully updated!")
+	g.render(w, r, g.EditView, vd, gallery)
+}
+
+// Delete removes a gallery owned by the signed in user.
+//
+// POST /galleries/:id/delete
+func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	if err := g.gs.Delete(r.Context(), gallery.ID); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	g.logger.InfoContext(r.Context(), "gallery deleted",
+		"gallery_id", gallery.ID)
+	g.audit(r, models.AuditGalleryDelete, gallery)
+	// The gallery is gone either way; photos that couldn't be
+	// removed are cleaned up by lenslocked-admin backfill.
+	if err := g.ps.RemoveAll(r.Context(), gallery); err != nil {
+		g.logger.ErrorContext(r.Context(), "remove photos of deleted gallery",
+			"gallery_id", gallery.ID, "err", err)
+	}
+
+	url, err := g.r.Get(IndexGallery).URL()
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// render shows gallery and its photos with view. A failure to load
+// the photos is shown as an alert unless vd already has one.
+func (g *Galleries) render(w http.ResponseWriter, r *http.Request,
+	view *views.View, vd views.Data, gallery *models.Gallery) {
+	vd.Yield = g.galleryData(r, &vd, gallery)
+	view.Render(w, vd)
+}
+
+// renderShow is render for the gallery's own page, which also has
+// the comments on the gallery.
+func (g *Galleries) renderShow(w http.ResponseWriter, r *http.Request,
+	vd views.Data, gallery *models.Gallery) {
+	data := g.galleryData(r, &vd, gallery)
+	data.CommentSection = g.comments(r, &vd, gallery, 0)
+	vd.Yield = data
 	g.ShowView.Render(w, vd)
 }
+
+func (g *Galleries) galleryData(r *http.Request, vd *views.Data,
+	gallery *models.Gallery) GalleryData {
+	photos, err := g.ps.ByGalleryID(r.Context(), gallery.ID)
+	if err != nil {
+		g.logger.ErrorContext(r.Context(), "look up photos",
+			"gallery_id", gallery.ID, "err", err)
+		if vd.Alert == nil {
+			vd.SetAlert(err)
+		}
+	}
+	return GalleryData{Gallery: gallery, Photos: photos}
+}
+
+// isOwner reports whether the signed in user owns gallery. Public
+// routes only know who is signed in when wrapped in middleware.User.
+func isOwner(r *http.Request, gallery *models.Gallery) bool {
+	user := context.User(r.Context())
+	return user != nil && user.ID == gallery.UserID
+}
+
+// ownedGallery looks up the gallery in the route and makes sure it
+// belongs to the signed in user. If anything goes wrong it writes
+// the error response itself and returns a non-nil error, so
+// callers only need to return.
+func (g *Galleries) ownedGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	id, err := routeID(r)
+	if err != nil {
+		http.Error(w, "Invalid Gallery ID", http.StatusNotFound)
+		return nil, err
+	}
+	gallery, err := g.gs.ByID(r.Context(), id)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+		default:
+			g.logger.ErrorContext(r.Context(), "look up gallery",
+				"gallery_id", id, "err", err)
+			http.Error(w, "Whoops! Something went wrong",
+				http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return nil, models.ErrNotFound
+	}
+	return gallery, nil
+}
+
+// audit records a gallery event performed by the signed in user.
+func (g *Galleries) audit(r *http.Request, action string, gallery *models.Gallery) {
+	g.as.Record(r.Context(), &models.AuditEvent{
+		UserID:  context.User(r.Context()).ID,
+		Action:  action,
+		Success: true,
+		Details: fmt.Sprintf("gallery %d: %s", gallery.ID, gallery.Title),
+	})
+}
@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"lenslocked.com/models"
+)
+
+func TestCreateGallery(t *testing.T) {
+	at := newAppTest(t)
+	user, cookie := at.user(t, "al@example.com")
+
+	if rec := at.do("GET", "/galleries/new", nil, nil); rec.Code != http.StatusFound ||
+		rec.Header().Get("Location") != "/login" {
+		t.Errorf("signed out: got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := at.do("GET", "/galleries/new", nil, cookie); rec.Code != http.StatusOK {
+		t.Errorf("new gallery page: got %d", rec.Code)
+	}
+
+	rec := at.do("POST", "/galleries", url.Values{"title": {""}}, cookie)
+	if rec.Code != http.StatusOK ||
+		!strings.Contains(rec.Body.String(), models.ErrTitleRequired.Public()) {
+		t.Errorf("without a title: got %d", rec.Code)
+	}
+
+	rec = at.do("POST", "/galleries", url.Values{"title": {"Holiday"}}, cookie)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/galleries/1" {
+		t.Fatalf("got %d to %q, want a redirect to /galleries/1",
+			rec.Code, rec.Header().Get("Location"))
+	}
+	galleries, err := at.galleries.ByUserID(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(galleries) != 1 || galleries[0].Title != "Holiday" {
+		t.Errorf("galleries %+v", galleries)
+	}
+}
+
+func TestShowGallery(t *testing.T) {
+	at := newAppTest(t)
+	user, _ := at.user(t, "al@example.com")
+	gallery := &models.Gallery{UserID: user.ID, Title: "Al's <holiday>"}
+	if err := at.galleries.Create(context.Background(), gallery); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := at.do("GET", "/galleries/1", nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, template.HTMLEscapeString(gallery.Title)) ||
+		strings.Contains(body, "<holiday>") {
+		t.Error("title missing or not escaped")
+	}
+	if rec := at.do("GET", "/galleries/2", nil, nil); !strings.Contains(rec.Body.String(), "Gallery not found") {
+		t.Error("missing gallery not reported")
+	}
+}
+
+func TestEditGallery(t *testing.T) {
+	at := newAppTest(t)
+	owner, ownerCookie := at.user(t, "al@example.com")
+	_, otherCookie := at.user(t, "bo@example.com")
+	gallery := &models.Gallery{UserID: owner.ID, Title: "Holiday"}
+	if err := at.galleries.Create(context.Background(), gallery); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := at.do("GET", "/galleries/1/edit", nil, ownerCookie); rec.Code != http.StatusOK {
+		t.Errorf("owner: got %d", rec.Code)
+	}
+	if rec := at.do("GET", "/galleries/1/edit", nil, otherCookie); rec.Code != http.StatusNotFound {
+		t.Errorf("someone else: got %d, want 404", rec.Code)
+	}
+	if rec := at.do("GET", "/galleries/1/edit", nil, nil); rec.Code != http.StatusFound {
+		t.Errorf("signed out: got %d, want a redirect", rec.Code)
+	}
+
+	rec := at.do("POST", "/galleries/1/update", url.Values{"title": {"Stolen"}}, otherCookie)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("update by someone else: got %d, want 404", rec.Code)
+	}
+	rec = at.do("POST", "/galleries/1/update", url.Values{"title": {""}}, ownerCookie)
+	if !strings.Contains(rec.Body.String(), models.ErrTitleRequired.Public()) {
+		t.Error("empty title not reported")
+	}
+	rec = at.do("POST", "/galleries/1/update",
+		url.Values{"title": {"Beach"}, "strip_gps": {"true"}}, ownerCookie)
+	if !strings.Contains(rec.Body.String(), "Gallery successfully updated!") {
+		t.Error("update not confirmed")
+	}
+	got, err := at.galleries.ByID(context.Background(), gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Beach" || !got.StripGPS {
+		t.Errorf("stored %q, strip GPS %v", got.Title, got.StripGPS)
+	}
+}
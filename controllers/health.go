@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// readyTimeout bounds how long a readiness probe waits on the
+// database before reporting the service as unavailable.
+const readyTimeout = 2 * time.Second
+
+// Pinger is implemented by anything that can report whether a
+// backing service (eg the database) is reachable.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+func NewHealth(db Pinger, logger *slog.Logger) *Health {
+	return &Health{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// Health serves the probes used by our load balancer.
+type Health struct {
+	db     Pinger
+	logger *slog.Logger
+}
+
+// Healthz reports that the process is up and able to serve
+// requests. It never touches any backing services.
+//
+// GET /healthz
+func (h *Health) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// Readyz reports whether the app can serve real traffic by
+// pinging the database.
+//
+// GET /readyz
+func (h *Health) Readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := h.db.Ping(ctx); err != nil {
+		h.logger.ErrorContext(r.Context(), "readiness check failed", "err", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "database unavailable")
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
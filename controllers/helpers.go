@@ -1,8 +1,12 @@
 package controllers
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 )
 
@@ -18,3 +22,28 @@ func parseForm(r *http.Request, dst interface{}) error {
 	}
 	return nil
 }
+
+// routeID parses the "id" route variable.
+func routeID(r *http.Request) (uint, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, err
+	}
+	return uint(id), nil
+}
+
+// extendDeadlines gives a request that moves a lot of data read to
+// send its body and write to receive the response, in place of the
+// server's timeouts, which are meant for ordinary pages. A zero
+// duration leaves that deadline alone.
+func extendDeadlines(w http.ResponseWriter, read, write time.Duration) error {
+	rc := http.NewResponseController(w)
+	var errs []error
+	if read > 0 {
+		errs = append(errs, rc.SetReadDeadline(time.Now().Add(read)))
+	}
+	if write > 0 {
+		errs = append(errs, rc.SetWriteDeadline(time.Now().Add(write)))
+	}
+	return errors.Join(errs...)
+}
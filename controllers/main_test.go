@@ -0,0 +1,26 @@
+package controllers
+
+import (
+	"html/template"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+// TestMain points the views at the templates in the repository root,
+// since tests run in the package directory.
+func TestMain(m *testing.M) {
+	views.LayoutDir = "../views/layouts/"
+	views.TemplateDir = "../views/"
+	views.AddFuncs(template.FuncMap{
+		"resized": func(*models.Photo, int, int, string) string { return "" },
+	})
+	os.Exit(m.Run())
+}
+
+// discard is a logger for controllers under test.
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"lenslocked.com/metrics"
+	"lenslocked.com/middleware"
+	"lenslocked.com/models"
+	"lenslocked.com/rand"
+	"lenslocked.com/sso"
+	"lenslocked.com/views"
+)
+
+// oidcFlowCookie holds the state of a sign in that is in progress
+// at a provider. It is scoped to /auth/<provider>/.
+const oidcFlowCookie = "oidc_flow"
+
+// oidcFlowTTL is how long a user has to complete a sign in at the
+// provider.
+const oidcFlowTTL = 10 * time.Minute
+
+// AlertMsgSignInFailed is shown when a sign in with an external
+// provider fails for a reason the user can't do anything about.
+const AlertMsgSignInFailed = "We couldn't sign you in with that provider. " +
+	"Please try again."
+
+// NewOIDC returns the controller for signing in with external
+// OpenID Connect providers. The providers are also added to the
+// login page served by users, and successful sign ins go through
+// users.signIn like any other login.
+func NewOIDC(users *Users, providers []*sso.Provider, logger *slog.Logger) *OIDC {
+	o := &OIDC{
+		users:     users,
+		providers: make(map[string]*sso.Provider),
+		logger:    logger,
+	}
+	for _, p := range providers {
+		o.providers[p.Name] = p
+		users.providers = append(users.providers, LoginProvider{
+			Name:        p.Name,
+			DisplayName: p.DisplayName,
+		})
+	}
+	return o
+}
+
+type OIDC struct {
+	users     *Users
+	providers map[string]*sso.Provider
+	logger    *slog.Logger
+}
+
+// LoginProvider is an external provider shown on the login page.
+type LoginProvider struct {
+	Name        string
+	DisplayName string
+}
+
+// oidcFlow is what we need to remember between sending the user
+// to the provider and them coming back.
+type oidcFlow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// Login starts a sign in by redirecting to the provider.
+//
+// GET /auth/:provider/login
+func (o *OIDC) Login(w http.ResponseWriter, r *http.Request) {
+	p, ok := o.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var flow oidcFlow
+	var err error
+	if flow.State, err = rand.Strings(16); err == nil {
+		flow.Nonce, err = rand.Strings(16)
+	}
+	if err != nil {
+		o.logger.ErrorContext(r.Context(), "generate oidc state", "err", err)
+		o.fail(w, AlertMsgSignInFailed)
+		return
+	}
+	flow.Verifier = sso.GenerateVerifier()
+
+	b, err := json.Marshal(flow)
+	if err != nil {
+		o.logger.ErrorContext(r.Context(), "encode oidc flow", "err", err)
+		o.fail(w, AlertMsgSignInFailed)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcFlowCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(b),
+		Path:     "/auth/" + p.Name + "/",
+		MaxAge:   int(oidcFlowTTL.Seconds()),
+		HttpOnly: true,
+		// Lax lets the cookie through on the top level redirect
+		// back from the provider.
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, p.AuthCodeURL(flow.State, flow.Nonce, flow.Verifier),
+		http.StatusFound)
+}
+
+// Callback finishes a sign in once the provider redirects back
+// with an authorization code.
+//
+// GET /auth/:provider/callback
+func (o *OIDC) Callback(w http.ResponseWriter, r *http.Request) {
+	p, ok := o.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := r.Context()
+
+	flow, err := readOIDCFlow(r)
+	// The flow is single use whatever happens next.
+	http.SetCookie(w, &http.Cookie{
+		Name:   oidcFlowCookie,
+		Path:   "/auth/" + p.Name + "/",
+		MaxAge: -1,
+	})
+	if err != nil || flow.State == "" || subtle.ConstantTimeCompare(
+		[]byte(flow.State), []byte(r.FormValue("state"))) != 1 {
+		o.logger.InfoContext(ctx, "oidc state mismatch",
+			"provider", p.Name, "err", err)
+		o.fail(w, "Your sign in attempt expired. Please try again.")
+		return
+	}
+	if e := r.FormValue("error"); e != "" {
+		o.logger.InfoContext(ctx, "oidc sign in refused",
+			"provider", p.Name, "error", e,
+			"description", r.FormValue("error_description"))
+		o.fail(w, "Sign in was cancelled.")
+		return
+	}
+
+	claims, err := p.Exchange(ctx, r.FormValue("code"), flow.Verifier, flow.Nonce)
+	if err != nil {
+		o.logger.WarnContext(ctx, "oidc exchange failed",
+			"provider", p.Name, "err", err)
+		metrics.Logins.WithLabelValues(metrics.Failure).Inc()
+		o.fail(w, AlertMsgSignInFailed)
+		return
+	}
+
+	user, err := o.users.us.AuthenticateIdentity(ctx, models.ExternalIdentity{
+		Provider:      p.Name,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+	})
+	if err != nil {
+		o.logger.InfoContext(ctx, "login failed", "provider", p.Name,
+			"reason", err)
+		metrics.Logins.WithLabelValues(metrics.Failure).Inc()
+		var vd views.Data
+		if err == models.ErrNotFound {
+			vd.AlertError("The account linked to that sign in no longer exists.")
+		} else {
+			vd.SetAlert(err)
+		}
+		o.users.renderLogin(w, vd)
+		return
+	}
+
+	if err := o.users.signIn(ctx, w, user); err != nil {
+		o.logger.ErrorContext(ctx, "sign in", "user", user, "err", err)
+		o.fail(w, AlertMsgSignInFailed)
+		return
+	}
+	o.logger.InfoContext(ctx, "user logged in", "user", user,
+		"provider", p.Name)
+	metrics.Logins.WithLabelValues(metrics.Success).Inc()
+	if user.PasswordResetRequired {
+		http.Redirect(w, r, middleware.PasswordChangePath, http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+func (o *OIDC) fail(w http.ResponseWriter, msg string) {
+	var vd views.Data
+	vd.AlertError(msg)
+	o.users.renderLogin(w, vd)
+}
+
+func readOIDCFlow(r *http.Request) (oidcFlow, error) {
+	var flow oidcFlow
+	cookie, err := r.Cookie(oidcFlowCookie)
+	if err != nil {
+		return flow, err
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return flow, err
+	}
+	err = json.Unmarshal(b, &flow)
+	return flow, err
+}
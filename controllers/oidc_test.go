@@ -0,0 +1,332 @@
+package controllers
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"lenslocked.com/models"
+	"lenslocked.com/sso"
+)
+
+// mockProvider is a minimal OpenID Connect provider: it serves a
+// discovery document, a JWKS and a token endpoint that checks the
+// PKCE verifier. The authorization step is skipped; tests call
+// authorize with what the user's browser would have sent.
+type mockProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+// mockGrant is what the provider remembers about an issued code.
+type mockGrant struct {
+	challenge string
+	nonce     string
+	claims    map[string]interface{}
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := &mockProvider{key: key, codes: make(map[string]mockGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", mp.discovery)
+	mux.HandleFunc("/jwks", mp.jwks)
+	mux.HandleFunc("/token", mp.token)
+	mp.Server = httptest.NewServer(mux)
+	t.Cleanup(mp.Close)
+	return mp
+}
+
+func (mp *mockProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                mp.URL,
+		"authorization_endpoint":                mp.URL + "/authorize",
+		"token_endpoint":                        mp.URL + "/token",
+		"jwks_uri":                              mp.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (mp *mockProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := mp.key.PublicKey
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (mp *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	mp.mu.Lock()
+	grant, ok := mp.codes[r.FormValue("code")]
+	delete(mp.codes, r.FormValue("code"))
+	mp.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	claims := map[string]interface{}{
+		"iss":   mp.URL,
+		"aud":   "client",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": grant.nonce,
+	}
+	for k, v := range grant.claims {
+		claims[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     mp.sign(claims),
+	})
+}
+
+func (mp *mockProvider) sign(claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"}) +
+		"." + enc(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, mp.key, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// authorize issues a code for the authorization request at authURL,
+// as the provider would once the user signed in. nonce overrides
+// the request's nonce when it isn't empty.
+func (mp *mockProvider) authorize(t *testing.T, authURL, nonce string,
+	claims map[string]interface{}) (code, state string) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("authorization request without S256 PKCE: %s", authURL)
+	}
+	if nonce == "" {
+		nonce = q.Get("nonce")
+	}
+	code = "code-" + q.Get("state")
+	mp.mu.Lock()
+	mp.codes[code] = mockGrant{
+		challenge: q.Get("code_challenge"),
+		nonce:     nonce,
+		claims:    claims,
+	}
+	mp.mu.Unlock()
+	return code, q.Get("state")
+}
+
+type oidcTest struct {
+	provider *mockProvider
+	users    models.UserService
+	router   *mux.Router
+}
+
+func newOIDCTest(t *testing.T) *oidcTest {
+	mp := newMockProvider(t)
+	p, err := sso.NewProvider(context.Background(), sso.Config{
+		Name:         "mock",
+		Issuer:       mp.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "http://example.com/auth/mock/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit := models.NewMemoryAuditService(discard)
+	us := models.NewMemoryUserService(discard, audit)
+	usersC := NewUsers(us, audit, nil, nil, nil, "http://example.com", discard)
+	oidcC := NewOIDC(usersC, []*sso.Provider{p}, discard)
+	r := mux.NewRouter()
+	r.HandleFunc("/auth/{provider}/login", oidcC.Login)
+	r.HandleFunc("/auth/{provider}/callback", oidcC.Callback)
+	return &oidcTest{provider: mp, users: us, router: r}
+}
+
+func (ot *oidcTest) do(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	ot.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// login starts a sign in and returns the flow cookie and the URL
+// the user is sent to at the provider.
+func (ot *oidcTest) login(t *testing.T) (*http.Cookie, string) {
+	rec := ot.do(httptest.NewRequest("GET", "/auth/mock/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login: got status %d, want %d", rec.Code, http.StatusFound)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcFlowCookie {
+		t.Fatalf("login: got cookies %v, want %s", cookies, oidcFlowCookie)
+	}
+	return cookies[0], rec.Header().Get("Location")
+}
+
+func (ot *oidcTest) callback(cookie *http.Cookie, code, state string) *httptest.ResponseRecorder {
+	q := url.Values{"code": {code}, "state": {state}}
+	req := httptest.NewRequest("GET", "/auth/mock/callback?"+q.Encode(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	return ot.do(req)
+}
+
+var verifiedAl = map[string]interface{}{
+	"sub":            "al-at-mock",
+	"email":          "al@example.com",
+	"email_verified": true,
+	"name":           "Al",
+}
+
+func TestOIDCCallback(t *testing.T) {
+	ot := newOIDCTest(t)
+	cookie, authURL := ot.login(t)
+	code, state := ot.provider.authorize(t, authURL, "", verifiedAl)
+	rec := ot.callback(cookie, code, state)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/galleries" {
+		t.Fatalf("got status %d to %q, want a redirect to /galleries:\n%s",
+			rec.Code, rec.Header().Get("Location"), rec.Body)
+	}
+	if !hasCookie(rec, "remember_token") {
+		t.Error("callback didn't sign the user in")
+	}
+	user, err := ot.users.ByEmail(context.Background(), "al@example.com")
+	if err != nil {
+		t.Fatalf("account wasn't created: %v", err)
+	}
+	if user.Name != "Al" {
+		t.Errorf("got name %q, want Al", user.Name)
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		// tamper changes the callback before it is made.
+		tamper func(cookie *http.Cookie, code, state string) (*http.Cookie, string, string)
+		nonce  string
+		claims map[string]interface{}
+		alert  string
+	}{
+		{
+			name: "wrong state",
+			tamper: func(c *http.Cookie, code, state string) (*http.Cookie, string, string) {
+				return c, code, "not-" + state
+			},
+			alert: "Your sign in attempt expired",
+		},
+		{
+			name: "no flow cookie",
+			tamper: func(c *http.Cookie, code, state string) (*http.Cookie, string, string) {
+				return nil, code, state
+			},
+			alert: "Your sign in attempt expired",
+		},
+		{
+			name:  "wrong nonce",
+			nonce: "replayed-nonce",
+			alert: AlertMsgSignInFailed,
+		},
+		{
+			name: "wrong PKCE verifier",
+			tamper: func(c *http.Cookie, code, state string) (*http.Cookie, string, string) {
+				b, _ := base64.RawURLEncoding.DecodeString(c.Value)
+				var flow oidcFlow
+				json.Unmarshal(b, &flow)
+				flow.Verifier = sso.GenerateVerifier()
+				b, _ = json.Marshal(flow)
+				return &http.Cookie{Name: c.Name,
+					Value: base64.RawURLEncoding.EncodeToString(b)}, code, state
+			},
+			alert: AlertMsgSignInFailed,
+		},
+		{
+			name: "unverified email",
+			claims: map[string]interface{}{
+				"sub":            "al-at-mock",
+				"email":          "al@example.com",
+				"email_verified": false,
+			},
+			alert: models.ErrIdentitySignupUnverified.Public(),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ot := newOIDCTest(t)
+			cookie, authURL := ot.login(t)
+			claims := tc.claims
+			if claims == nil {
+				claims = verifiedAl
+			}
+			code, state := ot.provider.authorize(t, authURL, tc.nonce, claims)
+			if tc.tamper != nil {
+				cookie, code, state = tc.tamper(cookie, code, state)
+			}
+			rec := ot.callback(cookie, code, state)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d, want the login page", rec.Code)
+			}
+			alert := template.HTMLEscapeString(tc.alert)
+			if body := rec.Body.String(); !strings.Contains(body, alert) {
+				t.Errorf("login page doesn't say %q:\n%s", tc.alert, body)
+			}
+			if hasCookie(rec, "remember_token") {
+				t.Error("user was signed in")
+			}
+			_, err := ot.users.ByEmail(context.Background(), "al@example.com")
+			if err != models.ErrNotFound {
+				t.Errorf("ByEmail: got %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func hasCookie(rec *httptest.ResponseRecorder, name string) bool {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == name && c.MaxAge >= 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,517 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+const (
+	// maxUploadBytes caps the size of a single upload request.
+	maxUploadBytes = 64 << 20
+	// maxZipUploadBytes caps the size of a ZIP archive upload.
+	maxZipUploadBytes = 1 << 30
+	// archiveTimeout is how long sending or receiving a ZIP archive
+	// may take, in place of the server's timeouts. It is long enough
+	// for a full sized upload over a 5 Mbit/s connection.
+	archiveTimeout = time.Hour
+	// maxUploadMemory is how much of an upload is held in memory
+	// before the rest is spooled to temporary files.
+	maxUploadMemory = 8 << 20
+)
+
+// Upload adds the images in the "photos" field of a multipart form
+// to the end of the gallery.
+//
+// POST /galleries/:id/photos
+func (g *Galleries) Upload(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		g.logger.InfoContext(r.Context(), "parse upload", "err", err)
+		vd.AlertError(fmt.Sprintf("Uploads are limited to %d MB at a time.",
+			maxUploadBytes>>20))
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File["photos"]
+	if len(files) == 0 {
+		vd.AlertError("Choose one or more images to upload.")
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	var uploaded []models.Photo
+	for _, fh := range files {
+		f, err := fh.Open()
+		if err != nil {
+			vd.SetAlert(err)
+			break
+		}
+		photo, err := g.ps.Upload(r.Context(), gallery, fh.Filename, f)
+		f.Close()
+		if err != nil {
+			g.logger.InfoContext(r.Context(), "upload photo failed",
+				"gallery_id", gallery.ID, "name", fh.Filename, "err", err)
+			vd.SetAlert(err)
+			break
+		}
+		uploaded = append(uploaded, *photo)
+	}
+	if len(uploaded) > 0 {
+		g.logger.InfoContext(r.Context(), "photos uploaded",
+			"gallery_id", gallery.ID, "count", len(uploaded))
+		g.audit(r, models.AuditPhotoUpload, gallery)
+	}
+	if vd.Alert == nil {
+		msg := fmt.Sprintf("Uploaded %d photo(s).", len(uploaded))
+		if warning := g.duplicateWarning(r, gallery, uploaded); warning != "" {
+			vd.AlertWarning(msg + " " + warning)
+		} else {
+			vd.AlertSuccess(msg)
+		}
+	}
+	g.render(w, r, g.EditView, vd, gallery)
+}
+
+// UploadZip adds the images in the ZIP archive in the "archive"
+// field of a multipart form to the end of the gallery. The archive
+// is spooled to disk while the form is parsed, so it is never held
+// in memory as a whole.
+//
+// POST /galleries/:id/photos/zip
+func (g *Galleries) UploadZip(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	if err := extendDeadlines(w, archiveTimeout, archiveTimeout); err != nil {
+		g.logger.DebugContext(r.Context(), "extend deadlines", "err", err)
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxZipUploadBytes)
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		g.logger.InfoContext(r.Context(), "parse zip upload", "err", err)
+		vd.AlertError(fmt.Sprintf("ZIP archives are limited to %d MB.",
+			maxZipUploadBytes>>20))
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	f, fh, err := r.FormFile("archive")
+	if err != nil {
+		vd.AlertError("Choose a ZIP archive to upload.")
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	defer f.Close()
+	imp, err := g.ps.ImportZip(r.Context(), gallery, f, fh.Size)
+	if imp != nil && len(imp.Photos) > 0 {
+		g.logger.InfoContext(r.Context(), "photos uploaded",
+			"gallery_id", gallery.ID, "count", len(imp.Photos), "archive", fh.Filename)
+		g.audit(r, models.AuditPhotoUpload, gallery)
+	}
+	if err != nil {
+		g.logger.InfoContext(r.Context(), "zip upload failed",
+			"gallery_id", gallery.ID, "name", fh.Filename, "err", err)
+		vd.SetAlert(err)
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	msg := fmt.Sprintf("Uploaded %d photo(s).", len(imp.Photos))
+	if len(imp.Skipped) > 0 {
+		msg += fmt.Sprintf(" Skipped %d file(s) that aren't images or are too large: %s.",
+			len(imp.Skipped), strings.Join(imp.Skipped, ", "))
+	}
+	if warning := g.duplicateWarning(r, gallery, imp.Photos); warning != "" {
+		vd.AlertWarning(msg + " " + warning)
+	} else {
+		vd.AlertSuccess(msg)
+	}
+	g.render(w, r, g.EditView, vd, gallery)
+}
+
+// Download streams a ZIP archive of the gallery's photos. Like the
+// photos themselves it is as public as the gallery page.
+//
+// GET /galleries/:id/download
+func (g *Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	id, err := routeID(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	gallery, err := g.gs.ByID(r.Context(), id)
+	if err != nil {
+		g.photoError(w, r, err)
+		return
+	}
+	originals := isOwner(r, gallery) || gallery.AllowOriginals
+	if err := extendDeadlines(w, 0, archiveTimeout); err != nil {
+		g.logger.DebugContext(r.Context(), "extend write deadline", "err", err)
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": gallery.Title + ".zip"}))
+	if err := g.ps.WriteZip(r.Context(), gallery, w, originals); err != nil {
+		// The archive is streamed, so by now the client has a
+		// truncated download and all we can do is log.
+		g.logger.ErrorContext(r.Context(), "download gallery",
+			"gallery_id", gallery.ID, "err", err)
+	}
+}
+
+// Photo serves a photo's file. Photos are as public as the gallery
+// page they are shown on. Visitors see the gallery's watermark, if
+// it has one; the owner sees the file they uploaded. Adding
+// ?original downloads the file as uploaded, for the owner and, if
+// the gallery has AllowOriginals set, for visitors. The owner can
+// add ?watermark to see what visitors do.
+//
+// GET /images/galleries/:id/:filename
+func (g *Galleries) Photo(w http.ResponseWriter, r *http.Request) {
+	gallery, photo, err := g.servedPhoto(w, r)
+	if err != nil {
+		return
+	}
+	owner := isOwner(r, gallery)
+	query := r.URL.Query()
+	original := query.Has("original") && (owner || gallery.AllowOriginals)
+	var f io.ReadSeekCloser
+	name := photo.Filename
+	if original || owner && !query.Has("watermark") {
+		f, err = g.ps.Open(gallery, photo)
+	} else {
+		f, name, err = g.ps.OpenWatermarked(gallery, photo)
+	}
+	if err != nil {
+		g.logger.ErrorContext(r.Context(), "open photo",
+			"photo_id", photo.ID, "err", err)
+		http.Error(w, "Whoops! Something went wrong",
+			http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if original && photo.Name != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+			map[string]string{"filename": photo.Name}))
+	}
+	g.serveImage(w, r, gallery, photo, owner, name, f)
+}
+
+// Resized serves a photo resized as the w, h, fit and fm parameters
+// say. The parameters are signed with s, which ResizedPath adds, so
+// only the sizes the site links to can be asked for. Visitors see
+// the gallery's watermark, like they do with Photo.
+//
+// GET /images/resized/:id/:filename
+func (g *Galleries) Resized(w http.ResponseWriter, r *http.Request) {
+	id, err := routeID(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	rs, err := models.ParseResize(query)
+	if err != nil {
+		http.Error(w, err.(views.PublicError).Public(), http.StatusBadRequest)
+		return
+	}
+	// The signature is checked before anything is looked up, so
+	// made up URLs cost next to nothing.
+	err = g.ps.VerifyResize(id, mux.Vars(r)["filename"], rs, query.Get("s"))
+	if err != nil {
+		http.Error(w, err.(views.PublicError).Public(), http.StatusForbidden)
+		return
+	}
+	gallery, photo, err := g.servedPhoto(w, r)
+	if err != nil {
+		return
+	}
+	owner := isOwner(r, gallery)
+	f, name, err := g.ps.OpenResized(gallery, photo, rs, !owner)
+	if err != nil {
+		g.logger.ErrorContext(r.Context(), "resize photo",
+			"photo_id", photo.ID, "err", err)
+		http.Error(w, "Whoops! Something went wrong",
+			http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	g.serveImage(w, r, gallery, photo, owner, name, f)
+}
+
+// servedPhoto looks up the photo an image URL is for. If it can't,
+// it writes the error and returns it.
+func (g *Galleries) servedPhoto(w http.ResponseWriter, r *http.Request) (*models.Gallery, *models.Photo, error) {
+	id, err := routeID(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, nil, err
+	}
+	// Looking the gallery up first means files of deleted
+	// galleries are no longer served.
+	gallery, err := g.gs.ByID(r.Context(), id)
+	if err != nil {
+		g.photoError(w, r, err)
+		return nil, nil, err
+	}
+	photo, err := g.ps.ByFilename(r.Context(), id, mux.Vars(r)["filename"])
+	if err != nil {
+		g.photoError(w, r, err)
+		return nil, nil, err
+	}
+	return gallery, photo, nil
+}
+
+// serveImage serves f, an image of photo whose content is named
+// name, with the caching headers the gallery's settings call for.
+func (g *Galleries) serveImage(w http.ResponseWriter, r *http.Request,
+	gallery *models.Gallery, photo *models.Photo, owner bool,
+	name string, f io.ReadSeeker) {
+	// What is served depends on the gallery's StripGPS and
+	// watermark settings, so changing the gallery has to invalidate
+	// cached copies.
+	modtime := photo.CreatedAt
+	if gallery.UpdatedAt.After(modtime) {
+		modtime = gallery.UpdatedAt
+	}
+	if gallery.Watermark.Enabled() {
+		// The owner's clean copy mustn't be handed to visitors by a
+		// shared cache.
+		w.Header().Add("Vary", "Cookie")
+		if owner {
+			w.Header().Set("Cache-Control", "private")
+		}
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, name, modtime, f)
+}
+
+// PhotoData is the Yield for a photo's page.
+type PhotoData struct {
+	Gallery *models.Gallery
+	Photo   *models.Photo
+	// Metadata is nil if the photo had no EXIF data.
+	Metadata *models.PhotoMetadata
+	// Prev and Next are the neighbouring photos in the gallery, if
+	// there are any.
+	Prev, Next *models.Photo
+	// Original is set when the viewer may download the photo as it
+	// was uploaded.
+	Original bool
+	// CommentSection is nil if the gallery doesn't take comments.
+	CommentSection *CommentsData
+}
+
+// PhotoPage shows a photo with the camera settings it was taken
+// with. The location is left out if the gallery has StripGPS set.
+//
+// GET /galleries/:id/photos/:photo_id
+func (g *Galleries) PhotoPage(w http.ResponseWriter, r *http.Request) {
+	id, err := routeID(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	gallery, err := g.gs.ByID(r.Context(), id)
+	if err != nil {
+		g.photoError(w, r, err)
+		return
+	}
+	photo, err := g.ownedPhoto(r, gallery)
+	if err != nil {
+		g.photoError(w, r, err)
+		return
+	}
+	g.renderPhoto(w, r, views.Data{}, gallery, photo)
+}
+
+// renderPhoto shows the page of photo, which is in gallery. Failures
+// to load any of it are shown as an alert unless vd already has one.
+func (g *Galleries) renderPhoto(w http.ResponseWriter, r *http.Request,
+	vd views.Data, gallery *models.Gallery, photo *models.Photo) {
+	var err error
+	data := PhotoData{
+		Gallery:  gallery,
+		Photo:    photo,
+		Original: isOwner(r, gallery) || gallery.AllowOriginals,
+	}
+	data.Metadata, err = g.ps.Metadata(r.Context(), photo.ID)
+	if err != nil && err != models.ErrNotFound {
+		g.logger.ErrorContext(r.Context(), "look up photo metadata",
+			"photo_id", photo.ID, "err", err)
+		if vd.Alert == nil {
+			vd.SetAlert(err)
+		}
+	}
+	if data.Metadata != nil && gallery.StripGPS {
+		data.Metadata.Latitude, data.Metadata.Longitude = nil, nil
+	}
+	photos, err := g.ps.ByGalleryID(r.Context(), gallery.ID)
+	if err != nil {
+		g.logger.ErrorContext(r.Context(), "look up photos",
+			"gallery_id", gallery.ID, "err", err)
+		if vd.Alert == nil {
+			vd.SetAlert(err)
+		}
+	}
+	for i := range photos {
+		if photos[i].ID != photo.ID {
+			continue
+		}
+		if i > 0 {
+			data.Prev = &photos[i-1]
+		}
+		if i+1 < len(photos) {
+			data.Next = &photos[i+1]
+		}
+	}
+	data.CommentSection = g.comments(r, &vd, gallery, photo.ID)
+	vd.Yield = data
+	g.PhotoView.Render(w, vd)
+}
+
+func (g *Galleries) photoError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == models.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	g.logger.ErrorContext(r.Context(), "look up photo", "err", err)
+	http.Error(w, "Whoops! Something went wrong",
+		http.StatusInternalServerError)
+}
+
+// DeletePhoto removes a photo from the gallery.
+//
+// POST /galleries/:id/photos/:photo_id/delete
+func (g *Galleries) DeletePhoto(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	photo, err := g.ownedPhoto(r, gallery)
+	if err == nil {
+		err = g.ps.Remove(r.Context(), gallery, photo)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	g.audit(r, models.AuditPhotoDelete, gallery)
+	vd.AlertSuccess("Photo deleted.")
+	g.render(w, r, g.EditView, vd, gallery)
+}
+
+type CoverForm struct {
+	PhotoID uint `schema:"photo_id"`
+}
+
+// SetCover chooses the photo that represents the gallery in lists.
+//
+// POST /galleries/:id/cover
+func (g *Galleries) SetCover(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	var form CoverForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	if err := g.ps.SetCover(r.Context(), gallery, form.PhotoID); err != nil {
+		vd.SetAlert(err)
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	vd.AlertSuccess("Cover photo updated.")
+	g.render(w, r, g.EditView, vd, gallery)
+}
+
+type PhotoOrderForm struct {
+	PhotoIDs []uint `schema:"photo_id"`
+}
+
+// ReorderPhotos saves a new order for the gallery's photos. The
+// form lists every photo_id in the gallery in the new order.
+//
+// POST /galleries/:id/photos/order
+func (g *Galleries) ReorderPhotos(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	var form PhotoOrderForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	if err := g.ps.Reorder(r.Context(), gallery.ID, form.PhotoIDs); err != nil {
+		g.logger.InfoContext(r.Context(), "reorder photos failed",
+			"gallery_id", gallery.ID, "err", err)
+		vd.SetAlert(err)
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	vd.AlertSuccess("Photo order saved.")
+	g.render(w, r, g.EditView, vd, gallery)
+}
+
+// SortPhotos orders the gallery's photos by capture time.
+//
+// POST /galleries/:id/photos/sort
+func (g *Galleries) SortPhotos(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	if err := g.ps.SortByTakenAt(r.Context(), gallery.ID); err != nil {
+		g.logger.ErrorContext(r.Context(), "sort photos failed",
+			"gallery_id", gallery.ID, "err", err)
+		vd.SetAlert(err)
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	vd.AlertSuccess("Photos sorted by the time they were taken.")
+	g.render(w, r, g.EditView, vd, gallery)
+}
+
+// ownedPhoto looks up the photo in the route, which must belong to
+// gallery.
+func (g *Galleries) ownedPhoto(r *http.Request, gallery *models.Gallery) (*models.Photo, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["photo_id"])
+	if err != nil {
+		return nil, models.ErrNotFound
+	}
+	photo, err := g.ps.ByID(r.Context(), uint(id))
+	if err != nil {
+		return nil, err
+	}
+	if photo.GalleryID != gallery.ID {
+		return nil, models.ErrNotFound
+	}
+	return photo, nil
+}
@@ -0,0 +1,321 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"lenslocked.com/models"
+)
+
+// testPNG returns a small PNG with a gradient, so resized and
+// watermarked copies differ from it.
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), 128, 255})
+		}
+	}
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// testGallery creates a gallery for a new user, with one photo in
+// it.
+func (at *appTest) testGallery(t *testing.T, email string) (*models.Gallery, *models.Photo, *http.Cookie) {
+	t.Helper()
+	user, cookie := at.user(t, email)
+	gallery := &models.Gallery{UserID: user.ID, Title: "Holiday"}
+	if err := at.galleries.Create(context.Background(), gallery); err != nil {
+		t.Fatal(err)
+	}
+	photo, err := at.photos.Upload(context.Background(), gallery, "beach.png",
+		bytes.NewReader(testPNG(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gallery, photo, cookie
+}
+
+func TestUploadZipSlow(t *testing.T) {
+	at := newAppTest(t)
+	gallery, _, cookie := at.testGallery(t, "al@example.com")
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	f, _ := zw.Create("sunset.png")
+	f.Write(testPNG(t))
+	zw.Close()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("archive", "holiday.zip")
+	part.Write(archive.Bytes())
+	mw.Close()
+
+	const timeout = 200 * time.Millisecond
+	srv := newTimeoutServer(t, at, timeout)
+	// The body arrives in ten pieces spread over three timeouts.
+	pr, pw := io.Pipe()
+	go func() {
+		b := body.Bytes()
+		step := len(b)/10 + 1
+		for len(b) > 0 {
+			time.Sleep(3 * timeout / 10)
+			n := min(step, len(b))
+			if _, err := pw.Write(b[:n]); err != nil {
+				return
+			}
+			b = b[n:]
+		}
+		pw.Close()
+	}()
+	req, err := http.NewRequest("POST",
+		srv.URL+"/galleries/"+strconv.Itoa(int(gallery.ID))+"/photos/zip", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = int64(body.Len())
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.AddCookie(cookie)
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("archive slower than the server's timeouts: %v", err)
+	}
+	page, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.Contains(string(page), "Uploaded 1 photo(s).") {
+		t.Errorf("got %d without the upload confirmed", res.StatusCode)
+	}
+}
+
+// markedArea returns the smallest rectangle holding every pixel of
+// got that differs from clean, which is empty if none do.
+func markedArea(t *testing.T, clean, got []byte) image.Rectangle {
+	t.Helper()
+	a, err := png.Decode(bytes.NewReader(clean))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := png.Decode(bytes.NewReader(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Bounds() != b.Bounds() {
+		t.Fatalf("got a %v image, want %v", b.Bounds(), a.Bounds())
+	}
+	var area image.Rectangle
+	for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+		for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x, y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				area = area.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return area
+}
+
+// watermark sets the text watermark of the gallery and whether
+// visitors can download the originals.
+func (at *appTest) watermark(t *testing.T, gallery *models.Gallery, text string, allowOriginals bool) {
+	t.Helper()
+	gallery.Watermark.Text = text
+	gallery.AllowOriginals = allowOriginals
+	if err := at.galleries.Update(context.Background(), gallery); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPhotoWatermark(t *testing.T) {
+	at := newAppTest(t)
+	gallery, photo, owner := at.testGallery(t, "al@example.com")
+	_, visitor := at.user(t, "bo@example.com")
+	clean := testPNG(t)
+
+	tests := []struct {
+		name           string
+		query          string
+		cookie         *http.Cookie
+		allowOriginals bool
+		marked         bool
+		attachment     bool
+	}{
+		{"owner", "", owner, false, false, false},
+		{"owner previewing the watermark", "?watermark", owner, false, true, false},
+		{"owner's original", "?original", owner, false, false, true},
+		{"visitor", "", visitor, false, true, false},
+		{"signed out visitor", "", nil, false, true, false},
+		{"visitor asking for the original", "?original", visitor, false, true, false},
+		{"visitor with originals allowed", "", visitor, true, true, false},
+		{"visitor's original", "?original", visitor, true, false, true},
+		{"signed out visitor's original", "?original", nil, true, false, true},
+	}
+	for _, tc := range tests {
+		at.watermark(t, gallery, "Al", tc.allowOriginals)
+		rec := at.do("GET", photo.Path()+tc.query, nil, tc.cookie)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: got %d", tc.name, rec.Code)
+			continue
+		}
+		area := markedArea(t, clean, rec.Body.Bytes())
+		switch {
+		case tc.marked && area.Empty():
+			t.Errorf("%s: got the photo without the watermark", tc.name)
+		case !tc.marked && !bytes.Equal(rec.Body.Bytes(), clean):
+			t.Errorf("%s: got a changed photo, want the file as uploaded", tc.name)
+		}
+		// The default position is the bottom right corner.
+		if tc.marked && !area.Empty() && (area.Min.X < 32 || area.Min.Y < 24) {
+			t.Errorf("%s: watermark drawn over %v", tc.name, area)
+		}
+		if got := rec.Header().Get("Content-Disposition") != ""; got != tc.attachment {
+			t.Errorf("%s: Content-Disposition %q", tc.name, rec.Header().Get("Content-Disposition"))
+		}
+		if tc.cookie == owner && rec.Header().Get("Cache-Control") != "private" {
+			t.Errorf("%s: Cache-Control %q, want private", tc.name, rec.Header().Get("Cache-Control"))
+		}
+	}
+
+	// Without a watermark everyone gets the same file.
+	at.watermark(t, gallery, "", false)
+	rec := at.do("GET", photo.Path(), nil, visitor)
+	if !bytes.Equal(rec.Body.Bytes(), clean) {
+		t.Error("visitor got a changed photo from a gallery without a watermark")
+	}
+}
+
+func TestResizedWatermark(t *testing.T) {
+	at := newAppTest(t)
+	gallery, photo, owner := at.testGallery(t, "al@example.com")
+	_, visitor := at.user(t, "bo@example.com")
+	at.watermark(t, gallery, "Al", true)
+	path := at.photos.ResizedPath(photo, models.Resize{Width: 32})
+
+	rec := at.do("GET", path, nil, owner)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("owner got %d", rec.Code)
+	}
+	clean := rec.Body.Bytes()
+	img, err := png.Decode(bytes.NewReader(clean))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 32 || img.Bounds().Dy() != 24 {
+		t.Errorf("resized to %v, want 32x24", img.Bounds())
+	}
+	// Allowing originals doesn't let visitors see resized photos
+	// without the watermark.
+	for _, cookie := range []*http.Cookie{visitor, nil} {
+		rec := at.do("GET", path, nil, cookie)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("visitor got %d", rec.Code)
+		}
+		if markedArea(t, clean, rec.Body.Bytes()).Empty() {
+			t.Error("visitor got the resized photo without the watermark")
+		}
+	}
+
+	rec = at.do("GET", strings.Replace(path, "w=32", "w=64", 1), nil, owner)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("size that wasn't signed: got %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestDownloadWatermark(t *testing.T) {
+	at := newAppTest(t)
+	gallery, _, owner := at.testGallery(t, "al@example.com")
+	_, visitor := at.user(t, "bo@example.com")
+	clean := testPNG(t)
+
+	tests := []struct {
+		name           string
+		cookie         *http.Cookie
+		allowOriginals bool
+		marked         bool
+	}{
+		{"owner", owner, false, false},
+		{"visitor", visitor, false, true},
+		{"signed out visitor", nil, false, true},
+		{"visitor with originals allowed", visitor, true, false},
+	}
+	for _, tc := range tests {
+		at.watermark(t, gallery, "Al", tc.allowOriginals)
+		rec := at.do("GET", "/galleries/"+strconv.Itoa(int(gallery.ID))+"/download", nil, tc.cookie)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: got %d", tc.name, rec.Code)
+			continue
+		}
+		zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(zr.File) != 1 {
+			t.Fatalf("%s: %d files, want 1", tc.name, len(zr.File))
+		}
+		f, err := zr.File[0].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if marked := !bytes.Equal(got, clean); marked != tc.marked {
+			t.Errorf("%s: watermarked = %v, want %v", tc.name, marked, tc.marked)
+		}
+		if tc.marked && markedArea(t, clean, got).Empty() {
+			t.Errorf("%s: got a changed photo without a watermark", tc.name)
+		}
+	}
+}
+
+func TestWatermarkSettingsInvalidateCache(t *testing.T) {
+	at := newAppTest(t)
+	gallery, photo, owner := at.testGallery(t, "al@example.com")
+	at.watermark(t, gallery, "Al", false)
+	clean := testPNG(t)
+	resized := at.photos.ResizedPath(photo, models.Resize{Width: 32})
+	before := at.do("GET", photo.Path(), nil, nil).Body.Bytes()
+	beforeResized := at.do("GET", resized, nil, nil).Body.Bytes()
+	if area := markedArea(t, clean, before); area.Min.X < 32 || area.Min.Y < 24 {
+		t.Fatalf("watermark drawn over %v, want the bottom right corner", area)
+	}
+
+	rec := at.do("POST", "/galleries/"+strconv.Itoa(int(gallery.ID))+"/watermark", url.Values{
+		"watermark_text":     {"Al"},
+		"watermark_position": {models.WatermarkTopLeft},
+		"watermark_opacity":  {"50"},
+		"watermark_scale":    {"25"},
+	}, owner)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Watermark saved.") {
+		t.Fatalf("saving the watermark: got %d", rec.Code)
+	}
+
+	after := at.do("GET", photo.Path(), nil, nil).Body.Bytes()
+	area := markedArea(t, clean, after)
+	if area.Empty() || area.Max.X > 32 || area.Max.Y > 24 {
+		t.Errorf("watermark drawn over %v after moving it to the top left", area)
+	}
+	afterResized := at.do("GET", resized, nil, nil).Body.Bytes()
+	if bytes.Equal(afterResized, beforeResized) {
+		t.Error("resized photo still has the old watermark")
+	}
+}
@@ -0,0 +1,408 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+// proofCookie holds the token a client's proof is known by. It is
+// scoped to the proofing link, so a client gets a separate proof for
+// every gallery.
+const proofCookie = "proof_token"
+
+// proofCookieAge is how long a client's browser remembers their
+// proof.
+const proofCookieAge = 180 * 24 * time.Hour
+
+// ProofingForm turns proofing on or off on the edit page.
+type ProofingForm struct {
+	Proofing bool `schema:"proofing"`
+	// NewLink replaces the proofing link, so the old one stops
+	// working.
+	NewLink bool `schema:"new_link"`
+}
+
+// PickForm is a client favoriting a photo or leaving a note on it.
+type PickForm struct {
+	Favorite bool   `schema:"favorite"`
+	Note     string `schema:"note"`
+}
+
+// SubmitProofForm is a client sending their selection.
+type SubmitProofForm struct {
+	Name  string `schema:"name"`
+	Email string `schema:"email"`
+}
+
+// ProofData is the Yield for a gallery's proofing page.
+type ProofData struct {
+	Gallery *models.Gallery
+	// Proof is the client's selection. It has no ID until they pick
+	// their first photo.
+	Proof  *models.Proof
+	Photos []ProofPhoto
+	// CommentSection is nil unless the gallery lets clients comment.
+	CommentSection *CommentsData
+}
+
+// ProofPhoto is a photo along with what a client thought of it.
+type ProofPhoto struct {
+	models.Photo
+	Pick models.ProofPick
+}
+
+// ProofsData is the Yield for the page summing up the selections
+// clients made from a gallery.
+type ProofsData struct {
+	Gallery *models.Gallery
+	Proofs  []ProofSummary
+}
+
+// ProofSummary is one client's selection, with the photos they
+// picked in gallery order.
+type ProofSummary struct {
+	models.Proof
+	Photos []ProofPhoto
+}
+
+// UpdateProofing turns the gallery's proofing link on or off, or
+// replaces it.
+//
+// POST /galleries/:id/proofing
+func (g *Galleries) UpdateProofing(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	var form ProofingForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	gallery.Proofing = form.Proofing
+	if form.NewLink {
+		gallery.ProofToken = ""
+	}
+	if err := g.gs.Update(r.Context(), gallery); err != nil {
+		vd.SetAlert(err)
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	g.audit(r, models.AuditGalleryUpdate, gallery)
+	switch {
+	case !gallery.Proofing:
+		vd.AlertSuccess("Proofing is off.")
+	case form.NewLink:
+		vd.AlertSuccess("Proofing link replaced. The old link no longer works.")
+	default:
+		vd.AlertSuccess("Proofing is on. Send the link to your clients.")
+	}
+	g.render(w, r, g.EditView, vd, gallery)
+}
+
+// Proofs sums up the selections clients made from the gallery.
+//
+// GET /galleries/:id/proofs
+func (g *Galleries) Proofs(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	data := ProofsData{Gallery: gallery}
+	data.Proofs, err = g.proofSummaries(r, gallery)
+	if err != nil {
+		g.logger.ErrorContext(r.Context(), "look up proofs",
+			"gallery_id", gallery.ID, "err", err)
+		vd.SetAlert(err)
+	}
+	vd.Yield = data
+	g.ProofsView.Render(w, vd)
+}
+
+// ProofsCSV downloads the photos in each selection clients sent as
+// CSV, one row per favorite.
+//
+// GET /galleries/:id/proofs.csv
+func (g *Galleries) ProofsCSV(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	proofs, err := g.proofSummaries(r, gallery)
+	if err != nil {
+		g.logger.ErrorContext(r.Context(), "look up proofs",
+			"gallery_id", gallery.ID, "err", err)
+		http.Error(w, "Whoops! Something went wrong",
+			http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(
+		"attachment; filename=gallery-%d-selections.csv", gallery.ID))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"client", "email", "submitted_at", "filename", "note"})
+	for _, p := range proofs {
+		if !p.Submitted() {
+			continue
+		}
+		for _, photo := range p.Photos {
+			if !photo.Pick.Favorite {
+				continue
+			}
+			name := photo.Name
+			if name == "" {
+				name = photo.Filename
+			}
+			cw.Write([]string{
+				csvText(p.Name),
+				csvText(p.Email),
+				p.SubmittedAt.UTC().Format(time.RFC3339),
+				csvText(name),
+				csvText(photo.Pick.Note),
+			})
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		g.logger.ErrorContext(r.Context(), "write proofs csv",
+			"gallery_id", gallery.ID, "err", err)
+	}
+}
+
+// csvText keeps what clients typed from being taken for a formula
+// by spreadsheets opening the CSV.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// proofSummaries returns the gallery's proofs with the photos each
+// client picked.
+func (g *Galleries) proofSummaries(r *http.Request, gallery *models.Gallery) ([]ProofSummary, error) {
+	proofs, err := g.prs.ByGalleryID(r.Context(), gallery.ID)
+	if err != nil {
+		return nil, err
+	}
+	photos, err := g.ps.ByGalleryID(r.Context(), gallery.ID)
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]ProofSummary, len(proofs))
+	for i, p := range proofs {
+		summaries[i].Proof = p
+		// Picks of photos deleted since are left out.
+		for _, photo := range photos {
+			pick := p.Pick(photo.ID)
+			if pick.Favorite || pick.Note != "" {
+				summaries[i].Photos = append(summaries[i].Photos,
+					ProofPhoto{Photo: photo, Pick: pick})
+			}
+		}
+	}
+	return summaries, nil
+}
+
+// Proofing shows a gallery to a client through its proofing link,
+// so they can favorite photos, leave notes and send their
+// selection.
+//
+// GET /proof/:token
+func (g *Galleries) Proofing(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.proofGallery(w, r)
+	if err != nil {
+		return
+	}
+	proof, err := g.clientProof(r, gallery)
+	if err != nil {
+		g.proofError(w, r, err)
+		return
+	}
+	g.renderProof(w, r, views.Data{}, gallery, proof)
+}
+
+// Pick favorites or unfavorites a photo for the client and saves
+// their note on it.
+//
+// POST /proof/:token/photos/:photo_id
+func (g *Galleries) Pick(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.proofGallery(w, r)
+	if err != nil {
+		return
+	}
+	proof, err := g.startProof(w, r, gallery)
+	if err != nil {
+		g.proofError(w, r, err)
+		return
+	}
+	var vd views.Data
+	var form PickForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderProof(w, r, vd, gallery, proof)
+		return
+	}
+	photoID, err := strconv.Atoi(mux.Vars(r)["photo_id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	photo, err := g.ps.ByID(r.Context(), uint(photoID))
+	if err == nil {
+		err = g.prs.Pick(r.Context(), proof, photo, form.Favorite, form.Note)
+	}
+	if err == models.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderProof(w, r, vd, gallery, proof)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/proof/%s#photo-%d",
+		gallery.ProofToken, photo.ID), http.StatusFound)
+}
+
+// SubmitProof sends the client's selection to the photographer.
+//
+// POST /proof/:token/submit
+func (g *Galleries) SubmitProof(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.proofGallery(w, r)
+	if err != nil {
+		return
+	}
+	proof, err := g.clientProof(r, gallery)
+	if err != nil {
+		g.proofError(w, r, err)
+		return
+	}
+	var vd views.Data
+	var form SubmitProofForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderProof(w, r, vd, gallery, proof)
+		return
+	}
+	if proof.ID == 0 {
+		// Nothing has been picked yet, so there is nothing to send.
+		vd.SetAlert(models.ErrProofNoFavorites)
+		vd.Form = r.PostForm
+		g.renderProof(w, r, vd, gallery, proof)
+		return
+	}
+	proof.Name = form.Name
+	proof.Email = form.Email
+	if err := g.prs.Submit(models.ValidateAll(r.Context()), proof); err != nil {
+		vd.SetAlert(err)
+		vd.Form = r.PostForm
+		g.renderProof(w, r, vd, gallery, proof)
+		return
+	}
+	g.logger.InfoContext(r.Context(), "proof submitted",
+		"gallery_id", gallery.ID, "proof_id", proof.ID,
+		"favorites", proof.Favorites())
+	vd.AlertSuccess("Thank you! Your selection has been sent.")
+	g.renderProof(w, r, vd, gallery, proof)
+}
+
+// proofGallery looks up the gallery the proofing link in the route
+// is for. If it can't, it writes the error and returns it.
+func (g *Galleries) proofGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	gallery, err := g.gs.ByProofToken(r.Context(), mux.Vars(r)["token"])
+	if err != nil {
+		if err == models.ErrNotFound {
+			http.Error(w, "This proofing link doesn't work anymore. "+
+				"Ask your photographer for a new one.", http.StatusNotFound)
+		} else {
+			g.proofError(w, r, err)
+		}
+		return nil, err
+	}
+	return gallery, nil
+}
+
+// clientProof returns the proof of the client making the request,
+// or a new, unsaved one if they haven't picked anything yet.
+func (g *Galleries) clientProof(r *http.Request, gallery *models.Gallery) (*models.Proof, error) {
+	cookie, err := r.Cookie(proofCookie)
+	if err != nil {
+		return &models.Proof{GalleryID: gallery.ID}, nil
+	}
+	proof, err := g.prs.ByToken(r.Context(), gallery.ID, cookie.Value)
+	if err == models.ErrNotFound {
+		return &models.Proof{GalleryID: gallery.ID}, nil
+	}
+	return proof, err
+}
+
+// startProof is clientProof, but saves the new proof and gives the
+// client the cookie it is known by.
+func (g *Galleries) startProof(w http.ResponseWriter, r *http.Request,
+	gallery *models.Gallery) (*models.Proof, error) {
+	proof, err := g.clientProof(r, gallery)
+	if err != nil || proof.ID != 0 {
+		return proof, err
+	}
+	if err := g.prs.Create(r.Context(), proof); err != nil {
+		return nil, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     proofCookie,
+		Value:    proof.Token,
+		Path:     "/proof/" + gallery.ProofToken,
+		MaxAge:   int(proofCookieAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return proof, nil
+}
+
+func (g *Galleries) proofError(w http.ResponseWriter, r *http.Request, err error) {
+	g.logger.ErrorContext(r.Context(), "proofing", "err", err)
+	http.Error(w, "Whoops! Something went wrong",
+		http.StatusInternalServerError)
+}
+
+// renderProof shows the proofing page of gallery to the client whose
+// selection is proof.
+func (g *Galleries) renderProof(w http.ResponseWriter, r *http.Request,
+	vd views.Data, gallery *models.Gallery, proof *models.Proof) {
+	photos, err := g.ps.ByGalleryID(r.Context(), gallery.ID)
+	if err != nil {
+		g.logger.ErrorContext(r.Context(), "look up photos",
+			"gallery_id", gallery.ID, "err", err)
+		if vd.Alert == nil {
+			vd.SetAlert(err)
+		}
+	}
+	data := ProofData{Gallery: gallery, Proof: proof}
+	for _, photo := range photos {
+		data.Photos = append(data.Photos,
+			ProofPhoto{Photo: photo, Pick: proof.Pick(photo.ID)})
+	}
+	if gallery.VisitorComments {
+		// Clients on the proofing link aren't signed in, so they get
+		// a form of their own.
+		data.CommentSection = g.comments(r, &vd, gallery, 0)
+	}
+	if data.CommentSection != nil {
+		data.CommentSection.Action = "/proof/" + gallery.ProofToken + "/comments"
+		data.CommentSection.Visitor = true
+	}
+	vd.Yield = data
+	g.ProofView.Render(w, vd)
+}
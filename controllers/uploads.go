@@ -0,0 +1,244 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+// The handlers in this file speak the tus resumable upload protocol
+// (https://tus.io/protocols/resumable-upload), version 1.0.0 with
+// the creation and expiration extensions. A client creates an
+// upload for a gallery, sends the file in PATCH requests and, after
+// a dropped connection, asks with HEAD how much arrived before
+// carrying on from there.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration"
+
+	// tusChunkTimeout is how long a single PATCH may take to send
+	// its body and get its response. It replaces the server's read
+	// and write timeouts, which are meant for small form posts
+	// rather than chunks of a photo sent over a slow connection.
+	// The write timeout counts from the start of the request, so it
+	// has to be extended too or the response to a slow chunk is
+	// lost.
+	tusChunkTimeout = 10 * time.Minute
+)
+
+// UploadOptions tells tus clients what the server supports.
+//
+// OPTIONS /uploads
+func (g *Galleries) UploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.Itoa(models.MaxResumableUploadBytes))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUpload starts a resumable upload of a photo into the
+// gallery. The Upload-Length header gives the size of the file and
+// the filename can be passed in Upload-Metadata.
+//
+// POST /galleries/:id/uploads
+func (g *Galleries) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Defer-Length is not supported",
+			http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	meta := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	name := meta["filename"]
+	if name == "" {
+		name = meta["name"]
+	}
+	upload := models.PendingUpload{
+		UserID:    context.User(r.Context()).ID,
+		GalleryID: gallery.ID,
+		Name:      name,
+		Length:    length,
+	}
+	if err := g.us.Start(r.Context(), &upload); err != nil {
+		g.uploadError(w, r, err)
+		return
+	}
+	g.logger.InfoContext(r.Context(), "upload started",
+		"gallery_id", gallery.ID, "upload_id", upload.ID, "length", length)
+	w.Header().Set("Location", "/uploads/"+upload.ID)
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UploadOffset reports how much of an upload has arrived.
+//
+// HEAD /uploads/:upload_id
+func (g *Galleries) UploadOffset(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	upload, err := g.ownedUpload(r)
+	if err != nil {
+		g.uploadError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// PatchUpload appends the request body to an upload at the offset
+// given in Upload-Offset. When the last byte arrives the file is
+// added to the gallery.
+//
+// PATCH /uploads/:upload_id
+func (g *Galleries) PatchUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream",
+			http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	upload, err := g.ownedUpload(r)
+	if err != nil {
+		g.uploadError(w, r, err)
+		return
+	}
+	if r.ContentLength > upload.Length-offset {
+		http.Error(w, "The chunk is longer than the rest of the upload",
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := extendDeadlines(w, tusChunkTimeout, tusChunkTimeout); err != nil {
+		g.logger.DebugContext(r.Context(), "extend deadlines", "err", err)
+	}
+
+	photo, err := g.us.Append(r.Context(), upload, offset, r.Body)
+	if err != nil {
+		g.uploadError(w, r, err)
+		return
+	}
+	if photo != nil {
+		gallery, err := g.gs.ByID(r.Context(), photo.GalleryID)
+		if err == nil {
+			g.logger.InfoContext(r.Context(), "photos uploaded",
+				"gallery_id", gallery.ID, "count", 1, "upload_id", upload.ID)
+			g.audit(r, models.AuditPhotoUpload, gallery)
+		}
+	} else {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusResumable sets the Tus-Resumable header on every response and
+// rejects requests for a version of the protocol we don't speak.
+func tusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// ownedUpload looks up the upload in the route, which must belong
+// to the signed in user.
+func (g *Galleries) ownedUpload(r *http.Request) (*models.PendingUpload, error) {
+	upload, err := g.us.ByID(r.Context(), mux.Vars(r)["upload_id"])
+	if err != nil {
+		return nil, err
+	}
+	if upload.UserID != context.User(r.Context()).ID {
+		return nil, models.ErrNotFound
+	}
+	return upload, nil
+}
+
+// uploadError writes the tus response for err. The clients are
+// programs, so the body is plain text.
+func (g *Galleries) uploadError(w http.ResponseWriter, r *http.Request, err error) {
+	var status int
+	switch err {
+	case models.ErrNotFound:
+		status = http.StatusNotFound
+	case models.ErrUploadLength:
+		status = http.StatusBadRequest
+	case models.ErrUploadTooLarge:
+		status = http.StatusRequestEntityTooLarge
+	case models.ErrQuotaExceeded, models.ErrPhotoQuotaExceeded,
+		models.ErrPhotoPixels:
+		status = http.StatusRequestEntityTooLarge
+	case models.ErrUploadOffset:
+		status = http.StatusConflict
+	case models.ErrUploadLocked:
+		status = http.StatusLocked
+	case models.ErrUploadsPending:
+		status = http.StatusTooManyRequests
+	case models.ErrPhotoType:
+		status = http.StatusUnsupportedMediaType
+	default:
+		if r.Context().Err() != nil {
+			// The client went away mid-chunk. Whatever arrived is
+			// kept and it can resume from there.
+			g.logger.InfoContext(r.Context(), "upload interrupted", "err", err)
+			return
+		}
+		g.logger.ErrorContext(r.Context(), "resumable upload", "err", err)
+		http.Error(w, "Whoops! Something went wrong",
+			http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, err.(views.PublicError).Public(), status)
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header, a comma
+// separated list of keys each followed by a space and a base64
+// value. Pairs that can't be decoded are left out.
+func parseUploadMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		meta[key] = string(b)
+	}
+	return meta
+}
@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"lenslocked.com/models"
+)
+
+// newTimeoutServer serves at's routes with read and write timeouts
+// of timeout, like the real server's but much shorter.
+func newTimeoutServer(t *testing.T, at *appTest, timeout time.Duration) *httptest.Server {
+	srv := httptest.NewUnstartedServer(at.router)
+	srv.Config.ReadTimeout = timeout
+	srv.Config.WriteTimeout = timeout
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// slowBody returns a reader that gives n bytes, one at a time,
+// spread over d.
+func slowBody(n int, d time.Duration) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < n; i++ {
+			time.Sleep(d / time.Duration(n))
+			if _, err := pw.Write([]byte{0}); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
+func TestPatchUploadSlowChunk(t *testing.T) {
+	at := newAppTest(t)
+	user, cookie := at.user(t, "al@example.com")
+	gallery := &models.Gallery{UserID: user.ID, Title: "Holiday"}
+	if err := at.galleries.Create(context.Background(), gallery); err != nil {
+		t.Fatal(err)
+	}
+	upload := &models.PendingUpload{UserID: user.ID, GalleryID: gallery.ID,
+		Name: "beach.png", Length: 100}
+	if err := at.uploads.Start(context.Background(), upload); err != nil {
+		t.Fatal(err)
+	}
+
+	const timeout = 200 * time.Millisecond
+	srv := newTimeoutServer(t, at, timeout)
+	const n = 10
+	req, err := http.NewRequest("PATCH", srv.URL+"/uploads/"+upload.ID,
+		slowBody(n, 3*timeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = n
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	req.AddCookie(cookie)
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("chunk slower than the server's timeouts: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent || res.Header.Get("Upload-Offset") != "10" {
+		t.Errorf("got %d with offset %q, want 204 with offset 10",
+			res.StatusCode, res.Header.Get("Upload-Offset"))
+	}
+}
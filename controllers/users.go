@@ -1,27 +1,66 @@
 package controllers
 
 import (
+	stdctx "context"
+	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 
+	"lenslocked.com/context"
+	"lenslocked.com/email"
+	"lenslocked.com/metrics"
+	"lenslocked.com/middleware"
 	"lenslocked.com/models"
 	"lenslocked.com/rand"
 	"lenslocked.com/views"
 )
 
-func NewUsers(us models.UserService) *Users {
+// NewUsers returns the users controller. baseURL is the public
+// address of the site and is used to build links in emails.
+func NewUsers(us models.UserService, as models.AuditService,
+	accounts models.AccountService, ps models.PhotoService,
+	mailer email.Mailer, baseURL string, logger *slog.Logger) *Users {
 	return &Users{
-		NewView:   views.NewView("bootstrap", "users/new"),
-		LoginView: views.NewView("bootstrap", "users/login"),
-		us:        us,
+		NewView:          views.NewView("bootstrap", "users/new"),
+		LoginView:        views.NewView("bootstrap", "users/login"),
+		PasswordView:     views.NewView("bootstrap", "users/password"),
+		SecurityView:     views.NewView("bootstrap", "users/security"),
+		AccountView:      views.NewView("bootstrap", "users/account"),
+		ConfirmEmailView: views.NewView("bootstrap", "users/confirm_email"),
+		DeleteView:       views.NewView("bootstrap", "users/delete"),
+		LoginLinkView:    views.NewView("bootstrap", "users/login_link"),
+		us:               us,
+		as:               as,
+		accounts:         accounts,
+		ps:               ps,
+		mailer:           mailer,
+		baseURL:          baseURL,
+		logger:           logger,
 	}
 }
 
 type Users struct {
-	NewView   *views.View
-	LoginView *views.View
-	us        models.UserService
+	NewView          *views.View
+	LoginView        *views.View
+	PasswordView     *views.View
+	SecurityView     *views.View
+	AccountView      *views.View
+	ConfirmEmailView *views.View
+	DeleteView       *views.View
+	LoginLinkView    *views.View
+	us               models.UserService
+	as               models.AuditService
+	accounts         models.AccountService
+	ps               models.PhotoService
+	mailer           email.Mailer
+	baseURL          string
+	logger           *slog.Logger
+
+	// providers are the external sign in providers offered on the
+	// login page. They are added by NewOIDC.
+	providers []LoginProvider
 }
 
 // New is used to render the form where a user can
@@ -49,7 +88,7 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 	var form SignupForm
 
 	if err := parseForm(r, &form); err != nil {
-		log.Println(err)
+		u.logger.WarnContext(r.Context(), "parse signup form", "err", err)
 		vd.SetAlert(err)
 		u.NewView.Render(w, vd)
 		return
@@ -61,18 +100,83 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		Password: form.Password,
 	}
 
-	if err := u.us.Create(&user); err != nil {
+	if err := u.us.Create(models.ValidateAll(r.Context()), &user); err != nil {
+		u.logger.InfoContext(r.Context(), "signup failed", "err", err)
+		metrics.Signups.WithLabelValues(metrics.Failure).Inc()
 		vd.SetAlert(err)
+		vd.Form = r.PostForm
 		u.NewView.Render(w, vd)
 		return
 	}
+	u.logger.InfoContext(r.Context(), "user signed up", "user", &user)
+	metrics.Signups.WithLabelValues(metrics.Success).Inc()
+	u.as.Record(r.Context(), &models.AuditEvent{
+		UserID:  user.ID,
+		Action:  models.AuditSignup,
+		Success: true,
+	})
 
-	err := u.signIn(w, &user)
+	err := u.signIn(r.Context(), w, &user)
 	if err != nil {
+		u.logger.ErrorContext(r.Context(), "sign in", "user", &user, "err", err)
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
-	http.Redirect(w, r, "/cookieTest", http.StatusFound)
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// PasswordStrength is the response to a password strength check.
+type PasswordStrength struct {
+	Score int    `json:"score"`
+	Label string `json:"label"`
+	// Message explains why the password would be rejected. It is
+	// empty if the password passes the policy.
+	Message string `json:"message,omitempty"`
+}
+
+// PasswordStrength rates the password in a signup form for the
+// strength meter, using the same policy the signup itself does.
+// Nothing is stored or logged.
+//
+// POST /signup/password-strength
+func (u *Users) PasswordStrength(w http.ResponseWriter, r *http.Request) {
+	var form SignupForm
+	if err := parseForm(r, &form); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	est, err := u.us.CheckPassword(&models.User{
+		Name:     form.Name,
+		Email:    form.Email,
+		Password: form.Password,
+	})
+	res := PasswordStrength{
+		Score: int(est.Score),
+		Label: est.Score.String(),
+	}
+	if pErr, ok := err.(views.PublicError); ok {
+		res.Message = pErr.Public()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(res)
+}
+
+// LoginData is the Yield for the login page.
+type LoginData struct {
+	Providers []LoginProvider
+}
+
+// LoginPage renders the login form.
+//
+// GET /login
+func (u *Users) LoginPage(w http.ResponseWriter, r *http.Request) {
+	u.renderLogin(w, views.Data{})
+}
+
+func (u *Users) renderLogin(w http.ResponseWriter, vd views.Data) {
+	vd.Yield = LoginData{Providers: u.providers}
+	u.LoginView.Render(w, vd)
 }
 
 type LoginForm struct {
@@ -89,65 +193,528 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 	var form LoginForm
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
-		u.LoginView.Render(w, vd)
+		u.renderLogin(w, vd)
 		return
 	}
 
-	user, err := u.us.Authenticate(form.Email, form.Password)
+	user, err := u.us.Authenticate(r.Context(), form.Email, form.Password)
 	if err != nil {
+		u.logger.InfoContext(r.Context(), "login failed", "reason", err)
+		metrics.Logins.WithLabelValues(metrics.Failure).Inc()
 		switch err {
 		case models.ErrNotFound:
 			vd.AlertError("No user exists with that email address")
+			vd.Errors = map[string]string{"email": "Check the email address"}
 		case models.ErrPasswordIncorrect:
 			vd.AlertError("Invalid Password")
+			vd.Errors = map[string]string{"password": "Check your password"}
+		case models.ErrAccountDisabled:
+			vd.SetAlert(err)
 		default:
 			vd.SetAlert(err)
 		}
-		u.LoginView.Render(w, vd)
+		vd.Form = r.PostForm
+		u.renderLogin(w, vd)
+		return
+	}
+
+	err = u.signIn(r.Context(), w, user)
+	if err != nil {
+		u.logger.ErrorContext(r.Context(), "sign in", "user", user, "err", err)
+		vd.SetAlert(err)
+		u.renderLogin(w, vd)
+		return
+	}
+	u.logger.InfoContext(r.Context(), "user logged in", "user", user)
+	metrics.Logins.WithLabelValues(metrics.Success).Inc()
+	if user.PasswordResetRequired {
+		http.Redirect(w, r, middleware.PasswordChangePath, http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+type LoginLinkForm struct {
+	Email string `schema:"email"`
+}
+
+// RequestLoginLink emails a single use login link to the address
+// in the form. The response is the same whether or not an account
+// exists so the form can't be used to discover who has one.
+//
+// POST /login/link
+func (u *Users) RequestLoginLink(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form LoginLinkForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderLogin(w, vd)
+		return
+	}
+
+	user, token, err := u.us.RequestLoginLink(r.Context(), form.Email)
+	switch err {
+	case nil:
+		link := u.baseURL + "/login/link?token=" + url.QueryEscape(token)
+		msg := email.Message{
+			To:      user.Email,
+			Subject: "Your LensLocked login link",
+			Body: fmt.Sprintf("Hi %s,\n\n"+
+				"Follow this link to log in to LensLocked:\n\n"+
+				"%s\n\n"+
+				"The link can only be used once and expires in %d minutes. "+
+				"If you didn't ask for it you can ignore this email.\n",
+				user.Name, link, int(models.LoginTokenTTL.Minutes())),
+		}
+		// Sending in the background keeps the response time the same
+		// for addresses with and without an account.
+		ctx := stdctx.WithoutCancel(r.Context())
+		go func() {
+			if err := u.mailer.Send(ctx, msg); err != nil {
+				u.logger.ErrorContext(ctx, "send login link",
+					"user", user, "err", err)
+			}
+		}()
+	case models.ErrNotFound, models.ErrAccountDisabled:
+		u.logger.InfoContext(r.Context(), "login link not sent", "reason", err)
+	default:
+		u.logger.ErrorContext(r.Context(), "request login link", "err", err)
+		vd.SetAlert(err)
+		u.renderLogin(w, vd)
+		return
+	}
+
+	vd.AlertSuccess(fmt.Sprintf("If there is an account for %s, we've "+
+		"emailed it a login link.", form.Email))
+	u.renderLogin(w, vd)
+}
+
+// LoginLink shows the page a login link points to. Signing in
+// takes a second click so that mail scanners that prefetch links
+// don't use up the token.
+//
+// GET /login/link?token=
+func (u *Users) LoginLink(w http.ResponseWriter, r *http.Request) {
+	u.LoginLinkView.Render(w, views.Data{Yield: r.FormValue("token")})
+}
+
+type LoginLinkTokenForm struct {
+	Token string `schema:"token"`
+}
+
+// LoginWithLink signs in the user a login link was sent to.
+//
+// POST /login/link/confirm
+func (u *Users) LoginWithLink(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form LoginLinkTokenForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderLogin(w, vd)
+		return
+	}
+
+	user, err := u.us.AuthenticateLoginLink(r.Context(), form.Token)
+	if err != nil {
+		u.logger.InfoContext(r.Context(), "login failed", "reason", err)
+		metrics.Logins.WithLabelValues(metrics.Failure).Inc()
+		vd.SetAlert(err)
+		u.renderLogin(w, vd)
+		return
+	}
+
+	if err := u.signIn(r.Context(), w, user); err != nil {
+		u.logger.ErrorContext(r.Context(), "sign in", "user", user, "err", err)
+		vd.SetAlert(err)
+		u.renderLogin(w, vd)
+		return
+	}
+	u.logger.InfoContext(r.Context(), "user logged in", "user", user)
+	metrics.Logins.WithLabelValues(metrics.Success).Inc()
+	if user.PasswordResetRequired {
+		http.Redirect(w, r, middleware.PasswordChangePath, http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+type PasswordForm struct {
+	CurrentPassword string `schema:"current_password"`
+	NewPassword     string `schema:"new_password"`
+}
+
+// Password renders the form used to change the signed in user's
+// password.
+//
+// GET /password/change
+func (u *Users) Password(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	if user := context.User(r.Context()); user.PasswordResetRequired {
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: "Please choose a new password to continue.",
+		}
+	}
+	u.PasswordView.Render(w, vd)
+}
+
+// ChangePassword processes the change password form shown to
+// users who must reset their password.
+//
+// POST /password/change
+func (u *Users) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form PasswordForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.PasswordView.Render(w, vd)
+		return
+	}
+	if err := u.updatePassword(w, r, form); err != nil {
+		setPasswordAlert(&vd, err)
+		u.PasswordView.Render(w, vd)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// updatePassword checks the current password in form and replaces
+// it with the new one. A successful change clears any forced reset
+// set by an admin and issues a new remember token, which signs out
+// every other session.
+func (u *Users) updatePassword(w http.ResponseWriter, r *http.Request,
+	form PasswordForm) error {
+	user := context.User(r.Context())
+	if err := u.us.VerifyPassword(user, form.CurrentPassword); err != nil {
+		return err
+	}
+	if form.NewPassword == "" {
+		return models.ErrPasswordRequired
+	}
+
+	user.Password = form.NewPassword
+	user.PasswordResetRequired = false
+	if err := u.us.Update(r.Context(), user); err != nil {
+		return err
+	}
+	u.logger.InfoContext(r.Context(), "password changed", "user", user)
+	u.as.Record(r.Context(), &models.AuditEvent{
+		UserID:  user.ID,
+		Action:  models.AuditPasswordChange,
+		Success: true,
+	})
+
+	user.Remember = ""
+	return u.signIn(r.Context(), w, user)
+}
+
+// setPasswordAlert explains why the current password was rejected.
+func setPasswordAlert(vd *views.Data, err error) {
+	if err == models.ErrPasswordIncorrect {
+		vd.AlertError("Your current password is incorrect")
 		return
 	}
+	vd.SetAlert(err)
+}
 
-	err = u.signIn(w, user)
+// Account renders the account settings page.
+//
+// GET /account
+func (u *Users) Account(w http.ResponseWriter, r *http.Request) {
+	u.renderAccount(w, r, views.Data{})
+}
+
+type NameForm struct {
+	Name string `schema:"name"`
+}
+
+// UpdateName changes the signed in user's name.
+//
+// POST /account/name
+func (u *Users) UpdateName(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form NameForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	user := context.User(r.Context())
+	user.Name = form.Name
+	if err := u.us.Update(r.Context(), user); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+	u.as.Record(r.Context(), &models.AuditEvent{
+		UserID:  user.ID,
+		Action:  models.AuditNameChange,
+		Success: true,
+	})
+	vd.AlertSuccess("Your name has been updated.")
+	u.renderAccount(w, r, vd)
+}
+
+type EmailForm struct {
+	Email    string `schema:"email"`
+	Password string `schema:"password"`
+}
+
+// ChangeEmail starts an email change. The new address only takes
+// effect once the user follows the link we send to it.
+//
+// POST /account/email
+func (u *Users) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form EmailForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	user := context.User(r.Context())
+	if err := u.us.VerifyPassword(user, form.Password); err != nil {
+		setPasswordAlert(&vd, err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+	token, err := u.us.RequestEmailChange(r.Context(), user, form.Email)
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+
+	link := u.baseURL + "/account/email/confirm?token=" + url.QueryEscape(token)
+	err = u.mailer.Send(r.Context(), email.Message{
+		To:      user.PendingEmail,
+		Subject: "Confirm your new LensLocked email address",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Please confirm your new email address by following this link:\n\n"+
+			"%s\n\n"+
+			"The link expires in 24 hours. If you didn't ask for this "+
+			"change you can ignore this email.\n", user.Name, link),
+	})
 	if err != nil {
+		u.logger.ErrorContext(r.Context(), "send email confirmation",
+			"user", user, "err", err)
 		vd.SetAlert(err)
-		u.LoginView.Render(w, vd)
+		u.renderAccount(w, r, vd)
 		return
 	}
-	http.Redirect(w, r, "/cookieTest", http.StatusFound)
+	vd.AlertSuccess(fmt.Sprintf("We sent a confirmation link to %s. "+
+		"Your email address will change once you follow it.", user.PendingEmail))
+	u.renderAccount(w, r, vd)
 }
 
-func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("remember_token")
+// ConfirmEmail completes an email change and lets the previous
+// address know about it. It does not require the user to be signed
+// in since the link may be opened on another device.
+//
+// GET /account/email/confirm?token=
+func (u *Users) ConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user, oldEmail, err := u.us.ConfirmEmailChange(r.Context(),
+		r.FormValue("token"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		vd.SetAlert(err)
+		u.ConfirmEmailView.Render(w, vd)
 		return
 	}
-	user, err := u.us.ByRemember(cookie.Value)
+	u.logger.InfoContext(r.Context(), "email changed", "user", user)
+
+	err = u.mailer.Send(r.Context(), email.Message{
+		To:      oldEmail,
+		Subject: "Your LensLocked email address was changed",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"The email address on your LensLocked account was changed "+
+			"to %s. If you didn't make this change, please contact us "+
+			"right away.\n", user.Name, user.Email),
+	})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		// The change has already happened, so only log the failure.
+		u.logger.ErrorContext(r.Context(), "send email change notice",
+			"user", user, "err", err)
+	}
+	vd.AlertSuccess(fmt.Sprintf("Your email address is now %s.", user.Email))
+	u.ConfirmEmailView.Render(w, vd)
+}
+
+// AccountPassword changes the signed in user's password from the
+// account settings page.
+//
+// POST /account/password
+func (u *Users) AccountPassword(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form PasswordForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderAccount(w, r, vd)
 		return
 	}
+	if err := u.updatePassword(w, r, form); err != nil {
+		setPasswordAlert(&vd, err)
+		u.renderAccount(w, r, vd)
+		return
+	}
+	vd.AlertSuccess("Your password has been changed and your other " +
+		"sessions have been signed out.")
+	u.renderAccount(w, r, vd)
+}
+
+// AccountData is what the account page shows.
+type AccountData struct {
+	*models.User
+	// Usage is nil if it couldn't be worked out.
+	Usage *models.StorageUsage
+}
+
+// renderAccount shows the account page for the signed in user. The
+// user is reloaded so that a failed update doesn't leave rejected
+// values in the forms.
+func (u *Users) renderAccount(w http.ResponseWriter, r *http.Request,
+	vd views.Data) {
+	user, err := u.us.ByID(r.Context(), context.User(r.Context()).ID)
+	if err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, vd)
+		return
+	}
+	usage, err := u.ps.Usage(r.Context(), user)
+	if err != nil {
+		// The rest of the page is still useful without it.
+		u.logger.ErrorContext(r.Context(), "storage usage", "err", err)
+	}
+	vd.Yield = AccountData{User: user, Usage: usage}
+	u.AccountView.Render(w, vd)
+}
+
+// Security lists the audit events for the signed in user so they
+// can spot activity they don't recognize.
+//
+// GET /account/security
+func (u *Users) Security(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	events, err := u.as.ByUserID(r.Context(), user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = events
+	u.SecurityView.Render(w, vd)
+}
+
+// Export downloads a ZIP archive of everything we hold about the
+// signed in user.
+//
+// GET /account/export
+func (u *Users) Export(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	// Writing every gallery's files takes far longer than the
+	// server's write timeout allows for ordinary pages.
+	if err := extendDeadlines(w, 0, archiveTimeout); err != nil {
+		u.logger.DebugContext(r.Context(), "extend write deadline", "err", err)
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(
+		`attachment; filename="lenslocked-export-%d.zip"`, user.ID))
+	if err := u.accounts.Export(r.Context(), user, w); err != nil {
+		// The archive is streamed, so by now the client has a
+		// truncated download and all we can do is log.
+		u.logger.ErrorContext(r.Context(), "export account",
+			"user", user, "err", err)
+		return
+	}
+	u.logger.InfoContext(r.Context(), "account exported", "user", user)
+}
+
+// DeleteData is the Yield for the account deletion page.
+type DeleteData struct {
+	// Deleted is set once the account has been deleted.
+	Deleted bool
+}
+
+type DeleteForm struct {
+	Password string `schema:"password"`
+}
+
+// ConfirmDelete renders the page used to delete the signed in
+// user's account.
+//
+// GET /account/delete
+func (u *Users) ConfirmDelete(w http.ResponseWriter, r *http.Request) {
+	u.DeleteView.Render(w, views.Data{Yield: DeleteData{}})
+}
+
+// Delete soft deletes the signed in user's account and signs them
+// out. The account and its galleries are purged by the background
+// sweep once the grace period is over.
+//
+// POST /account/delete
+func (u *Users) Delete(w http.ResponseWriter, r *http.Request) {
+	vd := views.Data{Yield: DeleteData{}}
+	var form DeleteForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.DeleteView.Render(w, vd)
+		return
+	}
+
+	user := context.User(r.Context())
+	if err := u.us.VerifyPassword(user, form.Password); err != nil {
+		setPasswordAlert(&vd, err)
+		u.DeleteView.Render(w, vd)
+		return
+	}
+	if err := u.accounts.Delete(r.Context(), user); err != nil {
+		u.logger.ErrorContext(r.Context(), "delete account",
+			"user", user, "err", err)
+		vd.SetAlert(err)
+		u.DeleteView.Render(w, vd)
+		return
+	}
+	u.logger.InfoContext(r.Context(), "account deleted", "user", user)
 
-	fmt.Fprintln(w, "User is: ", user)
+	http.SetCookie(w, &http.Cookie{
+		Name:     "remember_token",
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	vd.Yield = DeleteData{Deleted: true}
+	vd.AlertSuccess("Your account has been deleted.")
+	u.DeleteView.Render(w, vd)
 }
 
 // signIn will create a remember token if it is not already present
 // if the rememberToken is present in the user model then it will use that to create a cookie
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
+func (u *Users) signIn(ctx stdctx.Context, w http.ResponseWriter, user *models.User) error {
 	if user.Remember == "" {
 		token, err := rand.RememberToken()
 		if err != nil {
 			return err
 		}
 		user.Remember = token
-		err = u.us.Update(user)
+		err = u.us.Update(ctx, user)
 		if err != nil {
 			return err
 		}
+		u.as.Record(ctx, &models.AuditEvent{
+			UserID:  user.ID,
+			Action:  models.AuditRememberRotate,
+			Success: true,
+		})
 	}
+	// The path has to be set explicitly, otherwise signing in from
+	// somewhere like /login/link/confirm would scope the cookie to
+	// that directory.
 	cookie := http.Cookie{
 		Name:     "remember_token",
 		Value:    user.Remember,
+		Path:     "/",
 		HttpOnly: true,
 	}
 	http.SetCookie(w, &cookie)
@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"lenslocked.com/middleware"
+	"lenslocked.com/models"
+)
+
+// appTest wires the users and galleries controllers to memory
+// services behind the same routes and middleware as main.go.
+type appTest struct {
+	users     models.UserService
+	galleries models.GalleryService
+	photos    models.PhotoService
+	uploads   models.UploadService
+	router    *mux.Router
+}
+
+func newAppTest(t *testing.T) *appTest {
+	audit := models.NewMemoryAuditService(discard)
+	us := models.NewMemoryUserService(discard, audit)
+	gs := models.NewMemoryGalleryService()
+	dir := t.TempDir()
+	ps := models.NewMemoryPhotoService(gs, us, dir, models.Quota{},
+		models.ResizeConfig{Key: "test"})
+	ups := models.NewMemoryUploadService(ps, gs, dir, time.Hour)
+	r := mux.NewRouter()
+	usersC := NewUsers(us, audit, nil, ps, nil, "http://example.com", discard)
+	galleriesC := NewGalleries(gs, ps, ups,
+		models.NewMemoryProofService(), models.NewMemoryCommentService(),
+		audit, us, nil, "http://example.com", r, discard)
+	requireUserMw := &middleware.RequireUser{UserService: us, Logger: discard}
+	userMw := &middleware.User{UserService: us, Logger: discard}
+
+	r.HandleFunc("/signup", usersC.Create).Methods("POST")
+	r.HandleFunc("/login", usersC.Login).Methods("POST")
+	r.Handle("/galleries/new", requireUserMw.Apply(galleriesC.New)).Methods("GET")
+	r.Handle("/galleries", requireUserMw.ApplyFn(galleriesC.Index)).
+		Methods("GET").Name(IndexGallery)
+	r.Handle("/galleries", requireUserMw.ApplyFn(galleriesC.Create)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}",
+		userMw.ApplyFn(galleriesC.Show)).Methods("GET").Name(ShowGallery)
+	r.Handle("/galleries/{id:[0-9]+}/edit",
+		requireUserMw.ApplyFn(galleriesC.Edit)).Methods("GET").Name(EditGallery)
+	r.Handle("/galleries/{id:[0-9]+}/update",
+		requireUserMw.ApplyFn(galleriesC.Update)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/photos/zip",
+		requireUserMw.ApplyFn(galleriesC.UploadZip)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/download",
+		userMw.ApplyFn(galleriesC.Download)).Methods("GET")
+	r.Handle("/galleries/{id:[0-9]+}/uploads",
+		requireUserMw.ApplyFn(galleriesC.CreateUpload)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/watermark",
+		requireUserMw.ApplyFn(galleriesC.UpdateWatermark)).Methods("POST")
+	r.Handle("/uploads/{upload_id:[A-Za-z0-9_=-]+}",
+		requireUserMw.ApplyFn(galleriesC.PatchUpload)).Methods("PATCH")
+	r.Handle("/images/galleries/{id:[0-9]+}/{filename}",
+		userMw.ApplyFn(galleriesC.Photo)).Methods("GET")
+	r.Handle("/images/resized/{id:[0-9]+}/{filename}",
+		userMw.ApplyFn(galleriesC.Resized)).Methods("GET")
+	return &appTest{users: us, galleries: gs, photos: ps, uploads: ups, router: r}
+}
+
+// user creates a user and returns their remember token cookie.
+func (at *appTest) user(t *testing.T, email string) (*models.User, *http.Cookie) {
+	t.Helper()
+	user := &models.User{Name: "Al", Email: email, Password: "darkroom silver print"}
+	if err := at.users.Create(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user, &http.Cookie{Name: "remember_token", Value: user.Remember}
+}
+
+func (at *appTest) do(method, path string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, path, nil)
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	at.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// rememberCookie returns the remember token set by rec, if any.
+func rememberCookie(rec *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "remember_token" {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestSignup(t *testing.T) {
+	at := newAppTest(t)
+	at.user(t, "taken@example.com")
+
+	rec := at.do("POST", "/signup", url.Values{
+		"name":     {"Bo"},
+		"email":    {" Bo@Example.com "},
+		"password": {"darkroom silver print"},
+	}, nil)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/galleries" {
+		t.Fatalf("got %d to %q, want a redirect to /galleries",
+			rec.Code, rec.Header().Get("Location"))
+	}
+	cookie := rememberCookie(rec)
+	if cookie == nil || !cookie.HttpOnly || cookie.Path != "/" {
+		t.Fatalf("remember cookie %v", cookie)
+	}
+	user, err := at.users.ByRemember(context.Background(), cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "bo@example.com" || user.Name != "Bo" {
+		t.Errorf("signed up as %q <%s>", user.Name, user.Email)
+	}
+
+	rec = at.do("POST", "/signup", url.Values{
+		"email":    {"taken@example.com"},
+		"password": {"abc"},
+	}, nil)
+	if rec.Code != http.StatusOK || rememberCookie(rec) != nil {
+		t.Fatalf("invalid signup: got %d, cookie %v", rec.Code, rememberCookie(rec))
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		models.ErrEmailTaken.Public(),
+		"at least 8 characters",
+		`value="taken@example.com"`,
+	} {
+		if !strings.Contains(body, template.HTMLEscapeString(want)) &&
+			!strings.Contains(body, want) {
+			t.Errorf("invalid signup page is missing %q", want)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	at := newAppTest(t)
+	user, _ := at.user(t, "al@example.com")
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		want     string
+	}{
+		{"unknown email", "bo@example.com", "darkroom silver print", "No user exists with that email address"},
+		{"wrong password", "al@example.com", "darkroom gold print", "Invalid Password"},
+	}
+	for _, tc := range tests {
+		rec := at.do("POST", "/login", url.Values{
+			"email": {tc.email}, "password": {tc.password}}, nil)
+		if rec.Code != http.StatusOK || rememberCookie(rec) != nil {
+			t.Errorf("%s: got %d, cookie %v", tc.name, rec.Code, rememberCookie(rec))
+		}
+		if !strings.Contains(rec.Body.String(), tc.want) {
+			t.Errorf("%s: page is missing %q", tc.name, tc.want)
+		}
+	}
+
+	rec := at.do("POST", "/login", url.Values{
+		"email": {"AL@example.com"}, "password": {"darkroom silver print"}}, nil)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/galleries" {
+		t.Fatalf("got %d to %q, want a redirect to /galleries",
+			rec.Code, rec.Header().Get("Location"))
+	}
+	cookie := rememberCookie(rec)
+	if cookie == nil {
+		t.Fatal("no remember cookie")
+	}
+	got, err := at.users.ByRemember(context.Background(), cookie.Value)
+	if err != nil || got.ID != user.ID {
+		t.Errorf("cookie signs in %v, %v", got, err)
+	}
+}
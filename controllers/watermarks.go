@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+// WatermarkForm is the watermark settings form on the edit page.
+// The watermark image is sent alongside it in the
+// "watermark_image" field.
+type WatermarkForm struct {
+	Text           string `schema:"watermark_text"`
+	Position       string `schema:"watermark_position"`
+	Opacity        int    `schema:"watermark_opacity"`
+	Scale          int    `schema:"watermark_scale"`
+	RemoveImage    bool   `schema:"remove_image"`
+	AllowOriginals bool   `schema:"allow_originals"`
+}
+
+// UpdateWatermark saves the watermark drawn over the photos
+// visitors see and whether they can download the originals.
+//
+// POST /galleries/:id/watermark
+func (g *Galleries) UpdateWatermark(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.ownedGallery(w, r)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+	r.Body = http.MaxBytesReader(w, r.Body, models.MaxWatermarkImageBytes+64<<10)
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil &&
+		err != http.ErrNotMultipart {
+		g.logger.InfoContext(r.Context(), "parse watermark form", "err", err)
+		vd.AlertError(fmt.Sprintf("Watermark images are limited to %d MB.",
+			models.MaxWatermarkImageBytes>>20))
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+	var form WatermarkForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	gallery.Watermark.Text = form.Text
+	gallery.Watermark.Position = form.Position
+	gallery.Watermark.Opacity = form.Opacity
+	gallery.Watermark.Scale = form.Scale
+	gallery.AllowOriginals = form.AllowOriginals
+	if err := g.gs.Update(models.ValidateAll(r.Context()), gallery); err != nil {
+		vd.SetAlert(err)
+		vd.Form = r.PostForm
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+
+	f, _, err := r.FormFile("watermark_image")
+	switch {
+	case err == nil:
+		err = g.ps.SetWatermarkImage(r.Context(), gallery, f)
+		f.Close()
+	case form.RemoveImage:
+		err = g.ps.RemoveWatermarkImage(r.Context(), gallery)
+	default:
+		err = nil
+	}
+	if err != nil {
+		g.logger.InfoContext(r.Context(), "set watermark image failed",
+			"gallery_id", gallery.ID, "err", err)
+		vd.SetAlert(err)
+		g.render(w, r, g.EditView, vd, gallery)
+		return
+	}
+	g.audit(r, models.AuditGalleryUpdate, gallery)
+	vd.AlertSuccess("Watermark saved.")
+	g.render(w, r, g.EditView, vd, gallery)
+}
@@ -0,0 +1,118 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestLogMailerRedactsTokens(t *testing.T) {
+	var buf bytes.Buffer
+	lm := &LogMailer{Logger: slog.New(slog.NewTextHandler(&buf, nil))}
+	msg := Message{
+		To:      "al@example.com",
+		Subject: "Sign in",
+		Body: "https://example.com/login/link?token=s3cret-TOKEN\n" +
+			"https://example.com/account/email/confirm?a=1&token=other%3D&b=2\n",
+	}
+	if err := lm.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, token := range []string{"s3cret-TOKEN", "other%3D"} {
+		if strings.Contains(out, token) {
+			t.Errorf("log contains token %q: %s", token, out)
+		}
+	}
+	if !strings.Contains(out, "&b=2") {
+		t.Errorf("log lost the rest of the link: %s", out)
+	}
+}
+
+// fakeSMTP accepts a single session on a local port and sends what
+// was received on the returned channel.
+func fakeSMTP(t *testing.T) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	got := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var session strings.Builder
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ready")
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				got <- session.String()
+				return
+			}
+			session.WriteString(line)
+			switch {
+			case inData && line == ".\r\n":
+				inData = false
+				reply("250 queued")
+			case inData:
+			case strings.HasPrefix(line, "EHLO"):
+				reply("250 localhost")
+			case strings.HasPrefix(line, "DATA"):
+				inData = true
+				reply("354 go ahead")
+			case strings.HasPrefix(line, "QUIT"):
+				reply("221 bye")
+				got <- session.String()
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return l.Addr().String(), got
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	addr, got := fakeSMTP(t)
+	sm := &SMTPMailer{Addr: addr, From: "noreply@example.com"}
+	err := sm.Send(context.Background(), Message{
+		To:      "al@example.com",
+		Subject: "New comment on “Wedding”",
+		Body:    "Hi Al,\n\nSee it here.\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := <-got
+	for _, want := range []string{
+		"MAIL FROM:<noreply@example.com>",
+		"RCPT TO:<al@example.com>",
+		"To: al@example.com\r\n",
+		"Subject: =?utf-8?q?",
+		"\r\n\r\nHi Al,\r\n\r\nSee it here.\r\n",
+	} {
+		if !strings.Contains(session, want) {
+			t.Errorf("session is missing %q:\n%s", want, session)
+		}
+	}
+}
+
+func TestSMTPMailerRejectsHeaderInjection(t *testing.T) {
+	sm := &SMTPMailer{Addr: "127.0.0.1:1", From: "noreply@example.com"}
+	err := sm.Send(context.Background(), Message{
+		To: "al@example.com\r\nBcc: everyone@example.com",
+	})
+	if err == nil {
+		t.Fatal("Send accepted a recipient with a line break")
+	}
+}
@@ -0,0 +1,104 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTPMailer delivers messages through an SMTP server. It upgrades
+// the connection with STARTTLS when the server offers it, and
+// refuses to send credentials over a connection that isn't
+// encrypted.
+type SMTPMailer struct {
+	// Addr is the host:port of the server.
+	Addr string
+	// Username and Password are used to authenticate, if set.
+	Username string
+	Password string
+	// From is the sender address.
+	From string
+}
+
+var _ Mailer = &SMTPMailer{}
+
+// smtpTimeout bounds a delivery whose context has no deadline.
+const smtpTimeout = 30 * time.Second
+
+func (sm *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") {
+		return fmt.Errorf("email: invalid recipient %q", msg.To)
+	}
+	host, _, err := net.SplitHostPort(sm.Addr)
+	if err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, smtpTimeout)
+		defer cancel()
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", sm.Addr)
+	if err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("email: %w", err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("email: starttls: %w", err)
+		}
+	}
+	if sm.Username != "" {
+		// PlainAuth only sends the password over TLS, or to
+		// localhost.
+		auth := smtp.PlainAuth("", sm.Username, sm.Password, host)
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("email: auth: %w", err)
+		}
+	}
+	if err := c.Mail(sm.From); err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	if _, err := w.Write(sm.message(msg)); err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	return c.Quit()
+}
+
+// message formats msg with the headers a plain text email needs.
+func (sm *SMTPMailer) message(msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", sm.From)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(
+		strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String())
+}
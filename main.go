@@ -1,57 +1,286 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"html/template"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
+	"lenslocked.com/config"
 	"lenslocked.com/controllers"
 	"lenslocked.com/middleware"
 	"lenslocked.com/models"
+	"lenslocked.com/sso"
+	"lenslocked.com/views"
 
 	"github.com/gorilla/mux"
-)
-
-const (
-	host     = "localhost"
-	port     = 5432
-	user     = "postgres"
-	password = "your-password"
-	dbname   = "lenslocked_dev"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
-	services, err := models.NewServices(psqlInfo)
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	logger := cfg.NewLogger()
+	slog.SetDefault(logger)
+
+	if err := run(cfg, logger); err != nil {
+		logger.Error("exiting", "err", err)
+		os.Exit(1)
+	}
+}
+
+// run wires up the application and serves it until SIGINT or
+// SIGTERM is received. It is split out from main so that deferred
+// cleanup such as closing the database always runs.
+func run(cfg config.Config, logger *slog.Logger) error {
+	ctx, stop := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	mailer, err := cfg.Mail.NewMailer(logger)
+	if err != nil {
+		return err
+	}
+
+	services, err := models.NewServices(cfg.Database.Dialect,
+		cfg.Database.ConnectionInfo(),
+		models.WithLogger(logger),
+		models.WithSQLLogLevel(cfg.SQLLog),
+		models.WithImageDir(cfg.ImageDir),
+		models.WithPasswordPolicy(cfg.PasswordPolicy),
+		models.WithUploadExpiry(cfg.UploadExpiry),
+		models.WithQuota(cfg.Quota),
+		models.WithResize(cfg.Resize))
 	if err != nil {
-		panic(err)
+		return err
+	}
+	defer func() {
+		if err := services.Close(); err != nil {
+			logger.Error("closing services", "err", err)
+		}
+	}()
+	if err := services.AutoMigrate(); err != nil {
+		return err
+	}
+
+	// The sweepers use the database, so they have to be done before
+	// services are closed. Deferred calls run last-in first-out, so
+	// this one runs first.
+	var sweepers sync.WaitGroup
+	defer func() {
+		stop()
+		sweepers.Wait()
+	}()
+	if cfg.SweepInterval > 0 {
+		sweepers.Add(2)
+		go func() {
+			defer sweepers.Done()
+			sweepDeletedAccounts(ctx, services.Account, cfg.SweepInterval,
+				cfg.DeletionGrace, logger)
+		}()
+		go func() {
+			defer sweepers.Done()
+			sweepExpiredUploads(ctx, services.Upload, cfg.SweepInterval, logger)
+		}()
 	}
-	defer services.Close()
-	services.AutoMigrate()
 
 	r := mux.NewRouter()
 
+	// Templates link to resized photos with
+	//	{{resized .Photo 400 300 "cover"}}
+	// and have to be parsed after this.
+	views.AddFuncs(template.FuncMap{
+		"resized": func(photo *models.Photo, width, height int, fit string) string {
+			return services.Photo.ResizedPath(photo, models.Resize{
+				Width: width, Height: height, Fit: fit})
+		},
+	})
+
+	healthC := controllers.NewHealth(services, logger)
 	staticC := controllers.NewStatic()
-	usersC := controllers.NewUsers(services.User)
-	galleriesC := controllers.NewGalleries(services.Gallery, r)
+	usersC := controllers.NewUsers(services.User, services.Audit,
+		services.Account, services.Photo, mailer, cfg.Server.BaseURL, logger)
+	oidcC := controllers.NewOIDC(usersC, loadProviders(ctx, cfg.OIDC, logger),
+		logger)
+	galleriesC := controllers.NewGalleries(services.Gallery, services.Photo,
+		services.Upload, services.Proof, services.Comment, services.Audit,
+		services.User, mailer, cfg.Server.BaseURL, r, logger)
+	adminC := controllers.NewAdmin(services.User, services.Gallery,
+		services.Stats, services.Audit, cfg.Quota, logger)
 
 	requireUserMw := middleware.RequireUser{
 		UserService: services.User,
+		Logger:      logger,
+	}
+	userMw := middleware.User{
+		UserService: services.User,
+		Logger:      logger,
 	}
+	requireAdminMw := middleware.RequireAdmin{
+		RequireUser: requireUserMw,
+	}
+	requestLoggerMw := middleware.RequestLogger{
+		Logger:     logger,
+		TrustProxy: cfg.Server.TrustProxy,
+	}
+	routeMetricsMw := middleware.RouteMetrics{}
+	r.Use(routeMetricsMw.Middleware)
+	// Middleware added with Use only runs for requests that match a
+	// route, so the rest are counted here.
+	r.NotFoundHandler = routeMetricsMw.Apply(http.NotFoundHandler())
+	r.MethodNotAllowedHandler = routeMetricsMw.ApplyFn(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+				http.StatusMethodNotAllowed)
+		})
+
+	// Probes and metrics
+	r.HandleFunc("/healthz", healthC.Healthz).Methods("GET").Name("healthz")
+	r.HandleFunc("/readyz", healthC.Readyz).Methods("GET").Name("readyz")
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET").Name("metrics")
 
 	r.Handle("/", staticC.Home).Methods("GET")
 	r.Handle("/contact", staticC.Contact).Methods("GET")
 	r.HandleFunc("/signup", usersC.New).Methods("GET")
 	r.HandleFunc("/signup", usersC.Create).Methods("POST")
-	r.Handle("/login", usersC.LoginView).Methods("GET")
+	r.HandleFunc("/signup/password-strength", usersC.PasswordStrength).Methods("POST")
+	r.HandleFunc("/login", usersC.LoginPage).Methods("GET")
 	r.HandleFunc("/login", usersC.Login).Methods("POST")
-	r.HandleFunc("/cookietest", usersC.CookieTest).Methods("GET")
+	r.HandleFunc("/login/link", usersC.RequestLoginLink).Methods("POST")
+	r.HandleFunc("/login/link", usersC.LoginLink).Methods("GET")
+	r.HandleFunc("/login/link/confirm", usersC.LoginWithLink).Methods("POST")
+	r.HandleFunc("/auth/{provider}/login", oidcC.Login).Methods("GET")
+	r.HandleFunc("/auth/{provider}/callback", oidcC.Callback).Methods("GET")
+	r.Handle(middleware.PasswordChangePath,
+		requireUserMw.ApplyFn(usersC.Password)).Methods("GET")
+	r.Handle(middleware.PasswordChangePath,
+		requireUserMw.ApplyFn(usersC.ChangePassword)).Methods("POST")
+	r.Handle("/account", requireUserMw.ApplyFn(usersC.Account)).Methods("GET")
+	r.Handle("/account/name",
+		requireUserMw.ApplyFn(usersC.UpdateName)).Methods("POST")
+	r.Handle("/account/email",
+		requireUserMw.ApplyFn(usersC.ChangeEmail)).Methods("POST")
+	r.HandleFunc("/account/email/confirm", usersC.ConfirmEmail).Methods("GET")
+	r.Handle("/account/password",
+		requireUserMw.ApplyFn(usersC.AccountPassword)).Methods("POST")
+	r.Handle("/account/security",
+		requireUserMw.ApplyFn(usersC.Security)).Methods("GET")
+	r.Handle("/account/export",
+		requireUserMw.ApplyFn(usersC.Export)).Methods("GET")
+	r.Handle("/account/delete",
+		requireUserMw.ApplyFn(usersC.ConfirmDelete)).Methods("GET")
+	r.Handle("/account/delete",
+		requireUserMw.ApplyFn(usersC.Delete)).Methods("POST")
 	// Gallery routes
 	r.Handle("/galleries/new", requireUserMw.Apply(galleriesC.New)).Methods("GET")
+	r.Handle("/galleries", requireUserMw.ApplyFn(galleriesC.Index)).
+		Methods("GET").Name(controllers.IndexGallery)
 	r.Handle("/galleries", requireUserMw.ApplyFn(galleriesC.Create)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}",
-		galleriesC.Show).Methods("GET").Name(controllers.ShowGallery)
+	r.Handle("/galleries/duplicates",
+		requireUserMw.ApplyFn(galleriesC.Duplicates)).Methods("GET")
+	r.Handle("/galleries/{id:[0-9]+}",
+		userMw.ApplyFn(galleriesC.Show)).Methods("GET").Name(controllers.ShowGallery)
+	r.Handle("/galleries/{id:[0-9]+}/edit",
+		requireUserMw.ApplyFn(galleriesC.Edit)).Methods("GET").
+		Name(controllers.EditGallery)
+	r.Handle("/galleries/{id:[0-9]+}/update",
+		requireUserMw.ApplyFn(galleriesC.Update)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/delete",
+		requireUserMw.ApplyFn(galleriesC.Delete)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/photos",
+		requireUserMw.ApplyFn(galleriesC.Upload)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/photos/zip",
+		requireUserMw.ApplyFn(galleriesC.UploadZip)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/download",
+		userMw.ApplyFn(galleriesC.Download)).Methods("GET")
+	r.Handle("/galleries/{id:[0-9]+}/photos/order",
+		requireUserMw.ApplyFn(galleriesC.ReorderPhotos)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/photos/sort",
+		requireUserMw.ApplyFn(galleriesC.SortPhotos)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/photos/{photo_id:[0-9]+}",
+		userMw.ApplyFn(galleriesC.PhotoPage)).Methods("GET")
+	r.Handle("/galleries/{id:[0-9]+}/photos/{photo_id:[0-9]+}/delete",
+		requireUserMw.ApplyFn(galleriesC.DeletePhoto)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/duplicates/{photo_id:[0-9]+}/delete",
+		requireUserMw.ApplyFn(galleriesC.DeleteDuplicate)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/proofing",
+		requireUserMw.ApplyFn(galleriesC.UpdateProofing)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/proofs",
+		requireUserMw.ApplyFn(galleriesC.Proofs)).Methods("GET")
+	r.Handle("/galleries/{id:[0-9]+}/proofs.csv",
+		requireUserMw.ApplyFn(galleriesC.ProofsCSV)).Methods("GET")
+	r.Handle("/galleries/{id:[0-9]+}/commenting",
+		requireUserMw.ApplyFn(galleriesC.UpdateCommenting)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/comments",
+		requireUserMw.ApplyFn(galleriesC.Comment)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/comments/{comment_id:[0-9]+}/hide",
+		requireUserMw.ApplyFn(galleriesC.HideComment)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/comments/{comment_id:[0-9]+}/delete",
+		requireUserMw.ApplyFn(galleriesC.DeleteComment)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/watermark",
+		requireUserMw.ApplyFn(galleriesC.UpdateWatermark)).Methods("POST")
+	r.Handle("/galleries/{id:[0-9]+}/cover",
+		requireUserMw.ApplyFn(galleriesC.SetCover)).Methods("POST")
+	// Resumable uploads (tus)
+	r.HandleFunc("/uploads", galleriesC.UploadOptions).Methods("OPTIONS")
+	r.Handle("/galleries/{id:[0-9]+}/uploads",
+		requireUserMw.ApplyFn(galleriesC.CreateUpload)).Methods("POST")
+	r.Handle("/uploads/{upload_id:[A-Za-z0-9_=-]+}",
+		requireUserMw.ApplyFn(galleriesC.UploadOffset)).Methods("HEAD")
+	r.Handle("/uploads/{upload_id:[A-Za-z0-9_=-]+}",
+		requireUserMw.ApplyFn(galleriesC.PatchUpload)).Methods("PATCH")
+	r.Handle("/images/galleries/{id:[0-9]+}/{filename}",
+		userMw.ApplyFn(galleriesC.Photo)).Methods("GET")
+	r.HandleFunc("/proof/{token}", galleriesC.Proofing).Methods("GET")
+	r.HandleFunc("/proof/{token}/photos/{photo_id:[0-9]+}",
+		galleriesC.Pick).Methods("POST")
+	r.HandleFunc("/proof/{token}/submit",
+		galleriesC.SubmitProof).Methods("POST")
+	r.HandleFunc("/proof/{token}/comments",
+		galleriesC.VisitorComment).Methods("POST")
+	r.Handle("/images/resized/{id:[0-9]+}/{filename}",
+		userMw.ApplyFn(galleriesC.Resized)).Methods("GET")
+	// Admin routes
+	r.Handle("/admin", requireAdminMw.ApplyFn(adminC.Dashboard)).Methods("GET")
+	r.Handle("/admin/users", requireAdminMw.ApplyFn(adminC.Users)).Methods("GET")
+	r.Handle("/admin/users/{id:[0-9]+}/disable",
+		requireAdminMw.ApplyFn(adminC.DisableUser)).Methods("POST")
+	r.Handle("/admin/users/{id:[0-9]+}/enable",
+		requireAdminMw.ApplyFn(adminC.EnableUser)).Methods("POST")
+	r.Handle("/admin/users/{id:[0-9]+}/force-reset",
+		requireAdminMw.ApplyFn(adminC.ForcePasswordReset)).Methods("POST")
+	r.Handle("/admin/users/{id:[0-9]+}/quota",
+		requireAdminMw.ApplyFn(adminC.SetQuota)).Methods("POST")
+	r.Handle("/admin/galleries",
+		requireAdminMw.ApplyFn(adminC.Galleries)).Methods("GET")
+	r.Handle("/admin/galleries/{id:[0-9]+}/transfer",
+		requireAdminMw.ApplyFn(adminC.TransferGallery)).Methods("POST")
+	r.Handle("/admin/audit", requireAdminMw.ApplyFn(adminC.Audit)).Methods("GET")
 
-	fmt.Println("Starting the server on :3000...")
-	http.ListenAndServe("localhost:3000", r)
+	srv := newServer(cfg.Server, requestLoggerMw.Apply(r), logger)
+	return serve(ctx, srv, cfg.Server, logger)
+}
+
+// loadProviders runs discovery for every configured OpenID Connect
+// provider. A provider that can't be reached is logged and left off
+// the login page rather than stopping the server.
+func loadProviders(ctx context.Context, cfgs []sso.Config, logger *slog.Logger) []*sso.Provider {
+	var providers []*sso.Provider
+	for _, c := range cfgs {
+		p, err := sso.NewProvider(ctx, c)
+		if err != nil {
+			logger.Error("load sign in provider", "provider", c.Name, "err", err)
+			continue
+		}
+		providers = append(providers, p)
+	}
+	return providers
 }
@@ -0,0 +1,66 @@
+// Package metrics holds the Prometheus collectors exported on
+// /metrics. Collectors are registered with the default registry
+// when the package is loaded so any package can record to them.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "lenslocked"
+
+// Result label values used by the counters below.
+const (
+	Success = "success"
+	Failure = "failure"
+)
+
+var (
+	// HTTPRequests counts served requests by route, method and
+	// status code.
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests served.",
+	}, []string{"route", "method", "code"})
+
+	// HTTPDuration observes request latency by route and method.
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to serve HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// DBQueryDuration observes how long gorm operations take by
+	// operation (create, query, update, delete, row_query) and
+	// table.
+	DBQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Time taken by database operations.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation", "table"})
+
+	// Signups counts signup attempts by result.
+	Signups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "signups_total",
+		Help:      "Number of signup attempts.",
+	}, []string{"result"})
+
+	// Logins counts login attempts by result.
+	Logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Number of login attempts.",
+	}, []string{"result"})
+
+	// GalleriesCreated counts galleries created.
+	GalleriesCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "galleries_created_total",
+		Help:      "Number of galleries created.",
+	})
+)
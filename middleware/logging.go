@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/rand"
+)
+
+// RequestIDHeader is the header used to accept a request ID from
+// an upstream proxy and to echo it back to the client.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen caps the length of request IDs we accept from
+// clients so they can't stuff arbitrary data into our logs.
+const maxRequestIDLen = 64
+
+// RequestLogger assigns every request an ID, stores it and the
+// client's address in the request context and writes an access log
+// line once the request has been served.
+type RequestLogger struct {
+	Logger *slog.Logger
+	// TrustProxy takes the client IP from the last X-Forwarded-For
+	// entry instead of the connection's remote address.
+	TrustProxy bool
+}
+
+// Apply will return an http.HandlerFunc that logs every request
+// passed on to next.
+func (mw *RequestLogger) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn will return an http.HandlerFunc that tags the request
+// with an ID, calls next(w, r) and then logs the method, path,
+// status, size and latency of the response.
+func (mw *RequestLogger) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			var err error
+			id, err = rand.RequestID()
+			if err != nil {
+				mw.Logger.Error("generate request id", "err", err)
+			}
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		ctx := context.WithRequestID(r.Context(), id)
+		ctx = models.WithClientInfo(ctx, models.ClientInfo{
+			IP:        mw.clientIP(r),
+			UserAgent: r.UserAgent(),
+		})
+		r = r.WithContext(ctx)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		level := slog.LevelInfo
+		if rec.Status() >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		mw.Logger.Log(ctx, level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.Status(),
+			"bytes", rec.bytes,
+			"duration", time.Since(start),
+			"remote_addr", r.RemoteAddr,
+			"user_agent", r.UserAgent(),
+		)
+	})
+}
+
+// clientIP returns the address the request came from, without the
+// port. Behind a proxy that is the last X-Forwarded-For entry, the
+// one the proxy appended; anything before it came from the client
+// and can't be trusted.
+func (mw *RequestLogger) clientIP(r *http.Request) string {
+	if mw.TrustProxy {
+		fwd := r.Header.Values("X-Forwarded-For")
+		if len(fwd) > 0 {
+			last := fwd[len(fwd)-1]
+			if i := strings.LastIndex(last, ","); i >= 0 {
+				last = last[i+1:]
+			}
+			if ip := strings.TrimSpace(last); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder is an http.ResponseWriter that remembers the
+// status code and number of bytes written so they can be logged.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Status returns the status code sent to the client, defaulting
+// to 200 if the handler never wrote anything.
+func (rec *statusRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// Unwrap lets http.ResponseController reach the underlying
+// ResponseWriter for things like flushing.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"lenslocked.com/metrics"
+)
+
+// RouteMetrics records request counts and latency for every
+// request, labelled by the name of the mux route that matched. It
+// must be installed with Router.Use so the route is known by the
+// time it runs. Router.Use skips requests no route matched, so it
+// should also wrap the router's NotFoundHandler and
+// MethodNotAllowedHandler, which are counted as "unmatched".
+type RouteMetrics struct{}
+
+// Apply will return an http.HandlerFunc that records metrics for
+// every request passed on to next.
+func (mw *RouteMetrics) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn will return an http.HandlerFunc that calls next(w, r)
+// and then records its status code and latency.
+func (mw *RouteMetrics) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		route, method := routeName(r), methodLabel(r.Method)
+		metrics.HTTPDuration.WithLabelValues(route, method).
+			Observe(time.Since(start).Seconds())
+		metrics.HTTPRequests.WithLabelValues(route, method,
+			strconv.Itoa(rec.Status())).Inc()
+	})
+}
+
+// Middleware adapts Apply to the mux.MiddlewareFunc signature.
+func (mw *RouteMetrics) Middleware(next http.Handler) http.Handler {
+	return mw.Apply(next)
+}
+
+// routeName returns the name of the matched route, falling back
+// to its path template for unnamed routes so that label values
+// stay bounded.
+func routeName(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "unmatched"
+	}
+	if name := route.GetName(); name != "" {
+		return name
+	}
+	if tpl, err := route.GetPathTemplate(); err == nil {
+		return tpl
+	}
+	return "unknown"
+}
+
+// methodLabel returns method if it is one of the standard methods
+// and "other" if not. Clients can send any token as the method,
+// including to unmatched routes, so using it as is would let them
+// create as many series as they like.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodConnect,
+		http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
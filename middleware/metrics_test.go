@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"lenslocked.com/metrics"
+)
+
+func TestRouteMetricsMethod(t *testing.T) {
+	var mw RouteMetrics
+	r := mux.NewRouter()
+	r.Use(mw.Middleware)
+	r.HandleFunc("/galleries", func(w http.ResponseWriter, r *http.Request) {}).
+		Methods(http.MethodGet).Name("galleries")
+	r.NotFoundHandler = mw.Apply(http.NotFoundHandler())
+	r.MethodNotAllowedHandler = mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	})
+
+	tests := []struct {
+		method, path string
+		route, label string
+		code         int
+	}{
+		{http.MethodGet, "/galleries", "galleries", http.MethodGet, http.StatusOK},
+		{http.MethodDelete, "/galleries", "unmatched", http.MethodDelete, http.StatusMethodNotAllowed},
+		{"PROPFIND", "/galleries", "unmatched", "other", http.StatusMethodNotAllowed},
+		{"X-RANDOM-1234", "/nowhere", "unmatched", "other", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		counter := metrics.HTTPRequests.WithLabelValues(tc.route, tc.label, strconv.Itoa(tc.code))
+		before := testutil.ToFloat64(counter)
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tc.method, tc.path, nil))
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("%s %s counted %v times as {%s %s %d}, want 1",
+				tc.method, tc.path, got, tc.route, tc.label, tc.code)
+		}
+	}
+	if n := testutil.CollectAndCount(metrics.HTTPRequests, "lenslocked_http_requests_total"); n > 4 {
+		t.Errorf("%d series, want at most 4", n)
+	}
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"net/http"
+
+	"lenslocked.com/context"
+)
+
+// RequireAdmin builds on RequireUser and additionally requires
+// the signed in user to have the admin role.
+type RequireAdmin struct {
+	RequireUser
+}
+
+// Apply will return an http.HandlerFunc that only calls
+// next.ServeHTTP(w, r) for signed in admins.
+func (mw *RequireAdmin) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn will return an http.HandlerFunc that first runs the
+// RequireUser checks, then calls next(w, r) if the user is an
+// admin. Anyone else gets a 404 so the admin area isn't
+// advertised.
+func (mw *RequireAdmin) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.RequireUser.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil || !user.IsAdmin() {
+			mw.Logger.WarnContext(r.Context(), "non-admin denied access to admin area",
+				"path", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	})
+}
@@ -1,15 +1,20 @@
 package middleware
 
 import (
-	"fmt"
+	"log/slog"
 	"net/http"
 
 	"lenslocked.com/context"
 	"lenslocked.com/models"
 )
 
+// PasswordChangePath is where users flagged with
+// PasswordResetRequired are sent until they pick a new password.
+const PasswordChangePath = "/password/change"
+
 type RequireUser struct {
 	models.UserService
+	Logger *slog.Logger
 }
 
 // ApplyFn will return an http.HandlerFunc that will
@@ -36,15 +41,27 @@ func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 			http.Redirect(w, r, "/login", http.StatusFound)
 			return
 		}
-		user, err := mw.UserService.ByRemember(cookie.Value)
+		// Get the context from our request
+		ctx := r.Context()
+
+		user, err := mw.UserService.ByRemember(ctx, cookie.Value)
 		if err != nil {
+			mw.Logger.DebugContext(ctx, "remember token lookup failed",
+				"err", err)
 			http.Redirect(w, r, "/login", http.StatusFound)
 			return
 		}
-		fmt.Println("User Found: ", user)
+		mw.Logger.DebugContext(ctx, "user found", "user", user)
 
-		// Get the context from our request
-		ctx := r.Context()
+		if user.Disabled {
+			mw.Logger.InfoContext(ctx, "disabled user rejected", "user", user)
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		if user.PasswordResetRequired && r.URL.Path != PasswordChangePath {
+			http.Redirect(w, r, PasswordChangePath, http.StatusFound)
+			return
+		}
 
 		// create a new context from the existing one that has
 		// our user stored in it with the private user key
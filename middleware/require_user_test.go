@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	llctx "lenslocked.com/context"
+	"lenslocked.com/models"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestRequireUser(t *testing.T) {
+	ctx := context.Background()
+	us := models.NewMemoryUserService(discard, models.NewMemoryAuditService(discard))
+	newUser := func(email string, change func(*models.User)) string {
+		user := &models.User{Email: email, Password: "darkroom silver print"}
+		if err := us.Create(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		token := user.Remember
+		if change != nil {
+			change(user)
+			if err := us.Update(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return token
+	}
+	active := newUser("al@example.com", nil)
+	disabled := newUser("bo@example.com", func(u *models.User) { u.Disabled = true })
+	reset := newUser("cy@example.com", func(u *models.User) { u.PasswordResetRequired = true })
+
+	tests := []struct {
+		name  string
+		path  string
+		token string
+		// want is the user passed on, or "" if the request is
+		// redirected to location.
+		want     string
+		location string
+	}{
+		{"no cookie", "/galleries", "", "", "/login"},
+		{"unknown token", "/galleries", "bogus", "", "/login"},
+		{"signed in", "/galleries", active, "al@example.com", ""},
+		{"disabled", "/galleries", disabled, "", "/login"},
+		{"reset required", "/galleries", reset, "", PasswordChangePath},
+		{"reset required, changing password", PasswordChangePath, reset, "cy@example.com", ""},
+	}
+	for _, tc := range tests {
+		var got string
+		mw := &RequireUser{UserService: us, Logger: discard}
+		h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+			got = llctx.User(r.Context()).Email
+		})
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.token != "" {
+			req.AddCookie(&http.Cookie{Name: "remember_token", Value: tc.token})
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if got != tc.want {
+			t.Errorf("%s: passed on %q, want %q", tc.name, got, tc.want)
+		}
+		if loc := rec.Header().Get("Location"); loc != tc.location {
+			t.Errorf("%s: redirected to %q, want %q", tc.name, loc, tc.location)
+		}
+	}
+}
+
+func TestUser(t *testing.T) {
+	ctx := context.Background()
+	us := models.NewMemoryUserService(discard, models.NewMemoryAuditService(discard))
+	user := &models.User{Email: "al@example.com", Password: "darkroom silver print"}
+	if err := us.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"", "bogus", user.Remember} {
+		called := false
+		var got *models.User
+		mw := &User{UserService: us, Logger: discard}
+		h := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			got = llctx.User(r.Context())
+		})
+		req := httptest.NewRequest("GET", "/galleries/1", nil)
+		if token != "" {
+			req.AddCookie(&http.Cookie{Name: "remember_token", Value: token})
+		}
+		h(httptest.NewRecorder(), req)
+		if !called {
+			t.Errorf("token %q: visitor not let through", token)
+		}
+		if (got != nil) != (token == user.Remember) {
+			t.Errorf("token %q: got user %v", token, got)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+)
+
+// User looks up the signed in user, if there is one, and stores
+// them in the request context. Unlike RequireUser it lets visitors
+// who aren't signed in through, for public pages that show the
+// owner more than everyone else.
+type User struct {
+	UserService models.UserService
+	Logger      *slog.Logger
+}
+
+// Apply will return an http.HandlerFunc that adds the signed in
+// user to the context before calling next.ServeHTTP(w, r).
+func (mw *User) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn will return an http.HandlerFunc that adds the signed in
+// user to the context before calling next(w, r). Disabled users
+// and users who have to reset their password are treated as
+// visitors.
+func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("remember_token")
+		if err != nil {
+			next(w, r)
+			return
+		}
+		ctx := r.Context()
+		user, err := mw.UserService.ByRemember(ctx, cookie.Value)
+		if err != nil {
+			mw.Logger.DebugContext(ctx, "remember token lookup failed",
+				"err", err)
+			next(w, r)
+			return
+		}
+		if user.Disabled || user.PasswordResetRequired {
+			next(w, r)
+			return
+		}
+		next(w, r.WithContext(context.WithUser(ctx, user)))
+	})
+}
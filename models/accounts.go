@@ -0,0 +1,448 @@
+package models
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// DefaultDeletionGrace is how long a deleted account can still be
+// restored before the sweep removes it for good.
+const DefaultDeletionGrace = 30 * 24 * time.Hour
+
+// GalleryDir returns the directory holding the files that belong
+// to the gallery with the given ID, below the image root passed to
+// WithImageDir.
+func GalleryDir(imageDir string, galleryID uint) string {
+	return filepath.Join(imageDir, "galleries",
+		strconv.FormatUint(uint64(galleryID), 10))
+}
+
+// AccountService manages the lifecycle of a user's account as a
+// whole: deletion, restoration during the grace period, the final
+// purge and exporting everything we hold about the user.
+type AccountService interface {
+	// Delete soft deletes the user and all of their galleries. The
+	// account can be restored until it is purged.
+	Delete(ctx context.Context, user *User) error
+
+	// Restore undoes Delete for the soft deleted user with the
+	// given email address, along with the galleries deleted with
+	// them. It returns ErrNotFound if there is no such user.
+	Restore(ctx context.Context, email string) (*User, error)
+
+	// Purge permanently removes users deleted before the given
+	// time, including their galleries and gallery files. It
+	// returns the number of users removed.
+	Purge(ctx context.Context, before time.Time) (int, error)
+
+	// Export writes a ZIP archive of the user's profile, security
+	// activity and gallery files to w.
+	Export(ctx context.Context, user *User, w io.Writer) error
+}
+
+func NewAccountService(db *gorm.DB, audit AuditService, imageDir string,
+	logger *slog.Logger) AccountService {
+	return &accountGorm{
+		db:       db,
+		audit:    audit,
+		imageDir: imageDir,
+		logger:   logger,
+	}
+}
+
+type accountGorm struct {
+	db       *gorm.DB
+	audit    AuditService
+	imageDir string
+	logger   *slog.Logger
+}
+
+func (ag *accountGorm) Delete(ctx context.Context, user *User) error {
+	if user.ID == 0 {
+		return ErrIDInvalid
+	}
+	// Galleries share the user's deletion time so Restore can tell
+	// them apart from galleries deleted earlier on.
+	now := time.Now()
+	tx := withContext(ctx, ag.db).Begin()
+	if err := tx.Model(&Gallery{}).Where("user_id = ?", user.ID).
+		UpdateColumn("deleted_at", now).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Model(&User{}).Where("id = ?", user.ID).
+		UpdateColumn("deleted_at", now).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	ag.audit.Record(ctx, &AuditEvent{
+		UserID:  user.ID,
+		Action:  AuditAccountDelete,
+		Success: true,
+	})
+	return nil
+}
+
+func (ag *accountGorm) Restore(ctx context.Context, email string) (*User, error) {
+	var user User
+	db := withContext(ctx, ag.db).Unscoped()
+	err := first(db.Where("email = ? AND deleted_at IS NOT NULL",
+		strings.ToLower(strings.TrimSpace(email))), &user)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := db.Begin()
+	if err := tx.Model(&Gallery{}).
+		Where("user_id = ? AND deleted_at >= ?", user.ID, *user.DeletedAt).
+		UpdateColumn("deleted_at", nil).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Model(&User{}).Where("id = ?", user.ID).
+		UpdateColumn("deleted_at", nil).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	user.DeletedAt = nil
+	ag.audit.Record(ctx, &AuditEvent{
+		UserID:  user.ID,
+		Action:  AuditAccountRestore,
+		Success: true,
+	})
+	return &user, nil
+}
+
+func (ag *accountGorm) Purge(ctx context.Context, before time.Time) (int, error) {
+	var users []User
+	db := withContext(ctx, ag.db).Unscoped()
+	err := db.Where("deleted_at IS NOT NULL AND deleted_at < ?", before).
+		Find(&users).Error
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, user := range users {
+		if err := ag.purgeUser(ctx, db, &user); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// purgeUser removes the user and their galleries from the database
+// and then deletes the gallery files. Files that can't be removed
+// are logged rather than failing the purge, since the rows pointing
+// at them are already gone.
+func (ag *accountGorm) purgeUser(ctx context.Context, db *gorm.DB, user *User) error {
+	var galleries []Gallery
+	if err := db.Where("user_id = ?", user.ID).Find(&galleries).Error; err != nil {
+		return err
+	}
+
+	galleryIDs := make([]uint, len(galleries))
+	for i, g := range galleries {
+		galleryIDs[i] = g.ID
+	}
+	var uploads []PendingUpload
+	if err := db.Where("user_id = ?", user.ID).Find(&uploads).Error; err != nil {
+		return err
+	}
+
+	tx := db.Begin()
+	if len(galleryIDs) > 0 {
+		if err := tx.Where("photo_id IN (SELECT id FROM photos WHERE gallery_id IN (?))",
+			galleryIDs).Delete(&PhotoMetadata{}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Where("gallery_id IN (?)", galleryIDs).
+			Delete(&Photo{}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Where("proof_id IN (SELECT id FROM proofs WHERE gallery_id IN (?))",
+			galleryIDs).Delete(&ProofPick{}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Where("gallery_id IN (?)", galleryIDs).
+			Delete(&Proof{}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Where("gallery_id IN (?)", galleryIDs).
+			Delete(&Comment{}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	// Replies to the user's comments on other galleries stay, and
+	// are shown as if they started their own threads.
+	if err := tx.Where("user_id = ?", user.ID).Delete(&Comment{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("user_id = ?", user.ID).Delete(&Gallery{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("user_id = ?", user.ID).Delete(&LoginToken{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("user_id = ?", user.ID).Delete(&Identity{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("user_id = ?", user.ID).Delete(&PendingUpload{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Delete(user).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	for _, g := range galleries {
+		if err := os.RemoveAll(GalleryDir(ag.imageDir, g.ID)); err != nil {
+			ag.logger.ErrorContext(ctx, "remove gallery files",
+				"gallery_id", g.ID, "err", err)
+		}
+		err := os.RemoveAll(filepath.Join(ResizedCacheDir(ag.imageDir),
+			strconv.FormatUint(uint64(g.ID), 10)))
+		if err != nil {
+			ag.logger.ErrorContext(ctx, "remove resized photos",
+				"gallery_id", g.ID, "err", err)
+		}
+		if err := removeWatermarkFiles(ag.imageDir, &g); err != nil {
+			ag.logger.ErrorContext(ctx, "remove watermark files",
+				"gallery_id", g.ID, "err", err)
+		}
+	}
+	for _, u := range uploads {
+		err := os.Remove(filepath.Join(UploadDir(ag.imageDir), filepath.Base(u.ID)))
+		if err != nil && !os.IsNotExist(err) {
+			ag.logger.ErrorContext(ctx, "remove upload file",
+				"upload_id", u.ID, "err", err)
+		}
+	}
+	ag.logger.InfoContext(ctx, "purged deleted account",
+		"user", user, "galleries", len(galleries))
+	ag.audit.Record(ctx, &AuditEvent{
+		UserID:  user.ID,
+		Action:  AuditAccountPurge,
+		Success: true,
+		Details: user.Email,
+	})
+	return nil
+}
+
+// accountExport is the layout of profile.json in an export.
+type accountExport struct {
+	ExportedAt time.Time        `json:"exported_at"`
+	Profile    exportProfile    `json:"profile"`
+	Identities []exportIdentity `json:"linked_identities"`
+	Galleries  []exportGallery  `json:"galleries"`
+	Activity   []exportActivity `json:"security_activity"`
+}
+
+type exportIdentity struct {
+	Provider string    `json:"provider"`
+	Email    string    `json:"email"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+type exportProfile struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type exportGallery struct {
+	ID        uint      `json:"id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Files lists the paths of the gallery's files in the archive.
+	Files []string `json:"files"`
+}
+
+type exportActivity struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Success   bool      `json:"success"`
+	Reason    string    `json:"reason,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+func (ag *accountGorm) Export(ctx context.Context, user *User, w io.Writer) error {
+	var galleries []Gallery
+	err := withContext(ctx, ag.db).Where("user_id = ?", user.ID).
+		Order("id").Find(&galleries).Error
+	if err != nil {
+		return err
+	}
+	var identities []Identity
+	err = withContext(ctx, ag.db).Where("user_id = ?", user.ID).
+		Order("id").Find(&identities).Error
+	if err != nil {
+		return err
+	}
+	events, err := ag.audit.ByUserID(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	export := accountExport{
+		ExportedAt: time.Now(),
+		Profile: exportProfile{
+			ID:        user.ID,
+			Name:      user.Name,
+			Email:     user.Email,
+			Role:      user.Role,
+			CreatedAt: user.CreatedAt,
+			UpdatedAt: user.UpdatedAt,
+		},
+		Identities: []exportIdentity{},
+		Galleries:  []exportGallery{},
+		Activity:   []exportActivity{},
+	}
+	for _, i := range identities {
+		export.Identities = append(export.Identities, exportIdentity{
+			Provider: i.Provider,
+			Email:    i.Email,
+			LinkedAt: i.CreatedAt,
+		})
+	}
+	for _, e := range events {
+		export.Activity = append(export.Activity, exportActivity{
+			Time:      e.CreatedAt,
+			Action:    e.Action,
+			Success:   e.Success,
+			Reason:    e.Reason,
+			IP:        e.IP,
+			UserAgent: e.UserAgent,
+		})
+	}
+
+	// Gallery files are written first so profile.json can list
+	// where each one ended up.
+	zw := zip.NewWriter(w)
+	for _, g := range galleries {
+		prefix := path.Join("galleries", strconv.FormatUint(uint64(g.ID), 10))
+		files, err := ag.exportDir(ctx, zw, GalleryDir(ag.imageDir, g.ID), prefix)
+		if err != nil {
+			return err
+		}
+		export.Galleries = append(export.Galleries, exportGallery{
+			ID:        g.ID,
+			Title:     g.Title,
+			CreatedAt: g.CreatedAt,
+			UpdatedAt: g.UpdatedAt,
+			Files:     files,
+		})
+	}
+
+	f, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     "profile.json",
+		Method:   zip.Deflate,
+		Modified: export.ExportedAt,
+	})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(export); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// exportDir copies every regular file below dir into zw under
+// prefix and returns their archive paths. A missing dir simply has
+// no files.
+func (ag *accountGorm) exportDir(ctx context.Context, zw *zip.Writer,
+	dir, prefix string) ([]string, error) {
+	files := []string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(prefix, filepath.ToSlash(rel))
+		if err := addFile(zw, p, name); err != nil {
+			return err
+		}
+		files = append(files, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func addFile(zw *zip.Writer, src, name string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Method = zip.Deflate
+	dst, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
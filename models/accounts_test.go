@@ -0,0 +1,234 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestServices returns services on an in-memory sqlite database
+// with images kept in a temporary directory.
+func newTestServices(t *testing.T) *Services {
+	t.Helper()
+	s, err := NewServices(DialectSQLite, ":memory:",
+		WithLogger(discard), WithSQLLogLevel(SQLLogOff),
+		WithImageDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testAccount makes a user with a gallery holding a photo.
+func testAccount(t *testing.T, s *Services, email string) (*User, *Gallery, *Photo) {
+	t.Helper()
+	ctx := context.Background()
+	user := &User{Email: email, Password: "darkroom silver print"}
+	if err := s.User.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	gallery := &Gallery{UserID: user.ID, Title: "Holiday"}
+	if err := s.Gallery.Create(ctx, gallery); err != nil {
+		t.Fatal(err)
+	}
+	photo, err := s.Photo.Upload(ctx, gallery, "beach.png", bytes.NewReader(testPNGBytes(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, gallery, photo
+}
+
+// deletedAt backdates when a user and their galleries were deleted.
+func deletedAt(t *testing.T, s *Services, user *User, at time.Time) {
+	t.Helper()
+	db := s.db.Unscoped()
+	if err := db.Model(&Gallery{}).Where("user_id = ?", user.ID).
+		UpdateColumn("deleted_at", at).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&User{}).Where("id = ?", user.ID).
+		UpdateColumn("deleted_at", at).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAccountPurge(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServices(t)
+	now := time.Now()
+
+	old, oldGallery, _ := testAccount(t, s, "al@example.com")
+	if err := s.Account.Delete(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+	deletedAt(t, s, old, now.Add(-40*24*time.Hour))
+	recent, recentGallery, _ := testAccount(t, s, "bo@example.com")
+	if err := s.Account.Delete(ctx, recent); err != nil {
+		t.Fatal(err)
+	}
+	deletedAt(t, s, recent, now.Add(-24*time.Hour))
+	_, activeGallery, _ := testAccount(t, s, "cy@example.com")
+
+	n, err := s.Account.Purge(ctx, now.Add(-30*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Purge() = %d, want 1", n)
+	}
+
+	if _, err := s.User.ByEmailWithDeleted(ctx, old.Email); err != ErrNotFound {
+		t.Errorf("purged user: err = %v, want %v", err, ErrNotFound)
+	}
+	var photos int
+	if err := s.db.Model(&Photo{}).Where("gallery_id = ?", oldGallery.ID).
+		Count(&photos).Error; err != nil {
+		t.Fatal(err)
+	}
+	if photos != 0 {
+		t.Errorf("purged gallery has %d photos left", photos)
+	}
+	dir := GalleryDir(s.imageDir, oldGallery.ID)
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("purged gallery's files are still there: %v", err)
+	}
+
+	if _, err := s.User.ByEmailWithDeleted(ctx, recent.Email); err != nil {
+		t.Errorf("user deleted after the cutoff: %v", err)
+	}
+	for _, g := range []*Gallery{recentGallery, activeGallery} {
+		if _, err := os.Stat(GalleryDir(s.imageDir, g.ID)); err != nil {
+			t.Errorf("gallery %d's files: %v", g.ID, err)
+		}
+	}
+	if _, err := s.Gallery.ByID(ctx, activeGallery.ID); err != nil {
+		t.Errorf("active gallery: %v", err)
+	}
+}
+
+func TestAccountRestore(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServices(t)
+	user, kept, _ := testAccount(t, s, "al@example.com")
+	earlier := &Gallery{UserID: user.ID, Title: "Scrapped"}
+	if err := s.Gallery.Create(ctx, earlier); err != nil {
+		t.Fatal(err)
+	}
+	err := s.db.Model(earlier).
+		UpdateColumn("deleted_at", time.Now().Add(-time.Hour)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Account.Restore(ctx, user.Email); err != ErrNotFound {
+		t.Errorf("Restore() of an active account: err = %v, want %v", err, ErrNotFound)
+	}
+	if err := s.Account.Delete(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Gallery.ByID(ctx, kept.ID); err != ErrNotFound {
+		t.Errorf("gallery of a deleted account: err = %v, want %v", err, ErrNotFound)
+	}
+
+	restored, err := s.Account.Restore(ctx, " AL@example.com ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.ID != user.ID || restored.DeletedAt != nil {
+		t.Errorf("Restore() = %d deleted at %v, want %d", restored.ID, restored.DeletedAt, user.ID)
+	}
+	if _, err := s.User.ByEmail(ctx, user.Email); err != nil {
+		t.Errorf("restored user: %v", err)
+	}
+	if _, err := s.Gallery.ByID(ctx, kept.ID); err != nil {
+		t.Errorf("gallery deleted with the account: %v", err)
+	}
+	if _, err := s.Gallery.ByID(ctx, earlier.ID); err != ErrNotFound {
+		t.Errorf("gallery deleted before the account: err = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestAccountExport(t *testing.T) {
+	ctx := context.Background()
+	s := newTestServices(t)
+	user, gallery, photo := testAccount(t, s, "al@example.com")
+	_, other, _ := testAccount(t, s, "bo@example.com")
+
+	var buf bytes.Buffer
+	if err := s.Account.Export(ctx, user, &buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	photoName := path.Join("galleries", strconv.FormatUint(uint64(gallery.ID), 10), photo.Filename)
+	f, ok := files[photoName]
+	if !ok {
+		t.Fatalf("export is missing %s: %v", photoName, zr.File)
+	}
+	want, err := os.ReadFile(filepath.Join(GalleryDir(s.imageDir, gallery.ID), photo.Filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readZipFile(t, f); !bytes.Equal(got, want) {
+		t.Errorf("%s has %d bytes, want %d", photoName, len(got), len(want))
+	}
+	for name := range files {
+		if dir := path.Join("galleries", strconv.FormatUint(uint64(other.ID), 10)); path.Dir(name) == dir {
+			t.Errorf("export includes another user's file %s", name)
+		}
+	}
+
+	profile, ok := files["profile.json"]
+	if !ok {
+		t.Fatal("export is missing profile.json")
+	}
+	var export accountExport
+	if err := json.Unmarshal(readZipFile(t, profile), &export); err != nil {
+		t.Fatal(err)
+	}
+	if export.Profile.ID != user.ID || export.Profile.Email != user.Email {
+		t.Errorf("profile = %+v, want user %d %s", export.Profile, user.ID, user.Email)
+	}
+	if len(export.Galleries) != 1 {
+		t.Fatalf("%d galleries, want 1", len(export.Galleries))
+	}
+	g := export.Galleries[0]
+	if g.ID != gallery.ID || g.Title != gallery.Title {
+		t.Errorf("gallery = %d %q, want %d %q", g.ID, g.Title, gallery.ID, gallery.Title)
+	}
+	if len(g.Files) != 1 || g.Files[0] != photoName {
+		t.Errorf("gallery files = %v, want [%s]", g.Files, photoName)
+	}
+}
+
+func readZipFile(t *testing.T, f *zip.File) []byte {
+	t.Helper()
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(rc); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,199 @@
+package models
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrActionRequired is returned when an audit event is
+	// recorded without an action.
+	ErrActionRequired modelError = "models: audit action is required"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditLogin              = "login"
+	AuditLoginLinkRequest   = "login_link_request"
+	AuditIdentityLink       = "identity_link"
+	AuditSignup             = "signup"
+	AuditPasswordChange     = "password_change"
+	AuditNameChange         = "name_change"
+	AuditEmailChangeRequest = "email_change_request"
+	AuditEmailChange        = "email_change"
+	AuditAccountDelete      = "account_delete"
+	AuditAccountRestore     = "account_restore"
+	AuditAccountPurge       = "account_purge"
+	AuditRememberRotate     = "remember_token_rotate"
+	AuditGalleryCreate      = "gallery_create"
+	AuditGalleryUpdate      = "gallery_update"
+	AuditGalleryDelete      = "gallery_delete"
+	AuditPhotoUpload        = "photo_upload"
+	AuditPhotoDelete        = "photo_delete"
+	AuditCommentHide        = "comment_hide"
+	AuditCommentDelete      = "comment_delete"
+	AuditAdminDisable       = "admin_disable_user"
+	AuditAdminEnable        = "admin_enable_user"
+	AuditAdminForceReset    = "admin_force_password_reset"
+	AuditAdminTransfer      = "admin_transfer_gallery"
+	AuditAdminCreateUser    = "admin_create_user"
+	AuditAdminDeleteUser    = "admin_delete_user"
+	AuditAdminResetPW       = "admin_reset_password"
+	AuditAdminSetRole       = "admin_set_role"
+	AuditAdminSetQuota      = "admin_set_quota"
+)
+
+// AuditEvent is a single entry in the append-only audit log. It
+// deliberately doesn't embed gorm.Model: events are never updated
+// or deleted.
+type AuditEvent struct {
+	ID        uint      `gorm:"primary_key"`
+	CreatedAt time.Time `gorm:"index"`
+
+	// UserID is the user the event is about. It is 0 for failed
+	// logins with an unknown email address.
+	UserID uint `gorm:"index"`
+	// ActorID is the user who performed the action. It only
+	// differs from UserID for admin actions.
+	ActorID uint
+
+	Action  string `gorm:"not null;index"`
+	Success bool   `gorm:"not null"`
+	// Reason explains a failure, eg "incorrect password".
+	Reason string
+	// Details holds any extra context, such as the email address
+	// used in a failed login or the gallery affected.
+	Details string
+
+	IP        string
+	UserAgent string
+}
+
+// ClientInfo describes where a request came from. It is attached to
+// the request context by middleware and picked up by the audit
+// service so callers don't have to pass it around.
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+type clientInfoKey struct{}
+
+// WithClientInfo returns a copy of ctx carrying info.
+func WithClientInfo(ctx context.Context, info ClientInfo) context.Context {
+	return context.WithValue(ctx, clientInfoKey{}, info)
+}
+
+func clientInfo(ctx context.Context) ClientInfo {
+	info, _ := ctx.Value(clientInfoKey{}).(ClientInfo)
+	return info
+}
+
+// AuditFilter narrows down the events returned by AuditDB.Search.
+// Zero values match everything.
+type AuditFilter struct {
+	UserID uint
+	Action string
+}
+
+// AuditDB is used to write to and read from the audit log. There
+// are intentionally no methods to change or remove events.
+type AuditDB interface {
+	// Record appends event to the log.
+	Record(ctx context.Context, event *AuditEvent) error
+
+	// ByUserID returns the most recent events about the user,
+	// newest first, up to SearchLimit.
+	ByUserID(ctx context.Context, userID uint) ([]AuditEvent, error)
+
+	// Search returns the most recent events matching filter,
+	// newest first, up to SearchLimit.
+	Search(ctx context.Context, filter AuditFilter) ([]AuditEvent, error)
+}
+
+// AuditService records security relevant events.
+type AuditService interface {
+	AuditDB
+}
+
+func NewAuditService(db *gorm.DB, logger *slog.Logger) AuditService {
+	return &auditService{
+		AuditDB: &auditValidator{
+			AuditDB: &auditGorm{db: db},
+		},
+		logger: logger,
+	}
+}
+
+type auditService struct {
+	AuditDB
+	logger *slog.Logger
+}
+
+// Record writes event to the log. Failing to write an audit event
+// must never stop the action being audited, so errors are logged
+// before being returned and callers are free to ignore them.
+func (as *auditService) Record(ctx context.Context, event *AuditEvent) error {
+	err := as.AuditDB.Record(ctx, event)
+	if err != nil {
+		as.logger.ErrorContext(ctx, "record audit event",
+			"action", event.Action, "user_id", event.UserID, "err", err)
+	}
+	return err
+}
+
+// auditValidator fills in the request details and timestamp and
+// makes sure every event has an action.
+type auditValidator struct {
+	AuditDB
+}
+
+func (av *auditValidator) Record(ctx context.Context, event *AuditEvent) error {
+	if event.Action == "" {
+		return ErrActionRequired
+	}
+	info := clientInfo(ctx)
+	if event.IP == "" {
+		event.IP = info.IP
+	}
+	if event.UserAgent == "" {
+		event.UserAgent = info.UserAgent
+	}
+	if event.ActorID == 0 {
+		event.ActorID = event.UserID
+	}
+	return av.AuditDB.Record(ctx, event)
+}
+
+var _ AuditDB = &auditGorm{}
+
+type auditGorm struct {
+	db *gorm.DB
+}
+
+func (ag *auditGorm) Record(ctx context.Context, event *AuditEvent) error {
+	return withContext(ctx, ag.db).Create(event).Error
+}
+
+func (ag *auditGorm) ByUserID(ctx context.Context, userID uint) ([]AuditEvent, error) {
+	return ag.Search(ctx, AuditFilter{UserID: userID})
+}
+
+func (ag *auditGorm) Search(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	var events []AuditEvent
+	db := withContext(ctx, ag.db)
+	if filter.UserID != 0 {
+		db = db.Where("user_id = ? OR actor_id = ?", filter.UserID, filter.UserID)
+	}
+	if filter.Action != "" {
+		db = db.Where("action = ?", filter.Action)
+	}
+	err := db.Order("id desc").Limit(SearchLimit).Find(&events).Error
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,367 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrCommentBodyRequired is returned when a comment is left
+	// without any text.
+	ErrCommentBodyRequired modelError = "models: comment can't be empty"
+
+	// ErrCommentTooLong is returned when a comment is longer than
+	// MaxCommentBody.
+	ErrCommentTooLong modelError = "models: comments are limited to 5000 characters"
+
+	// ErrCommentAuthorRequired is returned when a comment doesn't say
+	// who left it.
+	ErrCommentAuthorRequired modelError = "models: name is required"
+
+	// ErrCommentAuthorTooLong is returned when the name on a comment
+	// is longer than MaxCommentAuthor.
+	ErrCommentAuthorTooLong modelError = "models: name is limited to 100 characters"
+
+	// ErrCommentParent is returned when a comment replies to one
+	// that isn't in the same thread.
+	ErrCommentParent modelError = "models: the comment you replied to is gone"
+
+	// ErrCommentsDisabled is returned when a comment is left on a
+	// gallery that doesn't take them.
+	ErrCommentsDisabled modelError = "models: comments are turned off for this gallery"
+)
+
+const (
+	// MaxCommentBody is the longest a comment can be, in
+	// characters.
+	MaxCommentBody = 5000
+
+	// MaxCommentAuthor is the longest name a comment can be left
+	// under, in characters.
+	MaxCommentAuthor = 100
+
+	// MaxCommentDepth is how deep replies nest. Replies to comments
+	// that deep go next to the comment instead of under it.
+	MaxCommentDepth = 3
+)
+
+// Comment is a comment on a gallery or on one of its photos. Replies
+// point at the comment they answer with ParentID.
+type Comment struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	GalleryID uint `gorm:"not null;index"`
+	// PhotoID is the photo the comment is on, or 0 for comments on
+	// the gallery itself.
+	PhotoID uint `gorm:"not null;default:0"`
+	// ParentID is the comment this one replies to, or 0. Depth is
+	// how many replies down it is, starting at 0.
+	ParentID uint `gorm:"not null;default:0;index"`
+	Depth    int  `gorm:"not null;default:0"`
+	// UserID is who left the comment, or 0 if it was a client with
+	// the gallery's proofing link. AuthorName is the name it is
+	// shown under either way.
+	UserID     uint   `gorm:"index"`
+	AuthorName string `gorm:"not null"`
+	// Body is the text of the comment as written, in the Markdown
+	// subset the views render.
+	Body string `gorm:"size:20000;not null"`
+	// Hidden comments are only shown to the gallery's owner, along
+	// with their replies.
+	Hidden bool `gorm:"not null;default:false"`
+}
+
+// CommentThread is a comment along with its replies, oldest first.
+type CommentThread struct {
+	Comment
+	Replies []CommentThread
+}
+
+// CommentService manages comments on galleries and photos.
+type CommentService interface {
+	CommentDB
+
+	// Threads returns the comments on the photo with the given ID,
+	// or on the gallery itself if photoID is 0, as threads, oldest
+	// first. Hidden comments and their replies are left out unless
+	// withHidden is set.
+	Threads(ctx context.Context, galleryID, photoID uint, withHidden bool) ([]CommentThread, error)
+}
+
+// CommentDB stores comments.
+type CommentDB interface {
+	ByID(ctx context.Context, id uint) (*Comment, error)
+
+	// ByGalleryID returns the comments on the photo with the given
+	// ID, or on the gallery itself if photoID is 0, oldest first.
+	ByGalleryID(ctx context.Context, galleryID, photoID uint) ([]Comment, error)
+
+	// Create adds comment. A reply to a comment that is
+	// MaxCommentDepth deep becomes a reply to that comment's parent.
+	Create(ctx context.Context, comment *Comment) error
+	Update(ctx context.Context, comment *Comment) error
+
+	// Delete deletes the comment with the given ID along with all
+	// of the replies to it.
+	Delete(ctx context.Context, id uint) error
+}
+
+func NewCommentService(db *gorm.DB) CommentService {
+	return &commentService{
+		CommentDB: &commentValidator{
+			CommentDB: &commentGorm{db: db},
+		},
+	}
+}
+
+type commentService struct {
+	CommentDB
+}
+
+func (cs *commentService) Threads(ctx context.Context, galleryID, photoID uint, withHidden bool) ([]CommentThread, error) {
+	comments, err := cs.ByGalleryID(ctx, galleryID, photoID)
+	if err != nil {
+		return nil, err
+	}
+	return commentThreads(comments, withHidden), nil
+}
+
+// commentThreads nests comments, which are oldest first, under the
+// comments they reply to. Replies whose parent is gone are shown as
+// if they started a thread.
+func commentThreads(comments []Comment, withHidden bool) []CommentThread {
+	ids := make(map[uint]bool, len(comments))
+	for _, c := range comments {
+		ids[c.ID] = true
+	}
+	children := make(map[uint][]Comment)
+	for _, c := range comments {
+		parent := c.ParentID
+		if !ids[parent] {
+			parent = 0
+		}
+		children[parent] = append(children[parent], c)
+	}
+	var build func(parent uint) []CommentThread
+	build = func(parent uint) []CommentThread {
+		var threads []CommentThread
+		for _, c := range children[parent] {
+			if c.Hidden && !withHidden {
+				continue
+			}
+			threads = append(threads, CommentThread{
+				Comment: c,
+				Replies: build(c.ID),
+			})
+		}
+		return threads
+	}
+	return build(0)
+}
+
+type commentValidator struct {
+	CommentDB
+}
+
+type commentValFn func(*Comment) error
+
+func runCommentValFns(comment *Comment, fns ...commentValFn) error {
+	for _, fn := range fns {
+		if err := fn(comment); err != nil {
+			return unwrapFieldError(err)
+		}
+	}
+	return nil
+}
+
+// runAllCommentValFns is runCommentValFns for ValidateAll.
+func runAllCommentValFns(comment *Comment, fns ...commentValFn) error {
+	errs := ValidationErrors{}
+	for _, fn := range fns {
+		if err := fn(comment); err != nil {
+			if err := collectError(errs, err); err != nil {
+				return err
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// commentField ties the errors of fns to a form field.
+func commentField(field string, fns ...commentValFn) commentValFn {
+	return commentValFn(func(c *Comment) error {
+		for _, fn := range fns {
+			if err := fn(c); err != nil {
+				return fieldError{field: field, err: err}
+			}
+		}
+		return nil
+	})
+}
+
+func (cv *commentValidator) Create(ctx context.Context, comment *Comment) error {
+	run := runCommentValFns
+	if validateAll(ctx) {
+		run = runAllCommentValFns
+	}
+	err := run(comment,
+		cv.galleryIDRequired,
+		cv.normalize,
+		commentField("author", cv.authorRequired, cv.authorLength),
+		commentField("body", cv.bodyRequired, cv.bodyLength),
+		cv.parentInThread(ctx))
+	if err != nil {
+		return err
+	}
+	return cv.CommentDB.Create(ctx, comment)
+}
+
+func (cv *commentValidator) Update(ctx context.Context, comment *Comment) error {
+	err := runCommentValFns(comment,
+		cv.galleryIDRequired,
+		cv.normalize,
+		cv.authorRequired,
+		cv.authorLength,
+		cv.bodyRequired,
+		cv.bodyLength)
+	if err != nil {
+		return err
+	}
+	return cv.CommentDB.Update(ctx, comment)
+}
+
+// Validation functions
+
+func (cv *commentValidator) galleryIDRequired(c *Comment) error {
+	if c.GalleryID == 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (cv *commentValidator) normalize(c *Comment) error {
+	c.AuthorName = strings.TrimSpace(c.AuthorName)
+	c.Body = strings.TrimSpace(strings.ReplaceAll(c.Body, "\r\n", "\n"))
+	return nil
+}
+
+func (cv *commentValidator) authorRequired(c *Comment) error {
+	if c.AuthorName == "" {
+		return ErrCommentAuthorRequired
+	}
+	return nil
+}
+
+func (cv *commentValidator) authorLength(c *Comment) error {
+	if utf8.RuneCountInString(c.AuthorName) > MaxCommentAuthor {
+		return ErrCommentAuthorTooLong
+	}
+	return nil
+}
+
+func (cv *commentValidator) bodyRequired(c *Comment) error {
+	if c.Body == "" {
+		return ErrCommentBodyRequired
+	}
+	return nil
+}
+
+func (cv *commentValidator) bodyLength(c *Comment) error {
+	if utf8.RuneCountInString(c.Body) > MaxCommentBody {
+		return ErrCommentTooLong
+	}
+	return nil
+}
+
+// parentInThread needs to look the parent up, so it returns a
+// commentValFn bound to the context of the calling request. It also
+// works out how deep the reply goes.
+func (cv *commentValidator) parentInThread(ctx context.Context) commentValFn {
+	return commentValFn(func(c *Comment) error {
+		c.Depth = 0
+		if c.ParentID == 0 {
+			return nil
+		}
+		parent, err := cv.ByID(ctx, c.ParentID)
+		if err == ErrNotFound {
+			return ErrCommentParent
+		}
+		if err != nil {
+			return err
+		}
+		if parent.GalleryID != c.GalleryID || parent.PhotoID != c.PhotoID {
+			return ErrCommentParent
+		}
+		c.Depth = parent.Depth + 1
+		if c.Depth >= MaxCommentDepth {
+			c.ParentID = parent.ParentID
+			c.Depth = parent.Depth
+		}
+		return nil
+	})
+}
+
+var _ CommentDB = &commentGorm{}
+
+type commentGorm struct {
+	db *gorm.DB
+}
+
+func (cg *commentGorm) ByID(ctx context.Context, id uint) (*Comment, error) {
+	var comment Comment
+	if err := first(withContext(ctx, cg.db).Where("id = ?", id), &comment); err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+func (cg *commentGorm) ByGalleryID(ctx context.Context, galleryID, photoID uint) ([]Comment, error) {
+	var comments []Comment
+	err := withContext(ctx, cg.db).
+		Where("gallery_id = ? AND photo_id = ?", galleryID, photoID).
+		Order("created_at, id").
+		Find(&comments).Error
+	if err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+func (cg *commentGorm) Create(ctx context.Context, comment *Comment) error {
+	return withContext(ctx, cg.db).Create(comment).Error
+}
+
+func (cg *commentGorm) Update(ctx context.Context, comment *Comment) error {
+	return withContext(ctx, cg.db).Save(comment).Error
+}
+
+func (cg *commentGorm) Delete(ctx context.Context, id uint) error {
+	tx := withContext(ctx, cg.db).Begin()
+	ids := []uint{id}
+	// Replies are at most MaxCommentDepth deep, so this takes a
+	// few queries at most.
+	for next := ids; len(next) > 0; {
+		var replies []uint
+		err := tx.Model(&Comment{}).Where("parent_id IN (?)", next).
+			Pluck("id", &replies).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		ids = append(ids, replies...)
+		next = replies
+	}
+	if err := tx.Where("id IN (?)", ids).Delete(&Comment{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,120 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCommentValidation(t *testing.T) {
+	ctx := context.Background()
+	cs := NewMemoryCommentService()
+	tests := []struct {
+		name    string
+		comment Comment
+		want    error
+	}{
+		{"no gallery", Comment{AuthorName: "Al", Body: "Nice"}, ErrIDInvalid},
+		{"no author", Comment{GalleryID: 1, AuthorName: "  ", Body: "Nice"}, ErrCommentAuthorRequired},
+		{"long author", Comment{GalleryID: 1, AuthorName: strings.Repeat("é", MaxCommentAuthor+1), Body: "Nice"}, ErrCommentAuthorTooLong},
+		{"no body", Comment{GalleryID: 1, AuthorName: "Al", Body: " \r\n "}, ErrCommentBodyRequired},
+		{"long body", Comment{GalleryID: 1, AuthorName: "Al", Body: strings.Repeat("é", MaxCommentBody+1)}, ErrCommentTooLong},
+		{"missing parent", Comment{GalleryID: 1, AuthorName: "Al", Body: "Nice", ParentID: 99}, ErrCommentParent},
+		{"longest body", Comment{GalleryID: 1, AuthorName: "Al", Body: strings.Repeat("é", MaxCommentBody)}, nil},
+	}
+	for _, tc := range tests {
+		if err := cs.Create(ctx, &tc.comment); err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	c := Comment{GalleryID: 1, AuthorName: " Al ", Body: " line one\r\nline two "}
+	if err := cs.Create(ctx, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.AuthorName != "Al" || c.Body != "line one\nline two" {
+		t.Errorf("stored %q by %q", c.Body, c.AuthorName)
+	}
+
+	err := cs.Create(ValidateAll(ctx), &Comment{GalleryID: 1})
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("ValidateAll: got %v, want ValidationErrors", err)
+	}
+	if errs["author"] != ErrCommentAuthorRequired || errs["body"] != ErrCommentBodyRequired {
+		t.Errorf("ValidateAll: got %v", errs)
+	}
+}
+
+func TestCommentReplies(t *testing.T) {
+	ctx := context.Background()
+	cs := NewMemoryCommentService()
+	create := func(parent *Comment, photoID uint) *Comment {
+		t.Helper()
+		c := &Comment{GalleryID: 1, PhotoID: photoID, AuthorName: "Al", Body: "Hi"}
+		if parent != nil {
+			c.ParentID = parent.ID
+		}
+		if err := cs.Create(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	root := create(nil, 0)
+	reply := create(root, 0)
+	deeper := create(reply, 0)
+	// Replies that would go past MaxCommentDepth sit next to the
+	// comment they answer.
+	deepest := create(deeper, 0)
+	if deeper.Depth != 2 || deepest.Depth != 2 || deepest.ParentID != reply.ID {
+		t.Errorf("depths %d, %d, parent %d", deeper.Depth, deepest.Depth, deepest.ParentID)
+	}
+
+	onPhoto := &Comment{GalleryID: 1, PhotoID: 5, ParentID: root.ID, AuthorName: "Al", Body: "Hi"}
+	if err := cs.Create(ctx, onPhoto); err != ErrCommentParent {
+		t.Errorf("reply across threads: got %v, want ErrCommentParent", err)
+	}
+	otherGallery := &Comment{GalleryID: 2, ParentID: root.ID, AuthorName: "Al", Body: "Hi"}
+	if err := cs.Create(ctx, otherGallery); err != ErrCommentParent {
+		t.Errorf("reply across galleries: got %v, want ErrCommentParent", err)
+	}
+	create(nil, 5)
+
+	threads, err := cs.Threads(ctx, 1, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads) != 1 || len(threads[0].Replies) != 1 ||
+		len(threads[0].Replies[0].Replies) != 2 {
+		t.Fatalf("threads %+v", threads)
+	}
+
+	reply.Hidden = true
+	if err := cs.Update(ctx, reply); err != nil {
+		t.Fatal(err)
+	}
+	threads, _ = cs.Threads(ctx, 1, 0, false)
+	if len(threads) != 1 || len(threads[0].Replies) != 0 {
+		t.Errorf("hidden reply shown: %+v", threads)
+	}
+	threads, _ = cs.Threads(ctx, 1, 0, true)
+	if len(threads) != 1 || len(threads[0].Replies) != 1 {
+		t.Errorf("owner doesn't see the hidden reply: %+v", threads)
+	}
+
+	if err := cs.Delete(ctx, reply.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Comment{reply, deeper, deepest} {
+		if _, err := cs.ByID(ctx, c.ID); err != ErrNotFound {
+			t.Errorf("comment %d: got %v after deleting its thread", c.ID, err)
+		}
+	}
+	if _, err := cs.ByID(ctx, root.ID); err != nil {
+		t.Errorf("root comment: %v", err)
+	}
+	photo, _ := cs.Threads(ctx, 1, 5, false)
+	if len(photo) != 1 {
+		t.Errorf("%d threads on the photo, want 1", len(photo))
+	}
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	contextKey = "lenslocked:context"
+	loggerKey  = "lenslocked:logger"
+)
+
+// withContext returns a copy of db carrying ctx. gorm (v1) has no
+// native context support, so the callbacks registered by
+// registerContextCallbacks use it to abort work for requests that
+// have already been cancelled or have run out of time. The copy
+// also logs its SQL with ctx, which ties the statements to the
+// request that ran them.
+func withContext(ctx context.Context, db *gorm.DB) *gorm.DB {
+	db = db.Set(contextKey, ctx)
+	if v, ok := db.Get(loggerKey); ok {
+		if logger, ok := v.(*slog.Logger); ok {
+			db.SetLogger(gormLogger{logger: logger, ctx: ctx})
+		}
+	}
+	return db
+}
+
+// setLogger makes db log through logger, along with every copy
+// withContext makes of it.
+func setLogger(db *gorm.DB, logger *slog.Logger) {
+	db.InstantSet(loggerKey, logger)
+	db.SetLogger(gormLogger{logger: logger, ctx: context.Background()})
+}
+
+// scopeContext returns the context attached with withContext, or
+// context.Background() if there isn't one.
+func scopeContext(scope *gorm.Scope) context.Context {
+	if v, ok := scope.Get(contextKey); ok {
+		if ctx, ok := v.(context.Context); ok {
+			return ctx
+		}
+	}
+	return context.Background()
+}
+
+// registerContextCallbacks makes every gorm operation check its
+// context before touching the database.
+func registerContextCallbacks(db *gorm.DB) {
+	cb := db.Callback()
+	cb.Create().Before("gorm:begin_transaction").Register("context:check_create", checkContext)
+	cb.Query().Before("gorm:query").Register("context:check_query", checkContext)
+	cb.Update().Before("gorm:assign_updating_attributes").Register("context:check_update", checkContext)
+	cb.Delete().Before("gorm:begin_transaction").Register("context:check_delete", checkContext)
+	cb.RowQuery().Before("gorm:row_query").Register("context:check_row_query", checkContext)
+}
+
+func checkContext(scope *gorm.Scope) {
+	if err := scopeContext(scope).Err(); err != nil {
+		scope.Err(err)
+		scope.SkipLeft()
+	}
+}
@@ -0,0 +1,276 @@
+package models
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/jinzhu/gorm"
+	_ "golang.org/x/image/webp"
+)
+
+// DuplicateDistance is the most bits two perceptual hashes can
+// differ by for their photos to count as near-duplicates. Resized
+// or recompressed copies of a photo are usually within 5.
+const DuplicateDistance = 10
+
+// LibraryPhoto is a photo along with the gallery it is in.
+type LibraryPhoto struct {
+	Photo
+	Gallery *Gallery
+}
+
+// PhotoMatch is a photo that duplicates another.
+type PhotoMatch struct {
+	LibraryPhoto
+	// Exact is set when the two files are byte for byte the same.
+	Exact bool
+	// Distance is how many bits the perceptual hashes differ by.
+	Distance int
+}
+
+// DuplicateGroup is a set of photos that each duplicate at least
+// one of the others, oldest first.
+type DuplicateGroup struct {
+	Photos []LibraryPhoto
+	// Exact is set when all of the files are byte for byte the
+	// same.
+	Exact bool
+}
+
+// hashPhoto returns the hex SHA-256 of the file at path and the
+// difference hash of the image in it. The difference hash is nil if
+// the image can't be decoded, or is too large to.
+func hashPhoto(path string) (string, *int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", nil, err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if err := checkPhotoPixels(path); err != nil {
+		return sum, nil, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	img, _, err := image.Decode(bufio.NewReader(f))
+	if err != nil {
+		return sum, nil, nil
+	}
+	d := int64(dHash(img))
+	return sum, &d, nil
+}
+
+// dHash computes the difference hash of img. The image is shrunk to
+// 9x8 grey pixels and each bit records whether a pixel is brighter
+// than the one to its right, so resizing, recompressing or slightly
+// editing a photo only flips a few bits.
+func dHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	b := img.Bounds()
+	if b.Empty() {
+		return 0
+	}
+	// Averaging every pixel of a large photo is slow and a few
+	// hundred samples across each side are plenty.
+	stepX := max(1, b.Dx()/(w*32))
+	stepY := max(1, b.Dy()/(h*32))
+	var sums [h][w]float64
+	var counts [h][w]int
+	for y := b.Min.Y; y < b.Max.Y; y += stepY {
+		gy := (y - b.Min.Y) * h / b.Dy()
+		for x := b.Min.X; x < b.Max.X; x += stepX {
+			gx := (x - b.Min.X) * w / b.Dx()
+			r, g, bl, _ := img.At(x, y).RGBA()
+			sums[gy][gx] += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+			counts[gy][gx]++
+		}
+	}
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			left := sums[y][x] / float64(max(1, counts[y][x]))
+			right := sums[y][x+1] / float64(max(1, counts[y][x+1]))
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// duplicates reports whether a and b are the same photo, and how
+// many bits their perceptual hashes differ by.
+func duplicates(a, b *Photo) (distance int, exact, ok bool) {
+	if a.ContentHash != "" && a.ContentHash == b.ContentHash {
+		return 0, true, true
+	}
+	if a.DHash == nil || b.DHash == nil {
+		return 0, false, false
+	}
+	distance = bits.OnesCount64(uint64(*a.DHash ^ *b.DHash))
+	return distance, false, distance <= DuplicateDistance
+}
+
+// library returns every photo the user has, along with its gallery.
+func (ps *photoService) library(ctx context.Context, userID uint) ([]LibraryPhoto, error) {
+	galleries, err := ps.galleries.ByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]*Gallery, len(galleries))
+	ids := make([]uint, len(galleries))
+	for i := range galleries {
+		byID[galleries[i].ID] = &galleries[i]
+		ids[i] = galleries[i].ID
+	}
+	photos, err := ps.ByGalleryIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	lib := make([]LibraryPhoto, len(photos))
+	for i, p := range photos {
+		lib[i] = LibraryPhoto{Photo: p, Gallery: byID[p.GalleryID]}
+	}
+	return lib, nil
+}
+
+func (ps *photoService) Matches(ctx context.Context, gallery *Gallery, photos []Photo) (map[uint][]PhotoMatch, error) {
+	lib, err := ps.library(ctx, gallery.UserID)
+	if err != nil {
+		return nil, err
+	}
+	matches := make(map[uint][]PhotoMatch)
+	for i := range photos {
+		photo := &photos[i]
+		var found []PhotoMatch
+		for _, other := range lib {
+			if other.ID == photo.ID {
+				continue
+			}
+			if distance, exact, ok := duplicates(photo, &other.Photo); ok {
+				found = append(found, PhotoMatch{
+					LibraryPhoto: other,
+					Exact:        exact,
+					Distance:     distance,
+				})
+			}
+		}
+		if len(found) == 0 {
+			continue
+		}
+		sort.SliceStable(found, func(i, j int) bool {
+			a, b := found[i], found[j]
+			if (a.GalleryID == gallery.ID) != (b.GalleryID == gallery.ID) {
+				return a.GalleryID == gallery.ID
+			}
+			return a.Distance < b.Distance
+		})
+		matches[photo.ID] = found
+	}
+	return matches, nil
+}
+
+func (ps *photoService) Duplicates(ctx context.Context, userID uint) ([]DuplicateGroup, error) {
+	lib, err := ps.library(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(lib, func(i, j int) bool {
+		return lib[i].CreatedAt.Before(lib[j].CreatedAt)
+	})
+
+	// Photos that duplicate one another are joined into groups
+	// with a union-find over their indexes in lib.
+	parent := make([]int, len(lib))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	union := func(i, j int) {
+		if ri, rj := find(i), find(j); ri != rj {
+			parent[max(ri, rj)] = min(ri, rj)
+		}
+	}
+	for i := range lib {
+		for j := i + 1; j < len(lib); j++ {
+			if _, _, ok := duplicates(&lib[i].Photo, &lib[j].Photo); ok {
+				union(i, j)
+			}
+		}
+	}
+
+	members := make(map[int][]LibraryPhoto)
+	var roots []int
+	for i := range lib {
+		root := find(i)
+		if _, ok := members[root]; !ok {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], lib[i])
+	}
+	var groups []DuplicateGroup
+	for _, root := range roots {
+		photos := members[root]
+		if len(photos) < 2 {
+			continue
+		}
+		group := DuplicateGroup{Photos: photos, Exact: true}
+		for _, p := range photos[1:] {
+			if p.ContentHash == "" || p.ContentHash != photos[0].ContentHash {
+				group.Exact = false
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// backfillPhotoHashes hashes the photos uploaded before hashes were
+// recorded, by reading their files.
+func backfillPhotoHashes(db *gorm.DB, imageDir string) error {
+	var photos []Photo
+	err := db.Where("content_hash = '' OR content_hash IS NULL").
+		Find(&photos).Error
+	if err != nil {
+		return err
+	}
+	for _, p := range photos {
+		sum, dhash, err := hashPhoto(filepath.Join(
+			GalleryDir(imageDir, p.GalleryID), filepath.Base(p.Filename)))
+		if err != nil {
+			continue
+		}
+		err = db.Model(&Photo{}).Where("id = ?", p.ID).
+			UpdateColumns(map[string]interface{}{
+				"content_hash": sum,
+				"d_hash":       dhash,
+			}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,6 +1,10 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"context"
+
+	"github.com/jinzhu/gorm"
+)
 
 // Gallery represents the galleries table in our DB
 // and is mostly a container resource composed of images.
@@ -29,7 +33,7 @@ type exampleService struct {
 }
 
 type ExampleDB interface {
-	Create(example *Example) error
+	Create(ctx context.Context, example *Example) error
 }
 
 type exampleValidator struct {
@@ -42,6 +46,6 @@ type exampleGorm struct {
 	db *gorm.DB
 }
 
-func (gg *exampleGorm) Create(example *Example) error {
-	return gg.db.Create(example).Error
+func (gg *exampleGorm) Create(ctx context.Context, example *Example) error {
+	return withContext(ctx, gg.db).Create(example).Error
 }
@@ -0,0 +1,496 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// PhotoMetadata is the camera information read from a photo's EXIF
+// data when it was uploaded. Fields the camera didn't record are
+// left zero, or nil for the pointers.
+type PhotoMetadata struct {
+	ID          uint `gorm:"primary_key"`
+	PhotoID     uint `gorm:"not null;unique_index"`
+	CameraMake  string
+	CameraModel string
+	Lens        string
+	// FNumber is the aperture, such as 2.8 for f/2.8.
+	FNumber float64
+	// ExposureTime is the shutter speed in seconds, written the way
+	// photographers do: "1/250" or "2".
+	ExposureTime string
+	ISO          int
+	// FocalLength is in millimetres.
+	FocalLength float64
+	// TakenAt is when the photo was captured, in the camera's clock.
+	TakenAt   *time.Time
+	Latitude  *float64
+	Longitude *float64
+}
+
+// Camera is the make and model of the camera. Many cameras repeat
+// the make in the model, so it is only added when it isn't there.
+func (m *PhotoMetadata) Camera() string {
+	if m.CameraMake == "" ||
+		strings.HasPrefix(strings.ToLower(m.CameraModel), strings.ToLower(m.CameraMake)) {
+		return m.CameraModel
+	}
+	return strings.TrimSpace(m.CameraMake + " " + m.CameraModel)
+}
+
+// Aperture is the f-number written as "f/2.8", or "" if unknown.
+func (m *PhotoMetadata) Aperture() string {
+	if m.FNumber <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("f/%g", m.FNumber)
+}
+
+// HasLocation reports whether the photo recorded where it was taken.
+func (m *PhotoMetadata) HasLocation() bool {
+	return m.Latitude != nil && m.Longitude != nil
+}
+
+// Location is the latitude and longitude in decimal degrees, or ""
+// if the photo has no location.
+func (m *PhotoMetadata) Location() string {
+	if !m.HasLocation() {
+		return ""
+	}
+	return fmt.Sprintf("%.5f, %.5f", *m.Latitude, *m.Longitude)
+}
+
+// MapURL links to the photo's location on OpenStreetMap, or is ""
+// if the photo has no location.
+func (m *PhotoMetadata) MapURL() string {
+	if !m.HasLocation() {
+		return ""
+	}
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%.6f&mlon=%.6f#map=15/%.6f/%.6f",
+		*m.Latitude, *m.Longitude, *m.Latitude, *m.Longitude)
+}
+
+// readMetadata parses the EXIF data of the JPEG read from r. It
+// returns nil when there is none.
+func readMetadata(r io.Reader) (*PhotoMetadata, error) {
+	_, seg := jpegExif(r)
+	if seg == nil {
+		return nil, nil
+	}
+	// Errors in optional sub-directories, such as a broken maker
+	// note, still leave the main tags usable, so only give up when
+	// there is nothing at all.
+	x, err := exif.Decode(bytes.NewReader(seg[4:]))
+	if x == nil {
+		return nil, err
+	}
+
+	meta := PhotoMetadata{
+		CameraMake:  exifString(x, exif.Make),
+		CameraModel: exifString(x, exif.Model),
+		Lens:        exifString(x, exif.LensModel),
+	}
+	if r := exifRat(x, exif.FNumber); r[1] != 0 {
+		meta.FNumber = float64(r[0]) / float64(r[1])
+	}
+	if r := exifRat(x, exif.FocalLength); r[1] != 0 {
+		meta.FocalLength = float64(r[0]) / float64(r[1])
+	}
+	meta.ExposureTime = exposureTime(exifRat(x, exif.ExposureTime))
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		meta.ISO, _ = tag.Int(0)
+	}
+	if t, err := x.DateTime(); err == nil {
+		meta.TakenAt = &t
+	}
+	if lat, long, err := x.LatLong(); err == nil {
+		meta.Latitude, meta.Longitude = &lat, &long
+	}
+	return &meta, nil
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+// exifRat returns the numerator and denominator of a rational tag,
+// or a zero denominator if the tag is missing.
+func exifRat(x *exif.Exif, name exif.FieldName) [2]int64 {
+	tag, err := x.Get(name)
+	if err != nil {
+		return [2]int64{}
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den <= 0 || num < 0 {
+		return [2]int64{}
+	}
+	return [2]int64{num, den}
+}
+
+// exposureTime formats a shutter speed given in seconds as a
+// fraction for fast speeds and in seconds for slow ones.
+func exposureTime(r [2]int64) string {
+	num, den := r[0], r[1]
+	if den == 0 || num == 0 {
+		return ""
+	}
+	if num >= den {
+		return fmt.Sprintf("%g", float64(num)/float64(den))
+	}
+	return fmt.Sprintf("1/%.0f", float64(den)/float64(num))
+}
+
+// jpegExif returns the APP1 segment, marker included, that holds
+// the EXIF data of the JPEG read from r and its offset in the file.
+// It returns a nil segment if there isn't one.
+func jpegExif(r io.Reader) (offset int64, seg []byte) {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return 0, nil
+	}
+	offset = 2
+	for {
+		var head [4]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil || head[0] != 0xFF {
+			return 0, nil
+		}
+		// EXIF comes before the image data, so there's no point
+		// looking past the start of scan.
+		if head[1] == 0xDA || head[1] == 0xD9 {
+			return 0, nil
+		}
+		size := int(binary.BigEndian.Uint16(head[2:]))
+		if size < 2 {
+			return 0, nil
+		}
+		seg = make([]byte, 2+size)
+		copy(seg, head[:])
+		if _, err := io.ReadFull(r, seg[4:]); err != nil {
+			return 0, nil
+		}
+		if head[1] == 0xE1 && bytes.HasPrefix(seg[4:], []byte("Exif\x00\x00")) {
+			return offset, seg
+		}
+		offset += int64(len(seg))
+	}
+}
+
+// tiffTypeSizes is the size in bytes of each TIFF field type.
+var tiffTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// clearGPS empties the GPS directory of the TIFF structure in b in
+// place, and reports whether there was one to empty.
+func clearGPS(b []byte) bool {
+	if len(b) < 8 {
+		return false
+	}
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return false
+	}
+	// entries returns the offset and count of the entries of the
+	// directory at off, if it fits in b.
+	entries := func(off int) (int, int, bool) {
+		if off < 8 || off+2 > len(b) {
+			return 0, 0, false
+		}
+		n := int(order.Uint16(b[off:]))
+		if off+2+12*n > len(b) {
+			return 0, 0, false
+		}
+		return off + 2, n, true
+	}
+
+	start, n, ok := entries(int(order.Uint32(b[4:])))
+	if !ok {
+		return false
+	}
+	gps := -1
+	for i := 0; i < n; i++ {
+		e := b[start+12*i:]
+		if order.Uint16(e) == 0x8825 {
+			gps = int(order.Uint32(e[8:]))
+		}
+	}
+	start, n, ok = entries(gps)
+	if !ok || n == 0 {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		e := b[start+12*i:]
+		size := tiffTypeSizes[order.Uint16(e[2:])] * int(order.Uint32(e[4:]))
+		if size > 4 {
+			if off := int(order.Uint32(e[8:])); off >= 0 && off+size <= len(b) {
+				clear(b[off : off+size])
+			}
+		}
+	}
+	// An empty directory is still a valid one, so the pointer to it
+	// can stay. Zeroing the entries also zeroes the offset of the
+	// next directory that follows them.
+	clear(b[start-2 : min(start+12*n+4, len(b))])
+	return true
+}
+
+// filePatch is a run of bytes to lay over a file at offset.
+type filePatch struct {
+	offset int64
+	data   []byte
+}
+
+// patchedFile reads a file with patches laid over it.
+type patchedFile struct {
+	f       *os.File
+	patches []filePatch
+}
+
+func (pf *patchedFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := pf.f.ReadAt(p, off)
+	for _, patch := range pf.patches {
+		start := max(off, patch.offset)
+		end := min(off+int64(n), patch.offset+int64(len(patch.data)))
+		if start < end {
+			copy(p[start-off:end-off],
+				patch.data[start-patch.offset:end-patch.offset])
+		}
+	}
+	return n, err
+}
+
+// strippedFile is a photo served without its location.
+type strippedFile struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (sf strippedFile) Close() error {
+	return sf.f.Close()
+}
+
+// withoutGPS returns a reader for f that leaves out the location
+// of a JPEG, PNG or WebP photo: the GPS tags of its EXIF data, and
+// its XMP packets, which can repeat them. The file is patched in
+// place rather than re-encoded, so it keeps its size and quality.
+// withoutGPS returns f itself when there is nothing to strip.
+func withoutGPS(f *os.File) (io.ReadSeekCloser, error) {
+	var head [12]byte
+	n, _ := io.ReadFull(f, head[:])
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var patches []filePatch
+	r := bufio.NewReader(f)
+	switch {
+	case bytes.HasPrefix(head[:n], []byte{0xFF, 0xD8}):
+		patches = jpegLocationPatches(r)
+	case bytes.HasPrefix(head[:n], pngSignature):
+		patches = pngLocationPatches(r)
+	case n == 12 && string(head[:4]) == "RIFF" && string(head[8:]) == "WEBP":
+		patches = webpLocationPatches(r)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if len(patches) == 0 {
+		return f, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	pf := &patchedFile{f: f, patches: patches}
+	return strippedFile{io.NewSectionReader(pf, 0, fi.Size()), f}, nil
+}
+
+// XMP packets are found behind these headers in JPEG APP1 segments.
+var (
+	xmpHeader         = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpExtendedHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+)
+
+// blank overwrites b with spaces. An XMP packet of only whitespace
+// is empty rather than broken, so readers skip it.
+func blank(b []byte) {
+	for i := range b {
+		b[i] = ' '
+	}
+}
+
+// jpegLocationPatches returns patches for the JPEG read from r
+// that empty the GPS directory of its EXIF segment and blank its
+// XMP segments. Everything else, such as the orientation, is kept.
+func jpegLocationPatches(r io.Reader) []filePatch {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return nil
+	}
+	var patches []filePatch
+	offset := int64(2)
+	for {
+		var head [4]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil || head[0] != 0xFF {
+			return patches
+		}
+		// Metadata comes before the image data, so there's no point
+		// looking past the start of scan.
+		if head[1] == 0xDA || head[1] == 0xD9 {
+			return patches
+		}
+		size := int(binary.BigEndian.Uint16(head[2:]))
+		if size < 2 {
+			return patches
+		}
+		seg := make([]byte, 2+size)
+		copy(seg, head[:])
+		if _, err := io.ReadFull(r, seg[4:]); err != nil {
+			return patches
+		}
+		body := seg[4:]
+		if head[1] == 0xE1 {
+			switch {
+			case bytes.HasPrefix(body, []byte("Exif\x00\x00")):
+				if clearGPS(body[6:]) {
+					patches = append(patches, filePatch{offset, seg})
+				}
+			case bytes.HasPrefix(body, xmpHeader):
+				blank(body[len(xmpHeader):])
+				patches = append(patches, filePatch{offset, seg})
+			case bytes.HasPrefix(body, xmpExtendedHeader):
+				blank(body[len(xmpExtendedHeader):])
+				patches = append(patches, filePatch{offset, seg})
+			}
+		}
+		offset += int64(len(seg))
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngLocationPatches returns patches for the PNG read from r that
+// empty the GPS directory of its eXIf chunk and blank the text
+// chunks that carry XMP or EXIF data. The CRCs of patched chunks
+// are recomputed.
+func pngLocationPatches(r io.Reader) []filePatch {
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, sig); err != nil || !bytes.Equal(sig, pngSignature) {
+		return nil
+	}
+	var patches []filePatch
+	offset := int64(len(pngSignature))
+	for {
+		var head [8]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return patches
+		}
+		size := binary.BigEndian.Uint32(head[:4])
+		typ := string(head[4:])
+		if typ == "IDAT" || typ == "IEND" || size > 1<<24 {
+			// Image data isn't read into memory; metadata before
+			// it is all browsers use, and all we strip.
+			return patches
+		}
+		chunk := make([]byte, 8+int(size)+4)
+		copy(chunk, head[:])
+		if _, err := io.ReadFull(r, chunk[8:]); err != nil {
+			return patches
+		}
+		data := chunk[8 : 8+size]
+		patched := false
+		switch typ {
+		case "eXIf":
+			patched = clearGPS(data)
+		case "tEXt", "zTXt", "iTXt":
+			// The keyword comes first in all three. The chunk is
+			// rewritten as a tEXt of the same size, so a
+			// compressed packet doesn't have to be re-compressed.
+			keyword, _, ok := bytes.Cut(data, []byte{0})
+			if ok && locationKeyword(string(keyword)) {
+				copy(chunk[4:8], "tEXt")
+				blank(data[len(keyword)+1:])
+				patched = true
+			}
+		}
+		if patched {
+			binary.BigEndian.PutUint32(chunk[8+size:], crc32.ChecksumIEEE(chunk[4:8+size]))
+			patches = append(patches, filePatch{offset, chunk})
+		}
+		offset += int64(len(chunk))
+	}
+}
+
+// locationKeyword reports whether a PNG text chunk with keyword can
+// hold a location: XMP, and the EXIF and XMP profiles ImageMagick
+// writes.
+func locationKeyword(keyword string) bool {
+	return keyword == "XML:com.adobe.xmp" ||
+		strings.HasPrefix(keyword, "Raw profile type ")
+}
+
+// webpLocationPatches returns patches for the WebP read from r that
+// empty the GPS directory of its EXIF chunk and blank its XMP
+// chunk.
+func webpLocationPatches(r io.Reader) []filePatch {
+	var head [12]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil
+	}
+	var patches []filePatch
+	offset := int64(12)
+	for {
+		var chunkHead [8]byte
+		if _, err := io.ReadFull(r, chunkHead[:]); err != nil {
+			return patches
+		}
+		size := int64(binary.LittleEndian.Uint32(chunkHead[4:]))
+		// Chunks are padded to an even size.
+		padded := size + size&1
+		typ := string(chunkHead[:4])
+		if typ != "EXIF" && typ != "XMP " || size > 1<<24 {
+			if _, err := io.CopyN(io.Discard, r, padded); err != nil {
+				return patches
+			}
+			offset += 8 + padded
+			continue
+		}
+		data := make([]byte, padded)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return patches
+		}
+		data = data[:size]
+		patched := true
+		if typ == "EXIF" {
+			// Some writers keep the JPEG "Exif\0\0" prefix.
+			patched = clearGPS(bytes.TrimPrefix(data, []byte("Exif\x00\x00")))
+		} else {
+			blank(data)
+		}
+		if patched {
+			patches = append(patches, filePatch{offset + 8, data})
+		}
+		offset += 8 + padded
+	}
+}
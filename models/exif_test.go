@@ -0,0 +1,227 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// testTIFF returns little endian EXIF data with an orientation of 6
+// and a GPS latitude of 51° 30' 0" N.
+func testTIFF() []byte {
+	le := binary.LittleEndian
+	b := []byte("II*\x00")
+	b = le.AppendUint32(b, 8)
+	// IFD0 at 8: orientation and the GPS pointer.
+	b = le.AppendUint16(b, 2)
+	b = append(b, entry(0x0112, 3, 1, 6)...)
+	b = append(b, entry(0x8825, 4, 1, 38)...)
+	b = le.AppendUint32(b, 0)
+	// GPS IFD at 38: latitude ref and latitude.
+	b = le.AppendUint16(b, 2)
+	b = append(b, entry(0x0001, 2, 2, uint32('N'))...)
+	b = append(b, entry(0x0002, 5, 3, 68)...)
+	b = le.AppendUint32(b, 0)
+	// Latitude rationals at 68.
+	for _, v := range []uint32{51, 1, 30, 1, 0, 1} {
+		b = le.AppendUint32(b, v)
+	}
+	return b
+}
+
+func entry(tag, typ uint16, count, value uint32) []byte {
+	le := binary.LittleEndian
+	e := le.AppendUint16(nil, tag)
+	e = le.AppendUint16(e, typ)
+	e = le.AppendUint32(e, count)
+	return le.AppendUint32(e, value)
+}
+
+const testXMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF ` +
+	`xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+	`<rdf:Description exif:GPSLatitude="51,30.0N"/></rdf:RDF></x:xmpmeta>`
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	img.Set(1, 1, color.RGBA{255, 0, 0, 255})
+	return img
+}
+
+func testJPEG(t *testing.T) []byte {
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	segment := func(marker byte, body []byte) []byte {
+		s := []byte{0xFF, marker, 0, 0}
+		binary.BigEndian.PutUint16(s[2:], uint16(len(body)+2))
+		return append(s, body...)
+	}
+	var b bytes.Buffer
+	b.Write([]byte{0xFF, 0xD8})
+	b.Write(segment(0xE1, append([]byte("Exif\x00\x00"), testTIFF()...)))
+	b.Write(segment(0xE1, append(append([]byte{}, xmpHeader...), testXMP...)))
+	b.Write(img.Bytes()[2:])
+	return b.Bytes()
+}
+
+func testPNG(t *testing.T) []byte {
+	var img bytes.Buffer
+	if err := png.Encode(&img, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	chunk := func(typ string, data []byte) []byte {
+		c := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+		c = append(append(c, typ...), data...)
+		return binary.BigEndian.AppendUint32(c, crc32.ChecksumIEEE(c[4:]))
+	}
+	src := img.Bytes()
+	// The IHDR chunk is 25 bytes long and has to stay first.
+	ihdr := len(pngSignature) + 25
+	var b bytes.Buffer
+	b.Write(src[:ihdr])
+	b.Write(chunk("eXIf", testTIFF()))
+	b.Write(chunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"+testXMP)))
+	b.Write(chunk("tEXt", []byte("Comment\x00taken on holiday")))
+	b.Write(src[ihdr:])
+	return b.Bytes()
+}
+
+func testWebP() []byte {
+	chunk := func(typ string, data []byte) []byte {
+		c := append([]byte(typ), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+		c = append(c, data...)
+		if len(data)%2 == 1 {
+			c = append(c, 0)
+		}
+		return c
+	}
+	var body []byte
+	body = append(body, "WEBP"...)
+	body = append(body, chunk("VP8X", make([]byte, 10))...)
+	body = append(body, chunk("VP8L", []byte("not decoded"))...)
+	body = append(body, chunk("EXIF", testTIFF())...)
+	body = append(body, chunk("XMP ", []byte(testXMP))...)
+	b := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+	return append(b, body...)
+}
+
+// stripped writes src to a file and reads it back through
+// withoutGPS.
+func stripped(t *testing.T, src []byte) []byte {
+	path := filepath.Join(t.TempDir(), "photo")
+	if err := os.WriteFile(path, src, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsc, err := withoutGPS(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsc.Close()
+	got, err := io.ReadAll(rsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(src) {
+		t.Fatalf("stripped file is %d bytes, want %d", len(got), len(src))
+	}
+	return got
+}
+
+// checkNoLocation fails if b still holds the test location, in the
+// EXIF data starting at tiff or the XMP packet.
+func checkNoLocation(t *testing.T, b []byte, tiff int) {
+	t.Helper()
+	if bytes.Contains(b, []byte("GPSLatitude")) {
+		t.Error("XMP location is still there")
+	}
+	x, err := exif.Decode(bytes.NewReader(b[tiff:]))
+	if x == nil {
+		t.Fatalf("EXIF no longer decodes: %v", err)
+	}
+	if _, err := x.Get(exif.GPSLatitude); err == nil {
+		t.Error("EXIF GPS latitude is still there")
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		t.Fatalf("orientation is gone: %v", err)
+	}
+	if o, _ := tag.Int(0); o != 6 {
+		t.Errorf("orientation is %d, want 6", o)
+	}
+}
+
+func TestWithoutGPS(t *testing.T) {
+	tiffAt := func(b []byte) int {
+		return bytes.Index(b, []byte("II*\x00"))
+	}
+
+	t.Run("jpeg", func(t *testing.T) {
+		src := testJPEG(t)
+		if x, _ := exif.Decode(bytes.NewReader(src[tiffAt(src):])); x == nil {
+			t.Fatal("test JPEG has no EXIF")
+		}
+		got := stripped(t, src)
+		checkNoLocation(t, got, tiffAt(got))
+		if _, err := jpeg.Decode(bytes.NewReader(got)); err != nil {
+			t.Errorf("stripped JPEG doesn't decode: %v", err)
+		}
+	})
+
+	t.Run("png", func(t *testing.T) {
+		got := stripped(t, testPNG(t))
+		checkNoLocation(t, got, tiffAt(got))
+		if !bytes.Contains(got, []byte("taken on holiday")) {
+			t.Error("unrelated text chunk was stripped")
+		}
+		// The decoder checks the CRC of every chunk.
+		if _, err := png.Decode(bytes.NewReader(got)); err != nil {
+			t.Errorf("stripped PNG doesn't decode: %v", err)
+		}
+	})
+
+	t.Run("webp", func(t *testing.T) {
+		got := stripped(t, testWebP())
+		checkNoLocation(t, got, tiffAt(got))
+	})
+
+	t.Run("nothing to strip", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := png.Encode(&b, testImage()); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "photo.png")
+		if err := os.WriteFile(path, b.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsc, err := withoutGPS(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsc.Close()
+		if rsc != io.ReadSeekCloser(f) {
+			t.Error("withoutGPS patched a file without a location")
+		}
+	})
+}
@@ -1,6 +1,11 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"context"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/rand"
+)
 
 const (
 	ErrUserIDRequired modelError = "models: user ID is required"
@@ -13,6 +18,28 @@ type Gallery struct {
 	gorm.Model
 	UserID uint   `gorm:"not_null;index"`
 	Title  string `gorm:"not_null"`
+	// CoverPhotoID is the photo chosen to represent the gallery, or
+	// 0 to use the first photo. See PhotoService.Covers.
+	CoverPhotoID uint
+	// StripGPS hides where the gallery's photos were taken from
+	// visitors, both on the photo pages and in the served files.
+	StripGPS bool `gorm:"not null;default:false"`
+	// Watermark is drawn over the photos visitors see.
+	Watermark Watermark `gorm:"embedded;embedded_prefix:watermark_"`
+	// AllowOriginals lets visitors download the photos without the
+	// watermark.
+	AllowOriginals bool `gorm:"not null;default:false"`
+	// Proofing lets clients favorite photos and send their
+	// selection through the gallery's proofing link, which has
+	// ProofToken in it. A new token is made whenever proofing is on
+	// and ProofToken is empty.
+	Proofing   bool   `gorm:"not null;default:false"`
+	ProofToken string `gorm:"size:64;index"`
+	// Comments lets signed in users comment on the gallery and its
+	// photos. VisitorComments also lets clients with the proofing
+	// link comment on the gallery.
+	Comments        bool `gorm:"not null;default:false"`
+	VisitorComments bool `gorm:"not null;default:false"`
 }
 
 func NewGalleryService(db *gorm.DB) GalleryService {
@@ -40,9 +67,25 @@ type galleryService struct {
 // If there is another error, we will return an error with
 // more information about what went wrong. This may not be
 // an error generated by the models package.
+//
+// Every method takes the context of the request it is serving so
+// that cancellation and deadlines reach the database.
 type GalleryDB interface {
-	Create(gallery *Gallery) error
-	ByID(id uint) (*Gallery, error)
+	ByID(ctx context.Context, id uint) (*Gallery, error)
+	ByUserID(ctx context.Context, userID uint) ([]Gallery, error)
+
+	// ByProofToken returns the gallery whose proofing link has the
+	// given token. Galleries with proofing off aren't found.
+	ByProofToken(ctx context.Context, token string) (*Gallery, error)
+
+	// Search returns up to SearchLimit galleries whose title
+	// contains query, ignoring case. An empty query matches
+	// every gallery.
+	Search(ctx context.Context, query string) ([]Gallery, error)
+
+	Create(ctx context.Context, gallery *Gallery) error
+	Update(ctx context.Context, gallery *Gallery) error
+	Delete(ctx context.Context, id uint) error
 }
 
 type galleryValidator struct {
@@ -55,23 +98,107 @@ type galleryGorm struct {
 	db *gorm.DB
 }
 
-func (gv *galleryValidator) Create(gallery *Gallery) error {
-	err := runGalleryValFns(gallery,
+func (gv *galleryValidator) Create(ctx context.Context, gallery *Gallery) error {
+	run := runGalleryValFns
+	if validateAll(ctx) {
+		run = runAllGalleryValFns
+	}
+	err := run(gallery,
+		gv.userIDRequired,
+		galleryField("title", gv.titleRequired),
+		gv.watermarkDefaults,
+		galleryField("watermark_text", gv.watermarkTextLength),
+		galleryField("watermark_position", gv.watermarkPosition),
+		galleryField("watermark_opacity", gv.watermarkOpacity),
+		galleryField("watermark_scale", gv.watermarkScale),
+		gv.setProofTokenIfUnset)
+	if err != nil {
+		return err
+	}
+	return gv.GalleryDB.Create(ctx, gallery)
+}
+
+func (gg *galleryGorm) Create(ctx context.Context, gallery *Gallery) error {
+	return withContext(ctx, gg.db).Create(gallery).Error
+}
+
+func (gv *galleryValidator) Update(ctx context.Context, gallery *Gallery) error {
+	run := runGalleryValFns
+	if validateAll(ctx) {
+		run = runAllGalleryValFns
+	}
+	err := run(gallery,
 		gv.userIDRequired,
-		gv.titleRequired)
+		galleryField("title", gv.titleRequired),
+		gv.watermarkDefaults,
+		galleryField("watermark_text", gv.watermarkTextLength),
+		galleryField("watermark_position", gv.watermarkPosition),
+		galleryField("watermark_opacity", gv.watermarkOpacity),
+		galleryField("watermark_scale", gv.watermarkScale),
+		gv.setProofTokenIfUnset)
 	if err != nil {
 		return err
 	}
-	return gv.GalleryDB.Create(gallery)
+	return gv.GalleryDB.Update(ctx, gallery)
+}
+
+func (gg *galleryGorm) Update(ctx context.Context, gallery *Gallery) error {
+	return withContext(ctx, gg.db).Save(gallery).Error
+}
+
+func (gv *galleryValidator) Delete(ctx context.Context, id uint) error {
+	var gallery Gallery
+	gallery.ID = id
+	if err := runGalleryValFns(&gallery, gv.idGreaterThan(0)); err != nil {
+		return err
+	}
+	return gv.GalleryDB.Delete(ctx, id)
+}
+
+func (gg *galleryGorm) Delete(ctx context.Context, id uint) error {
+	gallery := Gallery{Model: gorm.Model{ID: id}}
+	return withContext(ctx, gg.db).Delete(&gallery).Error
+}
+
+// ByUserID returns every gallery owned by the user, oldest first.
+func (gg *galleryGorm) ByUserID(ctx context.Context, userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := withContext(ctx, gg.db).
+		Where("user_id = ?", userID).
+		Order("id").
+		Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) Search(ctx context.Context, query string) ([]Gallery, error) {
+	var galleries []Gallery
+	db := withContext(ctx, gg.db)
+	if query != "" {
+		db = db.Where(`LOWER(title) LIKE ? ESCAPE '\'`, likePattern(query))
+	}
+	err := db.Order("id desc").Limit(SearchLimit).Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
 }
 
-func (gg *galleryGorm) Create(gallery *Gallery) error {
-	return gg.db.Create(gallery).Error
+func (gg *galleryGorm) ByProofToken(ctx context.Context, token string) (*Gallery, error) {
+	var gallery Gallery
+	db := withContext(ctx, gg.db).
+		Where("proofing = ? AND proof_token = ? AND proof_token <> ''", true, token)
+	if err := first(db, &gallery); err != nil {
+		return nil, err
+	}
+	return &gallery, nil
 }
 
-func (gg *galleryGorm) ByID(id uint) (*Gallery, error) {
+func (gg *galleryGorm) ByID(ctx context.Context, id uint) (*Gallery, error) {
 	var gallery Gallery
-	db := gg.db.Where("id = ?", id)
+	db := withContext(ctx, gg.db).Where("id = ?", id)
 	err := first(db, &gallery)
 	if err != nil {
 		return nil, err
@@ -86,14 +213,57 @@ type galleryValFn func(*Gallery) error
 func runGalleryValFns(gallery *Gallery, fns ...galleryValFn) error {
 	for _, fn := range fns {
 		if err := fn(gallery); err != nil {
-			return err
+			return unwrapFieldError(err)
+		}
+	}
+	return nil
+}
+
+// runAllGalleryValFns is runGalleryValFns for ValidateAll: it
+// carries on past failing checks and returns everything that is
+// wrong as ValidationErrors.
+func runAllGalleryValFns(gallery *Gallery, fns ...galleryValFn) error {
+	errs := ValidationErrors{}
+	for _, fn := range fns {
+		if err := fn(gallery); err != nil {
+			if err := collectError(errs, err); err != nil {
+				return err
+			}
 		}
 	}
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
+// galleryField runs fns in order, stopping at the first failure,
+// and ties the error to the named form field.
+func galleryField(field string, fns ...galleryValFn) galleryValFn {
+	return galleryValFn(func(g *Gallery) error {
+		for _, fn := range fns {
+			if err := fn(g); err != nil {
+				return fieldError{field: field, err: err}
+			}
+		}
+		return nil
+	})
+}
+
 // Validation functions
 
+func (gv *galleryValidator) setProofTokenIfUnset(g *Gallery) error {
+	if !g.Proofing || g.ProofToken != "" {
+		return nil
+	}
+	token, err := rand.Strings(24)
+	if err != nil {
+		return err
+	}
+	g.ProofToken = token
+	return nil
+}
+
 func (gv *galleryValidator) userIDRequired(g *Gallery) error {
 	if g.UserID <= 0 {
 		return ErrUserIDRequired
@@ -101,6 +271,15 @@ func (gv *galleryValidator) userIDRequired(g *Gallery) error {
 	return nil
 }
 
+func (gv *galleryValidator) idGreaterThan(n uint) galleryValFn {
+	return galleryValFn(func(g *Gallery) error {
+		if g.ID <= n {
+			return ErrIDInvalid
+		}
+		return nil
+	})
+}
+
 func (gv *galleryValidator) titleRequired(g *Gallery) error {
 	if g.Title == "" {
 		return ErrTitleRequired
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestGalleryValFns(t *testing.T) {
+	gv := &galleryValidator{GalleryDB: NewGalleryMemory()}
+	wm := func(w Watermark) Gallery {
+		return Gallery{Watermark: w}
+	}
+	valid := Watermark{Position: WatermarkBottomRight, Opacity: 50, Scale: 25}
+	tests := []struct {
+		name    string
+		fn      galleryValFn
+		gallery Gallery
+		want    error
+	}{
+		{"user required", gv.userIDRequired, Gallery{}, ErrUserIDRequired},
+		{"user set", gv.userIDRequired, Gallery{UserID: 1}, nil},
+		{"title required", gv.titleRequired, Gallery{}, ErrTitleRequired},
+		{"title set", gv.titleRequired, Gallery{Title: "Holiday"}, nil},
+		{"id zero", gv.idGreaterThan(0), Gallery{}, ErrIDInvalid},
+		{"text too long", gv.watermarkTextLength, wm(Watermark{Text: strings.Repeat("é", MaxWatermarkText+1)}), ErrWatermarkTextTooLong},
+		{"longest text", gv.watermarkTextLength, wm(Watermark{Text: strings.Repeat("é", MaxWatermarkText)}), nil},
+		{"unknown position", gv.watermarkPosition, wm(Watermark{Position: "middle"}), ErrWatermarkPosition},
+		{"valid position", gv.watermarkPosition, wm(valid), nil},
+		{"opacity zero", gv.watermarkOpacity, wm(Watermark{Opacity: 0}), ErrWatermarkOpacity},
+		{"opacity over 100", gv.watermarkOpacity, wm(Watermark{Opacity: 101}), ErrWatermarkOpacity},
+		{"valid opacity", gv.watermarkOpacity, wm(valid), nil},
+		{"scale too small", gv.watermarkScale, wm(Watermark{Scale: MinWatermarkScale - 1}), ErrWatermarkScale},
+		{"scale over 100", gv.watermarkScale, wm(Watermark{Scale: 101}), ErrWatermarkScale},
+		{"valid scale", gv.watermarkScale, wm(valid), nil},
+	}
+	for _, tc := range tests {
+		if err := tc.fn(&tc.gallery); err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestGalleryValidatorCreate(t *testing.T) {
+	ctx := context.Background()
+	gs := NewMemoryGalleryService()
+	gallery := &Gallery{UserID: 1, Title: "Holiday",
+		Watermark: Watermark{Text: "  © Al  "}}
+	if err := gs.Create(ctx, gallery); err != nil {
+		t.Fatal(err)
+	}
+	want := Watermark{Text: "© Al", Position: WatermarkBottomRight, Opacity: 50, Scale: 25}
+	if gallery.Watermark != want {
+		t.Errorf("watermark %+v, want %+v", gallery.Watermark, want)
+	}
+
+	err := gs.Create(ValidateAll(ctx), &Gallery{UserID: 1,
+		Watermark: Watermark{Position: "middle", Opacity: 200}})
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("ValidateAll: got %v, want ValidationErrors", err)
+	}
+	if errs["title"] != ErrTitleRequired || errs["watermark_position"] != ErrWatermarkPosition ||
+		errs["watermark_opacity"] != ErrWatermarkOpacity {
+		t.Errorf("ValidateAll: got %v", errs)
+	}
+	if err := gs.Create(ctx, &Gallery{Title: "Holiday"}); err != ErrUserIDRequired {
+		t.Errorf("no user: got %v, want ErrUserIDRequired", err)
+	}
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrIdentityEmailRequired is returned when an identity
+	// provider doesn't share an email address, so we can neither
+	// link nor create an account.
+	ErrIdentityEmailRequired modelError = "models: the sign-in provider did not share an email address"
+
+	// ErrIdentityEmailUnverified is returned when an account with
+	// the provider's email address exists but the provider hasn't
+	// verified that the user owns it.
+	ErrIdentityEmailUnverified modelError = "models: an account with this email already exists. " +
+		"Log in with your password to use it"
+
+	// ErrIdentitySignupUnverified is returned when signing in with
+	// a provider would create an account for an email address the
+	// provider hasn't verified.
+	ErrIdentitySignupUnverified modelError = "models: the sign-in provider has not verified your email address. " +
+		"Verify it with the provider, or sign up with a password"
+)
+
+// Identity links an account at an external OpenID Connect provider
+// to a User. Subject is the provider's stable ID for the user.
+type Identity struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"not null;index"`
+	Provider  string `gorm:"not null;unique_index:idx_identities_provider_subject"`
+	Subject   string `gorm:"not null;unique_index:idx_identities_provider_subject"`
+	// Email is the address the provider reported when the identity
+	// was linked. It is informational only.
+	Email string
+}
+
+// ExternalIdentity is what an identity provider told us about the
+// user signing in.
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// IdentityDB stores the links between users and external
+// identities.
+type IdentityDB interface {
+	// ByProviderSubject returns the identity for the given provider
+	// and subject, or ErrNotFound.
+	ByProviderSubject(ctx context.Context, provider, subject string) (*Identity, error)
+	ByUserID(ctx context.Context, userID uint) ([]Identity, error)
+	Create(ctx context.Context, identity *Identity) error
+}
+
+var _ IdentityDB = &identityGorm{}
+
+type identityGorm struct {
+	db *gorm.DB
+}
+
+func (ig *identityGorm) ByProviderSubject(ctx context.Context, provider, subject string) (*Identity, error) {
+	var identity Identity
+	db := withContext(ctx, ig.db).
+		Where("provider = ? AND subject = ?", provider, subject)
+	if err := first(db, &identity); err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (ig *identityGorm) ByUserID(ctx context.Context, userID uint) ([]Identity, error) {
+	var identities []Identity
+	err := withContext(ctx, ig.db).Where("user_id = ?", userID).
+		Order("id").Find(&identities).Error
+	if err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+func (ig *identityGorm) Create(ctx context.Context, identity *Identity) error {
+	return withContext(ctx, ig.db).Create(identity).Error
+}
@@ -0,0 +1,110 @@
+package models
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func newTestUserService() UserService {
+	return NewMemoryUserService(discard, NewMemoryAuditService(discard))
+}
+
+func TestAuthenticateIdentity(t *testing.T) {
+	ctx := context.Background()
+	us := newTestUserService()
+	existing := &User{Name: "Bo", Email: "bo@example.com",
+		Password: "darkroom silver print"}
+	if err := us.Create(ctx, existing); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		ext     ExternalIdentity
+		wantErr error
+		// wantID is the user signed in, or 0 for a new account.
+		wantID uint
+	}{
+		{
+			name: "new verified address signs up",
+			ext: ExternalIdentity{Provider: "mock", Subject: "al",
+				Email: "al@example.com", EmailVerified: true, Name: "Al"},
+		},
+		{
+			name: "new unverified address",
+			ext: ExternalIdentity{Provider: "mock", Subject: "cy",
+				Email: "cy@example.com"},
+			wantErr: ErrIdentitySignupUnverified,
+		},
+		{
+			name: "existing account, unverified",
+			ext: ExternalIdentity{Provider: "mock", Subject: "bo",
+				Email: "bo@example.com"},
+			wantErr: ErrIdentityEmailUnverified,
+		},
+		{
+			name: "existing account, verified",
+			ext: ExternalIdentity{Provider: "mock", Subject: "bo",
+				Email: "bo@example.com", EmailVerified: true},
+			wantID: existing.ID,
+		},
+		{
+			name: "linked identity ignores the email",
+			ext: ExternalIdentity{Provider: "mock", Subject: "bo",
+				Email: "someone-else@example.com"},
+			wantID: existing.ID,
+		},
+		{
+			name:    "no email",
+			ext:     ExternalIdentity{Provider: "mock", Subject: "dee"},
+			wantErr: ErrIdentityEmailRequired,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			user, err := us.AuthenticateIdentity(ctx, tc.ext)
+			if err != tc.wantErr {
+				t.Fatalf("got error %v, want %v", err, tc.wantErr)
+			}
+			if err != nil {
+				_, err := us.ByEmail(ctx, tc.ext.Email)
+				if tc.wantID == 0 && tc.ext.Email != existing.Email && err != ErrNotFound {
+					t.Errorf("an account was created for %s", tc.ext.Email)
+				}
+				return
+			}
+			if tc.wantID != 0 && user.ID != tc.wantID {
+				t.Errorf("signed in user %d, want %d", user.ID, tc.wantID)
+			}
+			if tc.wantID == 0 && user.ID == existing.ID {
+				t.Errorf("signed in the existing user instead of a new one")
+			}
+		})
+	}
+}
+
+func TestCreateWithIdentityRollsBack(t *testing.T) {
+	ctx := context.Background()
+	udb := NewUserMemory()
+	first := &User{Email: "al@example.com", RememberHash: "a"}
+	if err := udb.CreateWithIdentity(ctx, first,
+		&Identity{Provider: "mock", Subject: "al"}); err != nil {
+		t.Fatal(err)
+	}
+	second := &User{Email: "bo@example.com", RememberHash: "b"}
+	err := udb.CreateWithIdentity(ctx, second,
+		&Identity{Provider: "mock", Subject: "al"})
+	if err == nil {
+		t.Fatal("linked the same identity twice")
+	}
+	if _, err := udb.ByEmail(ctx, "bo@example.com"); err != ErrNotFound {
+		t.Errorf("ByEmail after a failed link: got %v, want ErrNotFound", err)
+	}
+	if _, ok := err.(modelError); ok {
+		t.Errorf("unique violation %q is a public error", err)
+	}
+}
@@ -0,0 +1,178 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// renderQuality is the JPEG quality of the photos the server draws
+// on or resizes.
+const renderQuality = 88
+
+// MaxPhotoPixels is the most pixels a photo can have. Decoding one
+// takes four bytes a pixel, so this keeps a single photo to 400 MB
+// however well it compresses.
+const MaxPhotoPixels = 100_000_000
+
+// checkPhotoPixels returns ErrPhotoPixels if the image in the file at
+// path has more than MaxPhotoPixels, going by its header alone. A
+// header that can't be read is left for the full decode to report.
+func checkPhotoPixels(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(bufio.NewReader(f))
+	if err != nil {
+		return nil
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > MaxPhotoPixels {
+		return ErrPhotoPixels
+	}
+	return nil
+}
+
+// decodePhoto decodes the image in the file at path, turned the way
+// its EXIF orientation says it should be shown. Encoding the result
+// drops the EXIF data, so without that portrait photos would come
+// out on their side.
+func decodePhoto(path string) (*image.RGBA, error) {
+	if err := checkPhotoPixels(path); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// The EXIF segment is at most 64 KB and comes first, so the
+	// orientation can be read from the start of the buffer without
+	// going through the file twice.
+	br := bufio.NewReaderSize(f, 72<<10)
+	head, _ := br.Peek(72 << 10)
+	src, _, err := image.Decode(br)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+	return orient(img, jpegOrientation(bytes.NewReader(head))), nil
+}
+
+// jpegOrientation returns the EXIF orientation of the JPEG read from
+// r, from 1 to 8, or 1 if it has none.
+func jpegOrientation(r io.Reader) int {
+	_, seg := jpegExif(r)
+	if seg == nil {
+		return 1
+	}
+	x, _ := exif.Decode(bytes.NewReader(seg[4:]))
+	if x == nil {
+		return 1
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	o, err := tag.Int(0)
+	if err != nil || o < 1 || o > 8 {
+		return 1
+	}
+	return o
+}
+
+// orient flips and rotates img as EXIF orientation o asks.
+func orient(img *image.RGBA, o int) *image.RGBA {
+	if o <= 1 || o > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch o {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			s := img.PixOffset(sx, sy)
+			d := dst.PixOffset(x, y)
+			copy(dst.Pix[d:d+4], img.Pix[s:s+4])
+		}
+	}
+	return dst
+}
+
+// renderedExt is the extension of the file the server writes when
+// it redraws a photo stored under filename. PNGs stay PNGs so that
+// transparency survives; everything else becomes a JPEG.
+func renderedExt(filename string) string {
+	if filepath.Ext(filename) == ".png" {
+		return ".png"
+	}
+	return ".jpg"
+}
+
+// encodePhoto writes img to w in the format of ext, which
+// renderedExt returned.
+func encodePhoto(w io.Writer, img image.Image, ext string) error {
+	if ext == ".png" {
+		return png.Encode(w, img)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: renderQuality})
+}
+
+// writeRendered encodes img to a new file at path. It is written
+// under a temporary name first, so requests rendering the same file
+// at once never see half of it.
+func writeRendered(path string, img image.Image) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".render-*")
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(tmp)
+	err = encodePhoto(bw, img, filepath.Ext(path))
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// hugePNG returns the header of a PNG with more pixels than
+// MaxPhotoPixels. There is no image data after it, so it only gets
+// as far as a decoder that reads the header first.
+func hugePNG() []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], 20000)
+	binary.BigEndian.PutUint32(ihdr[4:], 20000)
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 6 // RGBA
+	b := []byte("\x89PNG\r\n\x1a\n")
+	b = binary.BigEndian.AppendUint32(b, uint32(len(ihdr)))
+	chunk := append([]byte("IHDR"), ihdr...)
+	b = append(b, chunk...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(chunk))
+}
+
+func TestUploadPixels(t *testing.T) {
+	ctx := context.Background()
+	ps, gallery := newTestPhotoService(t, Quota{})
+	_, err := ps.Upload(ctx, gallery, "huge.png", bytes.NewReader(hugePNG()))
+	if err != ErrPhotoPixels {
+		t.Fatalf("got %v, want ErrPhotoPixels", err)
+	}
+	files, _ := os.ReadDir(GalleryDir(ps.(*photoService).imageDir, gallery.ID))
+	if len(files) != 0 {
+		t.Errorf("%d files left behind", len(files))
+	}
+	if _, err := ps.Upload(ctx, gallery, "beach.png", bytes.NewReader(testPNGBytes(t))); err != nil {
+		t.Errorf("small photo: %v", err)
+	}
+}
+
+func TestImportZipPixels(t *testing.T) {
+	ps, gallery := newTestPhotoService(t, Quota{})
+	zr := testZip(t, map[string][]byte{
+		"huge.png":  hugePNG(),
+		"beach.png": testPNGBytes(t),
+	})
+	imp, err := ps.ImportZip(context.Background(), gallery, zr, zr.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imp.Photos) != 1 || len(imp.Skipped) != 1 || imp.Skipped[0] != "huge.png" {
+		t.Errorf("imported %d, skipped %v", len(imp.Photos), imp.Skipped)
+	}
+}
+
+func TestDecodeHugePhoto(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "huge.png")
+	if err := os.WriteFile(path, hugePNG(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodePhoto(path); err != ErrPhotoPixels {
+		t.Errorf("decodePhoto: got %v, want ErrPhotoPixels", err)
+	}
+	sum, dhash, err := hashPhoto(path)
+	if err != nil || sum == "" || dhash != nil {
+		t.Errorf("hashPhoto: got %q, %v, %v", sum, dhash, err)
+	}
+}
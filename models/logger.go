@@ -0,0 +1,80 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// SQLLogLevel controls which gorm messages are logged.
+type SQLLogLevel int
+
+const (
+	// SQLLogErrors only logs failed queries. This is gorm's
+	// default behavior.
+	SQLLogErrors SQLLogLevel = iota
+
+	// SQLLogOff disables all gorm logging.
+	SQLLogOff
+
+	// SQLLogAll logs every SQL statement along with how long it
+	// took and how many rows it affected.
+	SQLLogAll
+)
+
+// ParseSQLLogLevel converts one of "errors", "off" or "all" into
+// the matching SQLLogLevel.
+func ParseSQLLogLevel(s string) (SQLLogLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "error", "errors":
+		return SQLLogErrors, nil
+	case "off", "none":
+		return SQLLogOff, nil
+	case "all":
+		return SQLLogAll, nil
+	}
+	return SQLLogErrors, fmt.Errorf("models: unknown SQL log level %q", s)
+}
+
+// gormLogger adapts a slog.Logger to the logger interface gorm
+// expects. Query arguments are deliberately never logged since
+// they include password and remember token hashes. Messages are
+// logged with ctx, so they carry the ID of the request they were
+// made for.
+type gormLogger struct {
+	logger *slog.Logger
+	ctx    context.Context
+}
+
+func (l gormLogger) Print(values ...interface{}) {
+	if len(values) < 2 {
+		l.logger.InfoContext(l.ctx, "gorm", "msg", fmt.Sprint(values...))
+		return
+	}
+	switch values[0] {
+	case "sql":
+		// "sql", source, duration, query, vars, rows affected
+		if len(values) < 6 {
+			break
+		}
+		l.logger.InfoContext(l.ctx, "sql",
+			"source", values[1],
+			"duration", values[2],
+			"query", values[3],
+			"rows", values[5])
+		return
+	case "error":
+		l.logger.ErrorContext(l.ctx, "sql error",
+			"source", values[1],
+			"err", fmt.Sprint(values[2:]...))
+		return
+	case "info":
+		// gorm reports things like callback registration this way.
+		l.logger.DebugContext(l.ctx, "gorm", "msg", fmt.Sprint(values[1:]...))
+		return
+	}
+	l.logger.InfoContext(l.ctx, "gorm",
+		"source", values[1],
+		"msg", fmt.Sprint(values[2:]...))
+}
@@ -0,0 +1,88 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrLoginTokenInvalid is returned when a login link is
+	// unknown, has already been used or has expired.
+	ErrLoginTokenInvalid modelError = "models: login link is invalid or has expired"
+)
+
+// LoginTokenTTL is how long an emailed login link stays valid.
+const LoginTokenTTL = 15 * time.Minute
+
+// LoginToken is a single use token emailed to a user so they can
+// sign in without a password. Only the HMAC of the token is
+// stored.
+type LoginToken struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UserID    uint      `gorm:"not null;index"`
+	TokenHash string    `gorm:"not null;unique_index"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+// LoginTokenDB stores login tokens. Tokens passed to it have
+// already been hashed.
+type LoginTokenDB interface {
+	// Create stores token, replacing any other tokens for the same
+	// user so only the most recent link works.
+	Create(ctx context.Context, token *LoginToken) error
+
+	// Consume deletes the unexpired token with the given hash and
+	// returns it. It returns ErrNotFound if there is no such
+	// token, which makes every token usable only once.
+	Consume(ctx context.Context, tokenHash string) (*LoginToken, error)
+}
+
+var _ LoginTokenDB = &loginTokenGorm{}
+
+type loginTokenGorm struct {
+	db *gorm.DB
+}
+
+func (ltg *loginTokenGorm) Create(ctx context.Context, token *LoginToken) error {
+	tx := withContext(ctx, ltg.db).Begin()
+	if err := tx.Where("user_id = ?", token.UserID).
+		Delete(&LoginToken{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Create(token).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (ltg *loginTokenGorm) Consume(ctx context.Context, tokenHash string) (*LoginToken, error) {
+	var token LoginToken
+	tx := withContext(ctx, ltg.db).Begin()
+	if err := first(tx.Where("token_hash = ?", tokenHash), &token); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	// Checking the deleted row count makes sure only one of two
+	// concurrent requests for the same link wins.
+	res := tx.Where("id = ?", token.ID).Delete(&LoginToken{})
+	if res.Error != nil {
+		tx.Rollback()
+		return nil, res.Error
+	}
+	if res.RowsAffected != 1 {
+		tx.Rollback()
+		return nil, ErrNotFound
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	if time.Now().After(token.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	return &token, nil
+}
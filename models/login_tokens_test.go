@@ -0,0 +1,136 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// loginTokenDBs returns each LoginTokenDB implementation, empty.
+func loginTokenDBs(t *testing.T) map[string]LoginTokenDB {
+	db := testDB(t)
+	if err := db.AutoMigrate(&LoginToken{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return map[string]LoginTokenDB{
+		"memory": NewLoginTokenMemory(),
+		"gorm":   &loginTokenGorm{db},
+	}
+}
+
+func TestLoginTokenConsume(t *testing.T) {
+	for name, ltdb := range loginTokenDBs(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			err := ltdb.Create(ctx, &LoginToken{
+				UserID:    1,
+				TokenHash: "fresh",
+				ExpiresAt: time.Now().Add(LoginTokenTTL),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := ltdb.Consume(ctx, "fresh")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.UserID != 1 {
+				t.Errorf("Consume() = token of user %d, want 1", token.UserID)
+			}
+			if _, err := ltdb.Consume(ctx, "fresh"); err != ErrNotFound {
+				t.Errorf("second Consume(): err = %v, want %v", err, ErrNotFound)
+			}
+			if _, err := ltdb.Consume(ctx, "unknown"); err != ErrNotFound {
+				t.Errorf("Consume() of an unknown token: err = %v, want %v", err, ErrNotFound)
+			}
+		})
+	}
+}
+
+func TestLoginTokenConsumeConcurrently(t *testing.T) {
+	for name, ltdb := range loginTokenDBs(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			err := ltdb.Create(ctx, &LoginToken{
+				UserID:    1,
+				TokenHash: "shared",
+				ExpiresAt: time.Now().Add(LoginTokenTTL),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			const n = 10
+			var wg sync.WaitGroup
+			errs := make(chan error, n)
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := ltdb.Consume(ctx, "shared")
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			used := 0
+			for err := range errs {
+				switch err {
+				case nil:
+					used++
+				case ErrNotFound:
+				default:
+					t.Error(err)
+				}
+			}
+			if used != 1 {
+				t.Errorf("token used %d times, want once", used)
+			}
+		})
+	}
+}
+
+func TestLoginTokenExpired(t *testing.T) {
+	for name, ltdb := range loginTokenDBs(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			err := ltdb.Create(ctx, &LoginToken{
+				UserID:    1,
+				TokenHash: "stale",
+				ExpiresAt: time.Now().Add(-time.Minute),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ltdb.Consume(ctx, "stale"); err != ErrNotFound {
+				t.Errorf("Consume() of an expired token: err = %v, want %v", err, ErrNotFound)
+			}
+		})
+	}
+}
+
+func TestLoginTokenCreateReplaces(t *testing.T) {
+	for name, ltdb := range loginTokenDBs(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			expires := time.Now().Add(LoginTokenTTL)
+			for _, token := range []LoginToken{
+				{UserID: 1, TokenHash: "first", ExpiresAt: expires},
+				{UserID: 2, TokenHash: "other", ExpiresAt: expires},
+				{UserID: 1, TokenHash: "second", ExpiresAt: expires},
+			} {
+				if err := ltdb.Create(ctx, &token); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := ltdb.Consume(ctx, "first"); err != ErrNotFound {
+				t.Errorf("Consume() of a replaced token: err = %v, want %v", err, ErrNotFound)
+			}
+			for _, hash := range []string{"second", "other"} {
+				if _, err := ltdb.Consume(ctx, hash); err != nil {
+					t.Errorf("Consume(%q): %v", hash, err)
+				}
+			}
+		})
+	}
+}
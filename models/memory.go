@@ -0,0 +1,1108 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"lenslocked.com/hash"
+)
+
+// uniqueViolation is the error the memory DBs return when a write
+// would break a unique index. Like the error from the database
+// driver, it is not a modelError, so it is never shown to users.
+func uniqueViolation(columns string) error {
+	return fmt.Errorf("UNIQUE constraint failed: %s", columns)
+}
+
+// NewMemoryUserService returns a UserService backed by an in-memory
+// UserDB instead of gorm. It runs through the same validation layer
+// as NewUserService, which makes it handy for tests and demos that
+// should not need a database.
+func NewMemoryUserService(logger *slog.Logger, audit AuditService) UserService {
+	hmac := hash.NewHMAC(hmacSecretKey)
+	um := NewUserMemory().(*userMemory)
+	uv := newUserValidator(um, hmac, DefaultPasswordPolicy)
+	return &userService{
+		UserDB:     uv,
+		logger:     logger,
+		audit:      audit,
+		tokens:     NewLoginTokenMemory(),
+		identities: um.identities,
+		hmac:       hmac,
+		policy:     DefaultPasswordPolicy,
+	}
+}
+
+// NewMemoryAuditService returns an AuditService backed by an
+// in-memory AuditDB instead of gorm.
+func NewMemoryAuditService(logger *slog.Logger) AuditService {
+	return &auditService{
+		AuditDB: &auditValidator{
+			AuditDB: NewAuditMemory(),
+		},
+		logger: logger,
+	}
+}
+
+// NewMemoryGalleryService returns a GalleryService backed by an
+// in-memory GalleryDB instead of gorm.
+func NewMemoryGalleryService() GalleryService {
+	return &galleryService{
+		GalleryDB: &galleryValidator{
+			GalleryDB: NewGalleryMemory(),
+		},
+	}
+}
+
+// NewMemoryPhotoService returns a PhotoService backed by an
+// in-memory PhotoDB instead of gorm. Photo files are still stored
+// under imageDir.
+func NewMemoryPhotoService(galleries GalleryDB, users UserDB,
+	imageDir string, quota Quota, resize ResizeConfig) PhotoService {
+	pv := &photoValidator{
+		PhotoDB:   NewPhotoMemory(),
+		galleries: galleries,
+		users:     users,
+		quota:     quota,
+	}
+	return &photoService{
+		PhotoDB:   pv,
+		validator: pv,
+		galleries: galleries,
+		imageDir:  imageDir,
+		resize:    resize,
+		resized:   newResizeCache(ResizedCacheDir(imageDir), resize.CacheSize),
+	}
+}
+
+// NewMemoryUploadService returns an UploadService backed by an
+// in-memory UploadDB instead of gorm. The uploaded bytes are still
+// kept below imageDir.
+func NewMemoryUploadService(photos PhotoService, galleries GalleryDB,
+	imageDir string, expiry time.Duration) UploadService {
+	return &uploadService{
+		UploadDB:  NewUploadMemory(),
+		photos:    photos,
+		galleries: galleries,
+		dir:       UploadDir(imageDir),
+		expiry:    expiry,
+		busy:      make(map[string]bool),
+	}
+}
+
+// NewMemoryProofService returns a ProofService backed by an
+// in-memory ProofDB instead of gorm.
+func NewMemoryProofService() ProofService {
+	return &proofService{
+		ProofDB: newProofValidator(NewProofMemory()),
+	}
+}
+
+// NewMemoryCommentService returns a CommentService backed by an
+// in-memory CommentDB instead of gorm.
+func NewMemoryCommentService() CommentService {
+	return &commentService{
+		CommentDB: &commentValidator{
+			CommentDB: NewCommentMemory(),
+		},
+	}
+}
+
+// NewUserMemory returns an empty in-memory UserDB. It honors the
+// same contract as the gorm implementation: lookups return
+// ErrNotFound for missing or deleted users, emails and remember
+// hashes are unique, and Delete is a soft delete.
+func NewUserMemory() UserDB {
+	return &userMemory{
+		users:      make(map[uint]*User),
+		identities: &identityMemory{},
+	}
+}
+
+var _ UserDB = &userMemory{}
+
+type userMemory struct {
+	mu     sync.Mutex
+	lastID uint
+	users  map[uint]*User
+	// identities is where CreateWithIdentity links identities.
+	identities *identityMemory
+}
+
+func (um *userMemory) ByID(ctx context.Context, id uint) (*User, error) {
+	return um.find(ctx, func(u *User) bool { return u.ID == id })
+}
+
+func (um *userMemory) ByEmail(ctx context.Context, email string) (*User, error) {
+	return um.find(ctx, func(u *User) bool { return u.Email == email })
+}
+
+func (um *userMemory) ByRemember(ctx context.Context, rememberHash string) (*User, error) {
+	return um.find(ctx, func(u *User) bool { return u.RememberHash == rememberHash })
+}
+
+func (um *userMemory) ByEmailToken(ctx context.Context, tokenHash string) (*User, error) {
+	return um.find(ctx, func(u *User) bool { return u.EmailTokenHash == tokenHash })
+}
+
+func (um *userMemory) ByEmailWithDeleted(ctx context.Context, email string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	for _, u := range um.users {
+		if u.Email == email {
+			cp := *u
+			return &cp, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (um *userMemory) All(ctx context.Context) ([]User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	users := make([]User, 0, len(um.users))
+	for _, u := range um.users {
+		if u.DeletedAt == nil {
+			users = append(users, *u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (um *userMemory) Search(ctx context.Context, query string) ([]User, error) {
+	users, err := um.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query = strings.ToLower(strings.TrimSpace(query))
+	var found []User
+	for _, u := range users {
+		if len(found) == SearchLimit {
+			break
+		}
+		if strings.Contains(strings.ToLower(u.Name), query) ||
+			strings.Contains(strings.ToLower(u.Email), query) {
+			found = append(found, u)
+		}
+	}
+	return found, nil
+}
+
+func (um *userMemory) Create(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	return um.insert(user)
+}
+
+// Update behaves like gorm's Save: a user without an ID is
+// inserted, otherwise the stored copy is replaced.
+func (um *userMemory) Update(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if user.ID == 0 {
+		return um.insert(user)
+	}
+	if err := um.checkUnique(user); err != nil {
+		return err
+	}
+	user.UpdatedAt = time.Now()
+	um.users[user.ID] = um.stored(user)
+	return nil
+}
+
+func (um *userMemory) CreateWithIdentity(ctx context.Context, user *User, identity *Identity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	im := um.identities
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if err := um.insert(user); err != nil {
+		return err
+	}
+	identity.UserID = user.ID
+	if err := im.insert(identity); err != nil {
+		delete(um.users, user.ID)
+		um.lastID--
+		user.ID = 0
+		return err
+	}
+	return nil
+}
+
+func (um *userMemory) Delete(ctx context.Context, id uint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if u, ok := um.users[id]; ok && u.DeletedAt == nil {
+		now := time.Now()
+		u.DeletedAt = &now
+	}
+	return nil
+}
+
+func (um *userMemory) insert(user *User) error {
+	if err := um.checkUnique(user); err != nil {
+		return err
+	}
+	um.lastID++
+	now := time.Now()
+	user.ID = um.lastID
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	um.users[user.ID] = um.stored(user)
+	return nil
+}
+
+// checkUnique enforces the unique indexes on email and
+// remember_hash. Like the database, soft deleted rows still count.
+func (um *userMemory) checkUnique(user *User) error {
+	for _, u := range um.users {
+		if u.ID == user.ID {
+			continue
+		}
+		if u.Email == user.Email {
+			return uniqueViolation("users.email")
+		}
+		if u.RememberHash == user.RememberHash {
+			return uniqueViolation("users.remember_hash")
+		}
+	}
+	return nil
+}
+
+// stored returns the copy of user we keep. Fields gorm doesn't
+// persist are cleared so lookups behave like the database.
+func (um *userMemory) stored(user *User) *User {
+	cp := *user
+	cp.Password = ""
+	cp.Remember = ""
+	cp.EmailToken = ""
+	return &cp
+}
+
+func (um *userMemory) find(ctx context.Context, match func(*User) bool) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	for _, u := range um.users {
+		if u.DeletedAt == nil && match(u) {
+			cp := *u
+			return &cp, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// NewGalleryMemory returns an empty in-memory GalleryDB that
+// returns ErrNotFound for missing galleries just like the gorm
+// implementation.
+func NewGalleryMemory() GalleryDB {
+	return &galleryMemory{
+		galleries: make(map[uint]*Gallery),
+	}
+}
+
+var _ GalleryDB = &galleryMemory{}
+
+type galleryMemory struct {
+	mu        sync.Mutex
+	lastID    uint
+	galleries map[uint]*Gallery
+}
+
+func (gm *galleryMemory) Create(ctx context.Context, gallery *Gallery) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	gm.insert(gallery)
+	return nil
+}
+
+func (gm *galleryMemory) insert(gallery *Gallery) {
+	gm.lastID++
+	now := time.Now()
+	gallery.ID = gm.lastID
+	gallery.CreatedAt = now
+	gallery.UpdatedAt = now
+	cp := *gallery
+	gm.galleries[gallery.ID] = &cp
+}
+
+func (gm *galleryMemory) Update(ctx context.Context, gallery *Gallery) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	if gallery.ID == 0 {
+		gm.insert(gallery)
+		return nil
+	}
+	gallery.UpdatedAt = time.Now()
+	cp := *gallery
+	gm.galleries[gallery.ID] = &cp
+	return nil
+}
+
+func (gm *galleryMemory) Delete(ctx context.Context, id uint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	if g, ok := gm.galleries[id]; ok && g.DeletedAt == nil {
+		now := time.Now()
+		g.DeletedAt = &now
+	}
+	return nil
+}
+
+func (gm *galleryMemory) ByUserID(ctx context.Context, userID uint) ([]Gallery, error) {
+	return gm.filter(ctx, func(g *Gallery) bool { return g.UserID == userID })
+}
+
+func (gm *galleryMemory) Search(ctx context.Context, query string) ([]Gallery, error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	found, err := gm.filter(ctx, func(g *Gallery) bool {
+		return strings.Contains(strings.ToLower(g.Title), query)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Search lists the newest galleries first.
+	sort.Slice(found, func(i, j int) bool { return found[i].ID > found[j].ID })
+	if len(found) > SearchLimit {
+		found = found[:SearchLimit]
+	}
+	return found, nil
+}
+
+// filter returns the live galleries matching fn ordered by ID.
+func (gm *galleryMemory) filter(ctx context.Context, fn func(*Gallery) bool) ([]Gallery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	var found []Gallery
+	for _, g := range gm.galleries {
+		if g.DeletedAt == nil && fn(g) {
+			found = append(found, *g)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].ID < found[j].ID })
+	return found, nil
+}
+
+func (gm *galleryMemory) ByProofToken(ctx context.Context, token string) (*Gallery, error) {
+	found, err := gm.filter(ctx, func(g *Gallery) bool {
+		return g.Proofing && token != "" && g.ProofToken == token
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, ErrNotFound
+	}
+	return &found[0], nil
+}
+
+func (gm *galleryMemory) ByID(ctx context.Context, id uint) (*Gallery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+	g, ok := gm.galleries[id]
+	if !ok || g.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+	cp := *g
+	return &cp, nil
+}
+
+// NewAuditMemory returns an empty in-memory AuditDB.
+func NewAuditMemory() AuditDB {
+	return &auditMemory{}
+}
+
+var _ AuditDB = &auditMemory{}
+
+type auditMemory struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (am *auditMemory) Record(ctx context.Context, event *AuditEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	event.ID = uint(len(am.events) + 1)
+	event.CreatedAt = time.Now()
+	am.events = append(am.events, *event)
+	return nil
+}
+
+func (am *auditMemory) ByUserID(ctx context.Context, userID uint) ([]AuditEvent, error) {
+	return am.Search(ctx, AuditFilter{UserID: userID})
+}
+
+func (am *auditMemory) Search(ctx context.Context, filter AuditFilter) ([]AuditEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	var found []AuditEvent
+	for i := len(am.events) - 1; i >= 0 && len(found) < SearchLimit; i-- {
+		e := am.events[i]
+		if filter.UserID != 0 && e.UserID != filter.UserID &&
+			e.ActorID != filter.UserID {
+			continue
+		}
+		if filter.Action != "" && e.Action != filter.Action {
+			continue
+		}
+		found = append(found, e)
+	}
+	return found, nil
+}
+
+var _ IdentityDB = &identityMemory{}
+
+// identityMemory is the in-memory IdentityDB that NewUserMemory
+// gives each userMemory.
+type identityMemory struct {
+	mu         sync.Mutex
+	identities []Identity
+}
+
+func (im *identityMemory) ByProviderSubject(ctx context.Context, provider, subject string) (*Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	for _, i := range im.identities {
+		if i.Provider == provider && i.Subject == subject {
+			return &i, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (im *identityMemory) ByUserID(ctx context.Context, userID uint) ([]Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	var found []Identity
+	for _, i := range im.identities {
+		if i.UserID == userID {
+			found = append(found, i)
+		}
+	}
+	return found, nil
+}
+
+func (im *identityMemory) Create(ctx context.Context, identity *Identity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	return im.insert(identity)
+}
+
+func (im *identityMemory) insert(identity *Identity) error {
+	for _, i := range im.identities {
+		if i.Provider == identity.Provider && i.Subject == identity.Subject {
+			return uniqueViolation("identities.provider, identities.subject")
+		}
+	}
+	identity.ID = uint(len(im.identities) + 1)
+	identity.CreatedAt = time.Now()
+	im.identities = append(im.identities, *identity)
+	return nil
+}
+
+// NewLoginTokenMemory returns an empty in-memory LoginTokenDB.
+func NewLoginTokenMemory() LoginTokenDB {
+	return &loginTokenMemory{
+		tokens: make(map[string]LoginToken),
+	}
+}
+
+var _ LoginTokenDB = &loginTokenMemory{}
+
+type loginTokenMemory struct {
+	mu     sync.Mutex
+	lastID uint
+	tokens map[string]LoginToken
+}
+
+func (ltm *loginTokenMemory) Create(ctx context.Context, token *LoginToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ltm.mu.Lock()
+	defer ltm.mu.Unlock()
+	for hash, t := range ltm.tokens {
+		if t.UserID == token.UserID {
+			delete(ltm.tokens, hash)
+		}
+	}
+	ltm.lastID++
+	token.ID = ltm.lastID
+	token.CreatedAt = time.Now()
+	ltm.tokens[token.TokenHash] = *token
+	return nil
+}
+
+func (ltm *loginTokenMemory) Consume(ctx context.Context, tokenHash string) (*LoginToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ltm.mu.Lock()
+	defer ltm.mu.Unlock()
+	token, ok := ltm.tokens[tokenHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(ltm.tokens, tokenHash)
+	if time.Now().After(token.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	return &token, nil
+}
+
+// NewPhotoMemory returns an empty in-memory PhotoDB.
+func NewPhotoMemory() PhotoDB {
+	return &photoMemory{
+		photos: make(map[uint]Photo),
+		metas:  make(map[uint]PhotoMetadata),
+	}
+}
+
+var _ PhotoDB = &photoMemory{}
+
+type photoMemory struct {
+	mu     sync.Mutex
+	lastID uint
+	photos map[uint]Photo
+	// metas is keyed by photo ID.
+	metas      map[uint]PhotoMetadata
+	lastMetaID uint
+}
+
+func (pm *photoMemory) ByID(ctx context.Context, id uint) (*Photo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	photo, ok := pm.photos[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &photo, nil
+}
+
+func (pm *photoMemory) ByFilename(ctx context.Context, galleryID uint, filename string) (*Photo, error) {
+	photos, err := pm.ByGalleryID(ctx, galleryID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range photos {
+		if p.Filename == filename {
+			return &p, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (pm *photoMemory) ByGalleryID(ctx context.Context, galleryID uint) ([]Photo, error) {
+	return pm.ByGalleryIDs(ctx, []uint{galleryID})
+}
+
+func (pm *photoMemory) ByGalleryIDs(ctx context.Context, galleryIDs []uint) ([]Photo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	in := make(map[uint]bool, len(galleryIDs))
+	for _, id := range galleryIDs {
+		in[id] = true
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	photos := []Photo{}
+	for _, p := range pm.photos {
+		if in[p.GalleryID] {
+			photos = append(photos, p)
+		}
+	}
+	sort.Slice(photos, func(i, j int) bool {
+		a, b := photos[i], photos[j]
+		if a.GalleryID != b.GalleryID {
+			return a.GalleryID < b.GalleryID
+		}
+		if a.Position != b.Position {
+			return a.Position < b.Position
+		}
+		return a.ID < b.ID
+	})
+	return photos, nil
+}
+
+func (pm *photoMemory) Create(ctx context.Context, photo *Photo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	photo.Position = 1
+	for _, p := range pm.photos {
+		if p.GalleryID == photo.GalleryID && p.Position >= photo.Position {
+			photo.Position = p.Position + 1
+		}
+	}
+	pm.lastID++
+	photo.ID = pm.lastID
+	photo.CreatedAt = time.Now()
+	pm.photos[photo.ID] = *photo
+	return nil
+}
+
+func (pm *photoMemory) Delete(ctx context.Context, id uint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if id == 0 {
+		return ErrIDInvalid
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	delete(pm.photos, id)
+	delete(pm.metas, id)
+	return nil
+}
+
+func (pm *photoMemory) Reorder(ctx context.Context, galleryID uint, photoIDs []uint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	var current []Photo
+	for _, p := range pm.photos {
+		if p.GalleryID == galleryID {
+			current = append(current, p)
+		}
+	}
+	if !sameIDs(current, photoIDs) {
+		return ErrPhotoOrderInvalid
+	}
+	for i, id := range photoIDs {
+		p := pm.photos[id]
+		p.Position = i + 1
+		pm.photos[id] = p
+	}
+	return nil
+}
+
+func (pm *photoMemory) Metadata(ctx context.Context, photoID uint) (*PhotoMetadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	meta, ok := pm.metas[photoID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &meta, nil
+}
+
+func (pm *photoMemory) MetadataByGalleryID(ctx context.Context, galleryID uint) (map[uint]PhotoMetadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	byPhoto := make(map[uint]PhotoMetadata)
+	for id, m := range pm.metas {
+		if pm.photos[id].GalleryID == galleryID {
+			byPhoto[id] = m
+		}
+	}
+	return byPhoto, nil
+}
+
+func (pm *photoMemory) CreateMetadata(ctx context.Context, meta *PhotoMetadata) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.lastMetaID++
+	meta.ID = pm.lastMetaID
+	pm.metas[meta.PhotoID] = *meta
+	return nil
+}
+
+func (pm *photoMemory) UsageByGalleryIDs(ctx context.Context, galleryIDs []uint) (map[uint]Usage, error) {
+	photos, err := pm.ByGalleryIDs(ctx, galleryIDs)
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[uint]Usage)
+	for _, p := range photos {
+		u := usage[p.GalleryID]
+		u.add(Usage{Photos: 1, Bytes: p.Size})
+		usage[p.GalleryID] = u
+	}
+	return usage, nil
+}
+
+// NewUploadMemory returns an empty in-memory UploadDB.
+func NewUploadMemory() UploadDB {
+	return &uploadMemory{
+		uploads: make(map[string]PendingUpload),
+	}
+}
+
+var _ UploadDB = &uploadMemory{}
+
+type uploadMemory struct {
+	mu      sync.Mutex
+	uploads map[string]PendingUpload
+}
+
+func (um *uploadMemory) ByID(ctx context.Context, id string) (*PendingUpload, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	upload, ok := um.uploads[id]
+	if !ok || !upload.ExpiresAt.After(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return &upload, nil
+}
+
+func (um *uploadMemory) ByUserID(ctx context.Context, userID uint) ([]PendingUpload, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	now := time.Now()
+	var uploads []PendingUpload
+	for _, u := range um.uploads {
+		if u.UserID == userID && u.ExpiresAt.After(now) {
+			uploads = append(uploads, u)
+		}
+	}
+	return uploads, nil
+}
+
+func (um *uploadMemory) Expired(ctx context.Context, now time.Time) ([]PendingUpload, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	var uploads []PendingUpload
+	for _, u := range um.uploads {
+		if !u.ExpiresAt.After(now) {
+			uploads = append(uploads, u)
+		}
+	}
+	return uploads, nil
+}
+
+func (um *uploadMemory) Create(ctx context.Context, upload *PendingUpload) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	upload.CreatedAt = time.Now()
+	um.uploads[upload.ID] = *upload
+	return nil
+}
+
+func (um *uploadMemory) Update(ctx context.Context, upload *PendingUpload) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if _, ok := um.uploads[upload.ID]; !ok {
+		return ErrNotFound
+	}
+	um.uploads[upload.ID] = *upload
+	return nil
+}
+
+func (um *uploadMemory) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	delete(um.uploads, id)
+	return nil
+}
+
+// NewProofMemory returns an empty in-memory ProofDB.
+func NewProofMemory() ProofDB {
+	return &proofMemory{
+		proofs: make(map[uint]*Proof),
+	}
+}
+
+var _ ProofDB = &proofMemory{}
+
+type proofMemory struct {
+	mu         sync.Mutex
+	lastID     uint
+	lastPickID uint
+	proofs     map[uint]*Proof
+}
+
+func (pm *proofMemory) ByTokenHash(ctx context.Context, galleryID uint, tokenHash string) (*Proof, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for _, p := range pm.proofs {
+		if p.GalleryID == galleryID && p.TokenHash == tokenHash {
+			return pm.copy(p), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (pm *proofMemory) ByGalleryID(ctx context.Context, galleryID uint) ([]Proof, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	var proofs []Proof
+	for _, p := range pm.proofs {
+		if p.GalleryID == galleryID {
+			proofs = append(proofs, *pm.copy(p))
+		}
+	}
+	sort.Slice(proofs, func(i, j int) bool { return proofs[i].ID < proofs[j].ID })
+	sortProofs(proofs)
+	return proofs, nil
+}
+
+func (pm *proofMemory) Create(ctx context.Context, proof *Proof) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	for _, p := range pm.proofs {
+		if p.TokenHash == proof.TokenHash {
+			return uniqueViolation("proofs.token_hash")
+		}
+	}
+	pm.lastID++
+	now := time.Now()
+	proof.ID = pm.lastID
+	proof.CreatedAt = now
+	proof.UpdatedAt = now
+	pm.proofs[proof.ID] = pm.copy(proof)
+	return nil
+}
+
+func (pm *proofMemory) Update(ctx context.Context, proof *Proof) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	stored, ok := pm.proofs[proof.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	proof.UpdatedAt = time.Now()
+	cp := *proof
+	// Picks are saved on their own with SavePick.
+	cp.Picks = stored.Picks
+	pm.proofs[proof.ID] = &cp
+	return nil
+}
+
+func (pm *proofMemory) SavePick(ctx context.Context, pick *ProofPick) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	p, ok := pm.proofs[pick.ProofID]
+	if !ok {
+		return ErrNotFound
+	}
+	picks := p.Picks[:0:0]
+	for _, pp := range p.Picks {
+		if pp.PhotoID != pick.PhotoID {
+			picks = append(picks, pp)
+		} else if pick.ID == 0 {
+			pick.ID = pp.ID
+		}
+	}
+	if !pick.empty() {
+		if pick.ID == 0 {
+			pm.lastPickID++
+			pick.ID = pm.lastPickID
+		}
+		pick.UpdatedAt = time.Now()
+		picks = append(picks, *pick)
+		sort.Slice(picks, func(i, j int) bool { return picks[i].ID < picks[j].ID })
+	}
+	p.Picks = picks
+	return nil
+}
+
+// copy returns a copy of p that doesn't share its picks.
+func (pm *proofMemory) copy(p *Proof) *Proof {
+	cp := *p
+	cp.Picks = append([]ProofPick(nil), p.Picks...)
+	return &cp
+}
+
+// NewCommentMemory returns an empty in-memory CommentDB.
+func NewCommentMemory() CommentDB {
+	return &commentMemory{
+		comments: make(map[uint]Comment),
+	}
+}
+
+var _ CommentDB = &commentMemory{}
+
+type commentMemory struct {
+	mu       sync.Mutex
+	lastID   uint
+	comments map[uint]Comment
+}
+
+func (cm *commentMemory) ByID(ctx context.Context, id uint) (*Comment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	c, ok := cm.comments[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &c, nil
+}
+
+func (cm *commentMemory) ByGalleryID(ctx context.Context, galleryID, photoID uint) ([]Comment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	var found []Comment
+	for _, c := range cm.comments {
+		if c.GalleryID == galleryID && c.PhotoID == photoID {
+			found = append(found, c)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].ID < found[j].ID })
+	return found, nil
+}
+
+func (cm *commentMemory) Create(ctx context.Context, comment *Comment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.lastID++
+	now := time.Now()
+	comment.ID = cm.lastID
+	comment.CreatedAt = now
+	comment.UpdatedAt = now
+	cm.comments[comment.ID] = *comment
+	return nil
+}
+
+func (cm *commentMemory) Update(ctx context.Context, comment *Comment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if _, ok := cm.comments[comment.ID]; !ok {
+		return ErrNotFound
+	}
+	comment.UpdatedAt = time.Now()
+	cm.comments[comment.ID] = *comment
+	return nil
+}
+
+func (cm *commentMemory) Delete(ctx context.Context, id uint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	doomed := map[uint]bool{id: true}
+	// Replies always have higher IDs than what they reply to, so
+	// one pass in ID order finds them all.
+	ids := make([]uint, 0, len(cm.comments))
+	for cid := range cm.comments {
+		ids = append(ids, cid)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, cid := range ids {
+		if doomed[cm.comments[cid].ParentID] {
+			doomed[cid] = true
+		}
+	}
+	for cid := range doomed {
+		delete(cm.comments, cid)
+	}
+	return nil
+}
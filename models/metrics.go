@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"lenslocked.com/metrics"
+)
+
+const metricsStartKey = "metrics:start"
+
+// registerMetricsCallbacks hooks into gorm's callback chains so
+// that the duration of every create, query, update, delete and
+// raw row query is recorded in metrics.DBQueryDuration.
+func registerMetricsCallbacks(db *gorm.DB) {
+	cb := db.Callback()
+	cb.Create().Before("gorm:create").Register("metrics:before_create", startTimer)
+	cb.Create().After("gorm:create").Register("metrics:after_create", observer("create"))
+	cb.Query().Before("gorm:query").Register("metrics:before_query", startTimer)
+	cb.Query().After("gorm:query").Register("metrics:after_query", observer("query"))
+	cb.Update().Before("gorm:update").Register("metrics:before_update", startTimer)
+	cb.Update().After("gorm:update").Register("metrics:after_update", observer("update"))
+	cb.Delete().Before("gorm:delete").Register("metrics:before_delete", startTimer)
+	cb.Delete().After("gorm:delete").Register("metrics:after_delete", observer("delete"))
+	cb.RowQuery().Before("gorm:row_query").Register("metrics:before_row_query", startTimer)
+	cb.RowQuery().After("gorm:row_query").Register("metrics:after_row_query", observer("row_query"))
+}
+
+func startTimer(scope *gorm.Scope) {
+	scope.InstanceSet(metricsStartKey, time.Now())
+}
+
+func observer(operation string) func(*gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		v, ok := scope.InstanceGet(metricsStartKey)
+		if !ok {
+			return
+		}
+		start, ok := v.(time.Time)
+		if !ok {
+			return
+		}
+		metrics.DBQueryDuration.WithLabelValues(operation, scope.TableName()).
+			Observe(time.Since(start).Seconds())
+	}
+}
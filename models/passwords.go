@@ -0,0 +1,87 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+
+	"lenslocked.com/password"
+)
+
+const (
+	// ErrPasswordCommon is returned when a password is on the
+	// bundled list of commonly used passwords.
+	ErrPasswordCommon modelError = "models: that password is too common. " +
+		"Please choose another one"
+
+	// ErrPasswordPersonal is returned when a password is the
+	// user's own email address or name.
+	ErrPasswordPersonal modelError = "models: password must not be your " +
+		"email address or name"
+
+	// ErrPasswordWeak is returned when a password is estimated to
+	// be too easy to guess.
+	ErrPasswordWeak modelError = "models: password is too easy to guess. " +
+		"Try a longer phrase of a few unrelated words"
+)
+
+// PasswordPolicy is the set of rules new passwords must pass.
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters.
+	MinLength int
+	// MinScore is the lowest strength estimate accepted, from
+	// password.VeryWeak to password.VeryStrong.
+	MinScore password.Score
+}
+
+// DefaultPasswordPolicy is used unless WithPasswordPolicy says
+// otherwise.
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength: 8,
+	MinScore:  password.Fair,
+}
+
+// errPasswordTooShort is returned when a password is shorter than
+// the policy's MinLength.
+func errPasswordTooShort(min int) modelError {
+	return modelError(fmt.Sprintf(
+		"models: password must be at least %d characters long", min))
+}
+
+// Check estimates the strength of user.Password, taking the user's
+// name and email address into account, and returns the estimate
+// along with the first rule the password breaks, if any.
+func (p PasswordPolicy) Check(user *User) (password.Estimate, error) {
+	pw := user.Password
+	est := password.Check(pw, user.Name, user.Email)
+	if len([]rune(pw)) < p.MinLength {
+		return est, errPasswordTooShort(p.MinLength)
+	}
+	if password.Common(pw) {
+		return est, ErrPasswordCommon
+	}
+	if personal(pw, user) {
+		return est, ErrPasswordPersonal
+	}
+	if est.Score < p.MinScore {
+		return est, ErrPasswordWeak
+	}
+	return est, nil
+}
+
+// personal reports whether pw is, ignoring case and spaces, the
+// user's email address, the part of it before the @, or their
+// name.
+func personal(pw string, user *User) bool {
+	squash := func(s string) string {
+		return strings.ToLower(strings.Join(strings.Fields(s), ""))
+	}
+	pw = squash(pw)
+	email := squash(user.Email)
+	local, _, _ := strings.Cut(email, "@")
+	for _, s := range []string{email, local, squash(user.Name)} {
+		if s != "" && pw == s {
+			return true
+		}
+	}
+	return false
+}
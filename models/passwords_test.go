@@ -0,0 +1,59 @@
+package models
+
+import (
+	"testing"
+
+	"lenslocked.com/password"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 10, MinScore: password.Fair}
+	tests := []struct {
+		name    string
+		user    User
+		wantErr error
+	}{
+		{
+			name: "strong",
+			user: User{Password: "darkroom silver print"},
+		},
+		{
+			name:    "too short",
+			user:    User{Password: "k8#Qv!2m"},
+			wantErr: errPasswordTooShort(10),
+		},
+		{
+			name:    "common",
+			user:    User{Password: "1234567890"},
+			wantErr: ErrPasswordCommon,
+		},
+		{
+			name:    "common with substitutions",
+			user:    User{Password: "B@sketb@ll"},
+			wantErr: ErrPasswordCommon,
+		},
+		{
+			name:    "email address",
+			user:    User{Email: "photographer@example.com", Password: "Photographer@Example.com"},
+			wantErr: ErrPasswordPersonal,
+		},
+		{
+			name:    "name with spaces",
+			user:    User{Name: "Ansel Adams Jr", Password: "anseladamsjr"},
+			wantErr: ErrPasswordPersonal,
+		},
+		{
+			name:    "weak",
+			user:    User{Password: "aaaaaaaaaaaa"},
+			wantErr: ErrPasswordWeak,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := policy.Check(&tc.user)
+			if err != tc.wantErr {
+				t.Errorf("got %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
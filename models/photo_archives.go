@@ -0,0 +1,186 @@
+package models
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// ErrZipInvalid is returned when an archive can't be read.
+	ErrZipInvalid modelError = "models: the file isn't a valid ZIP archive"
+
+	// ErrZipUnsafe is returned when an archive has entries whose
+	// names would point outside of it, such as "../photo.jpg".
+	ErrZipUnsafe modelError = "models: the ZIP archive contains unsafe file names"
+)
+
+const (
+	// MaxZipEntries is the most files an archive may hold.
+	MaxZipEntries = 2000
+	// MaxZipPhotoBytes is the largest a single photo in an archive
+	// may be once uncompressed.
+	MaxZipPhotoBytes = 64 << 20
+	// MaxZipTotalBytes caps the uncompressed size of an archive, so
+	// that a small upload can't expand into a huge one.
+	MaxZipTotalBytes = 4 << 30
+)
+
+// errZipTooLarge explains which of the archive limits was broken.
+func errZipTooLarge(reason string) modelError {
+	return modelError("models: the ZIP archive is too large: " + reason)
+}
+
+// ZipImport is the outcome of PhotoService.ImportZip.
+type ZipImport struct {
+	// Photos are the photos added to the gallery.
+	Photos []Photo
+	// Skipped lists the archive entries that weren't images, or were
+	// larger than MaxPhotoPixels.
+	Skipped []string
+}
+
+func (ps *photoService) ImportZip(ctx context.Context, gallery *Gallery, r io.ReaderAt, size int64) (*ZipImport, error) {
+	zr, err := zip.NewReader(r, size)
+	if errors.Is(err, zip.ErrInsecurePath) {
+		return nil, ErrZipUnsafe
+	}
+	if err != nil {
+		return nil, ErrZipInvalid
+	}
+
+	// Everything is checked before anything is imported, so a bad
+	// archive leaves the gallery as it was.
+	var files []*zip.File
+	var total uint64
+	for _, f := range zr.File {
+		name, ok := zipEntryName(f.Name)
+		if !ok {
+			return nil, ErrZipUnsafe
+		}
+		if f.FileInfo().IsDir() || zipJunk(name) {
+			continue
+		}
+		if f.UncompressedSize64 > MaxZipPhotoBytes {
+			return nil, errZipTooLarge(fmt.Sprintf("%s is over %d MB",
+				path.Base(name), MaxZipPhotoBytes>>20))
+		}
+		total += f.UncompressedSize64
+		files = append(files, f)
+	}
+	if len(files) > MaxZipEntries {
+		return nil, errZipTooLarge(fmt.Sprintf("it has more than %d files",
+			MaxZipEntries))
+	}
+	if total > MaxZipTotalBytes {
+		return nil, errZipTooLarge(fmt.Sprintf("it expands to more than %d GB",
+			MaxZipTotalBytes>>30))
+	}
+	// Entries that turn out not to be photos are skipped, so only
+	// the bytes can be checked against the quota up front.
+	if err := ps.CheckQuota(ctx, gallery, 0, int64(total)); err != nil {
+		return nil, err
+	}
+
+	imp := &ZipImport{}
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return imp, err
+		}
+		name, _ := zipEntryName(f.Name)
+		rc, err := f.Open()
+		if err != nil {
+			return imp, ErrZipInvalid
+		}
+		// archive/zip fails the read if an entry holds more than
+		// its header claims, so the size checks above hold.
+		photo, err := ps.Upload(ctx, gallery, path.Base(name), rc)
+		rc.Close()
+		switch {
+		case err == ErrPhotoType, err == ErrPhotoPixels:
+			imp.Skipped = append(imp.Skipped, name)
+		case errors.Is(err, zip.ErrFormat), errors.Is(err, zip.ErrChecksum),
+			errors.Is(err, zip.ErrAlgorithm):
+			return imp, ErrZipInvalid
+		case err != nil:
+			return imp, err
+		default:
+			imp.Photos = append(imp.Photos, *photo)
+		}
+	}
+	return imp, nil
+}
+
+// zipEntryName returns the name of an archive entry with forward
+// slashes, and whether it stays inside the archive.
+func zipEntryName(name string) (string, bool) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	return name, filepath.IsLocal(filepath.FromSlash(name)) && !strings.Contains(name, ":")
+}
+
+// zipJunk reports whether an archive entry is one of the files
+// operating systems add on their own, such as macOS resource forks.
+func zipJunk(name string) bool {
+	return strings.HasPrefix(name, "__MACOSX/") ||
+		strings.HasPrefix(path.Base(name), ".") ||
+		strings.EqualFold(path.Base(name), "Thumbs.db")
+}
+
+func (ps *photoService) WriteZip(ctx context.Context, gallery *Gallery, w io.Writer, originals bool) error {
+	photos, err := ps.ByGalleryID(ctx, gallery.ID)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(w)
+	for i := range photos {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := ps.writeZipPhoto(zw, gallery, &photos[i], i+1, originals); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeZipPhoto adds photo to zw. Entries are numbered so that they
+// sort in gallery order and photos uploaded under the same name
+// don't collide.
+func (ps *photoService) writeZipPhoto(zw *zip.Writer, gallery *Gallery, photo *Photo, n int, original bool) error {
+	var f io.ReadSeekCloser
+	var err error
+	served := photo.Filename
+	if original {
+		f, err = ps.Open(gallery, photo)
+	} else {
+		f, served, err = ps.OpenWatermarked(gallery, photo)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	name := photo.Name
+	if name == "" {
+		name = photo.Filename
+	}
+	// Watermarked GIFs and WebPs come out as JPEGs.
+	if ext := path.Ext(served); ext != path.Ext(photo.Filename) {
+		name = strings.TrimSuffix(name, path.Ext(name)) + ext
+	}
+	hw, err := zw.CreateHeader(&zip.FileHeader{
+		Name: fmt.Sprintf("%03d-%s", n, name),
+		// Images are already compressed.
+		Method:   zip.Store,
+		Modified: photo.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(hw, f)
+	return err
+}
@@ -0,0 +1,150 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"image/png"
+	"testing"
+)
+
+// newTestPhotoService returns a PhotoService that keeps photos in
+// memory and their files in a temporary directory, and a gallery
+// owned by a user with the given quota.
+func newTestPhotoService(t *testing.T, quota Quota) (PhotoService, *Gallery) {
+	t.Helper()
+	ctx := context.Background()
+	users := NewUserMemory()
+	user := &User{Email: "al@example.com", RememberHash: "al"}
+	if err := users.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	galleries := NewGalleryMemory()
+	gallery := &Gallery{UserID: user.ID, Title: "Holiday"}
+	if err := galleries.Create(ctx, gallery); err != nil {
+		t.Fatal(err)
+	}
+	ps := NewMemoryPhotoService(galleries, users, t.TempDir(), quota,
+		ResizeConfig{Key: "test"})
+	return ps, gallery
+}
+
+func testZip(t *testing.T, files map[string][]byte) *bytes.Reader {
+	t.Helper()
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(b.Bytes())
+}
+
+func testPNGBytes(t *testing.T) []byte {
+	var b bytes.Buffer
+	if err := png.Encode(&b, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestZipEntryName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"photo.jpg", "photo.jpg", true},
+		{"holiday/day 1/photo.jpg", "holiday/day 1/photo.jpg", true},
+		{`holiday\photo.jpg`, "holiday/photo.jpg", true},
+		{"../photo.jpg", "", false},
+		{"holiday/../../photo.jpg", "", false},
+		{`..\photo.jpg`, "", false},
+		{"/etc/passwd", "", false},
+		{`C:\photo.jpg`, "", false},
+		{"C:photo.jpg", "", false},
+		{"", "", false},
+	}
+	for _, tc := range tests {
+		got, ok := zipEntryName(tc.name)
+		if ok != tc.ok || ok && got != tc.want {
+			t.Errorf("zipEntryName(%q) = %q, %v, want %q, %v",
+				tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestImportZip(t *testing.T) {
+	ctx := context.Background()
+	ps, gallery := newTestPhotoService(t, Quota{})
+	img := testPNGBytes(t)
+	zr := testZip(t, map[string][]byte{
+		"holiday/beach.png":            img,
+		"holiday/notes.txt":            []byte("not a photo"),
+		"__MACOSX/holiday/._beach.png": []byte("resource fork"),
+		"holiday/.DS_Store":            []byte("junk"),
+	})
+	imp, err := ps.ImportZip(ctx, gallery, zr, zr.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imp.Photos) != 1 || imp.Photos[0].Name != "beach.png" {
+		t.Errorf("imported %+v, want beach.png", imp.Photos)
+	}
+	if len(imp.Skipped) != 1 || imp.Skipped[0] != "holiday/notes.txt" {
+		t.Errorf("skipped %v, want holiday/notes.txt", imp.Skipped)
+	}
+}
+
+func TestImportZipUnsafe(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"../escape.png", `..\escape.png`, "/abs.png"} {
+		ps, gallery := newTestPhotoService(t, Quota{})
+		zr := testZip(t, map[string][]byte{
+			"first.png": testPNGBytes(t),
+			name:        testPNGBytes(t),
+		})
+		_, err := ps.ImportZip(ctx, gallery, zr, zr.Size())
+		if err != ErrZipUnsafe {
+			t.Errorf("%s: got %v, want ErrZipUnsafe", name, err)
+		}
+		// Nothing is imported from an unsafe archive, not even the
+		// safe entries.
+		photos, err := ps.ByGalleryID(ctx, gallery.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(photos) != 0 {
+			t.Errorf("%s: imported %d photos from an unsafe archive", name, len(photos))
+		}
+	}
+}
+
+func TestImportZipQuota(t *testing.T) {
+	ctx := context.Background()
+	img := testPNGBytes(t)
+	ps, gallery := newTestPhotoService(t, Quota{Bytes: int64(len(img))})
+	zr := testZip(t, map[string][]byte{"a.png": img, "b.png": img})
+	_, err := ps.ImportZip(ctx, gallery, zr, zr.Size())
+	if _, ok := err.(modelError); !ok {
+		t.Fatalf("got %v, want a quota error", err)
+	}
+	photos, _ := ps.ByGalleryID(ctx, gallery.ID)
+	if len(photos) != 0 {
+		t.Errorf("imported %d photos over quota", len(photos))
+	}
+}
+
+func TestImportZipInvalid(t *testing.T) {
+	ps, gallery := newTestPhotoService(t, Quota{})
+	r := bytes.NewReader([]byte("this is not a zip file"))
+	if _, err := ps.ImportZip(context.Background(), gallery, r, r.Size()); err != ErrZipInvalid {
+		t.Errorf("got %v, want ErrZipInvalid", err)
+	}
+}
@@ -0,0 +1,665 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"lenslocked.com/rand"
+)
+
+const (
+	// ErrPhotoType is returned when an upload isn't a JPEG, PNG,
+	// GIF or WebP image.
+	ErrPhotoType modelError = "models: only JPEG, PNG, GIF and WebP images can be uploaded"
+
+	// ErrPhotoPixels is returned when an upload is larger than
+	// MaxPhotoPixels.
+	ErrPhotoPixels modelError = "models: photos can be at most 100 megapixels"
+
+	// ErrPhotoOrderInvalid is returned when a new ordering doesn't
+	// list every photo in the gallery exactly once.
+	ErrPhotoOrderInvalid modelError = "models: the photo order is out of date. " +
+		"Reload the page and try again"
+)
+
+// photoExts maps the image types we accept to the extension the
+// stored file gets.
+var photoExts = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// Photo is an image in a gallery. Photos are shown in ascending
+// Position order. The file lives in GalleryDir under Filename,
+// which is generated on upload; Name is what the file was called
+// on the uploader's computer.
+type Photo struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	GalleryID uint   `gorm:"not null;index"`
+	Filename  string `gorm:"not null"`
+	Name      string
+	Position  int `gorm:"not null;default:0"`
+	// Size is the size of the file in bytes.
+	Size int64 `gorm:"not null;default:0"`
+	// ContentHash is the hex SHA-256 of the file. DHash is a
+	// perceptual hash of the image, which is nil for images that
+	// couldn't be decoded. Both are used to spot duplicates.
+	ContentHash string `gorm:"size:64;index"`
+	DHash       *int64
+}
+
+// FileSize is Size written for people, such as "2.4 MB".
+func (p *Photo) FileSize() string {
+	return formatBytes(p.Size)
+}
+
+// Path is the URL the photo is served at.
+func (p *Photo) Path() string {
+	return "/images/galleries/" + strconv.FormatUint(uint64(p.GalleryID), 10) +
+		"/" + url.PathEscape(p.Filename)
+}
+
+// PhotoService manages the photos in galleries along with their
+// files.
+type PhotoService interface {
+	PhotoDB
+
+	// Upload stores the image read from r as a new photo at the end
+	// of gallery. name is the uploaded file's original name.
+	Upload(ctx context.Context, gallery *Gallery, name string, r io.Reader) (*Photo, error)
+
+	// Open opens the file behind photo, which is in gallery, the
+	// way it is served to visitors. The GPS tags of JPEGs are left
+	// out if the gallery has StripGPS set.
+	Open(gallery *Gallery, photo *Photo) (io.ReadSeekCloser, error)
+
+	// Remove deletes photo and its file, and clears it as the
+	// gallery's cover if it was one.
+	Remove(ctx context.Context, gallery *Gallery, photo *Photo) error
+
+	// RemoveAll deletes every photo in the gallery along with the
+	// files, for when the gallery itself is deleted. Deleted
+	// galleries don't count towards the quota, so their photos
+	// can't be left behind.
+	RemoveAll(ctx context.Context, gallery *Gallery) error
+
+	// SetCover makes the photo with the given ID the cover of
+	// gallery. It returns ErrNotFound if the photo isn't in the
+	// gallery.
+	SetCover(ctx context.Context, gallery *Gallery, photoID uint) error
+
+	// Covers returns the cover photo of each gallery that has
+	// photos, keyed by gallery ID. A gallery without a chosen cover
+	// uses its first photo.
+	Covers(ctx context.Context, galleries []Gallery) (map[uint]Photo, error)
+
+	// ImportZip adds the images in the ZIP archive read from r,
+	// which is size bytes long, to the end of gallery. Archives
+	// with unsafe names or that break the MaxZip* limits are
+	// rejected before anything is added. Entries that aren't images
+	// are skipped and listed in the result.
+	ImportZip(ctx context.Context, gallery *Gallery, r io.ReaderAt, size int64) (*ZipImport, error)
+
+	// WriteZip streams a ZIP archive of the gallery's photos, in
+	// order, to w. The files are the ones Open returns if originals
+	// is set and the ones OpenWatermarked returns if not.
+	WriteZip(ctx context.Context, gallery *Gallery, w io.Writer, originals bool) error
+
+	// OpenWatermarked opens photo, which is in gallery, the way it
+	// is shown to anyone but the owner: with the gallery's
+	// watermark drawn on. Rendered photos are cached on disk. The
+	// name returned has the extension of what is in the file, since
+	// drawing on a photo can change its format. Without a watermark
+	// it opens the same file as Open.
+	OpenWatermarked(gallery *Gallery, photo *Photo) (io.ReadSeekCloser, string, error)
+
+	// SetWatermarkImage stores the PNG read from r as the gallery's
+	// watermark, replacing any before it. RemoveWatermarkImage goes
+	// back to the watermark text.
+	SetWatermarkImage(ctx context.Context, gallery *Gallery, r io.Reader) error
+	RemoveWatermarkImage(ctx context.Context, gallery *Gallery) error
+
+	// ResizedPath returns the signed URL path of photo resized as
+	// rs says. VerifyResize returns ErrResizeSignature if sig isn't
+	// the signature ResizedPath gave the photo stored as filename
+	// in the gallery with the given ID.
+	ResizedPath(photo *Photo, rs Resize) string
+	VerifyResize(galleryID uint, filename string, rs Resize, sig string) error
+
+	// OpenResized opens photo, which is in gallery, resized as rs
+	// says, with the gallery's watermark drawn on if watermark is
+	// set. Resized photos are cached on disk. Like OpenWatermarked
+	// it returns the name of what is in the file.
+	OpenResized(gallery *Gallery, photo *Photo, rs Resize, watermark bool) (io.ReadSeekCloser, string, error)
+
+	// Usage returns what the user stores, in total and per gallery,
+	// along with the quota that applies to them.
+	Usage(ctx context.Context, user *User) (*StorageUsage, error)
+
+	// CheckQuota returns ErrQuotaExceeded or ErrPhotoQuotaExceeded
+	// if adding photos more photos to gallery, which take up bytes
+	// between them, would break its owner's quota. Create checks
+	// every photo anyway; this lets uploads fail before the bytes
+	// are sent.
+	CheckQuota(ctx context.Context, gallery *Gallery, photos int, bytes int64) error
+
+	// Matches looks for duplicates of photos, which are in gallery,
+	// among the gallery owner's photos. The matches are keyed by
+	// the ID of the photo they duplicate; the ones in gallery come
+	// first, then the closest. Photos without any are left out.
+	Matches(ctx context.Context, gallery *Gallery, photos []Photo) (map[uint][]PhotoMatch, error)
+
+	// Duplicates groups the photos of the user that are exact or
+	// near copies of one another, oldest group first.
+	Duplicates(ctx context.Context, userID uint) ([]DuplicateGroup, error)
+
+	// SortByTakenAt orders the gallery's photos by when they were
+	// taken, oldest first. Photos without a capture time keep their
+	// order after the rest.
+	SortByTakenAt(ctx context.Context, galleryID uint) error
+}
+
+// PhotoDB stores photos.
+type PhotoDB interface {
+	ByID(ctx context.Context, id uint) (*Photo, error)
+
+	// ByFilename returns the photo stored under filename in the
+	// gallery, or ErrNotFound.
+	ByFilename(ctx context.Context, galleryID uint, filename string) (*Photo, error)
+
+	// ByGalleryID returns the gallery's photos in order.
+	ByGalleryID(ctx context.Context, galleryID uint) ([]Photo, error)
+
+	// ByGalleryIDs returns the photos of all of the galleries,
+	// ordered by gallery ID and then position.
+	ByGalleryIDs(ctx context.Context, galleryIDs []uint) ([]Photo, error)
+
+	// Create stores photo after the gallery's last photo.
+	Create(ctx context.Context, photo *Photo) error
+
+	// Delete removes the photo and its metadata.
+	Delete(ctx context.Context, id uint) error
+
+	// Reorder gives the gallery's photos the order of photoIDs in
+	// a single transaction. photoIDs must list every photo in the
+	// gallery exactly once, otherwise ErrPhotoOrderInvalid is
+	// returned and nothing changes.
+	Reorder(ctx context.Context, galleryID uint, photoIDs []uint) error
+
+	// Metadata returns the EXIF metadata of the photo, or
+	// ErrNotFound if it had none.
+	Metadata(ctx context.Context, photoID uint) (*PhotoMetadata, error)
+
+	// MetadataByGalleryID returns the metadata of the gallery's
+	// photos that have any, keyed by photo ID.
+	MetadataByGalleryID(ctx context.Context, galleryID uint) (map[uint]PhotoMetadata, error)
+
+	CreateMetadata(ctx context.Context, meta *PhotoMetadata) error
+
+	// UsageByGalleryIDs returns how many photos each of the
+	// galleries holds and their size. Galleries without photos are
+	// left out.
+	UsageByGalleryIDs(ctx context.Context, galleryIDs []uint) (map[uint]Usage, error)
+}
+
+func NewPhotoService(db *gorm.DB, galleries GalleryDB, users UserDB,
+	imageDir string, quota Quota, resize ResizeConfig) PhotoService {
+	pv := &photoValidator{
+		PhotoDB:   &photoGorm{db},
+		galleries: galleries,
+		users:     users,
+		quota:     quota,
+	}
+	return &photoService{
+		PhotoDB:   pv,
+		validator: pv,
+		galleries: galleries,
+		imageDir:  imageDir,
+		resize:    resize,
+		resized:   newResizeCache(ResizedCacheDir(imageDir), resize.CacheSize),
+	}
+}
+
+type photoService struct {
+	PhotoDB
+	validator *photoValidator
+	galleries GalleryDB
+	imageDir  string
+	resize    ResizeConfig
+	resized   *resizeCache
+}
+
+func (ps *photoService) Upload(ctx context.Context, gallery *Gallery, name string, r io.Reader) (*Photo, error) {
+	// Sniff the type from the content rather than trusting the
+	// name or the browser.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return nil, ErrPhotoType
+		}
+		return nil, err
+	}
+	head = head[:n]
+	ext, ok := photoExts[http.DetectContentType(head)]
+	if !ok {
+		return nil, ErrPhotoType
+	}
+	// The size isn't known until the file is written, but a user
+	// who is already out of room can be stopped now.
+	if err := ps.CheckQuota(ctx, gallery, 1, 0); err != nil {
+		return nil, err
+	}
+
+	token, err := rand.Strings(12)
+	if err != nil {
+		return nil, err
+	}
+	photo := Photo{
+		GalleryID: gallery.ID,
+		Filename:  token + ext,
+		Name:      filepath.Base(name),
+	}
+	dir := GalleryDir(ps.imageDir, gallery.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, photo.Filename)
+	photo.Size, err = writeFile(path, io.MultiReader(bytes.NewReader(head), r))
+	if err != nil {
+		return nil, err
+	}
+	// A small file can hold a huge image, so its size is checked
+	// before anything decodes it.
+	if err := checkPhotoPixels(path); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	photo.ContentHash, photo.DHash, err = hashPhoto(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	var meta *PhotoMetadata
+	if ext == ".jpg" {
+		// EXIF data that can't be read just means the photo is
+		// shown without it.
+		meta, _ = readFileMetadata(path)
+	}
+	if err := ps.Create(ctx, &photo); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	if meta != nil {
+		meta.PhotoID = photo.ID
+		if err := ps.CreateMetadata(ctx, meta); err != nil {
+			ps.Delete(ctx, photo.ID)
+			os.Remove(path)
+			return nil, err
+		}
+	}
+	return &photo, nil
+}
+
+func readFileMetadata(path string) (*PhotoMetadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readMetadata(bufio.NewReader(f))
+}
+
+// writeFile writes r to a new file at path and returns its size,
+// removing it again if anything goes wrong.
+func writeFile(path string, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return 0, err
+	}
+	return n, nil
+}
+
+func (ps *photoService) Open(gallery *Gallery, photo *Photo) (io.ReadSeekCloser, error) {
+	if photo.GalleryID != gallery.ID {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(filepath.Join(GalleryDir(ps.imageDir, photo.GalleryID),
+		filepath.Base(photo.Filename)))
+	if err != nil {
+		return nil, err
+	}
+	if !gallery.StripGPS {
+		return f, nil
+	}
+	rsc, err := withoutGPS(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return rsc, nil
+}
+
+func (ps *photoService) Remove(ctx context.Context, gallery *Gallery, photo *Photo) error {
+	if photo.GalleryID != gallery.ID {
+		return ErrNotFound
+	}
+	if gallery.CoverPhotoID == photo.ID {
+		gallery.CoverPhotoID = 0
+		if err := ps.galleries.Update(ctx, gallery); err != nil {
+			return err
+		}
+	}
+	if err := ps.Delete(ctx, photo.ID); err != nil {
+		return err
+	}
+	stored := filepath.Base(photo.Filename)
+	err := os.Remove(filepath.Join(GalleryDir(ps.imageDir, photo.GalleryID), stored))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	base := strings.TrimSuffix(stored, filepath.Ext(stored))
+	removeRendered(WatermarkCacheDir(ps.imageDir, gallery.ID), base, "")
+	ps.resized.remove(gallery.ID, base+"-")
+	return nil
+}
+
+func (ps *photoService) RemoveAll(ctx context.Context, gallery *Gallery) error {
+	photos, err := ps.ByGalleryID(ctx, gallery.ID)
+	if err != nil {
+		return err
+	}
+	for _, p := range photos {
+		if err := ps.Delete(ctx, p.ID); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(GalleryDir(ps.imageDir, gallery.ID)); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(WatermarkCacheDir(ps.imageDir, gallery.ID)); err != nil {
+		return err
+	}
+	ps.resized.remove(gallery.ID, "")
+	return nil
+}
+
+func (ps *photoService) SetCover(ctx context.Context, gallery *Gallery, photoID uint) error {
+	photo, err := ps.ByID(ctx, photoID)
+	if err != nil {
+		return err
+	}
+	if photo.GalleryID != gallery.ID {
+		return ErrNotFound
+	}
+	gallery.CoverPhotoID = photo.ID
+	return ps.galleries.Update(ctx, gallery)
+}
+
+func (ps *photoService) Covers(ctx context.Context, galleries []Gallery) (map[uint]Photo, error) {
+	ids := make([]uint, len(galleries))
+	chosen := make(map[uint]uint, len(galleries))
+	for i, g := range galleries {
+		ids[i] = g.ID
+		chosen[g.ID] = g.CoverPhotoID
+	}
+	photos, err := ps.ByGalleryIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	covers := make(map[uint]Photo)
+	for _, p := range photos {
+		if _, ok := covers[p.GalleryID]; !ok || p.ID == chosen[p.GalleryID] {
+			covers[p.GalleryID] = p
+		}
+	}
+	return covers, nil
+}
+
+func (ps *photoService) Usage(ctx context.Context, user *User) (*StorageUsage, error) {
+	return ps.validator.usage(ctx, user)
+}
+
+func (ps *photoService) CheckQuota(ctx context.Context, gallery *Gallery, photos int, bytes int64) error {
+	return ps.validator.checkQuota(ctx, gallery.UserID, photos, bytes)
+}
+
+func (ps *photoService) SortByTakenAt(ctx context.Context, galleryID uint) error {
+	photos, err := ps.ByGalleryID(ctx, galleryID)
+	if err != nil {
+		return err
+	}
+	metas, err := ps.MetadataByGalleryID(ctx, galleryID)
+	if err != nil {
+		return err
+	}
+	takenAt := func(p Photo) *time.Time {
+		return metas[p.ID].TakenAt
+	}
+	sort.SliceStable(photos, func(i, j int) bool {
+		a, b := takenAt(photos[i]), takenAt(photos[j])
+		if a == nil || b == nil {
+			return a != nil && b == nil
+		}
+		return a.Before(*b)
+	})
+	ids := make([]uint, len(photos))
+	for i, p := range photos {
+		ids[i] = p.ID
+	}
+	return ps.Reorder(ctx, galleryID, ids)
+}
+
+var _ PhotoDB = &photoGorm{}
+
+type photoGorm struct {
+	db *gorm.DB
+}
+
+func (pg *photoGorm) ByID(ctx context.Context, id uint) (*Photo, error) {
+	var photo Photo
+	if err := first(withContext(ctx, pg.db).Where("id = ?", id), &photo); err != nil {
+		return nil, err
+	}
+	return &photo, nil
+}
+
+func (pg *photoGorm) ByFilename(ctx context.Context, galleryID uint, filename string) (*Photo, error) {
+	var photo Photo
+	db := withContext(ctx, pg.db).
+		Where("gallery_id = ? AND filename = ?", galleryID, filename)
+	if err := first(db, &photo); err != nil {
+		return nil, err
+	}
+	return &photo, nil
+}
+
+func (pg *photoGorm) ByGalleryID(ctx context.Context, galleryID uint) ([]Photo, error) {
+	return pg.ByGalleryIDs(ctx, []uint{galleryID})
+}
+
+func (pg *photoGorm) ByGalleryIDs(ctx context.Context, galleryIDs []uint) ([]Photo, error) {
+	photos := []Photo{}
+	if len(galleryIDs) == 0 {
+		return photos, nil
+	}
+	err := withContext(ctx, pg.db).
+		Where("gallery_id IN (?)", galleryIDs).
+		Order("gallery_id, position, id").
+		Find(&photos).Error
+	if err != nil {
+		return nil, err
+	}
+	return photos, nil
+}
+
+func (pg *photoGorm) Create(ctx context.Context, photo *Photo) error {
+	tx := withContext(ctx, pg.db).Begin()
+	if err := lockGallery(tx, photo.GalleryID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var last struct{ Position int }
+	err := tx.Model(&Photo{}).Select("COALESCE(MAX(position), 0) AS position").
+		Where("gallery_id = ?", photo.GalleryID).Scan(&last).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	photo.Position = last.Position + 1
+	if err := tx.Create(photo).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// lockGallery locks the gallery's row until tx ends, so photos
+// added or reordered at the same time get their positions one after
+// the other instead of both reading the same MAX(position). SQLite
+// has no FOR UPDATE, but runs on a single connection, so its
+// transactions never overlap.
+func lockGallery(tx *gorm.DB, galleryID uint) error {
+	if tx.Dialect().GetName() != DialectPostgres {
+		return nil
+	}
+	return tx.Exec("SELECT id FROM galleries WHERE id = ? FOR UPDATE",
+		galleryID).Error
+}
+
+func (pg *photoGorm) Delete(ctx context.Context, id uint) error {
+	if id == 0 {
+		return ErrIDInvalid
+	}
+	tx := withContext(ctx, pg.db).Begin()
+	if err := tx.Where("photo_id = ?", id).Delete(&PhotoMetadata{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("id = ?", id).Delete(&Photo{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (pg *photoGorm) Reorder(ctx context.Context, galleryID uint, photoIDs []uint) error {
+	tx := withContext(ctx, pg.db).Begin()
+	if err := lockGallery(tx, galleryID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var current []Photo
+	if err := tx.Where("gallery_id = ?", galleryID).Find(&current).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !sameIDs(current, photoIDs) {
+		tx.Rollback()
+		return ErrPhotoOrderInvalid
+	}
+	for i, id := range photoIDs {
+		if err := tx.Model(&Photo{}).Where("id = ?", id).
+			UpdateColumn("position", i+1).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (pg *photoGorm) Metadata(ctx context.Context, photoID uint) (*PhotoMetadata, error) {
+	var meta PhotoMetadata
+	db := withContext(ctx, pg.db).Where("photo_id = ?", photoID)
+	if err := first(db, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (pg *photoGorm) MetadataByGalleryID(ctx context.Context, galleryID uint) (map[uint]PhotoMetadata, error) {
+	var metas []PhotoMetadata
+	err := withContext(ctx, pg.db).
+		Where("photo_id IN (SELECT id FROM photos WHERE gallery_id = ?)", galleryID).
+		Find(&metas).Error
+	if err != nil {
+		return nil, err
+	}
+	byPhoto := make(map[uint]PhotoMetadata, len(metas))
+	for _, m := range metas {
+		byPhoto[m.PhotoID] = m
+	}
+	return byPhoto, nil
+}
+
+func (pg *photoGorm) CreateMetadata(ctx context.Context, meta *PhotoMetadata) error {
+	return withContext(ctx, pg.db).Create(meta).Error
+}
+
+func (pg *photoGorm) UsageByGalleryIDs(ctx context.Context, galleryIDs []uint) (map[uint]Usage, error) {
+	usage := make(map[uint]Usage)
+	if len(galleryIDs) == 0 {
+		return usage, nil
+	}
+	var rows []struct {
+		GalleryID uint
+		Photos    int
+		Bytes     int64
+	}
+	err := withContext(ctx, pg.db).Model(&Photo{}).
+		Select("gallery_id, COUNT(*) AS photos, COALESCE(SUM(size), 0) AS bytes").
+		Where("gallery_id IN (?)", galleryIDs).
+		Group("gallery_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		usage[r.GalleryID] = Usage{Photos: r.Photos, Bytes: r.Bytes}
+	}
+	return usage, nil
+}
+
+// sameIDs reports whether ids lists the ID of every photo exactly
+// once.
+func sameIDs(photos []Photo, ids []uint) bool {
+	if len(photos) != len(ids) {
+		return false
+	}
+	want := make(map[uint]bool, len(photos))
+	for _, p := range photos {
+		want[p.ID] = true
+	}
+	for _, id := range ids {
+		if !want[id] {
+			return false
+		}
+		delete(want, id)
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+// testDB returns an empty in-memory SQLite database with the photo
+// tables migrated.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(DialectSQLite, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DB().SetMaxOpenConns(1)
+	db.LogMode(false)
+	t.Cleanup(func() { db.Close() })
+	if err := db.AutoMigrate(&Gallery{}, &Photo{}, &PhotoMetadata{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// photoDBs returns each PhotoDB implementation, empty.
+func photoDBs(t *testing.T) map[string]PhotoDB {
+	return map[string]PhotoDB{
+		"memory": NewPhotoMemory(),
+		"gorm":   &photoGorm{testDB(t)},
+	}
+}
+
+func TestPhotoCreatePositions(t *testing.T) {
+	for name, pdb := range photoDBs(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			const n = 20
+			var wg sync.WaitGroup
+			errs := make(chan error, n)
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs <- pdb.Create(ctx, &Photo{GalleryID: 1, Filename: "p.jpg"})
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := pdb.Create(ctx, &Photo{GalleryID: 2, Filename: "q.jpg"}); err != nil {
+				t.Fatal(err)
+			}
+
+			photos, err := pdb.ByGalleryID(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(photos) != n {
+				t.Fatalf("got %d photos, want %d", len(photos), n)
+			}
+			for i, p := range photos {
+				if p.Position != i+1 {
+					t.Errorf("photo %d has position %d, want %d", p.ID, p.Position, i+1)
+				}
+			}
+			other, err := pdb.ByGalleryID(ctx, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(other) != 1 || other[0].Position != 1 {
+				t.Errorf("other gallery: got %+v, want one photo at position 1", other)
+			}
+		})
+	}
+}
+
+func TestPhotoReorder(t *testing.T) {
+	for name, pdb := range photoDBs(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			var ids []uint
+			for i := 0; i < 3; i++ {
+				p := &Photo{GalleryID: 1, Filename: "p.jpg"}
+				if err := pdb.Create(ctx, p); err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, p.ID)
+			}
+
+			invalid := [][]uint{
+				{ids[0], ids[1]},
+				{ids[0], ids[1], ids[1]},
+				{ids[0], ids[1], ids[2], 999},
+			}
+			for _, order := range invalid {
+				if err := pdb.Reorder(ctx, 1, order); err != ErrPhotoOrderInvalid {
+					t.Errorf("Reorder(%v): got %v, want ErrPhotoOrderInvalid", order, err)
+				}
+			}
+
+			want := []uint{ids[2], ids[0], ids[1]}
+			if err := pdb.Reorder(ctx, 1, want); err != nil {
+				t.Fatal(err)
+			}
+			photos, err := pdb.ByGalleryID(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []uint
+			for _, p := range photos {
+				got = append(got, p.ID)
+			}
+			if !equalIDs(got, want) {
+				t.Errorf("got order %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func equalIDs(a, b []uint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,458 @@
+package models
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+const (
+	// ErrProofSubmitted is returned when a client changes a
+	// selection they have already sent.
+	ErrProofSubmitted modelError = "models: your selection has already been sent"
+
+	// ErrProofNoFavorites is returned when a client sends a
+	// selection without any favorites in it.
+	ErrProofNoFavorites modelError = "models: choose at least one favorite before sending your selection"
+
+	// ErrProofNameRequired is returned when a client sends a
+	// selection without saying who they are.
+	ErrProofNameRequired modelError = "models: name is required"
+
+	// ErrProofNameTooLong is returned when a client's name is
+	// longer than MaxProofName.
+	ErrProofNameTooLong modelError = "models: name is limited to 100 characters"
+
+	// ErrProofNoteTooLong is returned when a note is longer than
+	// MaxProofNote.
+	ErrProofNoteTooLong modelError = "models: notes are limited to 1000 characters"
+)
+
+const (
+	// MaxProofName is the longest name a client can give, in
+	// characters.
+	MaxProofName = 100
+
+	// MaxProofNote is the longest note a client can leave on a
+	// photo, in characters.
+	MaxProofNote = 1000
+)
+
+// Proof is one client's selection from a gallery shared through its
+// proofing link: the photos they favorited and the notes they left.
+// Clients don't have accounts, so they are known by a random token
+// kept in a cookie. Only the HMAC of the token is stored.
+type Proof struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	GalleryID uint   `gorm:"not null;index"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	// Name and Email are who the client said they were when they
+	// sent their selection.
+	Name  string
+	Email string
+	// SubmittedAt is when the client sent their selection. It
+	// can't be changed after that.
+	SubmittedAt *time.Time
+	// Picks are the photos the client favorited or left a note
+	// on. They are loaded along with the proof.
+	Picks []ProofPick `gorm:"-"`
+}
+
+// Submitted reports whether the client has sent their selection.
+func (p *Proof) Submitted() bool {
+	return p.SubmittedAt != nil
+}
+
+// Pick returns the client's pick of the photo with the given ID, or
+// an empty one if they haven't picked it.
+func (p *Proof) Pick(photoID uint) ProofPick {
+	for _, pick := range p.Picks {
+		if pick.PhotoID == photoID {
+			return pick
+		}
+	}
+	return ProofPick{ProofID: p.ID, PhotoID: photoID}
+}
+
+// Favorites counts the photos the client favorited.
+func (p *Proof) Favorites() int {
+	n := 0
+	for _, pick := range p.Picks {
+		if pick.Favorite {
+			n++
+		}
+	}
+	return n
+}
+
+// ProofPick is what a client thought of one photo.
+type ProofPick struct {
+	ID        uint `gorm:"primary_key"`
+	UpdatedAt time.Time
+	ProofID   uint   `gorm:"not null;unique_index:idx_proof_picks_proof_photo"`
+	PhotoID   uint   `gorm:"not null;unique_index:idx_proof_picks_proof_photo"`
+	Favorite  bool   `gorm:"not null;default:false"`
+	Note      string `gorm:"size:4000"`
+}
+
+// empty reports whether there is nothing to keep of the pick.
+func (pp *ProofPick) empty() bool {
+	return !pp.Favorite && pp.Note == ""
+}
+
+// ProofService manages the selections clients make through the
+// proofing links of galleries.
+type ProofService interface {
+	ProofDB
+
+	// ByToken returns the proof the client holding token started
+	// in the gallery with the given ID. It returns ErrNotFound if
+	// they haven't started one.
+	ByToken(ctx context.Context, galleryID uint, token string) (*Proof, error)
+
+	// Pick stores what the client of proof thought of photo, which
+	// must be in the proof's gallery. It returns ErrProofSubmitted
+	// once the selection has been sent.
+	Pick(ctx context.Context, proof *Proof, photo *Photo, favorite bool, note string) error
+
+	// Submit sends the client's selection under the Name and Email
+	// set on proof.
+	Submit(ctx context.Context, proof *Proof) error
+}
+
+// ProofDB stores proofs and their picks.
+type ProofDB interface {
+	// ByTokenHash returns the proof in the gallery with the given
+	// ID whose token has the given hash, along with its picks.
+	ByTokenHash(ctx context.Context, galleryID uint, tokenHash string) (*Proof, error)
+
+	// ByGalleryID returns the gallery's proofs along with their
+	// picks, the most recently sent first and the ones still being
+	// made last.
+	ByGalleryID(ctx context.Context, galleryID uint) ([]Proof, error)
+
+	// Create starts a proof. A token is made up for it if it has
+	// none.
+	Create(ctx context.Context, proof *Proof) error
+	Update(ctx context.Context, proof *Proof) error
+
+	// SavePick stores pick in place of the earlier pick of the same
+	// photo in the same proof. A pick that is neither a favorite
+	// nor has a note is removed instead.
+	SavePick(ctx context.Context, pick *ProofPick) error
+}
+
+func NewProofService(db *gorm.DB) ProofService {
+	return &proofService{
+		ProofDB: newProofValidator(&proofGorm{db: db}),
+	}
+}
+
+type proofService struct {
+	ProofDB
+}
+
+func (ps *proofService) ByToken(ctx context.Context, galleryID uint, token string) (*Proof, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	return ps.ByTokenHash(ctx, galleryID, hashProofToken(token))
+}
+
+func (ps *proofService) Pick(ctx context.Context, proof *Proof, photo *Photo, favorite bool, note string) error {
+	if photo.GalleryID != proof.GalleryID {
+		return ErrNotFound
+	}
+	if proof.Submitted() {
+		return ErrProofSubmitted
+	}
+	pick := proof.Pick(photo.ID)
+	pick.Favorite = favorite
+	pick.Note = note
+	if err := ps.SavePick(ctx, &pick); err != nil {
+		return err
+	}
+	for i := range proof.Picks {
+		if proof.Picks[i].PhotoID == photo.ID {
+			proof.Picks = append(proof.Picks[:i], proof.Picks[i+1:]...)
+			break
+		}
+	}
+	if !pick.empty() {
+		proof.Picks = append(proof.Picks, pick)
+	}
+	return nil
+}
+
+func (ps *proofService) Submit(ctx context.Context, proof *Proof) error {
+	if proof.Submitted() {
+		return ErrProofSubmitted
+	}
+	now := time.Now()
+	proof.SubmittedAt = &now
+	if err := ps.Update(ctx, proof); err != nil {
+		proof.SubmittedAt = nil
+		return err
+	}
+	return nil
+}
+
+// hashProofToken returns the HMAC a proof's token is stored as. A
+// hash.HMAC can't be shared between goroutines, so one is made for
+// every call.
+func hashProofToken(token string) string {
+	return hash.NewHMAC(hmacSecretKey).Hash(token)
+}
+
+type proofValidator struct {
+	ProofDB
+	emailRegex *regexp.Regexp
+}
+
+func newProofValidator(db ProofDB) *proofValidator {
+	return &proofValidator{
+		ProofDB: db,
+		emailRegex: regexp.MustCompile(
+			`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+	}
+}
+
+type proofValFn func(*Proof) error
+
+func runProofValFns(proof *Proof, fns ...proofValFn) error {
+	for _, fn := range fns {
+		if err := fn(proof); err != nil {
+			return unwrapFieldError(err)
+		}
+	}
+	return nil
+}
+
+// runAllProofValFns is runProofValFns for ValidateAll.
+func runAllProofValFns(proof *Proof, fns ...proofValFn) error {
+	errs := ValidationErrors{}
+	for _, fn := range fns {
+		if err := fn(proof); err != nil {
+			if err := collectError(errs, err); err != nil {
+				return err
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// proofField ties the errors of fns to a form field.
+func proofField(field string, fns ...proofValFn) proofValFn {
+	return proofValFn(func(p *Proof) error {
+		for _, fn := range fns {
+			if err := fn(p); err != nil {
+				return fieldError{field: field, err: err}
+			}
+		}
+		return nil
+	})
+}
+
+func (pv *proofValidator) Create(ctx context.Context, proof *Proof) error {
+	err := runProofValFns(proof,
+		pv.setTokenIfUnset,
+		pv.hmacToken)
+	if err != nil {
+		return err
+	}
+	return pv.ProofDB.Create(ctx, proof)
+}
+
+func (pv *proofValidator) Update(ctx context.Context, proof *Proof) error {
+	run := runProofValFns
+	if validateAll(ctx) {
+		run = runAllProofValFns
+	}
+	err := run(proof,
+		pv.hmacToken,
+		pv.normalize,
+		proofField("name", pv.nameRequired, pv.nameLength),
+		proofField("email", pv.emailRequired, pv.emailFormat),
+		pv.favoritesRequired)
+	if err != nil {
+		return err
+	}
+	return pv.ProofDB.Update(ctx, proof)
+}
+
+func (pv *proofValidator) SavePick(ctx context.Context, pick *ProofPick) error {
+	pick.Note = strings.TrimSpace(pick.Note)
+	if utf8.RuneCountInString(pick.Note) > MaxProofNote {
+		return ErrProofNoteTooLong
+	}
+	return pv.ProofDB.SavePick(ctx, pick)
+}
+
+// Validation functions
+
+func (pv *proofValidator) setTokenIfUnset(p *Proof) error {
+	if p.Token != "" {
+		return nil
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	p.Token = token
+	return nil
+}
+
+func (pv *proofValidator) hmacToken(p *Proof) error {
+	if p.Token == "" {
+		return nil
+	}
+	p.TokenHash = hashProofToken(p.Token)
+	return nil
+}
+
+func (pv *proofValidator) normalize(p *Proof) error {
+	p.Name = strings.TrimSpace(p.Name)
+	p.Email = strings.ToLower(strings.TrimSpace(p.Email))
+	return nil
+}
+
+// The remaining checks only apply once the client sends their
+// selection; until then the proof has no name or email.
+
+func (pv *proofValidator) nameRequired(p *Proof) error {
+	if p.Submitted() && p.Name == "" {
+		return ErrProofNameRequired
+	}
+	return nil
+}
+
+func (pv *proofValidator) nameLength(p *Proof) error {
+	if utf8.RuneCountInString(p.Name) > MaxProofName {
+		return ErrProofNameTooLong
+	}
+	return nil
+}
+
+func (pv *proofValidator) emailRequired(p *Proof) error {
+	if p.Submitted() && p.Email == "" {
+		return ErrEmailRequired
+	}
+	return nil
+}
+
+func (pv *proofValidator) emailFormat(p *Proof) error {
+	if p.Email != "" && !pv.emailRegex.MatchString(p.Email) {
+		return ErrEmailInvalid
+	}
+	return nil
+}
+
+func (pv *proofValidator) favoritesRequired(p *Proof) error {
+	if p.Submitted() && p.Favorites() == 0 {
+		return ErrProofNoFavorites
+	}
+	return nil
+}
+
+var _ ProofDB = &proofGorm{}
+
+type proofGorm struct {
+	db *gorm.DB
+}
+
+func (pg *proofGorm) ByTokenHash(ctx context.Context, galleryID uint, tokenHash string) (*Proof, error) {
+	var proof Proof
+	db := withContext(ctx, pg.db).
+		Where("gallery_id = ? AND token_hash = ?", galleryID, tokenHash)
+	if err := first(db, &proof); err != nil {
+		return nil, err
+	}
+	err := withContext(ctx, pg.db).Where("proof_id = ?", proof.ID).
+		Order("id").Find(&proof.Picks).Error
+	if err != nil {
+		return nil, err
+	}
+	return &proof, nil
+}
+
+func (pg *proofGorm) ByGalleryID(ctx context.Context, galleryID uint) ([]Proof, error) {
+	var proofs []Proof
+	err := withContext(ctx, pg.db).Where("gallery_id = ?", galleryID).
+		Order("id").Find(&proofs).Error
+	if err != nil {
+		return nil, err
+	}
+	var picks []ProofPick
+	err = withContext(ctx, pg.db).
+		Where("proof_id IN (SELECT id FROM proofs WHERE gallery_id = ?)", galleryID).
+		Order("id").Find(&picks).Error
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint]*Proof, len(proofs))
+	for i := range proofs {
+		byID[proofs[i].ID] = &proofs[i]
+	}
+	for _, pick := range picks {
+		if p, ok := byID[pick.ProofID]; ok {
+			p.Picks = append(p.Picks, pick)
+		}
+	}
+	sortProofs(proofs)
+	return proofs, nil
+}
+
+func (pg *proofGorm) Create(ctx context.Context, proof *Proof) error {
+	return withContext(ctx, pg.db).Create(proof).Error
+}
+
+func (pg *proofGorm) Update(ctx context.Context, proof *Proof) error {
+	return withContext(ctx, pg.db).Save(proof).Error
+}
+
+func (pg *proofGorm) SavePick(ctx context.Context, pick *ProofPick) error {
+	db := withContext(ctx, pg.db)
+	if pick.empty() {
+		return db.Where("proof_id = ? AND photo_id = ?", pick.ProofID, pick.PhotoID).
+			Delete(&ProofPick{}).Error
+	}
+	if pick.ID == 0 {
+		// A pick made at the same time in another tab may have
+		// got there first.
+		var existing ProofPick
+		err := first(db.Where("proof_id = ? AND photo_id = ?",
+			pick.ProofID, pick.PhotoID), &existing)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		pick.ID = existing.ID
+	}
+	return db.Save(pick).Error
+}
+
+// sortProofs orders proofs the way ByGalleryID returns them.
+func sortProofs(proofs []Proof) {
+	sort.SliceStable(proofs, func(i, j int) bool {
+		a, b := proofs[i].SubmittedAt, proofs[j].SubmittedAt
+		if (a == nil) != (b == nil) {
+			return a != nil
+		}
+		if a == nil {
+			return proofs[i].UpdatedAt.After(proofs[j].UpdatedAt)
+		}
+		return a.After(*b)
+	})
+}
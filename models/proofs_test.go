@@ -0,0 +1,182 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestProofToken(t *testing.T) {
+	ctx := context.Background()
+	ps := NewMemoryProofService()
+	a := &Proof{GalleryID: 1}
+	b := &Proof{GalleryID: 1}
+	for _, p := range []*Proof{a, b} {
+		if err := ps.Create(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.Token == "" || a.Token == b.Token {
+		t.Fatalf("tokens %q and %q", a.Token, b.Token)
+	}
+	if a.TokenHash == "" || strings.Contains(a.TokenHash, a.Token) {
+		t.Errorf("token hash %q gives away the token", a.TokenHash)
+	}
+
+	got, err := ps.ByToken(ctx, 1, a.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != a.ID {
+		t.Errorf("got proof %d, want %d", got.ID, a.ID)
+	}
+	tests := []struct {
+		name      string
+		galleryID uint
+		token     string
+	}{
+		{"other gallery", 2, a.Token},
+		{"no token", 1, ""},
+		{"unknown token", 1, a.Token + "x"},
+		{"token hash", 1, a.TokenHash},
+	}
+	for _, tc := range tests {
+		if _, err := ps.ByToken(ctx, tc.galleryID, tc.token); err != ErrNotFound {
+			t.Errorf("%s: got %v, want ErrNotFound", tc.name, err)
+		}
+	}
+
+	dup := &Proof{GalleryID: 2, Token: a.Token}
+	if err := ps.Create(ctx, dup); err == nil {
+		t.Error("a second proof with the same token was created")
+	}
+}
+
+func TestProofPick(t *testing.T) {
+	ctx := context.Background()
+	ps := NewMemoryProofService()
+	proof := &Proof{GalleryID: 1}
+	if err := ps.Create(ctx, proof); err != nil {
+		t.Fatal(err)
+	}
+	photo := &Photo{ID: 7, GalleryID: 1}
+
+	if err := ps.Pick(ctx, proof, &Photo{ID: 8, GalleryID: 2}, true, ""); err != ErrNotFound {
+		t.Errorf("photo in another gallery: got %v, want ErrNotFound", err)
+	}
+	if err := ps.Pick(ctx, proof, photo, false, strings.Repeat("a", MaxProofNote+1)); err != ErrProofNoteTooLong {
+		t.Errorf("long note: got %v, want ErrProofNoteTooLong", err)
+	}
+	if err := ps.Pick(ctx, proof, photo, true, "  crop tighter "); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ps.ByToken(ctx, 1, proof.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pick := stored.Pick(photo.ID); !pick.Favorite || pick.Note != "crop tighter" {
+		t.Errorf("stored pick %+v", pick)
+	}
+	if err := ps.Pick(ctx, proof, photo, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ = ps.ByToken(ctx, 1, proof.Token)
+	if len(proof.Picks) != 0 || len(stored.Picks) != 0 {
+		t.Errorf("unpicked photo kept: %v, %v", proof.Picks, stored.Picks)
+	}
+}
+
+func TestProofSubmit(t *testing.T) {
+	ctx := context.Background()
+	ps := NewMemoryProofService()
+	proof := &Proof{GalleryID: 1}
+	if err := ps.Create(ctx, proof); err != nil {
+		t.Fatal(err)
+	}
+	photo := &Photo{ID: 7, GalleryID: 1}
+
+	tests := []struct {
+		name   string
+		pick   bool
+		client string
+		email  string
+		want   error
+	}{
+		{"no favorites", false, "Al", "al@example.com", ErrProofNoFavorites},
+		{"no name", true, " ", "al@example.com", ErrProofNameRequired},
+		{"long name", true, strings.Repeat("a", MaxProofName+1), "al@example.com", ErrProofNameTooLong},
+		{"no email", true, "Al", "", ErrEmailRequired},
+		{"bad email", true, "Al", "al@", ErrEmailInvalid},
+	}
+	for _, tc := range tests {
+		if err := ps.Pick(ctx, proof, photo, tc.pick, ""); err != nil {
+			t.Fatal(err)
+		}
+		proof.Name, proof.Email = tc.client, tc.email
+		if err := ps.Submit(ctx, proof); err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+		if proof.Submitted() {
+			t.Errorf("%s: proof marked as sent", tc.name)
+		}
+	}
+
+	proof.Name, proof.Email = " Al ", "Al@Example.com"
+	if err := ps.Submit(ctx, proof); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ps.ByToken(ctx, 1, proof.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Submitted() || stored.Name != "Al" || stored.Email != "al@example.com" {
+		t.Errorf("stored proof %+v", stored)
+	}
+	if err := ps.Pick(ctx, proof, photo, false, ""); err != ErrProofSubmitted {
+		t.Errorf("pick after sending: got %v, want ErrProofSubmitted", err)
+	}
+	if err := ps.Submit(ctx, proof); err != ErrProofSubmitted {
+		t.Errorf("second send: got %v, want ErrProofSubmitted", err)
+	}
+}
+
+func TestGalleryProofToken(t *testing.T) {
+	ctx := context.Background()
+	gs := NewMemoryGalleryService()
+	gallery := &Gallery{UserID: 1, Title: "Wedding"}
+	if err := gs.Create(ctx, gallery); err != nil {
+		t.Fatal(err)
+	}
+	if gallery.ProofToken != "" {
+		t.Errorf("token %q made without proofing", gallery.ProofToken)
+	}
+	gallery.Proofing = true
+	if err := gs.Update(ctx, gallery); err != nil {
+		t.Fatal(err)
+	}
+	token := gallery.ProofToken
+	if token == "" {
+		t.Fatal("no token made when proofing was turned on")
+	}
+	if got, err := gs.ByProofToken(ctx, token); err != nil || got.ID != gallery.ID {
+		t.Errorf("ByProofToken: got %v, %v", got, err)
+	}
+	if _, err := gs.ByProofToken(ctx, ""); err != ErrNotFound {
+		t.Errorf("empty token: got %v, want ErrNotFound", err)
+	}
+
+	gallery.Proofing = false
+	if err := gs.Update(ctx, gallery); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gs.ByProofToken(ctx, token); err != ErrNotFound {
+		t.Errorf("proofing off: got %v, want ErrNotFound", err)
+	}
+	gallery.Proofing = true
+	if err := gs.Update(ctx, gallery); err != nil {
+		t.Fatal(err)
+	}
+	if gallery.ProofToken != token {
+		t.Error("turning proofing back on changed the link")
+	}
+}
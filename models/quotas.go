@@ -0,0 +1,270 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrQuotaExceeded is returned when a photo would take its
+	// owner over the storage their quota allows.
+	ErrQuotaExceeded modelError = "models: this would take you over your storage quota. " +
+		"Delete some photos to make room"
+
+	// ErrPhotoQuotaExceeded is returned when the owner of a gallery
+	// already has as many photos as their quota allows.
+	ErrPhotoQuotaExceeded modelError = "models: you have as many photos as your quota allows. " +
+		"Delete some photos to make room"
+
+	// ErrQuotaInvalid is returned when a quota is negative.
+	ErrQuotaInvalid modelError = "models: quotas can't be negative"
+)
+
+// Quota limits what a user can store. A zero field means there is
+// no limit.
+type Quota struct {
+	// Bytes is the total size of the user's photos.
+	Bytes int64
+	// Photos is the number of photos across all galleries.
+	Photos int
+}
+
+// DefaultQuota is the quota of users who haven't been given one of
+// their own.
+var DefaultQuota = Quota{Bytes: 5 << 30, Photos: 10000}
+
+// Size is Bytes written for people, or "" when there is no limit.
+func (q Quota) Size() string {
+	if q.Bytes == 0 {
+		return ""
+	}
+	return formatBytes(q.Bytes)
+}
+
+// allows returns an error if adding photos that take up bytes on
+// top of used would break the quota.
+func (q Quota) allows(used Usage, photos int, bytes int64) error {
+	if q.Photos > 0 && used.Photos+photos > q.Photos {
+		return ErrPhotoQuotaExceeded
+	}
+	if q.Bytes > 0 && used.Bytes+bytes > q.Bytes {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Quota returns the quota that applies to the user: def, with the
+// user's own limits in place of it where an admin has set them.
+func (u *User) Quota(def Quota) Quota {
+	q := def
+	if u.QuotaBytes != nil {
+		q.Bytes = *u.QuotaBytes
+	}
+	if u.QuotaPhotos != nil {
+		q.Photos = *u.QuotaPhotos
+	}
+	return q
+}
+
+// Usage is how much is stored, by a user or in a gallery.
+type Usage struct {
+	Photos int
+	Bytes  int64
+}
+
+// Size is Bytes written for people.
+func (u Usage) Size() string {
+	return formatBytes(u.Bytes)
+}
+
+func (u *Usage) add(o Usage) {
+	u.Photos += o.Photos
+	u.Bytes += o.Bytes
+}
+
+// StorageUsage is what a user stores compared to their quota.
+type StorageUsage struct {
+	Usage
+	Quota Quota
+	// Galleries breaks Usage down by gallery, in the order the
+	// galleries were created.
+	Galleries []GalleryUsage
+}
+
+// GalleryUsage is what is stored in one gallery.
+type GalleryUsage struct {
+	Usage
+	Gallery Gallery
+}
+
+// BytesPercent is how much of the storage quota is used, from 0 to
+// 100. It is 0 when there is no limit.
+func (su *StorageUsage) BytesPercent() int {
+	return percent(su.Bytes, su.Quota.Bytes)
+}
+
+// PhotosPercent is how much of the photo quota is used, from 0 to
+// 100. It is 0 when there is no limit.
+func (su *StorageUsage) PhotosPercent() int {
+	return percent(int64(su.Photos), int64(su.Quota.Photos))
+}
+
+func percent(n, of int64) int {
+	if of <= 0 {
+		return 0
+	}
+	return int(min(100, n*100/of))
+}
+
+// formatBytes writes n in the largest unit that keeps it at 1 or
+// more, such as "1.5 GB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// photoValidator keeps each user's photos within their quota. The
+// quota is checked as photos are created rather than by the gallery
+// validator, since photos are added through PhotoDB without the
+// gallery itself changing, and a gallery only knows its own photos
+// while the quota covers all of the owner's galleries.
+type photoValidator struct {
+	PhotoDB
+	galleries GalleryDB
+	users     UserDB
+	quota     Quota
+
+	// creating is held from checking a photo against the quota
+	// until it is stored, so photos uploaded at the same time
+	// can't all claim the same room.
+	creating sync.Mutex
+}
+
+type photoValFn func(*Photo) error
+
+func runPhotoValFns(photo *Photo, fns ...photoValFn) error {
+	for _, fn := range fns {
+		if err := fn(photo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pv *photoValidator) Create(ctx context.Context, photo *Photo) error {
+	pv.creating.Lock()
+	defer pv.creating.Unlock()
+	if err := runPhotoValFns(photo, pv.withinQuota(ctx)); err != nil {
+		return err
+	}
+	return pv.PhotoDB.Create(ctx, photo)
+}
+
+// withinQuota makes sure the owner of the photo's gallery has room
+// for it.
+func (pv *photoValidator) withinQuota(ctx context.Context) photoValFn {
+	return func(photo *Photo) error {
+		gallery, err := pv.galleries.ByID(ctx, photo.GalleryID)
+		if err != nil {
+			return err
+		}
+		return pv.checkQuota(ctx, gallery.UserID, 1, photo.Size)
+	}
+}
+
+// checkQuota returns an error if the user has no room for another
+// photos photos of bytes in total.
+func (pv *photoValidator) checkQuota(ctx context.Context, userID uint, photos int, bytes int64) error {
+	user, err := pv.users.ByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	usage, err := pv.usage(ctx, user)
+	if err != nil {
+		return err
+	}
+	return usage.Quota.allows(usage.Usage, photos, bytes)
+}
+
+// usage adds up what the user stores in each of their galleries.
+func (pv *photoValidator) usage(ctx context.Context, user *User) (*StorageUsage, error) {
+	galleries, err := pv.galleries.ByUserID(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint, len(galleries))
+	for i, g := range galleries {
+		ids[i] = g.ID
+	}
+	byGallery, err := pv.UsageByGalleryIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	su := &StorageUsage{
+		Quota:     user.Quota(pv.quota),
+		Galleries: make([]GalleryUsage, len(galleries)),
+	}
+	for i, g := range galleries {
+		su.Galleries[i] = GalleryUsage{Gallery: g, Usage: byGallery[g.ID]}
+		su.add(byGallery[g.ID])
+	}
+	return su, nil
+}
+
+// backfillPhotoSizes records the size of photos uploaded before
+// sizes were tracked, by looking at their files. Photos whose files
+// are missing keep a size of 0.
+func backfillPhotoSizes(db *gorm.DB, imageDir string) error {
+	var photos []Photo
+	if err := db.Where("size = 0").Find(&photos).Error; err != nil {
+		return err
+	}
+	for _, p := range photos {
+		fi, err := os.Stat(filepath.Join(GalleryDir(imageDir, p.GalleryID),
+			filepath.Base(p.Filename)))
+		if err != nil {
+			continue
+		}
+		err = db.Model(&Photo{}).Where("id = ?", p.ID).
+			UpdateColumn("size", fi.Size()).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeDeletedGalleryPhotos removes the photos left in galleries
+// that were deleted on their own. Galleries deleted along with
+// their owner's account are left alone, since the account can
+// still be restored.
+func removeDeletedGalleryPhotos(ctx context.Context, db *gorm.DB, photos PhotoService) error {
+	var galleries []Gallery
+	err := withContext(ctx, db).Unscoped().
+		Where("deleted_at IS NOT NULL").
+		Where("id IN (SELECT gallery_id FROM photos)").
+		Where("user_id IN (SELECT id FROM users WHERE deleted_at IS NULL)").
+		Find(&galleries).Error
+	if err != nil {
+		return err
+	}
+	for i := range galleries {
+		if err := photos.RemoveAll(ctx, &galleries[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestQuotaAllows(t *testing.T) {
+	used := Usage{Photos: 9, Bytes: 900}
+	tests := []struct {
+		quota  Quota
+		photos int
+		bytes  int64
+		want   error
+	}{
+		{Quota{}, 1000, 1 << 40, nil},
+		{Quota{Photos: 10, Bytes: 1000}, 1, 100, nil},
+		{Quota{Photos: 10, Bytes: 1000}, 2, 0, ErrPhotoQuotaExceeded},
+		{Quota{Photos: 10, Bytes: 1000}, 1, 101, ErrQuotaExceeded},
+		{Quota{Photos: 0, Bytes: 1000}, 50, 100, nil},
+	}
+	for _, tc := range tests {
+		if got := tc.quota.allows(used, tc.photos, tc.bytes); got != tc.want {
+			t.Errorf("%+v allows(%d photos, %d bytes) = %v, want %v",
+				tc.quota, tc.photos, tc.bytes, got, tc.want)
+		}
+	}
+}
+
+func TestRemoveAll(t *testing.T) {
+	ctx := context.Background()
+	ps, gallery := newTestPhotoService(t, Quota{})
+	img := testPNGBytes(t)
+	for i := 0; i < 2; i++ {
+		if _, err := ps.Upload(ctx, gallery, "beach.png", bytes.NewReader(img)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ps.RemoveAll(ctx, gallery); err != nil {
+		t.Fatal(err)
+	}
+	photos, err := ps.ByGalleryID(ctx, gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(photos) != 0 {
+		t.Errorf("%d photos left", len(photos))
+	}
+	dir := GalleryDir(ps.(*photoService).imageDir, gallery.ID)
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("gallery directory is still there: %v", err)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewServices(DialectSQLite, ":memory:",
+		WithLogger(discard), WithSQLLogLevel(SQLLogOff),
+		WithImageDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	img := testPNGBytes(t)
+	// newGallery makes a user with a gallery holding a photo.
+	newGallery := func(email string) (*User, *Gallery, *Photo) {
+		user := &User{Email: email, Password: "darkroom silver print"}
+		if err := s.User.Create(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		gallery := &Gallery{UserID: user.ID, Title: "Holiday"}
+		if err := s.Gallery.Create(ctx, gallery); err != nil {
+			t.Fatal(err)
+		}
+		photo, err := s.Photo.Upload(ctx, gallery, "beach.png", bytes.NewReader(img))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user, gallery, photo
+	}
+
+	_, deleted, _ := newGallery("al@example.com")
+	if err := s.Gallery.Delete(ctx, deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+	owner, withAccount, _ := newGallery("bo@example.com")
+	if err := s.Account.Delete(ctx, owner); err != nil {
+		t.Fatal(err)
+	}
+	_, kept, unsized := newGallery("cy@example.com")
+	if err := s.db.Model(unsized).UpdateColumn("size", 0).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Backfill(ctx); err != nil {
+		t.Fatal(err)
+	}
+	count := func(g *Gallery) int {
+		photos, err := s.Photo.ByGalleryID(ctx, g.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(photos)
+	}
+	if n := count(deleted); n != 0 {
+		t.Errorf("deleted gallery still has %d photos", n)
+	}
+	if n := count(withAccount); n != 1 {
+		t.Errorf("gallery of a restorable account has %d photos, want 1", n)
+	}
+	photo, err := s.Photo.ByID(ctx, unsized.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if photo.Size != int64(len(img)) || count(kept) != 1 {
+		t.Errorf("got size %d, want %d", photo.Size, len(img))
+	}
+}
+
+// slowUsage makes every usage lookup take a while, so that quota
+// checks started together overlap.
+type slowUsage struct {
+	PhotoDB
+}
+
+func (su slowUsage) UsageByGalleryIDs(ctx context.Context, galleryIDs []uint) (map[uint]Usage, error) {
+	usage, err := su.PhotoDB.UsageByGalleryIDs(ctx, galleryIDs)
+	time.Sleep(10 * time.Millisecond)
+	return usage, err
+}
+
+func TestCreateWithinQuotaConcurrently(t *testing.T) {
+	ctx := context.Background()
+	const quota = 5
+	users := NewUserMemory()
+	user := &User{Email: "al@example.com", RememberHash: "al"}
+	if err := users.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	galleries := NewGalleryMemory()
+	gallery := &Gallery{UserID: user.ID, Title: "Holiday"}
+	if err := galleries.Create(ctx, gallery); err != nil {
+		t.Fatal(err)
+	}
+	pv := &photoValidator{
+		PhotoDB:   slowUsage{NewPhotoMemory()},
+		galleries: galleries,
+		users:     users,
+		quota:     Quota{Photos: quota},
+	}
+
+	start := make(chan struct{})
+	errs := make(chan error)
+	for i := 0; i < 4*quota; i++ {
+		go func(i int) {
+			<-start
+			errs <- pv.Create(ctx, &Photo{
+				GalleryID: gallery.ID,
+				Filename:  fmt.Sprintf("%d.png", i),
+				Size:      1,
+			})
+		}(i)
+	}
+	close(start)
+	created := 0
+	for i := 0; i < 4*quota; i++ {
+		switch err := <-errs; err {
+		case nil:
+			created++
+		case ErrPhotoQuotaExceeded:
+		default:
+			t.Error(err)
+		}
+	}
+	photos, err := pv.ByGalleryID(ctx, gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created != quota || len(photos) != quota {
+		t.Errorf("created %d photos and stored %d, want %d", created, len(photos), quota)
+	}
+}
@@ -0,0 +1,484 @@
+package models
+
+import (
+	"container/list"
+	"crypto/subtle"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"io/fs"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	xdraw "golang.org/x/image/draw"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+const (
+	// ErrResizeSize is returned when a resized photo is asked for
+	// without a size, or bigger than MaxResizeSide.
+	ErrResizeSize modelError = "models: width and height must be between 1 and 4000"
+
+	// ErrResizeFit is returned when a resized photo is asked for
+	// with a fit that isn't one of the Fit* constants.
+	ErrResizeFit modelError = "models: fit must be contain, cover or fill"
+
+	// ErrResizeFormat is returned when a resized photo is asked for
+	// in a format that isn't one of the Format* constants.
+	ErrResizeFormat modelError = "models: format must be jpeg or png"
+
+	// ErrResizeSignature is returned when the signature of a resize
+	// URL doesn't match its parameters.
+	ErrResizeSignature modelError = "models: image signature is not valid"
+)
+
+// How a photo is fitted into the width and height it is resized to.
+const (
+	// FitContain shrinks the photo until it fits inside the box,
+	// keeping its shape. It is the default.
+	FitContain = "contain"
+	// FitCover shrinks the photo until it covers the box and crops
+	// what sticks out on either side.
+	FitCover = "cover"
+	// FitFill stretches the photo to the box.
+	FitFill = "fill"
+)
+
+// Formats a resized photo can be encoded in. Without one a photo is
+// encoded as renderedExt says.
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+)
+
+const (
+	// MaxResizeSide is the widest or tallest a photo can be resized
+	// to.
+	MaxResizeSide = 4000
+
+	// DefaultResizeCacheSize is how many bytes of resized photos are
+	// kept on disk unless WithResize says otherwise.
+	DefaultResizeCacheSize = 512 << 20
+)
+
+// Resize describes a resized copy of a photo. Either Width or Height
+// can be 0 to leave that side to follow from the other. Photos are
+// never enlarged.
+type Resize struct {
+	Width, Height int
+	Fit           string
+	Format        string
+}
+
+// ParseResize reads a Resize from the w, h, fit and fm parameters
+// of q.
+func ParseResize(q url.Values) (Resize, error) {
+	rs := Resize{Fit: q.Get("fit"), Format: q.Get("fm")}
+	for _, p := range []struct {
+		key string
+		dst *int
+	}{{"w", &rs.Width}, {"h", &rs.Height}} {
+		v := q.Get(p.key)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return rs, ErrResizeSize
+		}
+		*p.dst = n
+	}
+	if rs.Fit == "" {
+		rs.Fit = FitContain
+	}
+	return rs, rs.validate()
+}
+
+func (rs Resize) validate() error {
+	if rs.Width == 0 && rs.Height == 0 ||
+		rs.Width < 0 || rs.Width > MaxResizeSide ||
+		rs.Height < 0 || rs.Height > MaxResizeSide {
+		return ErrResizeSize
+	}
+	switch rs.Fit {
+	case FitContain, FitCover, FitFill:
+	default:
+		return ErrResizeFit
+	}
+	switch rs.Format {
+	case "", FormatJPEG, FormatPNG:
+	default:
+		return ErrResizeFormat
+	}
+	return nil
+}
+
+// values returns the parameters ParseResize reads rs from, leaving
+// out the ones that are unset.
+func (rs Resize) values() url.Values {
+	v := url.Values{}
+	if rs.Width > 0 {
+		v.Set("w", strconv.Itoa(rs.Width))
+	}
+	if rs.Height > 0 {
+		v.Set("h", strconv.Itoa(rs.Height))
+	}
+	if rs.Fit != "" && rs.Fit != FitContain {
+		v.Set("fit", rs.Fit)
+	}
+	if rs.Format != "" {
+		v.Set("fm", rs.Format)
+	}
+	return v
+}
+
+// ext is the extension of the file a photo stored under filename is
+// resized into.
+func (rs Resize) ext(filename string) string {
+	switch rs.Format {
+	case FormatJPEG:
+		return ".jpg"
+	case FormatPNG:
+		return ".png"
+	}
+	return renderedExt(filename)
+}
+
+// bounds works out how big a photo of size src comes out and which
+// part of it is used.
+func (rs Resize) bounds(src image.Rectangle) (dst, crop image.Rectangle) {
+	sw, sh := float64(src.Dx()), float64(src.Dy())
+	w, h := float64(rs.Width), float64(rs.Height)
+	fit := rs.Fit
+	if w == 0 || h == 0 {
+		// With one side free the photo's own shape decides the other,
+		// which is what contain does.
+		fit = FitContain
+		if w == 0 {
+			w = math.Inf(1)
+		} else {
+			h = math.Inf(1)
+		}
+	}
+	crop = src
+	switch fit {
+	case FitFill:
+		w, h = math.Min(w, sw), math.Min(h, sh)
+	case FitCover:
+		// Shrink the box until it fits the photo, then cut the
+		// middle of the photo out in the box's shape.
+		if f := math.Min(sw/w, sh/h); f < 1 {
+			w, h = w*f, h*f
+		}
+		cw, ch := sw, sw*h/w
+		if ch > sh {
+			cw, ch = sh*w/h, sh
+		}
+		x := src.Min.X + int((sw-cw)/2)
+		y := src.Min.Y + int((sh-ch)/2)
+		crop = image.Rect(x, y, x+int(math.Round(cw)), y+int(math.Round(ch)))
+	default:
+		f := math.Min(1, math.Min(w/sw, h/sh))
+		w, h = sw*f, sh*f
+	}
+	dst = image.Rect(0, 0,
+		max(1, int(math.Round(w))), max(1, int(math.Round(h))))
+	return dst, crop
+}
+
+// ResizeConfig sets up the resized photos served by OpenResized.
+type ResizeConfig struct {
+	// Key signs the URLs of resized photos. If it is empty, a
+	// random one is made up and kept in ResizeKeyFile, so the URLs
+	// still work after a restart.
+	Key string
+	// CacheSize is how many bytes of resized photos are kept on
+	// disk. The ones used least recently are removed first.
+	CacheSize int64
+}
+
+// ResizedCacheDir returns the directory holding resized photos,
+// below the image root passed to WithImageDir.
+func ResizedCacheDir(imageDir string) string {
+	return filepath.Join(imageDir, "cache", "resized")
+}
+
+// ResizeKeyFile returns the file the resize key made up when none
+// is set is kept in, below the image root passed to WithImageDir.
+func ResizeKeyFile(imageDir string) string {
+	return filepath.Join(imageDir, "resize.key")
+}
+
+// loadResizeKey returns the key kept in ResizeKeyFile, making one up
+// and writing it there first if there isn't one. Only the server's
+// own user can read the file.
+func loadResizeKey(imageDir string) (string, error) {
+	path := ResizeKeyFile(imageDir)
+	key, err := readResizeKey(path)
+	if !os.IsNotExist(err) {
+		return key, err
+	}
+	if key, err = rand.Strings(32); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(imageDir, 0755); err != nil {
+		return "", err
+	}
+	// The key is written to a temporary file that is then linked
+	// into place, so of two processes starting at once, one wins and
+	// the other reads its key.
+	tmp, err := os.CreateTemp(imageDir, "resize.key.*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(key + "\n"); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Link(tmp.Name(), path); os.IsExist(err) {
+		return readResizeKey(path)
+	} else if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func readResizeKey(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(b))
+	if key == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return key, nil
+}
+
+// resizeMessage is what the signature of a resize URL is the HMAC of.
+func resizeMessage(galleryID uint, filename string, rs Resize) string {
+	return fmt.Sprintf("%d/%s?%s", galleryID, filename, rs.values().Encode())
+}
+
+func (ps *photoService) ResizedPath(photo *Photo, rs Resize) string {
+	v := rs.values()
+	// hash.HMAC can't be shared between goroutines, and making one
+	// is cheap next to serving an image.
+	v.Set("s", hash.NewHMAC(ps.resize.Key).Hash(
+		resizeMessage(photo.GalleryID, photo.Filename, rs)))
+	return "/images/resized/" + strconv.FormatUint(uint64(photo.GalleryID), 10) +
+		"/" + url.PathEscape(photo.Filename) + "?" + v.Encode()
+}
+
+func (ps *photoService) VerifyResize(galleryID uint, filename string, rs Resize, sig string) error {
+	want := hash.NewHMAC(ps.resize.Key).Hash(resizeMessage(galleryID, filename, rs))
+	if subtle.ConstantTimeCompare([]byte(want), []byte(sig)) != 1 {
+		return ErrResizeSignature
+	}
+	return nil
+}
+
+func (ps *photoService) OpenResized(gallery *Gallery, photo *Photo, rs Resize, watermark bool) (io.ReadSeekCloser, string, error) {
+	if photo.GalleryID != gallery.ID {
+		return nil, "", ErrNotFound
+	}
+	if rs.Fit == "" {
+		rs.Fit = FitContain
+	}
+	if err := rs.validate(); err != nil {
+		return nil, "", err
+	}
+	stored := filepath.Base(photo.Filename)
+	base := strings.TrimSuffix(stored, filepath.Ext(stored))
+	name := fmt.Sprintf("%s-%dx%d-%s", base, rs.Width, rs.Height, rs.Fit)
+	wm := &gallery.Watermark
+	watermark = watermark && wm.Enabled()
+	if watermark {
+		name += "-" + wm.key()
+	}
+	name += rs.ext(stored)
+	rel := filepath.Join(fmt.Sprint(gallery.ID), name)
+	if f, err := ps.resized.open(rel); err == nil {
+		return f, name, nil
+	}
+
+	src, err := decodePhoto(filepath.Join(GalleryDir(ps.imageDir, gallery.ID), stored))
+	if err != nil {
+		return nil, "", err
+	}
+	dr, crop := rs.bounds(src.Bounds())
+	img := image.NewRGBA(dr)
+	if filepath.Ext(name) == ".jpg" {
+		// JPEGs have no transparency, which would otherwise come
+		// out black.
+		draw.Draw(img, dr, image.NewUniform(color.White), image.Point{}, draw.Src)
+	}
+	xdraw.CatmullRom.Scale(img, dr, src, crop, draw.Over, nil)
+	if watermark {
+		if err := ps.drawWatermark(img, wm); err != nil {
+			return nil, "", err
+		}
+	}
+	path := filepath.Join(ps.resized.dir, rel)
+	if err := writeRendered(path, img); err != nil {
+		return nil, "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if fi, err := f.Stat(); err == nil {
+		ps.resized.add(rel, fi.Size())
+	}
+	return f, name, nil
+}
+
+// resizeCache keeps track of the resized photos on disk, and removes
+// the ones used least recently once they take up more than max
+// bytes. The files are listed from disk on first use, oldest
+// modification time first, and touched whenever they are served, so
+// the order survives a restart.
+type resizeCache struct {
+	dir string
+	max int64
+
+	mu      sync.Mutex
+	loaded  bool
+	size    int64
+	lru     *list.List // of *resizeEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type resizeEntry struct {
+	name string
+	size int64
+}
+
+func newResizeCache(dir string, max int64) *resizeCache {
+	return &resizeCache{
+		dir:     dir,
+		max:     max,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// load lists the files already in the cache. c.mu must be held.
+func (c *resizeCache) load() {
+	if c.loaded {
+		return
+	}
+	c.loaded = true
+	type file struct {
+		name    string
+		size    int64
+		modtime time.Time
+	}
+	var files []file
+	filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(c.dir, path)
+		files = append(files, file{rel, fi.Size(), fi.ModTime()})
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modtime.Before(files[j].modtime)
+	})
+	for _, f := range files {
+		c.put(f.name, f.size)
+	}
+	c.evict()
+}
+
+// open opens the cached file name and marks it as just used.
+func (c *resizeCache) open(name string) (*os.File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	e, ok := c.entries[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	path := filepath.Join(c.dir, name)
+	f, err := os.Open(path)
+	if err != nil {
+		c.drop(e)
+		return nil, err
+	}
+	c.lru.MoveToFront(e)
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return f, nil
+}
+
+// add records the file name, which is size bytes, as just written
+// and removes the least recently used files if the cache is full.
+func (c *resizeCache) add(name string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	c.put(name, size)
+	c.evict()
+}
+
+// remove removes the cached files of the gallery with the given ID
+// whose names start with prefix.
+func (c *resizeCache) remove(galleryID uint, prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load()
+	// The separator keeps gallery 1 from matching gallery 12.
+	prefix = fmt.Sprint(galleryID) + string(filepath.Separator) + prefix
+	for name, e := range c.entries {
+		if strings.HasPrefix(name, prefix) {
+			os.Remove(filepath.Join(c.dir, name))
+			c.drop(e)
+		}
+	}
+}
+
+// put adds name to the front of the list. c.mu must be held.
+func (c *resizeCache) put(name string, size int64) {
+	if e, ok := c.entries[name]; ok {
+		c.drop(e)
+	}
+	c.entries[name] = c.lru.PushFront(&resizeEntry{name: name, size: size})
+	c.size += size
+}
+
+// drop forgets e. c.mu must be held.
+func (c *resizeCache) drop(e *list.Element) {
+	re := c.lru.Remove(e).(*resizeEntry)
+	delete(c.entries, re.name)
+	c.size -= re.size
+}
+
+// evict removes the least recently used files until the cache fits
+// in c.max, keeping at least the newest. c.mu must be held.
+func (c *resizeCache) evict() {
+	for c.size > c.max && c.lru.Len() > 1 {
+		e := c.lru.Back()
+		os.Remove(filepath.Join(c.dir, e.Value.(*resizeEntry).name))
+		c.drop(e)
+	}
+}
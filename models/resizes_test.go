@@ -0,0 +1,110 @@
+package models
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+// signedResize returns the Resize and signature in the URL
+// ResizedPath makes for photo.
+func signedResize(t *testing.T, ps PhotoService, photo *Photo, rs Resize) (Resize, string) {
+	t.Helper()
+	u, err := url.Parse(ps.ResizedPath(photo, rs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseResize(u.Query())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got, u.Query().Get("s")
+}
+
+func TestVerifyResize(t *testing.T) {
+	ps, gallery := newTestPhotoService(t, Quota{})
+	photo := &Photo{GalleryID: gallery.ID, Filename: "abc.jpg"}
+	rs, sig := signedResize(t, ps, photo, Resize{Width: 400, Height: 300, Fit: FitCover})
+	if err := ps.VerifyResize(gallery.ID, "abc.jpg", rs, sig); err != nil {
+		t.Fatalf("signed URL: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		galleryID uint
+		filename  string
+		rs        Resize
+		sig       string
+	}{
+		{"other width", gallery.ID, "abc.jpg", Resize{Width: 4000, Height: 300, Fit: FitCover}, sig},
+		{"other fit", gallery.ID, "abc.jpg", Resize{Width: 400, Height: 300, Fit: FitFill}, sig},
+		{"other format", gallery.ID, "abc.jpg", Resize{Width: 400, Height: 300, Fit: FitCover, Format: FormatPNG}, sig},
+		{"other photo", gallery.ID, "def.jpg", rs, sig},
+		{"other gallery", gallery.ID + 1, "abc.jpg", rs, sig},
+		{"no signature", gallery.ID, "abc.jpg", rs, ""},
+		{"truncated", gallery.ID, "abc.jpg", rs, sig[:len(sig)-1]},
+	}
+	for _, tc := range tests {
+		err := ps.VerifyResize(tc.galleryID, tc.filename, tc.rs, tc.sig)
+		if err != ErrResizeSignature {
+			t.Errorf("%s: got %v, want ErrResizeSignature", tc.name, err)
+		}
+	}
+
+	other := NewMemoryPhotoService(NewGalleryMemory(), NewUserMemory(), t.TempDir(),
+		Quota{}, ResizeConfig{Key: "other"})
+	if err := other.VerifyResize(gallery.ID, "abc.jpg", rs, sig); err != ErrResizeSignature {
+		t.Errorf("other key: got %v, want ErrResizeSignature", err)
+	}
+}
+
+func TestLoadResizeKey(t *testing.T) {
+	dir := t.TempDir() + "/images"
+	key, err := loadResizeKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) < 32 {
+		t.Errorf("key %q is too short", key)
+	}
+	fi, err := os.Stat(ResizeKeyFile(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("key file mode is %v, want 0600", perm)
+	}
+	again, err := loadResizeKey(dir)
+	if err != nil || again != key {
+		t.Errorf("second start got %q, %v, want %q", again, err, key)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("%d files in the image directory, want just the key", len(entries))
+	}
+
+	if err := os.WriteFile(ResizeKeyFile(dir), []byte(" \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadResizeKey(dir); err == nil || !strings.Contains(err.Error(), "empty") {
+		t.Errorf("empty key file: got %v", err)
+	}
+}
+
+func TestNewServicesResizeKey(t *testing.T) {
+	dir := t.TempDir()
+	keys := make([]string, 2)
+	for i := range keys {
+		s, err := NewServices(DialectSQLite, ":memory:", WithLogger(discard),
+			WithSQLLogLevel(SQLLogOff), WithImageDir(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = s.resize.Key
+		s.Close()
+	}
+	if keys[0] == "" || keys[0] != keys[1] {
+		t.Errorf("keys across restarts: %q", keys)
+	}
+}
@@ -1,30 +1,196 @@
 package models
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// Supported values for the dialect passed to NewServices.
+const (
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite3"
 )
 
 type Services struct {
-	Gallery GalleryService
-	User    UserService
-	db      *gorm.DB
+	Gallery  GalleryService
+	User     UserService
+	Stats    StatsService
+	Audit    AuditService
+	Account  AccountService
+	Photo    PhotoService
+	Upload   UploadService
+	Proof    ProofService
+	Comment  CommentService
+	db       *gorm.DB
+	logger   *slog.Logger
+	imageDir string
+	policy   PasswordPolicy
+	expiry   time.Duration
+	quota    Quota
+	resize   ResizeConfig
+}
+
+// ServicesConfig is used to tweak the Services returned by
+// NewServices, eg to set the logger or SQL log level.
+type ServicesConfig func(*Services) error
+
+// WithLogger sets the logger used by the services and for any
+// SQL statements logged by gorm.
+func WithLogger(logger *slog.Logger) ServicesConfig {
+	return func(s *Services) error {
+		s.logger = logger
+		return nil
+	}
+}
+
+// WithImageDir sets the directory gallery files are stored
+// under. It defaults to "images".
+func WithImageDir(dir string) ServicesConfig {
+	return func(s *Services) error {
+		s.imageDir = dir
+		return nil
+	}
+}
+
+// WithPasswordPolicy sets the rules new passwords must pass. It
+// defaults to DefaultPasswordPolicy.
+func WithPasswordPolicy(policy PasswordPolicy) ServicesConfig {
+	return func(s *Services) error {
+		s.policy = policy
+		return nil
+	}
+}
+
+// WithUploadExpiry sets how long resumable uploads are kept after
+// their last chunk. It defaults to DefaultUploadExpiry.
+func WithUploadExpiry(expiry time.Duration) ServicesConfig {
+	return func(s *Services) error {
+		s.expiry = expiry
+		return nil
+	}
+}
+
+// WithQuota sets the quota of users who haven't been given one of
+// their own. It defaults to DefaultQuota.
+func WithQuota(quota Quota) ServicesConfig {
+	return func(s *Services) error {
+		if quota.Bytes < 0 || quota.Photos < 0 {
+			return ErrQuotaInvalid
+		}
+		s.quota = quota
+		return nil
+	}
+}
+
+// WithResize sets the key resized photo URLs are signed with and
+// how much disk their cache can use. The cache defaults to
+// DefaultResizeCacheSize.
+func WithResize(cfg ResizeConfig) ServicesConfig {
+	return func(s *Services) error {
+		if cfg.CacheSize < 0 {
+			return fmt.Errorf("models: resize cache size can't be negative")
+		}
+		s.resize = cfg
+		return nil
+	}
 }
 
-func NewServices(connectionInfo string) (*Services, error) {
-	db, err := gorm.Open("postgres", connectionInfo)
+// WithSQLLogLevel controls how much gorm logs. See SQLLogLevel
+// for the available levels.
+func WithSQLLogLevel(level SQLLogLevel) ServicesConfig {
+	return func(s *Services) error {
+		switch level {
+		case SQLLogOff:
+			s.db.LogMode(false)
+		case SQLLogAll:
+			s.db.LogMode(true)
+		}
+		return nil
+	}
+}
+
+// NewServices opens a database connection using the given gorm
+// dialect and builds every service on top of it.
+//
+// For DialectPostgres connectionInfo is a libpq connection string.
+// For DialectSQLite it is a file path, or ":memory:" for a
+// throwaway in-memory database.
+func NewServices(dialect, connectionInfo string, cfgs ...ServicesConfig) (*Services, error) {
+	dialect, err := ParseDialect(dialect)
+	if err != nil {
+		return nil, err
+	}
+	db, err := gorm.Open(dialect, connectionInfo)
 	if err != nil {
 		return nil,
-			fmt.Errorf("Unable to open postgres conn.. actual error: %s", err.Error())
+			fmt.Errorf("Unable to open %s conn.. actual error: %s", dialect, err.Error())
+	}
+	if dialect == DialectSQLite {
+		// SQLite only allows a single writer, and every connection
+		// to ":memory:" gets its own empty database, so funnel all
+		// queries through one connection.
+		db.DB().SetMaxOpenConns(1)
+	}
+
+	s := &Services{
+		db:       db,
+		logger:   slog.Default(),
+		imageDir: "images",
+		policy:   DefaultPasswordPolicy,
+		expiry:   DefaultUploadExpiry,
+		quota:    DefaultQuota,
+		resize:   ResizeConfig{CacheSize: DefaultResizeCacheSize},
+	}
+	for _, cfg := range cfgs {
+		if err := cfg(s); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if s.resize.Key == "" {
+		if s.resize.Key, err = loadResizeKey(s.imageDir); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("resize key: %w", err)
+		}
 	}
-	db.LogMode(true)
+	setLogger(db, s.logger)
+	registerContextCallbacks(db)
+	registerMetricsCallbacks(db)
+	s.Audit = NewAuditService(db, s.logger)
+	s.User = NewUserService(db, s.logger, s.Audit, s.policy)
+	s.Gallery = NewGalleryService(db)
+	s.Stats = NewStatsService(db)
+	s.Photo = NewPhotoService(db, s.Gallery, s.User, s.imageDir, s.quota,
+		s.resize)
+	s.Upload = NewUploadService(db, s.Photo, s.Gallery, s.imageDir, s.expiry)
+	s.Proof = NewProofService(db)
+	s.Comment = NewCommentService(db)
+	s.Account = NewAccountService(db, s.Audit, s.imageDir, s.logger)
+	return s, nil
+}
 
-	return &Services{
-		User:    NewUserService(db),
-		Gallery: NewGalleryService(db),
-		db:      db,
-	}, nil
+// ParseDialect normalizes a dialect name, accepting "sqlite" as
+// an alias for DialectSQLite.
+func ParseDialect(dialect string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(dialect)) {
+	case "", DialectPostgres, "postgresql":
+		return DialectPostgres, nil
+	case DialectSQLite, "sqlite":
+		return DialectSQLite, nil
+	}
+	return "", fmt.Errorf("models: unsupported database dialect %q", dialect)
+}
+
+// Ping verifies that the database is reachable.
+func (s *Services) Ping(ctx context.Context) error {
+	return s.db.DB().PingContext(ctx)
 }
 
 func (s *Services) Close() error {
@@ -32,13 +198,35 @@ func (s *Services) Close() error {
 }
 
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}).Error
+	return s.db.AutoMigrate(&User{}, &Gallery{}, &AuditEvent{},
+		&LoginToken{}, &Identity{}, &Photo{}, &PhotoMetadata{},
+		&PendingUpload{}, &Proof{}, &ProofPick{}, &Comment{}).Error
+}
+
+// Backfill brings data written by older versions up to date: it
+// records the size and hashes of photos uploaded before those were
+// tracked, and removes the photos of galleries deleted before their
+// photos were removed along with them. It goes through every photo,
+// so it is run once after upgrading, with lenslocked-admin backfill,
+// rather than on every start.
+func (s *Services) Backfill(ctx context.Context) error {
+	db := withContext(ctx, s.db)
+	if err := backfillPhotoSizes(db, s.imageDir); err != nil {
+		return err
+	}
+	if err := backfillPhotoHashes(db, s.imageDir); err != nil {
+		return err
+	}
+	return removeDeletedGalleryPhotos(ctx, s.db, s.Photo)
 }
 
 // DestructiveReset will drop all our tables and resets the database
 // This should not be used normally, but will help when writing tests
 func (s *Services) DestructiveReset() error {
-	if err := s.db.DropTableIfExists(&User{}, &Gallery{}).Error; err != nil {
+	if err := s.db.DropTableIfExists(&User{}, &Gallery{},
+		&AuditEvent{}, &LoginToken{}, &Identity{}, &Photo{},
+		&PhotoMetadata{}, &PendingUpload{}, &Proof{}, &ProofPick{},
+		&Comment{}).Error; err != nil {
 		return err
 	}
 	return s.AutoMigrate()
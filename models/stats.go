@@ -0,0 +1,68 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// SiteStats is a snapshot of basic usage numbers shown on the
+// admin dashboard.
+type SiteStats struct {
+	Users         int
+	Admins        int
+	DisabledUsers int
+	Galleries     int
+
+	// NewUsers and NewGalleries count what was created within
+	// the last RecentWindow.
+	NewUsers     int
+	NewGalleries int
+}
+
+// RecentWindow is the period SiteStats.NewUsers and
+// SiteStats.NewGalleries cover.
+const RecentWindow = 7 * 24 * time.Hour
+
+// StatsService computes site wide statistics.
+type StatsService interface {
+	Site(ctx context.Context) (*SiteStats, error)
+}
+
+func NewStatsService(db *gorm.DB) StatsService {
+	return &statsGorm{db: db}
+}
+
+type statsGorm struct {
+	db *gorm.DB
+}
+
+func (sg *statsGorm) Site(ctx context.Context) (*SiteStats, error) {
+	var stats SiteStats
+	since := time.Now().Add(-RecentWindow)
+	db := withContext(ctx, sg.db)
+
+	counts := []struct {
+		model interface{}
+		where []interface{}
+		dst   *int
+	}{
+		{&User{}, nil, &stats.Users},
+		{&User{}, []interface{}{"role = ?", RoleAdmin}, &stats.Admins},
+		{&User{}, []interface{}{"disabled = ?", true}, &stats.DisabledUsers},
+		{&User{}, []interface{}{"created_at > ?", since}, &stats.NewUsers},
+		{&Gallery{}, nil, &stats.Galleries},
+		{&Gallery{}, []interface{}{"created_at > ?", since}, &stats.NewGalleries},
+	}
+	for _, c := range counts {
+		q := db.Model(c.model)
+		if c.where != nil {
+			q = q.Where(c.where[0], c.where[1:]...)
+		}
+		if err := q.Count(c.dst).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &stats, nil
+}
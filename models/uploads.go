@@ -0,0 +1,385 @@
+package models
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+
+	"lenslocked.com/rand"
+)
+
+const (
+	// ErrUploadLength is returned when an upload doesn't say how
+	// big it will be, or says it will be empty.
+	ErrUploadLength modelError = "models: uploads must say how many bytes they have"
+
+	// ErrUploadTooLarge is returned when an upload is bigger than
+	// MaxResumableUploadBytes.
+	ErrUploadTooLarge modelError = "models: the upload is too large"
+
+	// ErrUploadOffset is returned when a chunk doesn't continue
+	// where the upload left off. The client should ask for the
+	// current offset and resume from there.
+	ErrUploadOffset modelError = "models: the chunk doesn't continue where the upload left off"
+
+	// ErrUploadLocked is returned while another request is still
+	// writing to the upload.
+	ErrUploadLocked modelError = "models: the upload is busy with another request"
+
+	// ErrUploadsPending is returned when a user already has
+	// MaxPendingUploads unfinished uploads.
+	ErrUploadsPending modelError = "models: you have too many unfinished uploads. " +
+		"Finish them, or wait for them to expire, before starting another"
+)
+
+const (
+	// MaxResumableUploadBytes is the largest file a resumable
+	// upload can hold.
+	MaxResumableUploadBytes = 256 << 20
+
+	// MaxPendingUploads is how many unfinished uploads a user may
+	// have at once.
+	MaxPendingUploads = 20
+
+	// DefaultUploadExpiry is how long an upload is kept after the
+	// last chunk arrived before the sweep removes it.
+	DefaultUploadExpiry = 24 * time.Hour
+)
+
+// PendingUpload is a resumable upload of a photo that hasn't been
+// completely received yet. The bytes received so far are kept in
+// a file below the image directory, so an upload can be continued
+// after a dropped connection or a server restart. Once Offset
+// reaches Length the file becomes a photo in the gallery and the
+// upload is removed.
+type PendingUpload struct {
+	ID        string `gorm:"primary_key;size:32"`
+	CreatedAt time.Time
+	UserID    uint `gorm:"not null;index"`
+	GalleryID uint `gorm:"not null"`
+	// Name is what the file is called on the uploader's computer.
+	Name   string
+	Length int64 `gorm:"not null"`
+	Offset int64 `gorm:"not null;default:0"`
+	// ExpiresAt is pushed back whenever a chunk arrives.
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// Complete reports whether every byte of the upload has arrived.
+func (u *PendingUpload) Complete() bool {
+	return u.Offset >= u.Length
+}
+
+// UploadService manages resumable uploads.
+type UploadService interface {
+	UploadDB
+
+	// Start creates the upload and the empty file its bytes will
+	// be written to. The ID and expiry are filled in.
+	Start(ctx context.Context, upload *PendingUpload) error
+
+	// Append writes the bytes read from r to the upload, which
+	// must currently be at offset. Anything past the upload's
+	// Length is left unread. The bytes that did arrive are kept
+	// even when reading r fails, so the client can resume. When the
+	// last byte arrives the file is added to the gallery and the
+	// new photo is returned; until then the photo is nil.
+	Append(ctx context.Context, upload *PendingUpload, offset int64, r io.Reader) (*Photo, error)
+
+	// Remove deletes the upload and its file.
+	Remove(ctx context.Context, upload *PendingUpload) error
+
+	// RemoveExpired removes the uploads that expired before now
+	// and returns how many there were.
+	RemoveExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+// UploadDB stores resumable uploads. ByID returns ErrNotFound for
+// uploads that don't exist or have expired.
+type UploadDB interface {
+	ByID(ctx context.Context, id string) (*PendingUpload, error)
+	// ByUserID returns the user's uploads that haven't expired.
+	ByUserID(ctx context.Context, userID uint) ([]PendingUpload, error)
+	Expired(ctx context.Context, now time.Time) ([]PendingUpload, error)
+	Create(ctx context.Context, upload *PendingUpload) error
+	Update(ctx context.Context, upload *PendingUpload) error
+	Delete(ctx context.Context, id string) error
+}
+
+// UploadDir returns the directory holding the bytes of resumable
+// uploads, below the image root passed to WithImageDir.
+func UploadDir(imageDir string) string {
+	return filepath.Join(imageDir, "uploads")
+}
+
+func NewUploadService(db *gorm.DB, photos PhotoService, galleries GalleryDB,
+	imageDir string, expiry time.Duration) UploadService {
+	return &uploadService{
+		UploadDB:  &uploadGorm{db},
+		photos:    photos,
+		galleries: galleries,
+		dir:       UploadDir(imageDir),
+		expiry:    expiry,
+		busy:      make(map[string]bool),
+	}
+}
+
+type uploadService struct {
+	UploadDB
+	photos    PhotoService
+	galleries GalleryDB
+	dir       string
+	expiry    time.Duration
+
+	// busy holds the IDs of the uploads being written to, so that
+	// two requests can't append to the same upload at once.
+	mu   sync.Mutex
+	busy map[string]bool
+
+	// starting is held while an upload is checked against the
+	// uploads already pending and created, so uploads started at
+	// the same time can't all claim the same room.
+	starting sync.Mutex
+}
+
+func (us *uploadService) path(id string) string {
+	return filepath.Join(us.dir, filepath.Base(id))
+}
+
+func (us *uploadService) Start(ctx context.Context, upload *PendingUpload) error {
+	if upload.Length <= 0 {
+		return ErrUploadLength
+	}
+	if upload.Length > MaxResumableUploadBytes {
+		return ErrUploadTooLarge
+	}
+	us.starting.Lock()
+	defer us.starting.Unlock()
+	// Refuse uploads that could never fit before the client spends
+	// time sending them. The user's other unfinished uploads count
+	// as if they had arrived, otherwise many could be started that
+	// only fit one at a time. Create checks again once the file is
+	// here.
+	gallery, err := us.galleries.ByID(ctx, upload.GalleryID)
+	if err != nil {
+		return err
+	}
+	pending, err := us.ByUserID(ctx, upload.UserID)
+	if err != nil {
+		return err
+	}
+	if len(pending) >= MaxPendingUploads {
+		return ErrUploadsPending
+	}
+	reserved := upload.Length
+	for _, p := range pending {
+		reserved += p.Length
+	}
+	if err := us.photos.CheckQuota(ctx, gallery, len(pending)+1, reserved); err != nil {
+		return err
+	}
+	id, err := rand.Strings(18)
+	if err != nil {
+		return err
+	}
+	upload.ID = id
+	upload.Offset = 0
+	upload.Name = filepath.Base(upload.Name)
+	upload.ExpiresAt = time.Now().Add(us.expiry)
+
+	if err := os.MkdirAll(us.dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(us.path(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(us.path(id))
+		return err
+	}
+	if err := us.Create(ctx, upload); err != nil {
+		os.Remove(us.path(id))
+		return err
+	}
+	return nil
+}
+
+func (us *uploadService) lock(id string) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if us.busy[id] {
+		return false
+	}
+	us.busy[id] = true
+	return true
+}
+
+func (us *uploadService) unlock(id string) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	delete(us.busy, id)
+}
+
+func (us *uploadService) Append(ctx context.Context, upload *PendingUpload, offset int64, r io.Reader) (*Photo, error) {
+	if !us.lock(upload.ID) {
+		return nil, ErrUploadLocked
+	}
+	defer us.unlock(upload.ID)
+
+	// Another request may have moved the upload on since the
+	// caller looked it up.
+	current, err := us.ByID(ctx, upload.ID)
+	if err != nil {
+		return nil, err
+	}
+	*upload = *current
+	if offset != upload.Offset {
+		return nil, ErrUploadOffset
+	}
+	// A completed upload that is still here failed to become a
+	// photo, so appending nothing tries again.
+	if upload.Complete() {
+		return us.finish(ctx, upload)
+	}
+
+	f, err := os.OpenFile(us.path(upload.ID), os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	n, readErr := io.Copy(f, io.LimitReader(r, upload.Length-upload.Offset))
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		upload.Offset += n
+		upload.ExpiresAt = time.Now().Add(us.expiry)
+		// A dropped connection cancels ctx, and that is exactly
+		// when the bytes that made it need recording.
+		if err := us.Update(context.WithoutCancel(ctx), upload); err != nil {
+			return nil, err
+		}
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	if !upload.Complete() {
+		return nil, nil
+	}
+	return us.finish(ctx, upload)
+}
+
+// finish adds the completed upload to its gallery as a photo and
+// removes the upload. An upload that isn't an image, or is too
+// large a one, can never become a photo, so it is removed as well.
+func (us *uploadService) finish(ctx context.Context, upload *PendingUpload) (*Photo, error) {
+	gallery, err := us.galleries.ByID(ctx, upload.GalleryID)
+	if err == ErrNotFound {
+		us.Remove(ctx, upload)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(us.path(upload.ID))
+	if err != nil {
+		return nil, err
+	}
+	photo, err := us.photos.Upload(ctx, gallery, upload.Name, f)
+	f.Close()
+	if err != nil && err != ErrPhotoType && err != ErrPhotoPixels {
+		return nil, err
+	}
+	if rmErr := us.Remove(ctx, upload); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	return photo, err
+}
+
+func (us *uploadService) Remove(ctx context.Context, upload *PendingUpload) error {
+	if err := us.Delete(ctx, upload.ID); err != nil {
+		return err
+	}
+	err := os.Remove(us.path(upload.ID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (us *uploadService) RemoveExpired(ctx context.Context, now time.Time) (int, error) {
+	uploads, err := us.Expired(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for i := range uploads {
+		if !us.lock(uploads[i].ID) {
+			continue
+		}
+		err := us.Remove(ctx, &uploads[i])
+		us.unlock(uploads[i].ID)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+var _ UploadDB = &uploadGorm{}
+
+type uploadGorm struct {
+	db *gorm.DB
+}
+
+func (ug *uploadGorm) ByID(ctx context.Context, id string) (*PendingUpload, error) {
+	var upload PendingUpload
+	db := withContext(ctx, ug.db).Where("id = ? AND expires_at > ?", id, time.Now())
+	if err := first(db, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (ug *uploadGorm) ByUserID(ctx context.Context, userID uint) ([]PendingUpload, error) {
+	var uploads []PendingUpload
+	err := withContext(ctx, ug.db).
+		Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Find(&uploads).Error
+	if err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+func (ug *uploadGorm) Expired(ctx context.Context, now time.Time) ([]PendingUpload, error) {
+	var uploads []PendingUpload
+	err := withContext(ctx, ug.db).Where("expires_at <= ?", now).
+		Find(&uploads).Error
+	if err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+func (ug *uploadGorm) Create(ctx context.Context, upload *PendingUpload) error {
+	return withContext(ctx, ug.db).Create(upload).Error
+}
+
+func (ug *uploadGorm) Update(ctx context.Context, upload *PendingUpload) error {
+	return withContext(ctx, ug.db).Save(upload).Error
+}
+
+func (ug *uploadGorm) Delete(ctx context.Context, id string) error {
+	return withContext(ctx, ug.db).Where("id = ?", id).Delete(&PendingUpload{}).Error
+}
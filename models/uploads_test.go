@@ -0,0 +1,193 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// newTestUploadService returns an UploadService that adds finished
+// uploads to gallery, which is owned by a user with quota.
+func newTestUploadService(t *testing.T, quota Quota) (UploadService, PhotoService, *Gallery) {
+	t.Helper()
+	ps, gallery := newTestPhotoService(t, quota)
+	svc := ps.(*photoService)
+	us := NewMemoryUploadService(ps, svc.galleries, svc.imageDir, time.Hour)
+	return us, ps, gallery
+}
+
+func startUpload(t *testing.T, us UploadService, gallery *Gallery, length int64) *PendingUpload {
+	t.Helper()
+	upload := &PendingUpload{UserID: gallery.UserID, GalleryID: gallery.ID,
+		Name: "beach.png", Length: length}
+	if err := us.Start(context.Background(), upload); err != nil {
+		t.Fatal(err)
+	}
+	return upload
+}
+
+func TestUploadAppend(t *testing.T) {
+	ctx := context.Background()
+	us, ps, gallery := newTestUploadService(t, Quota{})
+	img := testPNGBytes(t)
+	upload := startUpload(t, us, gallery, int64(len(img)))
+	half := int64(len(img) / 2)
+
+	photo, err := us.Append(ctx, upload, 0, bytes.NewReader(img[:half]))
+	if err != nil || photo != nil {
+		t.Fatalf("first chunk: got %v, %v, want no photo yet", photo, err)
+	}
+	if upload.Offset != half {
+		t.Errorf("offset after first chunk = %d, want %d", upload.Offset, half)
+	}
+
+	// A chunk that doesn't continue at the current offset, such as
+	// a retry of one that did arrive, is refused.
+	for _, offset := range []int64{0, half - 1, half + 1} {
+		_, err := us.Append(ctx, upload, offset, bytes.NewReader(img[offset:]))
+		if err != ErrUploadOffset {
+			t.Errorf("append at %d: got %v, want ErrUploadOffset", offset, err)
+		}
+	}
+
+	// The client looks the offset up again, as it would after a
+	// dropped connection.
+	current, err := us.ByID(ctx, upload.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Offset != half {
+		t.Fatalf("stored offset = %d, want %d", current.Offset, half)
+	}
+	// Bytes past Length are left unread.
+	rest := io.MultiReader(bytes.NewReader(img[half:]), bytes.NewReader([]byte("extra")))
+	photo, err = us.Append(ctx, current, half, rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if photo == nil || photo.Size != int64(len(img)) {
+		t.Fatalf("got photo %+v, want one of %d bytes", photo, len(img))
+	}
+	if _, err := us.ByID(ctx, upload.ID); err != ErrNotFound {
+		t.Errorf("finished upload is still there: %v", err)
+	}
+	photos, _ := ps.ByGalleryID(ctx, gallery.ID)
+	if len(photos) != 1 {
+		t.Errorf("gallery has %d photos, want 1", len(photos))
+	}
+}
+
+// failingReader returns some bytes and then an error, like a
+// connection that drops mid-chunk.
+type failingReader struct {
+	data []byte
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if len(fr.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, fr.data)
+	fr.data = fr.data[n:]
+	return n, nil
+}
+
+func TestUploadAppendKeepsPartialChunk(t *testing.T) {
+	ctx := context.Background()
+	us, _, gallery := newTestUploadService(t, Quota{})
+	img := testPNGBytes(t)
+	upload := startUpload(t, us, gallery, int64(len(img)))
+
+	_, err := us.Append(ctx, upload, 0, &failingReader{img[:10]})
+	if err == nil {
+		t.Fatal("Append didn't report the failed read")
+	}
+	current, err := us.ByID(ctx, upload.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Offset != 10 {
+		t.Errorf("offset = %d, want the 10 bytes that arrived", current.Offset)
+	}
+	photo, err := us.Append(ctx, current, 10, bytes.NewReader(img[10:]))
+	if err != nil || photo == nil {
+		t.Fatalf("resume: got %v, %v, want a photo", photo, err)
+	}
+}
+
+func TestUploadStartLimits(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		quota   Quota
+		started []int64
+		length  int64
+		wantErr error
+	}{
+		{name: "no length", length: 0, wantErr: ErrUploadLength},
+		{name: "too large", length: MaxResumableUploadBytes + 1, wantErr: ErrUploadTooLarge},
+		{name: "over quota", quota: Quota{Bytes: 100}, length: 101, wantErr: ErrQuotaExceeded},
+		{
+			name:    "pending uploads count against the quota",
+			quota:   Quota{Bytes: 100},
+			started: []int64{60},
+			length:  60,
+			wantErr: ErrQuotaExceeded,
+		},
+		{
+			name:    "pending uploads count against the photo quota",
+			quota:   Quota{Photos: 2},
+			started: []int64{1, 1},
+			length:  1,
+			wantErr: ErrPhotoQuotaExceeded,
+		},
+		{
+			name:    "too many pending uploads",
+			started: make([]int64, MaxPendingUploads),
+			length:  1,
+			wantErr: ErrUploadsPending,
+		},
+		{
+			name:    "fits alongside pending uploads",
+			quota:   Quota{Bytes: 100, Photos: 3},
+			started: []int64{40, 40},
+			length:  20,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			us, _, gallery := newTestUploadService(t, tc.quota)
+			for _, length := range tc.started {
+				if length == 0 {
+					length = 1
+				}
+				startUpload(t, us, gallery, length)
+			}
+			upload := &PendingUpload{UserID: gallery.UserID,
+				GalleryID: gallery.ID, Length: tc.length}
+			if err := us.Start(ctx, upload); err != tc.wantErr {
+				t.Errorf("got %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestUploadRemoveExpired(t *testing.T) {
+	ctx := context.Background()
+	us, _, gallery := newTestUploadService(t, Quota{})
+	upload := startUpload(t, us, gallery, 10)
+	n, err := us.RemoveExpired(ctx, time.Now())
+	if err != nil || n != 0 {
+		t.Fatalf("removed %d, %v before the upload expired", n, err)
+	}
+	n, err = us.RemoveExpired(ctx, time.Now().Add(2*time.Hour))
+	if err != nil || n != 1 {
+		t.Fatalf("removed %d, %v, want 1", n, err)
+	}
+	if _, err := us.ByID(ctx, upload.ID); err != ErrNotFound {
+		t.Errorf("expired upload is still there: %v", err)
+	}
+}
@@ -1,15 +1,18 @@
 package models
 
 import (
+	"context"
+	"log/slog"
 	"regexp"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 	"lenslocked.com/hash"
+	"lenslocked.com/password"
 	"lenslocked.com/rand"
 
 	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/postgres"
 )
 
 const hmacSecretKey = "my_secret-hmac-key"
@@ -28,10 +31,6 @@ const (
 	// is used when attempting to authenticate a user.
 	ErrPasswordIncorrect modelError = "models: incorrect password provided"
 
-	// ErrPasswordTooShort is returned when a user tries to set
-	// a password that is less than 8 characters long.
-	ErrPasswordTooShort modelError = "models: password must be at least 8 characters long"
-
 	// ErrPasswordRequired is returned when a create is attempted
 	// without a user password provided.
 	ErrPasswordRequired modelError = "models: password is required"
@@ -48,6 +47,11 @@ const (
 	// with an email address that is already in use.
 	ErrEmailTaken modelError = "models: email address is already taken"
 
+	// ErrEmailPendingDeletion is returned when an email address
+	// belongs to an account that was deleted but not yet purged.
+	ErrEmailPendingDeletion modelError = "models: this email address belongs to an account that is being deleted. " +
+		"It can be used again once the deletion is complete, or contact us to restore the account"
+
 	// ErrRememberRequired is returned when a create or update
 	// is attempted without a user remember token hash
 	ErrRememberRequired modelError = "models: remember token is required"
@@ -55,6 +59,32 @@ const (
 	// ErrRememberTooShort is returned when a remember token is
 	// not at least 32 bytes
 	ErrRememberTooShort modelError = "models: remember token must be at least 32 bytes"
+
+	// ErrRoleInvalid is returned when a user is given a role
+	// other than RoleUser or RoleAdmin.
+	ErrRoleInvalid modelError = "models: role is not valid"
+
+	// ErrAccountDisabled is returned when a user whose account was
+	// disabled by an admin tries to authenticate.
+	ErrAccountDisabled modelError = "models: this account has been disabled"
+
+	// ErrEmailUnchanged is returned when a user asks to change
+	// their email address to the one they already have.
+	ErrEmailUnchanged modelError = "models: that is already your email address"
+
+	// ErrEmailTokenInvalid is returned when an email confirmation
+	// token is unknown or has expired.
+	ErrEmailTokenInvalid modelError = "models: email confirmation link is invalid or has expired"
+)
+
+// EmailTokenTTL is how long a user has to confirm a new email
+// address.
+const EmailTokenTTL = 24 * time.Hour
+
+// Roles a user can have.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
 )
 
 type User struct {
@@ -65,6 +95,47 @@ type User struct {
 	PasswordHash string `gorm:"not null"`
 	Remember     string `gorm:"-"`
 	RememberHash string `gorm:"not null;unique_index"`
+	Role         string `gorm:"not null;default:'user'"`
+
+	// Disabled accounts can no longer log in.
+	Disabled bool `gorm:"not null;default:false"`
+
+	// PasswordResetRequired forces the user to choose a new
+	// password before they can do anything else.
+	PasswordResetRequired bool `gorm:"not null;default:false"`
+
+	// QuotaBytes and QuotaPhotos are limits an admin set for this
+	// user in place of the default quota. Nil means the default
+	// applies and zero means there is no limit.
+	QuotaBytes  *int64
+	QuotaPhotos *int
+
+	// PendingEmail is the address the user asked to change to. It
+	// replaces Email once the link sent to it has been followed.
+	PendingEmail        string
+	EmailToken          string `gorm:"-"`
+	EmailTokenHash      string `gorm:"index"`
+	EmailTokenExpiresAt time.Time
+}
+
+// IsAdmin reports whether the user has the admin role.
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// LogValue implements slog.LogValuer so that logging a User only
+// ever writes its identifying fields. Passwords, remember tokens
+// and their hashes are never included.
+func (u *User) LogValue() slog.Value {
+	if u == nil {
+		return slog.AnyValue(nil)
+	}
+	return slog.GroupValue(
+		slog.Uint64("id", uint64(u.ID)),
+		slog.String("name", u.Name),
+		slog.String("email", u.Email),
+		slog.String("role", u.Role),
+	)
 }
 
 // UserDB is used to interact with the users database.
@@ -79,16 +150,37 @@ type User struct {
 // For single user queries, any error but ErrNotFound should
 // probably result in a 500 error until we make "public"
 // facing errors.
+//
+// Every method takes the context of the request it is serving so
+// that cancellation and deadlines reach the database.
 type UserDB interface {
 	// methods for querying single users
-	ByID(id uint) (*User, error)
-	ByEmail(email string) (*User, error)
-	ByRemember(token string) (*User, error)
+	ByID(ctx context.Context, id uint) (*User, error)
+	ByEmail(ctx context.Context, email string) (*User, error)
+	ByRemember(ctx context.Context, token string) (*User, error)
+	ByEmailToken(ctx context.Context, token string) (*User, error)
+
+	// ByEmailWithDeleted is ByEmail, but also finds users whose
+	// accounts were deleted and are waiting to be purged.
+	ByEmailWithDeleted(ctx context.Context, email string) (*User, error)
+
+	// All returns every user ordered by ID.
+	All(ctx context.Context) ([]User, error)
+
+	// Search returns up to SearchLimit users whose name or email
+	// contains query, ignoring case. An empty query matches every
+	// user.
+	Search(ctx context.Context, query string) ([]User, error)
 
 	// methods for creating and modifying a user
-	Create(user *User) error
-	Update(user *User) error
-	Delete(id uint) error
+	Create(ctx context.Context, user *User) error
+	Update(ctx context.Context, user *User) error
+	Delete(ctx context.Context, id uint) error
+
+	// CreateWithIdentity creates user and links identity to it in
+	// one transaction, so a failed link doesn't leave an account
+	// behind that nobody can sign in to.
+	CreateWithIdentity(ctx context.Context, user *User, identity *Identity) error
 }
 
 // UserService provides methods that interact with user model
@@ -98,13 +190,57 @@ type UserService interface {
 	// If it is a match return foundUser, nil
 	// If email not found rerturn nil, ErrNotFound
 	// If password does not match return nil, ErrInvalidPassword
+	// If the account is disabled return nil, ErrAccountDisabled
 	// otherwise return nil, error
-	Authenticate(email string, pwd string) (*User, error)
+	Authenticate(ctx context.Context, email string, pwd string) (*User, error)
+
+	// VerifyPassword checks pwd against the password of user, who
+	// is already signed in, eg before a change to their account.
+	// It returns ErrPasswordIncorrect if it doesn't match. Unlike
+	// Authenticate it isn't a login, so nothing is audited.
+	VerifyPassword(user *User, pwd string) error
+
+	// RequestEmailChange records email as the user's pending
+	// address and returns the token that must be sent to it to
+	// confirm the change.
+	RequestEmailChange(ctx context.Context, user *User, email string) (string, error)
+
+	// ConfirmEmailChange swaps in the pending address of the user
+	// the token was issued to. It returns the updated user along
+	// with their previous address, or ErrEmailTokenInvalid.
+	ConfirmEmailChange(ctx context.Context, token string) (user *User, oldEmail string, err error)
+
+	// RequestLoginLink creates a single use login token for the
+	// user with the given email address. It returns ErrNotFound or
+	// ErrAccountDisabled if no link should be sent.
+	RequestLoginLink(ctx context.Context, email string) (*User, string, error)
+
+	// AuthenticateLoginLink signs in the user a login token was
+	// issued to, using up the token. It returns
+	// ErrLoginTokenInvalid if the token can't be used.
+	AuthenticateLoginLink(ctx context.Context, token string) (*User, error)
+
+	// AuthenticateIdentity signs in the user linked to an identity
+	// from an external provider. Unknown identities are linked to
+	// the account with the same email address if the provider has
+	// verified it, or get a new account if there is none.
+	AuthenticateIdentity(ctx context.Context, ext ExternalIdentity) (*User, error)
+
+	// CheckPassword runs user.Password through the password policy
+	// without saving anything, so forms can show how strong a
+	// password is before it is submitted.
+	CheckPassword(user *User) (password.Estimate, error)
 	UserDB
 }
 
 type userService struct {
 	UserDB
+	logger     *slog.Logger
+	audit      AuditService
+	tokens     LoginTokenDB
+	identities IdentityDB
+	hmac       hash.HMAC
+	policy     PasswordPolicy
 }
 
 type userGorm struct {
@@ -118,6 +254,7 @@ type userValidator struct {
 	UserDB
 	hmac       hash.HMAC
 	emailRegex *regexp.Regexp
+	policy     PasswordPolicy
 }
 
 type userValFn func(*User) error
@@ -125,25 +262,64 @@ type userValFn func(*User) error
 func runUserValFns(user *User, fns ...userValFn) error {
 	for _, fn := range fns {
 		if err := fn(user); err != nil {
-			return err
+			return unwrapFieldError(err)
+		}
+	}
+	return nil
+}
+
+// runAllUserValFns is runUserValFns for ValidateAll: it carries on
+// past failing checks and returns everything that is wrong as
+// ValidationErrors.
+func runAllUserValFns(user *User, fns ...userValFn) error {
+	errs := ValidationErrors{}
+	for _, fn := range fns {
+		if err := fn(user); err != nil {
+			if err := collectError(errs, err); err != nil {
+				return err
+			}
 		}
 	}
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
-func NewUserService(db *gorm.DB) UserService {
+// userField runs fns in order, stopping at the first failure, and
+// ties the error to the named form field.
+func userField(field string, fns ...userValFn) userValFn {
+	return userValFn(func(user *User) error {
+		for _, fn := range fns {
+			if err := fn(user); err != nil {
+				return fieldError{field: field, err: err}
+			}
+		}
+		return nil
+	})
+}
+
+func NewUserService(db *gorm.DB, logger *slog.Logger, audit AuditService,
+	policy PasswordPolicy) UserService {
 	ug := &userGorm{db}
 	hmac := hash.NewHMAC(hmacSecretKey)
-	uv := newUserValidator(ug, hmac)
+	uv := newUserValidator(ug, hmac, policy)
 	return &userService{
-		UserDB: uv,
+		UserDB:     uv,
+		logger:     logger,
+		audit:      audit,
+		tokens:     &loginTokenGorm{db},
+		identities: &identityGorm{db},
+		hmac:       hmac,
+		policy:     policy,
 	}
 }
 
-func newUserValidator(udb UserDB, hmac hash.HMAC) *userValidator {
+func newUserValidator(udb UserDB, hmac hash.HMAC, policy PasswordPolicy) *userValidator {
 	return &userValidator{
 		UserDB: udb,
 		hmac:   hmac,
+		policy: policy,
 		emailRegex: regexp.MustCompile(
 			`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
 	}
@@ -219,35 +395,99 @@ func (uv *userValidator) emailFormat(user *User) error {
 	return nil
 }
 
-func (uv *userValidator) emailTaken(user *User) error {
-	existing, err := uv.ByEmail(user.Email)
-	if err == ErrNotFound {
-		// Email address is available
+// emailTaken needs to query the database, so it returns a
+// userValFn bound to the context of the calling request. Deleted
+// accounts keep their address until they are purged, since the
+// unique index on email still covers them.
+func (uv *userValidator) emailTaken(ctx context.Context) userValFn {
+	return userValFn(func(user *User) error {
+		return uv.emailAvailable(ctx, user.ID, user.Email)
+	})
+}
+
+// emailAvailable returns nil if email isn't used by any user other
+// than the one with the given ID.
+func (uv *userValidator) emailAvailable(ctx context.Context, id uint, email string) error {
+	existing, err := uv.ByEmailWithDeleted(ctx, email)
+	switch {
+	case err == ErrNotFound:
 		return nil
-	}
-	if err != nil {
-		// return if there is any other error
+	case err != nil:
 		return err
+	case existing.ID == id:
+		return nil
+	case existing.DeletedAt != nil:
+		return ErrEmailPendingDeletion
+	}
+	return ErrEmailTaken
+}
+
+func (uv *userValidator) hmacEmailToken(user *User) error {
+	if user.EmailToken == "" {
+		return nil
 	}
-	// If we get here that means we found a user w/ this email
-	// address, so we need to see if this is the same user we
-	// are updating, or if we have a conflict.
-	if user.ID != existing.ID {
-		return ErrEmailTaken
+	user.EmailTokenHash = uv.hmac.Hash(user.EmailToken)
+	return nil
+}
+
+func (uv *userValidator) normalizePendingEmail(user *User) error {
+	user.PendingEmail = strings.ToLower(user.PendingEmail)
+	user.PendingEmail = strings.TrimSpace(user.PendingEmail)
+	return nil
+}
+
+// pendingEmailValid applies the same rules to the pending address
+// as to the current one, so a confirmed change can't fail later.
+func (uv *userValidator) pendingEmailValid(ctx context.Context) userValFn {
+	return userValFn(func(user *User) error {
+		if user.PendingEmail == "" {
+			return nil
+		}
+		if user.PendingEmail == user.Email {
+			return ErrEmailUnchanged
+		}
+		if !uv.emailRegex.MatchString(user.PendingEmail) {
+			return ErrEmailInvalid
+		}
+		return uv.emailAvailable(ctx, user.ID, user.PendingEmail)
+	})
+}
+
+func (uv *userValidator) setRoleIfUnset(user *User) error {
+	if user.Role == "" {
+		user.Role = RoleUser
 	}
 	return nil
 }
 
-func (uv *userValidator) passwordLength(user *User) error {
-	if user.Password == "" {
+func (uv *userValidator) roleValid(user *User) error {
+	switch user.Role {
+	case RoleUser, RoleAdmin:
 		return nil
 	}
-	if len(user.Password) < 4 {
-		return ErrPasswordTooShort
+	return ErrRoleInvalid
+}
+
+func (uv *userValidator) quotaValid(user *User) error {
+	if user.QuotaBytes != nil && *user.QuotaBytes < 0 {
+		return ErrQuotaInvalid
+	}
+	if user.QuotaPhotos != nil && *user.QuotaPhotos < 0 {
+		return ErrQuotaInvalid
 	}
 	return nil
 }
 
+// passwordPolicy checks a new password against the policy. It
+// must run before bcryptPassword clears the plain text password.
+func (uv *userValidator) passwordPolicy(user *User) error {
+	if user.Password == "" {
+		return nil
+	}
+	_, err := uv.policy.Check(user)
+	return err
+}
+
 func (uv *userValidator) passwordRequired(user *User) error {
 	if user.Password == "" {
 		return ErrPasswordRequired
@@ -283,71 +523,117 @@ func (uv *userValidator) rememberHashRequired(user *User) error {
 	return nil
 }
 
-func (uv *userValidator) Create(user *User) error {
-	err := runUserValFns(user,
-		uv.passwordRequired,
-		uv.passwordLength,
+func (uv *userValidator) Create(ctx context.Context, user *User) error {
+	if err := uv.validateCreate(ctx, user); err != nil {
+		return err
+	}
+	return uv.UserDB.Create(ctx, user)
+}
+
+func (uv *userValidator) CreateWithIdentity(ctx context.Context, user *User, identity *Identity) error {
+	if err := uv.validateCreate(ctx, user); err != nil {
+		return err
+	}
+	return uv.UserDB.CreateWithIdentity(ctx, user, identity)
+}
+
+// validateCreate normalizes and validates a user that is about to
+// be created.
+func (uv *userValidator) validateCreate(ctx context.Context, user *User) error {
+	run := runUserValFns
+	if validateAll(ctx) {
+		run = runAllUserValFns
+	}
+	err := run(user,
+		userField("password",
+			uv.passwordRequired,
+			uv.passwordPolicy),
 		uv.bcryptPassword,
 		uv.setRememberIfUnset,
 		uv.rememberMinBytes,
 		uv.hmacRemember,
-		uv.normalizeEmail,
-		uv.requireEmail,
-		uv.emailFormat,
-		uv.emailTaken,
+		userField("email",
+			uv.normalizeEmail,
+			uv.requireEmail,
+			uv.emailFormat,
+			uv.emailTaken(ctx)),
+		uv.setRoleIfUnset,
+		uv.roleValid,
 	)
-	if err != nil {
-		return err
-	}
-	return uv.UserDB.Create(user)
+	return err
 }
 
 // Creates a user in the database with the associated hashed password
 // This function makes sure we do not store raw password and only stores hashed
 // passwords with the user record
-func (ug *userGorm) Create(user *User) error {
-	return ug.db.Create(user).Error
+func (ug *userGorm) Create(ctx context.Context, user *User) error {
+	return withContext(ctx, ug.db).Create(user).Error
+}
+
+func (ug *userGorm) CreateWithIdentity(ctx context.Context, user *User, identity *Identity) error {
+	tx := withContext(ctx, ug.db).Begin()
+	if err := tx.Create(user).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	identity.UserID = user.ID
+	if err := tx.Create(identity).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
 }
 
-func (uv *userValidator) Update(user *User) error {
-	if err := runUserValFns(user,
-		uv.passwordLength,
+func (uv *userValidator) Update(ctx context.Context, user *User) error {
+	run := runUserValFns
+	if validateAll(ctx) {
+		run = runAllUserValFns
+	}
+	if err := run(user,
+		userField("password", uv.passwordPolicy),
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
 		uv.rememberMinBytes,
 		uv.hmacRemember,
-		uv.normalizeEmail,
-		uv.requireEmail,
-		uv.emailFormat,
-		uv.emailTaken,
+		userField("email",
+			uv.normalizeEmail,
+			uv.requireEmail,
+			uv.emailFormat,
+			uv.emailTaken(ctx)),
+		uv.normalizePendingEmail,
+		uv.pendingEmailValid(ctx),
+		uv.hmacEmailToken,
+		uv.setRoleIfUnset,
+		uv.roleValid,
+		uv.quotaValid,
 	); err != nil {
 		return err
 	}
 
-	return uv.UserDB.Update(user)
+	return uv.UserDB.Update(ctx, user)
 }
 
 // Update will update the provided user with all of the data
 // in the provided user object.
-func (ug *userGorm) Update(user *User) error {
-	return ug.db.Save(user).Error
+func (ug *userGorm) Update(ctx context.Context, user *User) error {
+	return withContext(ctx, ug.db).Save(user).Error
 }
 
-func (uv *userValidator) Delete(id uint) error {
+func (uv *userValidator) Delete(ctx context.Context, id uint) error {
 	var user User
 	user.ID = id
 	err := runUserValFns(&user, uv.idGreaterThan(0))
 	if err != nil {
 		return err
 	}
-	return uv.UserDB.Delete(id)
+	return uv.UserDB.Delete(ctx, id)
 }
 
 // Delete will delete the user with provided ID
 // Delete will return an ErrInvalidID if ID provided is 0
-func (ug *userGorm) Delete(id uint) error {
+func (ug *userGorm) Delete(ctx context.Context, id uint) error {
 	user := User{Model: gorm.Model{ID: id}}
-	return ug.db.Delete(user).Error
+	return withContext(ctx, ug.db).Delete(user).Error
 }
 
 // ByID will look up a user with the provided ID.
@@ -359,9 +645,9 @@ func (ug *userGorm) Delete(id uint) error {
 //
 // As a general rule, any error but ErrNotFound should
 // probably result in a 500 error.
-func (ug *userGorm) ByID(id uint) (*User, error) {
+func (ug *userGorm) ByID(ctx context.Context, id uint) (*User, error) {
 	var user User
-	db := ug.db.Where("id = ?", id)
+	db := withContext(ctx, ug.db).Where("id = ?", id)
 	err := first(db, &user)
 
 	if err != nil {
@@ -372,7 +658,7 @@ func (ug *userGorm) ByID(id uint) (*User, error) {
 
 // ByEmail will normalize an email address before passing
 // it on to the database layer to perform the query.
-func (uv *userValidator) ByEmail(email string) (*User, error) {
+func (uv *userValidator) ByEmail(ctx context.Context, email string) (*User, error) {
 	user := User{
 		Email: email,
 	}
@@ -380,7 +666,7 @@ func (uv *userValidator) ByEmail(email string) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
-	return uv.UserDB.ByEmail(user.Email)
+	return uv.UserDB.ByEmail(ctx, user.Email)
 }
 
 // ByEmail will look up a user with the provided Email Address.
@@ -392,9 +678,18 @@ func (uv *userValidator) ByEmail(email string) (*User, error) {
 //
 // As a general rule, any error but ErrNotFound should
 // probably result in a 500 error.
-func (ug *userGorm) ByEmail(email string) (*User, error) {
+func (ug *userGorm) ByEmailWithDeleted(ctx context.Context, email string) (*User, error) {
+	var user User
+	db := withContext(ctx, ug.db).Unscoped().Where("email = ?", email)
+	if err := first(db, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (ug *userGorm) ByEmail(ctx context.Context, email string) (*User, error) {
 	var user User
-	db := ug.db.Where("email = ?", email)
+	db := withContext(ctx, ug.db).Where("email = ?", email)
 	err := first(db, &user)
 
 	if err != nil {
@@ -403,7 +698,7 @@ func (ug *userGorm) ByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-func (uv *userValidator) ByRemember(token string) (*User, error) {
+func (uv *userValidator) ByRemember(ctx context.Context, token string) (*User, error) {
 	user := User{
 		Remember: token,
 	}
@@ -411,15 +706,15 @@ func (uv *userValidator) ByRemember(token string) (*User, error) {
 		return nil, err
 	}
 
-	return uv.UserDB.ByRemember(user.RememberHash)
+	return uv.UserDB.ByRemember(ctx, user.RememberHash)
 }
 
 // ByRemember will lookup & return a user record that matches the provided Remember token.
 // If the user is found, we will return a nil error
 // If the user is not found, we will return ErrNotFound
-func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
+func (ug *userGorm) ByRemember(ctx context.Context, rememberHash string) (*User, error) {
 	var user User
-	db := ug.db.Where("remember_hash = ?", rememberHash)
+	db := withContext(ctx, ug.db).Where("remember_hash = ?", rememberHash)
 	err := first(db, &user)
 
 	if err != nil {
@@ -428,32 +723,366 @@ func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
 	return &user, nil
 }
 
+func (uv *userValidator) ByEmailToken(ctx context.Context, token string) (*User, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	user := User{
+		EmailToken: token,
+	}
+	if err := runUserValFns(&user, uv.hmacEmailToken); err != nil {
+		return nil, err
+	}
+	return uv.UserDB.ByEmailToken(ctx, user.EmailTokenHash)
+}
+
+// ByEmailToken looks up the user with a pending email change
+// matching the provided token hash.
+func (ug *userGorm) ByEmailToken(ctx context.Context, tokenHash string) (*User, error) {
+	var user User
+	db := withContext(ctx, ug.db).Where("email_token_hash = ?", tokenHash)
+	err := first(db, &user)
+
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// All returns every user ordered by ID.
+func (ug *userGorm) All(ctx context.Context) ([]User, error) {
+	var users []User
+	err := withContext(ctx, ug.db).Order("id").Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (ug *userGorm) Search(ctx context.Context, query string) ([]User, error) {
+	var users []User
+	db := withContext(ctx, ug.db)
+	if query != "" {
+		pattern := likePattern(query)
+		db = db.Where(`LOWER(name) LIKE ? ESCAPE '\' OR `+
+			`LOWER(email) LIKE ? ESCAPE '\'`, pattern, pattern)
+	}
+	err := db.Order("id").Limit(SearchLimit).Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
 // Authenticate a user by comparing the input email & password with
 // the stored users hashed password. Returns User and Error
 // If it is a match return foundUser, nil
 // If email not found rerturn nil, ErrNotFound
 // If password does not match return nil, ErrInvalidPassword
 // otherwise return nil, error
-func (us *userService) Authenticate(email string, pwd string) (*User, error) {
-	foundUser, err := us.ByEmail(email)
+func (us *userService) Authenticate(ctx context.Context, email string, pwd string) (*User, error) {
+	foundUser, err := us.ByEmail(ctx, email)
 	if err != nil {
+		us.logger.InfoContext(ctx, "authentication failed", "reason", err)
+		if err == ErrNotFound {
+			us.audit.Record(ctx, &AuditEvent{
+				Action:  AuditLogin,
+				Reason:  "unknown email",
+				Details: email,
+			})
+		}
 		return nil, err
 	}
 
-	err = bcrypt.CompareHashAndPassword(
-		[]byte(foundUser.PasswordHash),
-		[]byte(pwd+userPwPepper))
-	switch err {
+	switch err := us.VerifyPassword(foundUser, pwd); err {
 	case nil:
+		if foundUser.Disabled {
+			us.logger.InfoContext(ctx, "authentication failed",
+				"user", foundUser, "reason", ErrAccountDisabled)
+			us.auditLogin(ctx, foundUser, "account disabled")
+			return nil, ErrAccountDisabled
+		}
+		us.logger.InfoContext(ctx, "authentication succeeded", "user", foundUser)
+		us.auditLogin(ctx, foundUser, "")
 		return foundUser, nil
-	case bcrypt.ErrMismatchedHashAndPassword:
+	case ErrPasswordIncorrect:
+		us.logger.InfoContext(ctx, "authentication failed",
+			"user", foundUser, "reason", ErrPasswordIncorrect)
+		us.auditLogin(ctx, foundUser, "incorrect password")
 		return nil, ErrPasswordIncorrect
 	default:
+		us.logger.ErrorContext(ctx, "authentication error",
+			"user", foundUser, "err", err)
 		return nil, err
 	}
 
 }
 
+func (us *userService) VerifyPassword(user *User, pwd string) error {
+	err := bcrypt.CompareHashAndPassword(
+		[]byte(user.PasswordHash),
+		[]byte(pwd+userPwPepper))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrPasswordIncorrect
+	}
+	return err
+}
+
+func (us *userService) RequestEmailChange(ctx context.Context, user *User, email string) (string, error) {
+	token, err := rand.RememberToken()
+	if err != nil {
+		return "", err
+	}
+	user.PendingEmail = email
+	user.EmailToken = token
+	user.EmailTokenExpiresAt = time.Now().Add(EmailTokenTTL)
+	if err := us.Update(ctx, user); err != nil {
+		return "", err
+	}
+	us.audit.Record(ctx, &AuditEvent{
+		UserID:  user.ID,
+		Action:  AuditEmailChangeRequest,
+		Success: true,
+		Details: user.PendingEmail,
+	})
+	return token, nil
+}
+
+func (us *userService) ConfirmEmailChange(ctx context.Context, token string) (*User, string, error) {
+	user, err := us.ByEmailToken(ctx, token)
+	if err == ErrNotFound {
+		return nil, "", ErrEmailTokenInvalid
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if user.PendingEmail == "" || time.Now().After(user.EmailTokenExpiresAt) {
+		return nil, "", ErrEmailTokenInvalid
+	}
+
+	oldEmail := user.Email
+	user.Email = user.PendingEmail
+	user.PendingEmail = ""
+	user.EmailTokenHash = ""
+	user.EmailTokenExpiresAt = time.Time{}
+	if err := us.Update(ctx, user); err != nil {
+		return nil, "", err
+	}
+	us.audit.Record(ctx, &AuditEvent{
+		UserID:  user.ID,
+		Action:  AuditEmailChange,
+		Success: true,
+		Details: oldEmail + " -> " + user.Email,
+	})
+	return user, oldEmail, nil
+}
+
+func (us *userService) RequestLoginLink(ctx context.Context, email string) (*User, string, error) {
+	user, err := us.ByEmail(ctx, email)
+	if err != nil {
+		return nil, "", err
+	}
+	if user.Disabled {
+		return nil, "", ErrAccountDisabled
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return nil, "", err
+	}
+	err = us.tokens.Create(ctx, &LoginToken{
+		UserID:    user.ID,
+		TokenHash: us.hmac.Hash(token),
+		ExpiresAt: time.Now().Add(LoginTokenTTL),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	us.audit.Record(ctx, &AuditEvent{
+		UserID:  user.ID,
+		Action:  AuditLoginLinkRequest,
+		Success: true,
+	})
+	return user, token, nil
+}
+
+func (us *userService) AuthenticateLoginLink(ctx context.Context, token string) (*User, error) {
+	if token == "" {
+		return nil, ErrLoginTokenInvalid
+	}
+	lt, err := us.tokens.Consume(ctx, us.hmac.Hash(token))
+	if err == ErrNotFound {
+		us.logger.InfoContext(ctx, "authentication failed",
+			"reason", ErrLoginTokenInvalid)
+		us.audit.Record(ctx, &AuditEvent{
+			Action: AuditLogin,
+			Reason: "invalid login link",
+		})
+		return nil, ErrLoginTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := us.ByID(ctx, lt.UserID)
+	if err == ErrNotFound {
+		return nil, ErrLoginTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		us.logger.InfoContext(ctx, "authentication failed",
+			"user", user, "reason", ErrAccountDisabled)
+		us.auditLogin(ctx, user, "account disabled")
+		return nil, ErrAccountDisabled
+	}
+	us.logger.InfoContext(ctx, "authentication succeeded",
+		"user", user, "method", "login link")
+	us.audit.Record(ctx, &AuditEvent{
+		UserID:  user.ID,
+		Action:  AuditLogin,
+		Success: true,
+		Details: "login link",
+	})
+	return user, nil
+}
+
+func (us *userService) AuthenticateIdentity(ctx context.Context, ext ExternalIdentity) (*User, error) {
+	identity, err := us.identities.ByProviderSubject(ctx, ext.Provider, ext.Subject)
+	var user *User
+	switch err {
+	case nil:
+		user, err = us.ByID(ctx, identity.UserID)
+		if err != nil {
+			return nil, err
+		}
+	case ErrNotFound:
+		user, err = us.linkIdentity(ctx, ext)
+		if err != nil {
+			us.logger.InfoContext(ctx, "authentication failed",
+				"provider", ext.Provider, "reason", err)
+			us.audit.Record(ctx, &AuditEvent{
+				Action:  AuditLogin,
+				Reason:  err.Error(),
+				Details: ext.Provider + ": " + ext.Email,
+			})
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	if user.Disabled {
+		us.logger.InfoContext(ctx, "authentication failed",
+			"user", user, "reason", ErrAccountDisabled)
+		us.auditLogin(ctx, user, "account disabled")
+		return nil, ErrAccountDisabled
+	}
+	us.logger.InfoContext(ctx, "authentication succeeded",
+		"user", user, "method", ext.Provider)
+	us.audit.Record(ctx, &AuditEvent{
+		UserID:  user.ID,
+		Action:  AuditLogin,
+		Success: true,
+		Details: ext.Provider,
+	})
+	return user, nil
+}
+
+// linkIdentity finds or creates the user an unknown external
+// identity belongs to and records the link. Accounts are only
+// linked or created when the provider has verified the email
+// address, otherwise anyone could take over an account, or claim
+// an address, by registering it with a provider.
+func (us *userService) linkIdentity(ctx context.Context, ext ExternalIdentity) (*User, error) {
+	if ext.Email == "" {
+		return nil, ErrIdentityEmailRequired
+	}
+	identity := &Identity{
+		Provider: ext.Provider,
+		Subject:  ext.Subject,
+		Email:    ext.Email,
+	}
+	user, err := us.ByEmail(ctx, ext.Email)
+	switch err {
+	case nil:
+		if !ext.EmailVerified {
+			return nil, ErrIdentityEmailUnverified
+		}
+		identity.UserID = user.ID
+		if err := us.identities.Create(ctx, identity); err != nil {
+			return nil, err
+		}
+	case ErrNotFound:
+		// The new account is for whoever owns the address, so the
+		// provider has to have checked that they do.
+		if !ext.EmailVerified {
+			return nil, ErrIdentitySignupUnverified
+		}
+		// The account gets a random password; the user can sign in
+		// with the provider or a login link.
+		pw, err := rand.RememberToken()
+		if err != nil {
+			return nil, err
+		}
+		user = &User{
+			Name:     ext.Name,
+			Email:    ext.Email,
+			Password: pw,
+		}
+		if err := us.CreateWithIdentity(ctx, user, identity); err != nil {
+			return nil, err
+		}
+		us.audit.Record(ctx, &AuditEvent{
+			UserID:  user.ID,
+			Action:  AuditSignup,
+			Success: true,
+			Details: ext.Provider,
+		})
+	default:
+		return nil, err
+	}
+
+	us.audit.Record(ctx, &AuditEvent{
+		UserID:  user.ID,
+		Action:  AuditIdentityLink,
+		Success: true,
+		Details: ext.Provider + ": " + ext.Email,
+	})
+	return user, nil
+}
+
+// CheckPassword runs user.Password through the service's password
+// policy.
+func (us *userService) CheckPassword(user *User) (password.Estimate, error) {
+	return us.policy.Check(user)
+}
+
+// auditLogin records a login attempt for user. An empty reason
+// means the attempt succeeded.
+func (us *userService) auditLogin(ctx context.Context, user *User, reason string) {
+	us.audit.Record(ctx, &AuditEvent{
+		UserID:  user.ID,
+		Action:  AuditLogin,
+		Success: reason == "",
+		Reason:  reason,
+	})
+}
+
+// SearchLimit caps the number of rows returned by the Search
+// methods.
+const SearchLimit = 100
+
+// likePattern turns a search query into a case-insensitive LIKE
+// pattern, escaping any wildcards the user typed. Queries using it
+// must declare backslash as the escape character.
+func likePattern(query string) string {
+	query = strings.ToLower(strings.TrimSpace(query))
+	query = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query)
+	return "%" + query + "%"
+}
+
 // first will query the database supplied by gorm.DB and place the first
 // record returned in dst. If nothing is found it will return ErrNotFound
 
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"context"
+	"testing"
+
+	"lenslocked.com/hash"
+)
+
+func newTestUserValidator(t *testing.T) *userValidator {
+	t.Helper()
+	uv := newUserValidator(NewUserMemory(), hash.NewHMAC("test"),
+		DefaultPasswordPolicy)
+	ctx := context.Background()
+	taken := &User{Email: "taken@example.com", Password: "darkroom silver print"}
+	gone := &User{Email: "gone@example.com", Password: "darkroom silver print"}
+	for _, u := range []*User{taken, gone} {
+		if err := uv.Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := uv.Delete(ctx, gone.ID); err != nil {
+		t.Fatal(err)
+	}
+	return uv
+}
+
+func TestUserValFns(t *testing.T) {
+	ctx := context.Background()
+	uv := newTestUserValidator(t)
+	neg, negBytes := -1, int64(-1)
+	withID := func(id uint, u User) User {
+		u.ID = id
+		return u
+	}
+	tests := []struct {
+		name string
+		fn   userValFn
+		user User
+		want error
+	}{
+		{"email required", uv.requireEmail, User{}, ErrEmailRequired},
+		{"email present", uv.requireEmail, User{Email: "al@example.com"}, nil},
+		{"email format", uv.emailFormat, User{Email: "al@example"}, ErrEmailInvalid},
+		{"email with plus", uv.emailFormat, User{Email: "al+lens@example.co.uk"}, nil},
+		{"empty email skips format", uv.emailFormat, User{}, nil},
+		{"email taken", uv.emailTaken(ctx), User{Email: "taken@example.com"}, ErrEmailTaken},
+		{"own email", uv.emailTaken(ctx), withID(1, User{Email: "taken@example.com"}), nil},
+		{"email of deleted account", uv.emailTaken(ctx), User{Email: "gone@example.com"}, ErrEmailPendingDeletion},
+		{"email free", uv.emailTaken(ctx), User{Email: "al@example.com"}, nil},
+		{"pending unchanged", uv.pendingEmailValid(ctx), User{Email: "al@example.com", PendingEmail: "al@example.com"}, ErrEmailUnchanged},
+		{"pending invalid", uv.pendingEmailValid(ctx), User{Email: "al@example.com", PendingEmail: "al@"}, ErrEmailInvalid},
+		{"pending taken", uv.pendingEmailValid(ctx), User{Email: "al@example.com", PendingEmail: "taken@example.com"}, ErrEmailTaken},
+		{"no pending", uv.pendingEmailValid(ctx), User{Email: "al@example.com"}, nil},
+		{"password required", uv.passwordRequired, User{}, ErrPasswordRequired},
+		{"password hash required", uv.passwordHashRequired, User{}, ErrPasswordRequired},
+		{"password too short", uv.passwordPolicy, User{Password: "a1!"}, errPasswordTooShort(8)},
+		{"no new password", uv.passwordPolicy, User{}, nil},
+		{"remember too short", uv.rememberMinBytes, User{Remember: "c2hvcnQ="}, ErrRememberTooShort},
+		{"remember hash required", uv.rememberHashRequired, User{}, ErrRememberRequired},
+		{"role invalid", uv.roleValid, User{Role: "root"}, ErrRoleInvalid},
+		{"role admin", uv.roleValid, User{Role: RoleAdmin}, nil},
+		{"negative quota", uv.quotaValid, User{QuotaBytes: &negBytes}, ErrQuotaInvalid},
+		{"negative photo quota", uv.quotaValid, User{QuotaPhotos: &neg}, ErrQuotaInvalid},
+		{"id zero", uv.idGreaterThan(0), User{}, ErrIDInvalid},
+		{"id set", uv.idGreaterThan(0), withID(3, User{}), nil},
+	}
+	for _, tc := range tests {
+		if err := tc.fn(&tc.user); err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestUserValidatorCreate(t *testing.T) {
+	ctx := context.Background()
+	uv := newTestUserValidator(t)
+	user := &User{Email: "  Al@Example.COM ", Password: "darkroom silver print"}
+	if err := uv.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "al@example.com" {
+		t.Errorf("email stored as %q", user.Email)
+	}
+	if user.Password != "" || user.PasswordHash == "" {
+		t.Error("plain text password kept")
+	}
+	if user.Remember == "" || user.RememberHash != uv.hmac.Hash(user.Remember) {
+		t.Error("remember token not set and hashed")
+	}
+	if user.Role != RoleUser {
+		t.Errorf("role %q, want %q", user.Role, RoleUser)
+	}
+
+	err := uv.Create(ValidateAll(ctx), &User{Email: "taken@example.com"})
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("ValidateAll: got %v, want ValidationErrors", err)
+	}
+	if errs["password"] != ErrPasswordRequired || errs["email"] != ErrEmailTaken {
+		t.Errorf("ValidateAll: got %v", errs)
+	}
+	if err := uv.Create(ctx, &User{Email: "bo@example.com"}); err != ErrPasswordRequired {
+		t.Errorf("without ValidateAll: got %v, want ErrPasswordRequired", err)
+	}
+}
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// AlertMsgFixFields is the public message for ValidationErrors
+// that are all about particular fields.
+const AlertMsgFixFields = "Please correct the highlighted fields."
+
+// ValidationErrors is returned by Create and Update when they are
+// called with a context from ValidateAll and any check fails. It
+// maps form field names, such as "email" or "title", to what is
+// wrong with them. Problems that don't belong to a single field
+// are under the empty key.
+type ValidationErrors map[string]error
+
+func (ve ValidationErrors) Error() string {
+	fields := make([]string, 0, len(ve))
+	for field := range ve {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	msgs := make([]string, 0, len(ve))
+	for _, field := range fields {
+		msg := strings.TrimPrefix(ve[field].Error(), "models: ")
+		if field != "" {
+			msg = field + ": " + msg
+		}
+		msgs = append(msgs, msg)
+	}
+	return "models: " + strings.Join(msgs, "; ")
+}
+
+// Public returns the error that isn't about a single field, if
+// there is one, or asks the user to correct the fields otherwise.
+func (ve ValidationErrors) Public() string {
+	if err, ok := ve[""]; ok {
+		return publicMessage(err)
+	}
+	return AlertMsgFixFields
+}
+
+// FieldErrors returns the public message for each field.
+func (ve ValidationErrors) FieldErrors() map[string]string {
+	msgs := make(map[string]string, len(ve))
+	for field, err := range ve {
+		if field != "" {
+			msgs[field] = publicMessage(err)
+		}
+	}
+	return msgs
+}
+
+func publicMessage(err error) string {
+	if pErr, ok := err.(interface{ Public() string }); ok {
+		return pErr.Public()
+	}
+	return err.Error()
+}
+
+type validateAllKey struct{}
+
+// ValidateAll returns a copy of ctx that makes Create and Update
+// run every validation check instead of stopping at the first one
+// that fails, and report the problems as ValidationErrors. Forms
+// use it to point out everything that is wrong in one go.
+func ValidateAll(ctx context.Context) context.Context {
+	return context.WithValue(ctx, validateAllKey{}, true)
+}
+
+func validateAll(ctx context.Context) bool {
+	all, _ := ctx.Value(validateAllKey{}).(bool)
+	return all
+}
+
+// fieldError ties the error from a validator to the form field it
+// is about. The run*ValFns functions unwrap it again.
+type fieldError struct {
+	field string
+	err   error
+}
+
+func (fe fieldError) Error() string {
+	return fe.err.Error()
+}
+
+func (fe fieldError) Unwrap() error {
+	return fe.err
+}
+
+// collectError adds err, as returned by a validator, to errs. It
+// returns err unchanged if it isn't a modelError, since those are
+// failures of the validation itself rather than of the data.
+func collectError(errs ValidationErrors, err error) error {
+	fe, ok := err.(fieldError)
+	if !ok {
+		fe = fieldError{err: err}
+	}
+	if _, ok := fe.err.(modelError); !ok {
+		return fe.err
+	}
+	if _, ok := errs[fe.field]; !ok {
+		errs[fe.field] = fe.err
+	}
+	return nil
+}
+
+// unwrapFieldError returns the error behind a fieldError, so that
+// callers that stop at the first failure can still compare it with
+// the Err* values.
+func unwrapFieldError(err error) error {
+	if fe, ok := err.(fieldError); ok {
+		return fe.err
+	}
+	return err
+}
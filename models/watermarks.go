@@ -0,0 +1,404 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+
+	"lenslocked.com/rand"
+)
+
+const (
+	// ErrWatermarkPosition is returned when a watermark is given a
+	// position that isn't one of WatermarkPositions.
+	ErrWatermarkPosition modelError = "models: watermark position is not valid"
+
+	// ErrWatermarkOpacity is returned when a watermark's opacity
+	// isn't between 1 and 100 percent.
+	ErrWatermarkOpacity modelError = "models: watermark opacity must be between 1 and 100"
+
+	// ErrWatermarkScale is returned when a watermark's scale isn't
+	// between MinWatermarkScale and 100 percent.
+	ErrWatermarkScale modelError = "models: watermark size must be between 5 and 100"
+
+	// ErrWatermarkTextTooLong is returned when watermark text is
+	// longer than MaxWatermarkText characters.
+	ErrWatermarkTextTooLong modelError = "models: watermark text must be 100 characters or fewer"
+
+	// ErrWatermarkImage is returned when an uploaded watermark isn't
+	// a PNG image, or is too big.
+	ErrWatermarkImage modelError = "models: the watermark must be a PNG image under 2 MB " +
+		"and 4000 pixels across"
+)
+
+// Where a watermark is drawn on a photo. WatermarkTile repeats it
+// across the whole photo.
+const (
+	WatermarkCenter      = "center"
+	WatermarkTopLeft     = "top-left"
+	WatermarkTopRight    = "top-right"
+	WatermarkBottomLeft  = "bottom-left"
+	WatermarkBottomRight = "bottom-right"
+	WatermarkTile        = "tile"
+)
+
+// WatermarkPositions lists the positions a watermark can have.
+var WatermarkPositions = []string{
+	WatermarkBottomRight,
+	WatermarkBottomLeft,
+	WatermarkTopRight,
+	WatermarkTopLeft,
+	WatermarkCenter,
+	WatermarkTile,
+}
+
+const (
+	// MaxWatermarkText is the longest watermark text, in characters.
+	MaxWatermarkText = 100
+	// MinWatermarkScale is the smallest a watermark can be, as a
+	// percentage of the photo's width.
+	MinWatermarkScale = 5
+	// MaxWatermarkImageBytes is the largest PNG that can be
+	// uploaded as a watermark.
+	MaxWatermarkImageBytes = 2 << 20
+	// maxWatermarkImageSide is the widest or tallest it can be.
+	maxWatermarkImageSide = 4000
+)
+
+// Watermark is drawn over a gallery's photos when they are shown to
+// anyone but the owner. A watermark with neither Text nor Image is
+// off.
+type Watermark struct {
+	// Text is drawn when there is no Image.
+	Text string
+	// Image is the file name of an uploaded PNG in WatermarkDir.
+	Image    string
+	Position string `gorm:"not null;default:'bottom-right'"`
+	// Opacity is from 1 to 100 percent.
+	Opacity int `gorm:"not null;default:50"`
+	// Scale is the width of the watermark as a percentage of the
+	// photo's.
+	Scale int `gorm:"not null;default:25"`
+}
+
+// Enabled reports whether there is a watermark to draw.
+func (wm *Watermark) Enabled() bool {
+	return wm.Text != "" || wm.Image != ""
+}
+
+// key identifies what the watermark looks like. Rendered photos are
+// cached under it, so changing any setting renders them again.
+func (wm *Watermark) key() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%q|%q|%s|%d|%d",
+		wm.Text, wm.Image, wm.Position, wm.Opacity, wm.Scale)))
+	return hex.EncodeToString(sum[:6])
+}
+
+// WatermarkDir returns the directory holding uploaded watermark
+// images, below the image root passed to WithImageDir.
+func WatermarkDir(imageDir string) string {
+	return filepath.Join(imageDir, "watermarks")
+}
+
+// WatermarkCacheDir returns the directory holding the gallery's
+// photos with the watermark drawn on.
+func WatermarkCacheDir(imageDir string, galleryID uint) string {
+	return filepath.Join(imageDir, "cache", "watermarked",
+		fmt.Sprint(galleryID))
+}
+
+// removeWatermarkFiles removes the gallery's watermark image and
+// rendered photos.
+func removeWatermarkFiles(imageDir string, gallery *Gallery) error {
+	if gallery.Watermark.Image != "" {
+		err := os.Remove(filepath.Join(WatermarkDir(imageDir),
+			filepath.Base(gallery.Watermark.Image)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.RemoveAll(WatermarkCacheDir(imageDir, gallery.ID))
+}
+
+// Validation functions for the watermark settings of a gallery.
+
+func (gv *galleryValidator) watermarkDefaults(g *Gallery) error {
+	wm := &g.Watermark
+	wm.Text = strings.TrimSpace(wm.Text)
+	if wm.Position == "" {
+		wm.Position = WatermarkBottomRight
+	}
+	if wm.Opacity == 0 {
+		wm.Opacity = 50
+	}
+	if wm.Scale == 0 {
+		wm.Scale = 25
+	}
+	return nil
+}
+
+func (gv *galleryValidator) watermarkTextLength(g *Gallery) error {
+	if utf8.RuneCountInString(g.Watermark.Text) > MaxWatermarkText {
+		return ErrWatermarkTextTooLong
+	}
+	return nil
+}
+
+func (gv *galleryValidator) watermarkPosition(g *Gallery) error {
+	for _, p := range WatermarkPositions {
+		if g.Watermark.Position == p {
+			return nil
+		}
+	}
+	return ErrWatermarkPosition
+}
+
+func (gv *galleryValidator) watermarkOpacity(g *Gallery) error {
+	if g.Watermark.Opacity < 1 || g.Watermark.Opacity > 100 {
+		return ErrWatermarkOpacity
+	}
+	return nil
+}
+
+func (gv *galleryValidator) watermarkScale(g *Gallery) error {
+	if g.Watermark.Scale < MinWatermarkScale || g.Watermark.Scale > 100 {
+		return ErrWatermarkScale
+	}
+	return nil
+}
+
+func (ps *photoService) SetWatermarkImage(ctx context.Context, gallery *Gallery, r io.Reader) error {
+	b, err := io.ReadAll(io.LimitReader(r, MaxWatermarkImageBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > MaxWatermarkImageBytes || http.DetectContentType(b) != "image/png" {
+		return ErrWatermarkImage
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(b))
+	if err != nil || cfg.Width > maxWatermarkImageSide || cfg.Height > maxWatermarkImageSide {
+		return ErrWatermarkImage
+	}
+
+	token, err := rand.Strings(12)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.png", gallery.ID, token)
+	dir := WatermarkDir(ps.imageDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name)
+	if _, err := writeFile(path, bytes.NewReader(b)); err != nil {
+		return err
+	}
+	old := gallery.Watermark.Image
+	gallery.Watermark.Image = name
+	if err := ps.galleries.Update(ctx, gallery); err != nil {
+		gallery.Watermark.Image = old
+		os.Remove(path)
+		return err
+	}
+	if old != "" {
+		os.Remove(filepath.Join(dir, filepath.Base(old)))
+	}
+	return nil
+}
+
+func (ps *photoService) RemoveWatermarkImage(ctx context.Context, gallery *Gallery) error {
+	old := gallery.Watermark.Image
+	if old == "" {
+		return nil
+	}
+	gallery.Watermark.Image = ""
+	if err := ps.galleries.Update(ctx, gallery); err != nil {
+		gallery.Watermark.Image = old
+		return err
+	}
+	err := os.Remove(filepath.Join(WatermarkDir(ps.imageDir), filepath.Base(old)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (ps *photoService) OpenWatermarked(gallery *Gallery, photo *Photo) (io.ReadSeekCloser, string, error) {
+	if !gallery.Watermark.Enabled() {
+		f, err := ps.Open(gallery, photo)
+		return f, photo.Filename, err
+	}
+	if photo.GalleryID != gallery.ID {
+		return nil, "", ErrNotFound
+	}
+	stored := filepath.Base(photo.Filename)
+	base := strings.TrimSuffix(stored, filepath.Ext(stored))
+	name := base + "-" + gallery.Watermark.key() + renderedExt(stored)
+	dir := WatermarkCacheDir(ps.imageDir, gallery.ID)
+	path := filepath.Join(dir, name)
+	if f, err := os.Open(path); err == nil {
+		return f, name, nil
+	}
+
+	img, err := decodePhoto(filepath.Join(GalleryDir(ps.imageDir, gallery.ID), stored))
+	if err != nil {
+		return nil, "", err
+	}
+	if err := ps.drawWatermark(img, &gallery.Watermark); err != nil {
+		return nil, "", err
+	}
+	if err := writeRendered(path, img); err != nil {
+		return nil, "", err
+	}
+	// The photo may have been rendered with earlier settings, and
+	// those copies won't be asked for again.
+	removeRendered(dir, base, name)
+	f, err := os.Open(path)
+	return f, name, err
+}
+
+// removeRendered removes the copies of the photo stored as base in
+// dir other than keep.
+func removeRendered(dir, base, keep string) {
+	old, _ := filepath.Glob(filepath.Join(dir, base+"-*"))
+	for _, path := range old {
+		if filepath.Base(path) != keep {
+			os.Remove(path)
+		}
+	}
+}
+
+// drawWatermark draws wm onto img.
+func (ps *photoService) drawWatermark(img *image.RGBA, wm *Watermark) error {
+	b := img.Bounds()
+	width := max(1, b.Dx()*wm.Scale/100)
+	var mark image.Image
+	var err error
+	if wm.Image != "" {
+		mark, err = ps.watermarkImage(wm.Image, width)
+	} else {
+		mark, err = watermarkText(wm.Text, width)
+	}
+	if err != nil {
+		return err
+	}
+
+	mask := image.NewUniform(color.Alpha{A: uint8(wm.Opacity * 255 / 100)})
+	mb := mark.Bounds()
+	margin := min(b.Dx(), b.Dy()) * 3 / 100
+	var at []image.Point
+	switch wm.Position {
+	case WatermarkTopLeft:
+		at = append(at, image.Pt(margin, margin))
+	case WatermarkTopRight:
+		at = append(at, image.Pt(b.Dx()-mb.Dx()-margin, margin))
+	case WatermarkBottomLeft:
+		at = append(at, image.Pt(margin, b.Dy()-mb.Dy()-margin))
+	case WatermarkCenter:
+		at = append(at, image.Pt((b.Dx()-mb.Dx())/2, (b.Dy()-mb.Dy())/2))
+	case WatermarkTile:
+		// Every other row is shifted by half a step so the marks
+		// don't line up into columns that are easy to crop out.
+		stepX, stepY := mb.Dx()*3/2+1, mb.Dy()*3+1
+		for row, y := 0, 0; y < b.Dy(); row, y = row+1, y+stepY {
+			for x := -(row % 2) * stepX / 2; x < b.Dx(); x += stepX {
+				at = append(at, image.Pt(x, y))
+			}
+		}
+	default:
+		at = append(at, image.Pt(b.Dx()-mb.Dx()-margin, b.Dy()-mb.Dy()-margin))
+	}
+	for _, p := range at {
+		r := mb.Sub(mb.Min).Add(p).Add(b.Min)
+		draw.DrawMask(img, r, mark, mb.Min, mask, image.Point{}, draw.Over)
+	}
+	return nil
+}
+
+// watermarkImage loads the uploaded watermark called name, scaled
+// to width.
+func (ps *photoService) watermarkImage(name string, width int) (image.Image, error) {
+	f, err := os.Open(filepath.Join(WatermarkDir(ps.imageDir), filepath.Base(name)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	src, err := png.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	sb := src.Bounds()
+	height := max(1, sb.Dy()*width/max(1, sb.Dx()))
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, sb, draw.Over, nil)
+	return dst, nil
+}
+
+// watermarkFont is the typeface watermark text is set in.
+var watermarkFont = sync.OnceValues(func() (*opentype.Font, error) {
+	return opentype.Parse(gobold.TTF)
+})
+
+// watermarkText renders text in white with a soft dark outline, so
+// that it shows on both light and dark photos, sized to be width
+// pixels wide.
+func watermarkText(text string, width int) (image.Image, error) {
+	ttf, err := watermarkFont()
+	if err != nil {
+		return nil, err
+	}
+	// Measure at a reference size and scale to fit.
+	const ref = 100.0
+	face, err := opentype.NewFace(ttf, &opentype.FaceOptions{Size: ref, DPI: 72})
+	if err != nil {
+		return nil, err
+	}
+	adv := font.MeasureString(face, text).Ceil()
+	face.Close()
+	size := max(6, ref*float64(width)/float64(max(1, adv)))
+	face, err = opentype.NewFace(ttf, &opentype.FaceOptions{
+		Size:    size,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	m := face.Metrics()
+	outline := max(1, int(size/20))
+	w := font.MeasureString(face, text).Ceil() + 2*outline
+	h := (m.Ascent + m.Descent).Ceil() + 2*outline
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	d := font.Drawer{Dst: dst, Face: face}
+	baseline := outline + m.Ascent.Ceil()
+	d.Src = image.NewUniform(color.RGBA{A: 140})
+	for _, off := range []image.Point{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+		d.Dot = fixed.P(outline+off.X*outline, baseline+off.Y*outline)
+		d.DrawString(text)
+	}
+	d.Src = image.White
+	d.Dot = fixed.P(outline, baseline)
+	d.DrawString(text)
+	return dst, nil
+}
@@ -0,0 +1,416 @@
+// Package password estimates how hard a password is to guess.
+//
+// The estimate follows the approach of Dropbox's zxcvbn: the
+// password is split into the cheapest sequence of patterns an
+// attacker would try (common passwords, personal details, keyboard
+// runs, sequences, repeats, years and brute force), and the guesses
+// needed for each pattern are multiplied together. Everything runs
+// offline against a bundled list of common passwords.
+package password
+
+import (
+	_ "embed"
+	"math"
+	"strings"
+)
+
+// Score buckets a guess estimate, from 0 (trivial to guess) to 4
+// (very hard to guess). The thresholds are the ones zxcvbn uses.
+type Score int
+
+const (
+	VeryWeak Score = iota
+	Weak
+	Fair
+	Strong
+	VeryStrong
+)
+
+func (s Score) String() string {
+	switch s {
+	case VeryWeak:
+		return "very weak"
+	case Weak:
+		return "weak"
+	case Fair:
+		return "fair"
+	case Strong:
+		return "strong"
+	}
+	return "very strong"
+}
+
+// Estimate is the result of Check.
+type Estimate struct {
+	// Guesses is the estimated number of guesses needed to find
+	// the password.
+	Guesses float64
+	Score   Score
+}
+
+// maxLength caps how much of a password is analysed. Anything
+// longer is more than long enough.
+const maxLength = 100
+
+// common.txt lists the 305 passwords seen most often in published
+// password leaks, most common first, one per line. It is checked
+// in rather than fetched so that builds are reproducible and a
+// change to the list shows up in review.
+//
+//go:embed common.txt
+var commonList string
+
+// common maps each bundled common password to its rank, with the
+// most common password ranked 1.
+var common = func() map[string]int {
+	m := make(map[string]int)
+	for i, pw := range strings.Fields(commonList) {
+		if _, ok := m[pw]; !ok {
+			m[pw] = i + 1
+		}
+	}
+	return m
+}()
+
+// Common reports whether pw, ignoring case and common character
+// substitutions such as "p@ssw0rd", is on the bundled list of
+// common passwords.
+func Common(pw string) bool {
+	lower := strings.ToLower(pw)
+	if _, ok := common[lower]; ok {
+		return true
+	}
+	_, ok := common[unleet(lower)]
+	return ok
+}
+
+// Check estimates how many guesses it would take to find pw.
+// userInputs are words an attacker targeting this user would try
+// first, such as their name and email address.
+func Check(pw string, userInputs ...string) Estimate {
+	if len(pw) > maxLength {
+		pw = pw[:maxLength]
+	}
+	guesses := mostGuessable(pw, userDictionary(userInputs))
+	return Estimate{Guesses: guesses, Score: score(guesses)}
+}
+
+func score(guesses float64) Score {
+	const delta = 5
+	switch {
+	case guesses < 1e3+delta:
+		return VeryWeak
+	case guesses < 1e6+delta:
+		return Weak
+	case guesses < 1e8+delta:
+		return Fair
+	case guesses < 1e10+delta:
+		return Strong
+	}
+	return VeryStrong
+}
+
+// userDictionary ranks the words in userInputs. Email addresses
+// and names are split into their parts so "jane.doe@example.com"
+// yields "jane", "doe" and "example" as well.
+func userDictionary(inputs []string) map[string]int {
+	dict := make(map[string]int)
+	add := func(w string) {
+		if len(w) < 3 {
+			return
+		}
+		if _, ok := dict[w]; !ok {
+			dict[w] = len(dict) + 1
+		}
+	}
+	for _, in := range inputs {
+		in = strings.ToLower(strings.TrimSpace(in))
+		add(in)
+		add(strings.Join(strings.Fields(in), ""))
+		for _, part := range strings.FieldsFunc(in, func(r rune) bool {
+			return !('a' <= r && r <= 'z' || '0' <= r && r <= '9')
+		}) {
+			add(part)
+		}
+	}
+	return dict
+}
+
+// minSubmatchGuesses stops a short pattern inside a longer password
+// from looking cheaper than a couple of brute force characters.
+const (
+	minSubmatchGuessesSingleChar = 10
+	minSubmatchGuessesMultiChar  = 50
+)
+
+// mostGuessable finds the split of pw into patterns that needs the
+// fewest guesses. Following zxcvbn, a split into k patterns costs
+// k! times the product of the pattern guesses, since the attacker
+// also has to guess how the patterns are arranged.
+func mostGuessable(pw string, userDict map[string]int) float64 {
+	runes := []rune(pw)
+	n := len(runes)
+	if n == 0 {
+		return 1
+	}
+
+	// cost[i][j] is log10 of the guesses for runes[i:j] as a single
+	// pattern.
+	cost := make([][]float64, n)
+	for i := range cost {
+		cost[i] = make([]float64, n+1)
+		for j := i + 1; j <= n; j++ {
+			g := patternGuesses(runes[i:j], userDict)
+			if j-i < n {
+				min := float64(minSubmatchGuessesMultiChar)
+				if j-i == 1 {
+					min = minSubmatchGuessesSingleChar
+				}
+				g = math.Max(g, min)
+			}
+			cost[i][j] = math.Log10(g)
+		}
+	}
+
+	// best[k][j] is the cheapest log10 product covering runes[:j]
+	// with exactly k patterns.
+	inf := math.Inf(1)
+	best := make([][]float64, n+1)
+	for k := range best {
+		best[k] = make([]float64, n+1)
+		for j := range best[k] {
+			best[k][j] = inf
+		}
+	}
+	best[0][0] = 0
+	for k := 1; k <= n; k++ {
+		for j := 1; j <= n; j++ {
+			for i := k - 1; i < j; i++ {
+				if prev := best[k-1][i]; prev != inf {
+					best[k][j] = math.Min(best[k][j], prev+cost[i][j])
+				}
+			}
+		}
+	}
+
+	min := inf
+	logFact := 0.0
+	for k := 1; k <= n; k++ {
+		logFact += math.Log10(float64(k))
+		if best[k][n] != inf {
+			min = math.Min(min, best[k][n]+logFact)
+		}
+	}
+	return math.Pow(10, min)
+}
+
+// bruteforceCardinality is the number of guesses zxcvbn charges per
+// character that isn't part of any pattern.
+const bruteforceCardinality = 10
+
+// patternGuesses returns the guesses needed for s taken as the
+// cheapest single pattern, falling back to brute force.
+func patternGuesses(s []rune, userDict map[string]int) float64 {
+	guesses := math.Pow(bruteforceCardinality, float64(len(s)))
+	for _, fn := range []func([]rune, map[string]int) float64{
+		dictionaryGuesses,
+		repeatGuesses,
+		sequenceGuesses,
+		keyboardGuesses,
+		yearGuesses,
+	} {
+		if g := fn(s, userDict); g > 0 && g < guesses {
+			guesses = g
+		}
+	}
+	return guesses
+}
+
+// dictionaryGuesses returns the guesses for s as a, possibly
+// reversed, capitalised or l33t spelled, entry in the common
+// password list or the user's own details, or 0 if it is neither.
+func dictionaryGuesses(s []rune, userDict map[string]int) float64 {
+	if len(s) < 3 {
+		return 0
+	}
+	word := string(s)
+	lower := strings.ToLower(word)
+	variations := uppercaseVariations(s)
+
+	best := 0.0
+	try := func(w string, multiplier float64) {
+		rank, ok := userDict[w]
+		if !ok {
+			rank, ok = common[w]
+		}
+		if !ok {
+			return
+		}
+		g := float64(rank) * variations * multiplier
+		if best == 0 || g < best {
+			best = g
+		}
+	}
+	try(lower, 1)
+	try(reverse(lower), 2)
+	if u := unleet(lower); u != lower {
+		try(u, 2)
+	}
+	return best
+}
+
+// uppercaseVariations is how many capitalisations of a word an
+// attacker tries before reaching the one in s.
+func uppercaseVariations(s []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range s {
+		switch {
+		case 'A' <= r && r <= 'Z':
+			upper++
+		case 'a' <= r && r <= 'z':
+			lower++
+		}
+	}
+	if upper == 0 {
+		return 1
+	}
+	first := 'A' <= s[0] && s[0] <= 'Z'
+	last := 'A' <= s[len(s)-1] && s[len(s)-1] <= 'Z'
+	if lower == 0 || upper == 1 && (first || last) {
+		return 2
+	}
+	// Sum of C(upper+lower, i) for i up to the smaller of the two.
+	total := 0.0
+	for i := 1; i <= upper && i <= lower; i++ {
+		total += binomial(upper+lower, i)
+	}
+	return math.Max(total, 2)
+}
+
+func binomial(n, k int) float64 {
+	r := 1.0
+	for i := 1; i <= k; i++ {
+		r = r * float64(n-k+i) / float64(i)
+	}
+	return r
+}
+
+// repeatGuesses handles s made of one block repeated, such as
+// "aaaa" or "abcabc".
+func repeatGuesses(s []rune, userDict map[string]int) float64 {
+	n := len(s)
+	for size := 1; size <= n/2; size++ {
+		if n%size != 0 {
+			continue
+		}
+		repeated := true
+		for i := size; i < n; i++ {
+			if s[i] != s[i%size] {
+				repeated = false
+				break
+			}
+		}
+		if repeated {
+			base := patternGuesses(s[:size], userDict)
+			return base * float64(n/size)
+		}
+	}
+	return 0
+}
+
+// sequenceGuesses handles runs with a constant step, such as
+// "abcd", "9876" or "aceg".
+func sequenceGuesses(s []rune, _ map[string]int) float64 {
+	if len(s) < 3 {
+		return 0
+	}
+	delta := s[1] - s[0]
+	if delta == 0 || delta > 5 || delta < -5 {
+		return 0
+	}
+	for i := 2; i < len(s); i++ {
+		if s[i]-s[i-1] != delta {
+			return 0
+		}
+	}
+
+	var base float64
+	switch first := s[0]; {
+	case strings.ContainsRune("aAzZ019", first):
+		base = 4
+	case '0' <= first && first <= '9':
+		base = 10
+	default:
+		base = 26
+	}
+	if delta < 0 {
+		base *= 2
+	}
+	return base * float64(len(s))
+}
+
+// keyboardRows are the rows of a US QWERTY keyboard.
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+}
+
+// keyboardGuesses handles runs of neighbouring keys along a row,
+// such as "qwert" or "lkjh".
+func keyboardGuesses(s []rune, _ map[string]int) float64 {
+	if len(s) < 4 {
+		return 0
+	}
+	lower := strings.ToLower(string(s))
+	for _, row := range keyboardRows {
+		if strings.Contains(row, lower) || strings.Contains(reverse(row), lower) {
+			// Roughly the number of starting keys times the two
+			// directions, times the length of the run.
+			return 47 * 2 * float64(len(s)) * uppercaseVariations(s)
+		}
+	}
+	return 0
+}
+
+// referenceYear is the year the year pattern is measured from.
+// Recent years are guessed first.
+const referenceYear = 2026
+
+// yearGuesses handles four digit years from 1900 to 2099.
+func yearGuesses(s []rune, _ map[string]int) float64 {
+	if len(s) != 4 {
+		return 0
+	}
+	year := 0
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return 0
+		}
+		year = year*10 + int(r-'0')
+	}
+	if year < 1900 || year > 2099 {
+		return 0
+	}
+	return math.Max(math.Abs(float64(year-referenceYear)), 20)
+}
+
+var leetReplacer = strings.NewReplacer(
+	"4", "a", "@", "a", "8", "b", "(", "c", "3", "e", "6", "g",
+	"1", "i", "!", "i", "|", "l", "0", "o", "$", "s", "5", "s",
+	"7", "t", "+", "t", "2", "z",
+)
+
+// unleet undoes common character substitutions.
+func unleet(s string) string {
+	return leetReplacer.Replace(s)
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
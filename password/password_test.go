@@ -0,0 +1,67 @@
+package password
+
+import "testing"
+
+func TestCommon(t *testing.T) {
+	tests := []struct {
+		pw   string
+		want bool
+	}{
+		{"password", true},
+		{"PASSWORD", true},
+		{"p@ssw0rd", true},
+		{"123456", true},
+		{"qwerty", true},
+		{"darkroom silver print", false},
+		{"", false},
+	}
+	for _, tc := range tests {
+		if got := Common(tc.pw); got != tc.want {
+			t.Errorf("Common(%q) = %v, want %v", tc.pw, got, tc.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		pw         string
+		userInputs []string
+		max        Score
+		min        Score
+	}{
+		{pw: "password", max: VeryWeak},
+		{pw: "qwertyuiop", max: Weak},
+		{pw: "abcdefgh", max: Weak},
+		{pw: "aaaaaaaaaaaa", max: Weak},
+		{pw: "janedoe", userInputs: []string{"Jane Doe", "jane.doe@example.com"}, max: VeryWeak},
+		{pw: "darkroom silver print", min: Strong, max: VeryStrong},
+		{pw: "k8#Qv!2mZr$w9Lx", min: VeryStrong, max: VeryStrong},
+	}
+	for _, tc := range tests {
+		est := Check(tc.pw, tc.userInputs...)
+		if est.Score < tc.min || est.Score > tc.max {
+			t.Errorf("Check(%q) = %v (%g guesses), want between %v and %v",
+				tc.pw, est.Score, est.Guesses, tc.min, tc.max)
+		}
+	}
+}
+
+func TestCheckUserInputs(t *testing.T) {
+	const pw = "jane.doe1990"
+	without := Check(pw)
+	with := Check(pw, "Jane Doe", "jane.doe@example.com")
+	if with.Guesses >= without.Guesses {
+		t.Errorf("Check(%q) with the user's name and email = %g guesses, want fewer than %g",
+			pw, with.Guesses, without.Guesses)
+	}
+}
+
+func TestCheckLongPassword(t *testing.T) {
+	long := make([]byte, 10*maxLength)
+	for i := range long {
+		long[i] = 'a' + byte(i%26)
+	}
+	// Only the first maxLength characters are analysed, which
+	// keeps this from taking cubic time in the full length.
+	Check(string(long))
+}
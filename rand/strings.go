@@ -7,10 +7,20 @@ import (
 
 const RememberTokenBytes = 32
 
+// RequestIDBytes is the number of random bytes used to build
+// the IDs returned by RequestID.
+const RequestIDBytes = 12
+
 func RememberToken() (string, error) {
 	return Strings(RememberTokenBytes)
 }
 
+// RequestID returns a short random string suitable for
+// correlating the log lines written for a single request.
+func RequestID() (string, error) {
+	return Strings(RequestIDBytes)
+}
+
 // NBytes returns the number of bytes used in any string
 // generated by the String or RememberToken functions in
 // this package.
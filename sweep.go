@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"lenslocked.com/models"
+)
+
+// sweepDeletedAccounts purges accounts that were deleted more than
+// grace ago, once immediately and then every interval, until ctx
+// is cancelled.
+func sweepDeletedAccounts(ctx context.Context, accounts models.AccountService,
+	interval, grace time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := accounts.Purge(ctx, time.Now().Add(-grace))
+		if err != nil && ctx.Err() == nil {
+			logger.Error("purge deleted accounts", "err", err)
+		} else if n > 0 {
+			logger.Info("purged deleted accounts", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweepExpiredUploads removes resumable uploads that haven't been
+// continued before they expired, once immediately and then every
+// interval, until ctx is cancelled.
+func sweepExpiredUploads(ctx context.Context, uploads models.UploadService,
+	interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := uploads.RemoveExpired(ctx, time.Now())
+		if err != nil && ctx.Err() == nil {
+			logger.Error("remove expired uploads", "err", err)
+		} else if n > 0 {
+			logger.Info("removed expired uploads", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
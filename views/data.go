@@ -1,6 +1,10 @@
 package views
 
-import "log"
+import (
+	"html/template"
+	"log/slog"
+	"net/url"
+)
 
 const (
 	AlertLvlError   = "danger"
@@ -18,6 +22,12 @@ const (
 // to come in.
 type Data struct {
 	Alert *Alert
+	// Errors maps form field names to what is wrong with the
+	// value entered. It is filled in by SetAlert.
+	Errors map[string]string
+	// Form holds the values submitted with a form that is being
+	// shown again, so the user doesn't have to retype them.
+	Form  url.Values
 	Yield interface{}
 }
 
@@ -32,12 +42,23 @@ type PublicError interface {
 	Public() string
 }
 
+// FieldErrors is implemented by errors that know which form fields
+// they are about, such as models.ValidationErrors.
+type FieldErrors interface {
+	PublicError
+	// FieldErrors maps form field names to public messages.
+	FieldErrors() map[string]string
+}
+
 func (d *Data) SetAlert(err error) {
 	var msg string
-	if pErr, ok := err.(PublicError); ok {
+	if fErr, ok := err.(FieldErrors); ok {
+		d.Errors = fErr.FieldErrors()
+		msg = fErr.Public()
+	} else if pErr, ok := err.(PublicError); ok {
 		msg = pErr.Public()
 	} else {
-		log.Println(err)
+		slog.Error("unexpected error rendered as generic alert", "err", err)
 		msg = AlertMsgGeneric
 	}
 	d.Alert = &Alert{
@@ -52,3 +73,40 @@ func (d *Data) AlertError(msg string) {
 		Message: msg,
 	}
 }
+
+func (d *Data) AlertSuccess(msg string) {
+	d.Alert = &Alert{
+		Level:   AlertLvlSuccess,
+		Message: msg,
+	}
+}
+
+func (d *Data) AlertWarning(msg string) {
+	d.Alert = &Alert{
+		Level:   AlertLvlWarning,
+		Message: msg,
+	}
+}
+
+// formFuncs returns the template functions forms use to show the
+// errors and values in d:
+//
+//	fieldError "email"         the error for the field, or ""
+//	fieldValue "title" .Title  the submitted value, or the
+//	                           default if the form wasn't submitted
+func (d Data) formFuncs() template.FuncMap {
+	return template.FuncMap{
+		"fieldError": func(field string) string {
+			return d.Errors[field]
+		},
+		"fieldValue": func(field string, def ...string) string {
+			if vs, ok := d.Form[field]; ok && len(vs) > 0 {
+				return vs[0]
+			}
+			if len(def) > 0 {
+				return def[0]
+			}
+			return ""
+		},
+	}
+}
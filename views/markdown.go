@@ -0,0 +1,118 @@
+package views
+
+import (
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	mdCode   = regexp.MustCompile("`([^`\n]+)`")
+	mdLink   = regexp.MustCompile(`\[([^\]\n]+)\]\(((?:https?://|mailto:)[^\s()]+)\)`)
+	mdURL    = regexp.MustCompile(`\bhttps?://[^\s<]*[^\s<.,:;!?'")\]]`)
+	mdStrong = regexp.MustCompile(`\*\*([^*\n]+)\*\*`)
+	mdEm     = regexp.MustCompile(`(^|[^\w*])[*_]([^*_\n]+)[*_]($|[^\w*])`)
+	mdHold   = regexp.MustCompile("\x02([0-9]+)\x03")
+)
+
+// Markdown renders the small subset of Markdown comments are written
+// in: paragraphs, "- " lists, "> " quotes, `code`, **bold**, *italics*
+// and links. Everything else is shown as typed, and since the text is
+// escaped before any of it is turned into HTML, no markup of the
+// writer's own gets through. Only http, https and mailto links are
+// made, and they are marked nofollow.
+func Markdown(src string) template.HTML {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	var b strings.Builder
+	var run []string
+	kind := mdText
+	flush := func() {
+		switch {
+		case len(run) == 0:
+		case kind == mdList:
+			b.WriteString("<ul>")
+			for _, line := range run {
+				b.WriteString("<li>" + mdInline(line[2:]) + "</li>")
+			}
+			b.WriteString("</ul>")
+		case kind == mdQuote:
+			for i, line := range run {
+				run[i] = strings.TrimPrefix(line[1:], " ")
+			}
+			b.WriteString("<blockquote>" + string(Markdown(strings.Join(run, "\n"))) +
+				"</blockquote>")
+		default:
+			for i, line := range run {
+				run[i] = mdInline(line)
+			}
+			b.WriteString("<p>" + strings.Join(run, "<br>") + "</p>")
+		}
+		run = nil
+	}
+	// Blank lines end paragraphs, and lines of a different kind
+	// start a new block.
+	for _, line := range strings.Split(src, "\n") {
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		if k := mdKind(line); k != kind {
+			flush()
+			kind = k
+		}
+		run = append(run, line)
+	}
+	flush()
+	return template.HTML(b.String())
+}
+
+const (
+	mdText = iota
+	mdList
+	mdQuote
+)
+
+func mdKind(line string) int {
+	switch {
+	case strings.HasPrefix(line, "- "), strings.HasPrefix(line, "* "):
+		return mdList
+	case strings.HasPrefix(line, ">"):
+		return mdQuote
+	}
+	return mdText
+}
+
+// mdInline renders the markup inside one line. Code spans and links
+// are swapped out for placeholders while emphasis is worked out, so
+// neither their text nor their URLs get mangled.
+func mdInline(line string) string {
+	var held []string
+	hold := func(html string) string {
+		held = append(held, html)
+		return "\x02" + strconv.Itoa(len(held)-1) + "\x03"
+	}
+	line = strings.NewReplacer("\x02", "", "\x03", "").Replace(line)
+	line = mdCode.ReplaceAllStringFunc(line, func(m string) string {
+		return hold("<code>" + template.HTMLEscapeString(m[1:len(m)-1]) + "</code>")
+	})
+	line = mdLink.ReplaceAllStringFunc(line, func(m string) string {
+		parts := mdLink.FindStringSubmatch(m)
+		return hold(mdAnchor(parts[2], template.HTMLEscapeString(parts[1])))
+	})
+	line = mdURL.ReplaceAllStringFunc(line, func(m string) string {
+		return hold(mdAnchor(m, template.HTMLEscapeString(m)))
+	})
+	line = template.HTMLEscapeString(line)
+	line = mdStrong.ReplaceAllString(line, "<strong>$1</strong>")
+	line = mdEm.ReplaceAllString(line, "$1<em>$2</em>$3")
+	return mdHold.ReplaceAllStringFunc(line, func(m string) string {
+		i, _ := strconv.Atoi(m[1 : len(m)-1])
+		return held[i]
+	})
+}
+
+func mdAnchor(href, text string) string {
+	return `<a href="` + template.HTMLEscapeString(href) +
+		`" rel="nofollow noopener noreferrer">` + text + `</a>`
+}
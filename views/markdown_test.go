@@ -0,0 +1,66 @@
+package views
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMarkdown(t *testing.T) {
+	const rel = `" rel="nofollow noopener noreferrer">`
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"paragraphs", "one\ntwo\n\nthree", "<p>one<br>two</p><p>three</p>"},
+		{"emphasis", "**bold** and *it* and _it_", "<p><strong>bold</strong> and <em>it</em> and <em>it</em></p>"},
+		{"snake_case", "a_b_c and 2*3*4", "<p>a_b_c and 2*3*4</p>"},
+		{"code", "`**not bold** <b>`", "<p><code>**not bold** &lt;b&gt;</code></p>"},
+		{"list", "- one\n* two", "<ul><li>one</li><li>two</li></ul>"},
+		{"quote", "> quoted\n>\n> - item", "<blockquote><p>quoted</p><ul><li>item</li></ul></blockquote>"},
+		{"link", "[site](https://example.com/a_b_c)", `<p><a href="https://example.com/a_b_c` + rel + `site</a></p>`},
+		{"bare URL", "see https://example.com/x.", `<p>see <a href="https://example.com/x` + rel + `https://example.com/x</a>.</p>`},
+		{"mailto", "[me](mailto:me@example.com)", `<p><a href="mailto:me@example.com` + rel + `me</a></p>`},
+		{"CRLF", "one\r\ntwo", "<p>one<br>two</p>"},
+	}
+	for _, tc := range tests {
+		if got := string(Markdown(tc.src)); got != tc.want {
+			t.Errorf("%s:\ngot  %s\nwant %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestMarkdownSanitizes feeds Markdown the markup a commenter might
+// try to sneak in. None of it may come out as an element or
+// attribute of its own.
+func TestMarkdownSanitizes(t *testing.T) {
+	tests := []string{
+		"<script>alert(1)</script>",
+		`<img src=x onerror="alert(1)">`,
+		"[x](javascript:alert(1))",
+		"[x](JavaScript:alert(1))",
+		"[x](data:text/html;base64,PHNjcmlwdD4=)",
+		`[x](https://example.com/"onmouseover="alert(1))`,
+		`https://example.com/"><script>alert(1)</script>`,
+		"[<b>x</b>](https://example.com)",
+		"**<i>x</i>**",
+		"`</code><script>`",
+		"\x02" + "0\x03 <script>",
+		"> <iframe src=https://example.com>",
+		"- <svg onload=alert(1)>",
+	}
+	for _, src := range tests {
+		got := string(Markdown(src))
+		for _, bad := range []string{"<script", "<img", "<iframe", "<svg",
+			"<b>", "<i>", `href="javascript:`, `href="JavaScript:`,
+			`href="data:`, `"onmouseover`, `onerror="`} {
+			if strings.Contains(got, bad) {
+				t.Errorf("%q rendered as %s", src, got)
+				break
+			}
+		}
+		if strings.Count(got, "<a ") != strings.Count(got, `rel="nofollow noopener noreferrer"`) {
+			t.Errorf("%q made a link without rel: %s", src, got)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"html/template"
 	"io"
+	"log/slog"
 	"net/http"
 	"path/filepath"
 )
@@ -14,11 +15,31 @@ var (
 	TemplateDir string = "views/"
 )
 
+// funcs are the template functions added with AddFuncs, along with
+// the ones every template gets.
+var funcs = template.FuncMap{
+	"markdown": Markdown,
+}
+
+// AddFuncs makes fns available to the templates of every View made
+// after it is called.
+func AddFuncs(fns template.FuncMap) {
+	for name, fn := range fns {
+		funcs[name] = fn
+	}
+}
+
 func NewView(layout string, files ...string) *View {
 	addTemplatePath(files)
 	addTemplateExt(files)
 	files = append(files, layoutFiles()...)
-	t, err := template.ParseFiles(files...)
+	// The form helpers are placeholders so the templates parse.
+	// Render replaces them with ones bound to the Data being
+	// rendered.
+	t, err := template.New(filepath.Base(files[0])).
+		Funcs(funcs).
+		Funcs(Data{}.formFuncs()).
+		ParseFiles(files...)
 	if err != nil {
 		panic(err)
 	}
@@ -29,6 +50,9 @@ func NewView(layout string, files ...string) *View {
 	}
 }
 
+// View is a layout plus the templates rendered into it. Template
+// is never executed directly; Render executes a clone of it so each
+// render can bind its own form helpers.
 type View struct {
 	Template *template.Template
 	Layout   string
@@ -36,16 +60,22 @@ type View struct {
 
 func (v *View) Render(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "text/html")
-	switch data.(type) {
-	case Data:
-		// do nothing
-	default:
-		data = Data{
+	vd, ok := data.(Data)
+	if !ok {
+		vd = Data{
 			Yield: data,
 		}
 	}
+	tpl, err := v.Template.Clone()
+	if err != nil {
+		slog.Error("clone template", "err", err)
+		http.Error(w, "Something went wrong. If the problem "+
+			"persists, please email support@lenslocked.com",
+			http.StatusInternalServerError)
+		return
+	}
 	var buf bytes.Buffer
-	err := v.Template.ExecuteTemplate(&buf, v.Layout, data)
+	err = tpl.Funcs(vd.formFuncs()).ExecuteTemplate(&buf, v.Layout, vd)
 	if err != nil {
 		http.Error(w, "Something went wrong. If the problem "+
 			"persists, please email support@lenslocked.com",